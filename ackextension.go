@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// ackProgress is the ack body telling JetStream a message is still being worked on,
+// which restarts its AckWait
+var ackProgress = []byte("+WPI")
+
+// WithAckExtension keeps JetStream from redelivering a message while a slow handler is still
+// processing it: every half AckWait, an in-progress ack restarts the AckWait of the consumer.
+// Each of the maxExtensions extensions lasts one AckWait, two in-progress acks, so the message
+// is redelivered (maxExtensions+1)*AckWait after its delivery when the handler never returns,
+// instead of being held forever.
+// The subscriber must wait for the ack as long, see ACK_EXTENSIONS.
+// Core NATS messages have nothing to extend, they are passed through
+func (s *subscriber) WithAckExtension(maxExtensions int) Middleware {
+	return func(h Handler) Handler {
+		if maxExtensions <= 0 || s.ackWait <= 0 {
+			return h
+		}
+		return func(ctx context.Context, msg *message.Message) error {
+			ackSubject := msg.Metadata.Get(ackSubjectKey)
+			if ackSubject == "" {
+				return h(ctx, msg)
+			}
+
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				ticker := time.NewTicker(s.ackWait / 2)
+				defer ticker.Stop()
+				for sent := 0; sent < 2*maxExtensions; sent++ {
+					select {
+					case <-done:
+						return
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+					}
+					if err := s.conn.Publish(ackSubject, ackProgress); err != nil {
+						log.Printf("[%s] cannot extend the ack deadline of message %s: %v", s.name, msg.UUID, err)
+						return
+					}
+				}
+				log.Printf("[%s] message %s still processing after %d ack extensions, it will be redelivered", s.name, msg.UUID, maxExtensions)
+			}()
+			return h(ctx, msg)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+// testAckWait is the AckWait of the consumers of the ack extension tests
+const testAckWait = 400 * time.Millisecond
+
+// deliverForExtension publishes a message and returns the subscription of a consumer with
+// testAckWait, along with the first delivery unmarshaled like the subscribers do
+func deliverForExtension(t *testing.T) (*subscriber, *nc.Subscription, *message.Message) {
+	t.Helper()
+	conn := connect(t, runServer(t, true))
+	js := addStream(t, conn, "events", "events.>")
+	m, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := m.Marshal("events.a", message.NewMessage(watermill.NewUUID(), []byte("slow")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.PublishMsg(out); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := js.SubscribeSync("events.a", nc.ManualAck(), nc.AckWait(testAckWait))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sub.Unsubscribe() })
+	natsMsg, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := m.Unmarshal(natsMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &subscriber{conn: conn, name: "test", ackWait: testAckWait}, sub, msg
+}
+
+// TestAckExtensionCoversSubscriberWait runs a handler for 2.5 AckWait with 2 extensions,
+// which cover 3 AckWait: the message must not be redelivered meanwhile
+func TestAckExtensionCoversSubscriberWait(t *testing.T) {
+	s, sub, msg := deliverForExtension(t)
+	h := s.WithAckExtension(2)(func(ctx context.Context, msg *message.Message) error {
+		time.Sleep(testAckWait * 5 / 2)
+		return nil
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- h(context.Background(), msg) }()
+	if redelivered, err := sub.NextMsg(testAckWait * 5 / 2); err == nil {
+		meta, _ := redelivered.Metadata()
+		t.Fatalf("message redelivered while the handler was running: %+v", meta)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAckExtensionStopsAfterCap never returns from the handler: after its single extension,
+// the message is redelivered 2 AckWait after its delivery
+func TestAckExtensionStopsAfterCap(t *testing.T) {
+	s, sub, msg := deliverForExtension(t)
+	release := make(chan struct{})
+	defer close(release)
+	h := s.WithAckExtension(1)(func(ctx context.Context, msg *message.Message) error {
+		<-release
+		return nil
+	})
+
+	start := time.Now()
+	go func() { _ = h(context.Background(), msg) }()
+	redelivered, err := sub.NextMsg(4 * testAckWait)
+	if err != nil {
+		t.Fatalf("message not redelivered once the extensions were exhausted: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < testAckWait*3/2 {
+		t.Errorf("message redelivered after %s, before its extension ran out", elapsed)
+	}
+	if meta, err := redelivered.Metadata(); err != nil || meta.NumDelivered != 2 {
+		t.Errorf("metadata = %+v, %v, want a second delivery", meta, err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	nc "github.com/nats-io/nats.go"
+)
+
+// admin serves the state of the JetStream streams and consumers, read-only, to the
+// requests carrying its token as "Authorization: Bearer <token>"
+//   - GET /admin/streams lists every stream with its message and byte counts
+//   - GET /admin/consumers lists the consumers of every stream with their pending and ack pending counts
+type admin struct {
+	js     nc.JetStreamManager
+	token  string
+	logger watermill.LoggerAdapter
+}
+
+// streamState is the JSON view of a stream served by GET /admin/streams
+type streamState struct {
+	Name      string    `json:"name"`
+	Subjects  []string  `json:"subjects"`
+	Messages  uint64    `json:"messages"`
+	Bytes     uint64    `json:"bytes"`
+	FirstSeq  uint64    `json:"first_seq"`
+	LastSeq   uint64    `json:"last_seq"`
+	LastTime  time.Time `json:"last_time"`
+	Consumers int       `json:"consumers"`
+}
+
+// consumerState is the JSON view of a consumer served by GET /admin/consumers
+type consumerState struct {
+	Stream         string `json:"stream"`
+	Name           string `json:"name"`
+	FilterSubject  string `json:"filter_subject,omitempty"`
+	NumPending     uint64 `json:"num_pending"`
+	NumAckPending  int    `json:"num_ack_pending"`
+	NumRedelivered int    `json:"num_redelivered"`
+	NumWaiting     int    `json:"num_waiting"`
+}
+
+// register adds the admin endpoints to mux
+func (a *admin) register(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/streams", a.authorized(func(w http.ResponseWriter, r *http.Request) {
+		streams := []streamState{}
+		for info := range a.js.Streams(nc.Context(r.Context())) {
+			streams = append(streams, streamState{
+				Name:      info.Config.Name,
+				Subjects:  info.Config.Subjects,
+				Messages:  info.State.Msgs,
+				Bytes:     info.State.Bytes,
+				FirstSeq:  info.State.FirstSeq,
+				LastSeq:   info.State.LastSeq,
+				LastTime:  info.State.LastTime,
+				Consumers: info.State.Consumers,
+			})
+		}
+		a.write(w, streams)
+	}))
+	mux.HandleFunc("/admin/consumers", a.authorized(func(w http.ResponseWriter, r *http.Request) {
+		consumers := []consumerState{}
+		for stream := range a.js.StreamNames(nc.Context(r.Context())) {
+			for info := range a.js.Consumers(stream, nc.Context(r.Context())) {
+				consumers = append(consumers, consumerState{
+					Stream:         info.Stream,
+					Name:           info.Name,
+					FilterSubject:  info.Config.FilterSubject,
+					NumPending:     info.NumPending,
+					NumAckPending:  info.NumAckPending,
+					NumRedelivered: info.NumRedelivered,
+					NumWaiting:     info.NumWaiting,
+				})
+			}
+		}
+		a.write(w, consumers)
+	}))
+}
+
+// authorized only lets GET requests carrying the admin token through to h
+func (a *admin) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return requireToken(http.MethodGet, a.token, h)
+}
+
+// requireToken only lets the requests with method carrying "Authorization: Bearer <token>" through to h,
+// every request with method when token is empty
+func requireToken(method, token string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if token == "" {
+			h(w, r)
+			return
+		}
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid or missing admin token", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (a *admin) write(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		a.logger.Error("Cannot write admin response", err, nil)
+	}
+}
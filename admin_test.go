@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	nc "github.com/nats-io/nats.go"
+)
+
+func TestRequireToken(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	tests := []struct {
+		name          string
+		token         string
+		method        string
+		authorization string
+		want          int
+	}{
+		{name: "valid token", token: "secret", method: http.MethodPost, authorization: "Bearer secret", want: http.StatusNoContent},
+		{name: "missing token", token: "secret", method: http.MethodPost, want: http.StatusUnauthorized},
+		{name: "wrong token", token: "secret", method: http.MethodPost, authorization: "Bearer guess", want: http.StatusUnauthorized},
+		{name: "not a bearer", token: "secret", method: http.MethodPost, authorization: "secret", want: http.StatusUnauthorized},
+		{name: "wrong method", token: "secret", method: http.MethodGet, authorization: "Bearer secret", want: http.StatusMethodNotAllowed},
+		{name: "no token configured", method: http.MethodPost, want: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/pause", nil)
+		if tt.authorization != "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+		w := httptest.NewRecorder()
+		requireToken(http.MethodPost, tt.token, ok)(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:8081": true,
+		"localhost:8081": true,
+		"[::1]:8081":     true,
+		":8081":          false,
+		"0.0.0.0:8081":   false,
+		"10.0.0.1:8081":  false,
+		"invalid":        false,
+	} {
+		if got := loopback(addr); got != want {
+			t.Errorf("loopback(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+// fakeJetStreamManager lists streams and their consumers, the other methods are not implemented
+type fakeJetStreamManager struct {
+	nc.JetStreamManager
+	streams   []*nc.StreamInfo
+	consumers map[string][]*nc.ConsumerInfo
+}
+
+func (f fakeJetStreamManager) Streams(opts ...nc.JSOpt) <-chan *nc.StreamInfo {
+	ch := make(chan *nc.StreamInfo, len(f.streams))
+	for _, info := range f.streams {
+		ch <- info
+	}
+	close(ch)
+	return ch
+}
+
+func (f fakeJetStreamManager) StreamNames(opts ...nc.JSOpt) <-chan string {
+	ch := make(chan string, len(f.streams))
+	for _, info := range f.streams {
+		ch <- info.Config.Name
+	}
+	close(ch)
+	return ch
+}
+
+func (f fakeJetStreamManager) Consumers(stream string, opts ...nc.JSOpt) <-chan *nc.ConsumerInfo {
+	ch := make(chan *nc.ConsumerInfo, len(f.consumers[stream]))
+	for _, info := range f.consumers[stream] {
+		ch <- info
+	}
+	close(ch)
+	return ch
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	lastTime := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	js := fakeJetStreamManager{
+		streams: []*nc.StreamInfo{
+			{
+				Config: nc.StreamConfig{Name: "orders", Subjects: []string{"orders.>"}},
+				State:  nc.StreamState{Msgs: 3, Bytes: 120, FirstSeq: 1, LastSeq: 3, LastTime: lastTime, Consumers: 1},
+			},
+			{Config: nc.StreamConfig{Name: "audit", Subjects: []string{"audit.>"}}},
+		},
+		consumers: map[string][]*nc.ConsumerInfo{
+			"orders": {{
+				Stream:         "orders",
+				Name:           "orders_eu",
+				Config:         nc.ConsumerConfig{FilterSubject: "orders.eu"},
+				NumPending:     2,
+				NumAckPending:  1,
+				NumRedelivered: 1,
+			}},
+		},
+	}
+	mux := http.NewServeMux()
+	(&admin{js: js, token: "secret", logger: watermill.NopLogger{}}).register(mux)
+	get := func(path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/admin/streams", "secret")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("GET /admin/streams: status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var streams []streamState
+	if err := json.NewDecoder(w.Body).Decode(&streams); err != nil {
+		t.Fatal(err)
+	}
+	want := streamState{Name: "orders", Subjects: []string{"orders.>"}, Messages: 3, Bytes: 120, FirstSeq: 1, LastSeq: 3, LastTime: lastTime, Consumers: 1}
+	if len(streams) != 2 || streams[1].Name != "audit" || !reflect.DeepEqual(streams[0], want) {
+		t.Errorf("streams = %+v, want %+v and audit", streams, want)
+	}
+
+	w = get("/admin/consumers", "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /admin/consumers: status %d", w.Code)
+	}
+	var consumers []consumerState
+	if err := json.NewDecoder(w.Body).Decode(&consumers); err != nil {
+		t.Fatal(err)
+	}
+	wantConsumer := consumerState{Stream: "orders", Name: "orders_eu", FilterSubject: "orders.eu", NumPending: 2, NumAckPending: 1, NumRedelivered: 1}
+	if len(consumers) != 1 || consumers[0] != wantConsumer {
+		t.Errorf("consumers = %+v, want %+v", consumers, wantConsumer)
+	}
+
+	if w := get("/admin/consumers", "guess"); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /admin/consumers with a wrong token: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// an empty list is served as [], not null
+	mux = http.NewServeMux()
+	(&admin{js: fakeJetStreamManager{}, logger: watermill.NopLogger{}}).register(mux)
+	for _, path := range []string{"/admin/streams", "/admin/consumers"} {
+		if body := strings.TrimSpace(get(path, "").Body.String()); body != "[]" {
+			t.Errorf("GET %s with no stream = %s, want []", path, body)
+		}
+	}
+}
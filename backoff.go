@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+)
+
+// backoff delays the redelivery of nacked messages exponentially with the delivery attempt:
+// base, 2*base, 4*base... capped at max, so that a struggling downstream is not hammered.
+// It implements nats.Delay, the subscriber calls it with the delivery count read from the
+// JetStream metadata and nacks with nc.NakWithDelay
+type backoff struct {
+	base time.Duration
+	max  time.Duration
+}
+
+var _ nats.Delay = backoff{}
+
+// newBackoff returns nil when base is 0, in which case nacked messages are redelivered immediately
+func newBackoff(base, max time.Duration) (nats.Delay, error) {
+	if base < 0 {
+		return nil, fmt.Errorf("NACK_BACKOFF_BASE must not be negative, got %s", base)
+	}
+	if base == 0 {
+		return nil, nil
+	}
+	if max < base {
+		return nil, fmt.Errorf("NACK_BACKOFF_MAX (%s) must not be less than NACK_BACKOFF_BASE (%s)", max, base)
+	}
+	return backoff{base: base, max: max}, nil
+}
+
+// delay returns how long to wait before redelivering a message nacked on its attempt-th delivery
+func (b backoff) delay(attempt int) time.Duration {
+	d := b.base
+	for i := 1; i < attempt && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		return b.max
+	}
+	return d
+}
+
+func (b backoff) WaitTime(retryNum uint64) time.Duration {
+	return b.delay(int(retryNum))
+}
+
+// reconnectDelay returns the nc.CustomReconnectDelay of the connections: the backoff of base
+// and max, of which up to a jitter fraction is randomly taken off, so that the clients
+// disconnected by the same outage do not all reconnect at once
+func reconnectDelay(base, max time.Duration, jitter float64) (func(attempts int) time.Duration, error) {
+	if base <= 0 {
+		return nil, fmt.Errorf("RECONNECT_WAIT must be positive, got %s", base)
+	}
+	if max < base {
+		return nil, fmt.Errorf("RECONNECT_WAIT_MAX (%s) must not be less than RECONNECT_WAIT (%s)", max, base)
+	}
+	if jitter < 0 || jitter > 1 {
+		return nil, fmt.Errorf("RECONNECT_JITTER must be between 0 and 1, got %g", jitter)
+	}
+	b := backoff{base: base, max: max}
+	return func(attempts int) time.Duration {
+		d := b.delay(attempts)
+		return d - time.Duration(jitter*rand.Float64()*float64(d))
+	}, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffGrows(t *testing.T) {
+	b := backoff{base: time.Second, max: 10 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		attempt := i + 1
+		if got := b.delay(attempt); got != w {
+			t.Errorf("delay(%d) = %s, want %s", attempt, got, w)
+		}
+		if got := b.WaitTime(uint64(attempt)); got != w {
+			t.Errorf("WaitTime(%d) = %s, want %s", attempt, got, w)
+		}
+	}
+	// far attempts stay at the cap instead of overflowing
+	if got := b.delay(1000); got != b.max {
+		t.Errorf("delay(1000) = %s, want %s", got, b.max)
+	}
+}
+
+func TestNewBackoff(t *testing.T) {
+	if d, err := newBackoff(0, time.Minute); err != nil || d != nil {
+		t.Errorf("newBackoff(0) = %v, %v, want no backoff", d, err)
+	}
+	if _, err := newBackoff(-time.Second, time.Minute); err == nil {
+		t.Error("a negative base was accepted")
+	}
+	if _, err := newBackoff(time.Minute, time.Second); err == nil {
+		t.Error("a max below the base was accepted")
+	}
+	d, err := newBackoff(time.Second, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first, second := d.WaitTime(1), d.WaitTime(2); second <= first {
+		t.Errorf("WaitTime(2) = %s is not longer than WaitTime(1) = %s", second, first)
+	}
+}
+
+func TestReconnectDelayJitter(t *testing.T) {
+	delay, err := reconnectDelay(time.Second, 30*time.Second, 0.2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 1; attempt < 10; attempt++ {
+		full := backoff{base: time.Second, max: 30 * time.Second}.delay(attempt)
+		if d := delay(attempt); d > full || d < full*8/10 {
+			t.Errorf("delay(%d) = %s, want between %s and %s", attempt, d, full*8/10, full)
+		}
+	}
+	// the jitter takes off at most a fifth, less than the doubling until the cap adds
+	for attempt := 1; attempt < 6; attempt++ {
+		if d, next := delay(attempt), delay(attempt+1); next <= d {
+			t.Errorf("delay(%d) = %s is not longer than delay(%d) = %s", attempt+1, next, attempt, d)
+		}
+	}
+	// the jitter is drawn on every call
+	if first, second := delay(3), delay(3); first == second {
+		t.Errorf("delay(3) returned %s twice, want a jitter", first)
+	}
+	for _, jitter := range []float64{-0.1, 1.1} {
+		if _, err := reconnectDelay(time.Second, time.Minute, jitter); err == nil {
+			t.Errorf("jitter %g was accepted", jitter)
+		}
+	}
+}
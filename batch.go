@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+// batchMaxPending is the default number of async publishes of a batchPublisher allowed to wait for their acks at once
+const batchMaxPending = 16384
+
+// errBackpressure is returned when maxPending async publishes are still waiting for
+// their acks, callers should slow down
+var errBackpressure = errors.New("too many pending async publishes")
+
+// batchPublisher publishes many messages at once with JetStream async publishes,
+// waiting for all their acks together instead of one round trip per message
+type batchPublisher struct {
+	js        nc.JetStreamContext
+	marshaler nats.Marshaler
+	jsConfig  nats.JetStreamConfig
+	// maxPending is the number of async publishes allowed to wait for their acks at once
+	maxPending int
+	// timeout bounds how long PublishBatch waits for the acks of a batch
+	timeout time.Duration
+}
+
+// newBatchPublisher creates a batchPublisher sharing the connection of the publisher
+func newBatchPublisher(conn *nc.Conn, marshaler nats.Marshaler, jsConfig nats.JetStreamConfig, maxPending int, timeout time.Duration) (*batchPublisher, error) {
+	opts := append([]nc.JSOpt{nc.PublishAsyncMaxPending(maxPending)}, jsConfig.ConnectOptions...)
+	js, err := conn.JetStream(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &batchPublisher{js: js, marshaler: marshaler, jsConfig: jsConfig, maxPending: maxPending, timeout: timeout}, nil
+}
+
+// FlushPending waits until every outstanding async publish got its ack, or until ctx is done
+func (b *batchPublisher) FlushPending(ctx context.Context) error {
+	select {
+	case <-b.js.PublishAsyncComplete():
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %d publishes still pending", ctx.Err(), b.js.PublishAsyncPending())
+	}
+}
+
+// BatchFailure is a message of a batch that was not stored by JetStream
+type BatchFailure struct {
+	// Index is the position of the message in the batch
+	Index int
+	UUID  string
+	Err   error
+}
+
+// BatchError lists every failed message of a batch, the other messages were stored
+type BatchError struct {
+	Failures []BatchFailure
+}
+
+func (e *BatchError) Error() string {
+	parts := make([]string, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		parts = append(parts, fmt.Sprintf("#%d (%s): %v", f.Index, f.UUID, f.Err))
+	}
+	return fmt.Sprintf("%d messages of the batch failed: %s", len(e.Failures), strings.Join(parts, "; "))
+}
+
+// BatchOutcome is what happened to one message of a batch: where JetStream stored it, or why it was not
+type BatchOutcome struct {
+	UUID string
+	// Stream and Sequence locate the stored message, they are empty when Err is not nil
+	Stream   string
+	Sequence uint64
+	Err      error
+}
+
+// BatchResult holds the outcome of every message of a batch, in the order of the batch,
+// so that callers can retry only the failed messages
+type BatchResult struct {
+	Outcomes []BatchOutcome
+}
+
+// Failed returns the positions in the batch of the messages that were not stored
+func (r BatchResult) Failed() []int {
+	var failed []int
+	for i, outcome := range r.Outcomes {
+		if outcome.Err != nil {
+			failed = append(failed, i)
+		}
+	}
+	return failed
+}
+
+// Err returns a *BatchError listing the failed messages, nil when every message was stored
+func (r BatchResult) Err() error {
+	var failures []BatchFailure
+	for i, outcome := range r.Outcomes {
+		if outcome.Err != nil {
+			failures = append(failures, BatchFailure{Index: i, UUID: outcome.UUID, Err: outcome.Err})
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	return &BatchError{Failures: failures}
+}
+
+// PublishBatch publishes msgs to topic and waits for all their acks.
+// When maxPending publishes are outstanding, it flushes them before publishing more;
+// the messages that could not be published in time fail with errBackpressure.
+// The result holds the outcome of every message, like PublishSync the stored ones get
+// their stream and sequence in the streamKey and streamSequenceKey metadata.
+// The error is result.Err(), a *BatchError identifying the messages that failed
+func (b *batchPublisher) PublishBatch(topic string, msgs []*message.Message) (BatchResult, error) {
+	if err := validateSubject(topic); err != nil {
+		return BatchResult{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+
+	result := BatchResult{Outcomes: make([]BatchOutcome, len(msgs))}
+	futures := make([]nc.PubAckFuture, len(msgs))
+
+	for i, msg := range msgs {
+		result.Outcomes[i].UUID = msg.UUID
+		// past maxPending, PublishMsgAsync would stall and then fail, flush first instead
+		if b.js.PublishAsyncPending() >= b.maxPending {
+			if err := b.FlushPending(ctx); err != nil {
+				result.Outcomes[i].Err = fmt.Errorf("%w: %v", errBackpressure, err)
+				continue
+			}
+		}
+
+		natsMsg, err := b.marshaler.Marshal(topic, msg)
+		if err != nil {
+			result.Outcomes[i].Err = fmt.Errorf("%w: %w", ErrMarshal, err)
+			continue
+		}
+
+		opts := b.jsConfig.PublishOptions
+		if b.jsConfig.TrackMsgId {
+			opts = append(opts, nc.MsgId(msg.UUID))
+		}
+		if futures[i], err = b.js.PublishMsgAsync(natsMsg, opts...); err != nil {
+			result.Outcomes[i].Err = classifyPublishError(err)
+		}
+	}
+
+	// once ctx is done, what already landed is collected and the rest given up on
+	for i, future := range futures {
+		if future == nil {
+			continue
+		}
+		var ack *nc.PubAck
+		select {
+		case ack = <-future.Ok():
+		case err := <-future.Err():
+			result.Outcomes[i].Err = classifyPublishError(err)
+		case <-ctx.Done():
+			select {
+			case ack = <-future.Ok():
+			case err := <-future.Err():
+				result.Outcomes[i].Err = classifyPublishError(err)
+			default:
+				result.Outcomes[i].Err = ErrPublishTimeout
+			}
+		}
+		if ack != nil {
+			result.Outcomes[i].Stream, result.Outcomes[i].Sequence = ack.Stream, ack.Sequence
+			msgs[i].Metadata.Set(streamKey, ack.Stream)
+			msgs[i].Metadata.Set(streamSequenceKey, strconv.FormatUint(ack.Sequence, 10))
+		}
+	}
+	return result, result.Err()
+}
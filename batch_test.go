@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// benchmarkBatchSize is the number of messages of a batch in BenchmarkPublishBatch
+const benchmarkBatchSize = 100
+
+func benchmarkMessages(n int) []*message.Message {
+	msgs := make([]*message.Message, n)
+	for i := range msgs {
+		msgs[i] = message.NewMessage(watermill.NewUUID(), make([]byte, 256))
+	}
+	return msgs
+}
+
+// BenchmarkPublishIndividual publishes with the watermill publisher, waiting for each ack in turn
+func BenchmarkPublishIndividual(b *testing.B) {
+	url := runServer(b, true)
+	addStream(b, connect(b, url), "bench", "bench.>")
+	pub, err := nats.NewPublisher(nats.PublisherConfig{URL: url, Marshaler: &nats.NATSMarshaler{}}, watermill.NopLogger{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer pub.Close()
+	msgs := benchmarkMessages(b.N)
+
+	b.ResetTimer()
+	for _, msg := range msgs {
+		if err := pub.Publish("bench.individual", msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPublishBatch publishes benchmarkBatchSize messages at once, waiting for their acks together
+func BenchmarkPublishBatch(b *testing.B) {
+	url := runServer(b, true)
+	conn := connect(b, url)
+	addStream(b, conn, "bench", "bench.>")
+	batches, err := newBatchPublisher(conn, &nats.NATSMarshaler{}, nats.JetStreamConfig{}, batchMaxPending, time.Minute)
+	if err != nil {
+		b.Fatal(err)
+	}
+	msgs := benchmarkMessages(b.N)
+
+	b.ResetTimer()
+	for len(msgs) > 0 {
+		n := benchmarkBatchSize
+		if n > len(msgs) {
+			n = len(msgs)
+		}
+		if _, err := batches.PublishBatch("bench.batch", msgs[:n]); err != nil {
+			b.Fatal(err)
+		}
+		msgs = msgs[n:]
+	}
+}
+
+// TestPublishBatchDrainsFlood publishes far more messages than maxPending at once: PublishBatch
+// must flush the pending publishes instead of failing, and leave nothing pending behind
+func TestPublishBatchDrainsFlood(t *testing.T) {
+	const maxPending, flood = 8, 1000
+	url := runServer(t, true)
+	conn := connect(t, url)
+	js := addStream(t, conn, "flood", "flood.>")
+	batches, err := newBatchPublisher(conn, &nats.NATSMarshaler{}, nats.JetStreamConfig{}, maxPending, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := batches.PublishBatch("flood.test", benchmarkMessages(flood))
+	if err != nil {
+		t.Fatalf("flood failed: %v", err)
+	}
+	if len(result.Outcomes) != flood || len(result.Failed()) != 0 {
+		t.Fatalf("%d outcomes, %d failed, want %d stored", len(result.Outcomes), len(result.Failed()), flood)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := batches.FlushPending(ctx); err != nil {
+		t.Fatalf("FlushPending: %v", err)
+	}
+	if pending := batches.js.PublishAsyncPending(); pending != 0 {
+		t.Errorf("%d publishes still pending", pending)
+	}
+	info, err := js.StreamInfo("flood")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != flood {
+		t.Errorf("stream holds %d messages, want %d", info.State.Msgs, flood)
+	}
+	// each message got its own sequence, in the order of the batch
+	for i, outcome := range result.Outcomes {
+		if outcome.Sequence != uint64(i+1) {
+			t.Fatalf("message %d stored at sequence %d", i, outcome.Sequence)
+		}
+	}
+}
+
+// TestPublishBatchReportsOversized publishes a batch mixing messages under and over the
+// max payload of the server: exactly the oversized ones must be reported as failed
+func TestPublishBatchReportsOversized(t *testing.T) {
+	const maxPayload = 1024
+	url := runServerWith(t, &server.Options{JetStream: true, MaxPayload: maxPayload})
+	conn := connect(t, url)
+	js := addStream(t, conn, "mixed", "mixed.>")
+	batches, err := newBatchPublisher(conn, &nats.NATSMarshaler{}, nats.JetStreamConfig{}, batchMaxPending, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oversized := map[int]bool{1: true, 2: true, 5: true}
+	msgs := make([]*message.Message, 7)
+	for i := range msgs {
+		size := 16
+		if oversized[i] {
+			size = 2 * maxPayload
+		}
+		msgs[i] = message.NewMessage(watermill.NewUUID(), make([]byte, size))
+	}
+
+	result, err := batches.PublishBatch("mixed.test", msgs)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || len(batchErr.Failures) != len(oversized) {
+		t.Fatalf("err = %v, want a BatchError listing the %d oversized messages", err, len(oversized))
+	}
+	if failed := result.Failed(); len(failed) != len(oversized) {
+		t.Fatalf("failed = %v, want %v", failed, oversized)
+	}
+	for i, outcome := range result.Outcomes {
+		if outcome.UUID != msgs[i].UUID {
+			t.Errorf("outcome %d is for %s, want %s", i, outcome.UUID, msgs[i].UUID)
+		}
+		if oversized[i] {
+			if !errors.Is(outcome.Err, ErrPayloadTooLarge) {
+				t.Errorf("message %d: err = %v, want ErrPayloadTooLarge", i, outcome.Err)
+			}
+			if outcome.Sequence != 0 || msgs[i].Metadata.Get(streamSequenceKey) != "" {
+				t.Errorf("oversized message %d was given a sequence", i)
+			}
+			continue
+		}
+		if outcome.Err != nil || outcome.Stream != "mixed" || outcome.Sequence == 0 {
+			t.Errorf("message %d: outcome = %+v, want it stored", i, outcome)
+		}
+		if got := msgs[i].Metadata.Get(streamSequenceKey); got != strconv.FormatUint(outcome.Sequence, 10) {
+			t.Errorf("message %d: %s = %q, want %d", i, streamSequenceKey, got, outcome.Sequence)
+		}
+	}
+	info, err := js.StreamInfo("mixed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := uint64(len(msgs) - len(oversized)); info.State.Msgs != want {
+		t.Errorf("stream holds %d messages, want %d", info.State.Msgs, want)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/klauspost/compress/zstd"
+	nc "github.com/nats-io/nats.go"
+)
+
+// contentEncodingHdr names the codec a NATS body was compressed with
+const contentEncodingHdr = "Content-Encoding"
+
+// codec compresses and decompresses NATS bodies
+type codec interface {
+	name() string
+	compress(data []byte) ([]byte, error)
+	decompress(data []byte) ([]byte, error)
+}
+
+// withCompression wraps m so that bodies of at least threshold bytes are compressed with
+// the codec selected by kind (none, gzip or zstd). Decompression follows the Content-Encoding
+// header of each message, so any codec is accepted on consume whatever kind is. Bodies
+// decompressing to more than maxSize bytes fail with ErrPayloadTooLarge
+func withCompression(m nats.MarshalerUnmarshaler, kind string, threshold int, maxSize int64) (nats.MarshalerUnmarshaler, error) {
+	if threshold < 0 {
+		return nil, fmt.Errorf("compression threshold must not be negative, got %d", threshold)
+	}
+	if maxSize < 1 {
+		return nil, fmt.Errorf("decompressed size limit must be positive, got %d", maxSize)
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(maxSize)))
+	if err != nil {
+		return nil, err
+	}
+	codecs := map[string]codec{
+		"gzip": gzipCodec{maxSize: maxSize},
+		"zstd": zstdCodec{decoder: decoder, maxSize: maxSize},
+	}
+	c := compressingMarshaler{MarshalerUnmarshaler: m, threshold: threshold, codecs: codecs}
+	switch kind {
+	case "", "none":
+	case "gzip", "zstd":
+		c.codec = codecs[kind]
+	default:
+		return nil, fmt.Errorf("unknown compression %q, expected one of none, gzip, zstd", kind)
+	}
+	return c, nil
+}
+
+// compressingMarshaler compresses the NATS body produced by the wrapped marshaler
+type compressingMarshaler struct {
+	nats.MarshalerUnmarshaler
+	// codec is nil when publishing uncompressed
+	codec     codec
+	threshold int
+	// codecs decompress the bodies, by Content-Encoding
+	codecs map[string]codec
+}
+
+func (c compressingMarshaler) Marshal(topic string, msg *message.Message) (*nc.Msg, error) {
+	natsMsg, err := c.MarshalerUnmarshaler.Marshal(topic, msg)
+	// empty bodies (headers-only messages) are left alone, whatever the threshold
+	if err != nil || c.codec == nil || len(natsMsg.Data) == 0 || len(natsMsg.Data) < c.threshold {
+		return natsMsg, err
+	}
+
+	data, err := c.codec.compress(natsMsg.Data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot compress message: %w", err)
+	}
+	natsMsg.Data = data
+	if natsMsg.Header == nil {
+		natsMsg.Header = make(nc.Header)
+	}
+	natsMsg.Header.Set(contentEncodingHdr, c.codec.name())
+	return natsMsg, nil
+}
+
+func (c compressingMarshaler) Unmarshal(natsMsg *nc.Msg) (*message.Message, error) {
+	encoding := natsMsg.Header.Get(contentEncodingHdr)
+	if encoding == "" {
+		return c.MarshalerUnmarshaler.Unmarshal(natsMsg)
+	}
+
+	dec, ok := c.codecs[encoding]
+	if !ok {
+		return nil, fmt.Errorf("unsupported %s %q", contentEncodingHdr, encoding)
+	}
+	var data []byte
+	// a headers-only message has nothing to decompress, even when a publisher flagged it
+	if len(natsMsg.Data) > 0 {
+		var err error
+		if data, err = dec.decompress(natsMsg.Data); err != nil {
+			return nil, fmt.Errorf("cannot decompress message: %w", err)
+		}
+	}
+
+	// work on a copy so that the header is not turned into metadata and the original message stays intact
+	decompressed := *natsMsg
+	decompressed.Data = data
+	decompressed.Header = make(nc.Header, len(natsMsg.Header))
+	for k, v := range natsMsg.Header {
+		if k != contentEncodingHdr {
+			decompressed.Header[k] = v
+		}
+	}
+	return c.MarshalerUnmarshaler.Unmarshal(&decompressed)
+}
+
+// gzipCodec stops reading past maxSize decompressed bytes
+type gzipCodec struct {
+	maxSize int64
+}
+
+func (gzipCodec) name() string { return "gzip" }
+
+func (gzipCodec) compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (g gzipCodec) decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err = io.ReadAll(io.LimitReader(r, g.maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > g.maxSize {
+		return nil, fmt.Errorf("%w: decompresses to more than %d bytes", ErrPayloadTooLarge, g.maxSize)
+	}
+	return data, nil
+}
+
+// zstdEncoder is safe for concurrent use when only EncodeAll is called
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+// zstdCodec decompresses with a decoder limited to maxSize bytes, it is safe
+// for concurrent use when only DecodeAll is called
+type zstdCodec struct {
+	decoder *zstd.Decoder
+	maxSize int64
+}
+
+func (zstdCodec) name() string { return "zstd" }
+
+func (zstdCodec) compress(data []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(data, nil), nil
+}
+
+func (z zstdCodec) decompress(data []byte) ([]byte, error) {
+	data, err := z.decoder.DecodeAll(data, nil)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		return nil, fmt.Errorf("%w: decompresses to more than %d bytes", ErrPayloadTooLarge, z.maxSize)
+	}
+	return data, err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func newTestCompression(t *testing.T, kind string, threshold int, maxSize int64) compressingMarshaler {
+	t.Helper()
+	base, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := withCompression(base, kind, threshold, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.(compressingMarshaler)
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte(`{"document":"large and repetitive"}`), 100)
+	for _, kind := range []string{"none", "gzip", "zstd"} {
+		t.Run(kind, func(t *testing.T) {
+			c := newTestCompression(t, kind, 1024, 1<<20)
+			msg := message.NewMessage("1", payload)
+			msg.Metadata.Set("Tenant", "acme")
+			natsMsg, err := c.Marshal("example_topic.a", msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoding := natsMsg.Header.Get(contentEncodingHdr)
+			if kind == "none" {
+				if encoding != "" || !bytes.Contains(natsMsg.Data, payload) {
+					t.Errorf("uncompressed body was altered, %s %q", contentEncodingHdr, encoding)
+				}
+			} else if encoding != kind || len(natsMsg.Data) >= len(payload) {
+				t.Errorf("%s = %q and %d bytes, want %q and less than %d", contentEncodingHdr, encoding, len(natsMsg.Data), kind, len(payload))
+			}
+
+			got, err := c.Unmarshal(natsMsg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Payload, payload) || got.Metadata.Get("Tenant") != "acme" {
+				t.Errorf("round trip = %d bytes, Tenant %q", len(got.Payload), got.Metadata.Get("Tenant"))
+			}
+			if _, ok := got.Metadata[contentEncodingHdr]; ok {
+				t.Errorf("%s is in the metadata", contentEncodingHdr)
+			}
+		})
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	c := newTestCompression(t, "zstd", 1024, 1<<20)
+	natsMsg, err := c.Marshal("example_topic.a", message.NewMessage("1", []byte("small")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoding := natsMsg.Header.Get(contentEncodingHdr); encoding != "" {
+		t.Errorf("a body below the threshold was compressed with %s", encoding)
+	}
+}
+
+// a small compressed message must not decompress past the limit
+func TestDecompressionLimit(t *testing.T) {
+	bomb := make([]byte, 4<<20)
+	for _, kind := range []string{"gzip", "zstd"} {
+		t.Run(kind, func(t *testing.T) {
+			natsMsg, err := newTestCompression(t, kind, 0, int64(len(bomb))).Marshal("example_topic.a", message.NewMessage("1", bomb))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = newTestCompression(t, kind, 0, 1<<20).Unmarshal(natsMsg)
+			if !errors.Is(err, ErrPayloadTooLarge) {
+				t.Errorf("%d compressed bytes decompressing to %d: err = %v, want %v", len(natsMsg.Data), len(bomb), err, ErrPayloadTooLarge)
+			}
+		})
+	}
+}
@@ -0,0 +1,720 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	nc "github.com/nats-io/nats.go"
+)
+
+const (
+	defaultSubscribersCount = 4
+	defaultQueueGroupPrefix = "example"
+	defaultDurablePrefix    = "my-durable"
+	defaultSubjects         = "example_topic.>"
+)
+
+// Config holds every tunable the publisher and the subscribers are wired from, so that
+// both sides derive their URL, options and JetStream settings from the same values.
+// Settings only used by one component (TLS, stream, rate limit...) are read where they are used
+type Config struct {
+	// URL is NATS_URL, the comma-separated servers of the cluster
+	URL string
+	// FlushEvery flushes the core NATS publishers after that many publishes, 0 never does
+	FlushEvery int
+	// MirrorURL is MIRROR_NATS_URL, the servers of a second cluster every message is also published to
+	MirrorURL string
+	// ClientName prefixes the name of every connection, see clientName
+	ClientName string
+	// Marshaler, Compression and CompressionThreshold select the wire format
+	Marshaler            string
+	Compression          string
+	CompressionThreshold int
+	// MaxDecompressedSize bounds the size of a body once decompressed
+	MaxDecompressedSize int64
+	// MaxPayload is the largest message published, 0 uses the limit of the server
+	MaxPayload int64
+	// OnUnmarshalError is nack, drop or dlq
+	OnUnmarshalError string
+	// SchemaDir holds the JSON Schema of each subject, "<subject>.json"
+	SchemaDir string
+
+	// SubscribersCount goroutines consume messages in each subscriber, sharing QueueGroupPrefix
+	SubscribersCount int
+	// HandlerConcurrency bounds how many messages each subscriber processes at once
+	HandlerConcurrency int
+	// ScaleMax is the largest number of subscribers per pattern POST /scale may run
+	ScaleMax int
+	// SubscribeBufferSize is how many delivered messages each subscriber buffers for its handlers
+	SubscribeBufferSize int
+	QueueGroupPrefix    string
+	// DurablePrefix names the durable consumer of every subscriber, DurablePrefixes overrides it
+	// for the first subscribers of each pattern. DurableCollision is warn or error
+	DurablePrefix    string
+	DurablePrefixes  []string
+	DurableCollision string
+	// SubscriberMarshalers overrides Marshaler for the first subscribers of each pattern
+	SubscriberMarshalers []string
+
+	JetStreamEnabled bool
+	Dedup            bool
+	// Ordered processes one message at a time with a single subscriber per pattern
+	Ordered bool
+	// Ephemeral consumes with consumers deleted once the subscribers are gone
+	Ephemeral bool
+	// DuplicateCacheSize is how many processed message UUIDs are remembered to skip duplicates, 0 disables it
+	DuplicateCacheSize int
+	// MessageTTL sets the expiry of the published messages that have none, 0 publishes them without
+	MessageTTL time.Duration
+	// ExpiryCheck skips the messages received past their expiry
+	ExpiryCheck bool
+	// VerifyOrder stamps the published messages with a sequence checked on consume
+	VerifyOrder bool
+	// DryRun logs the messages instead of publishing them, and consumes nothing
+	DryRun         bool
+	AckWaitTimeout time.Duration
+	// HandlerTimeout is how long a handler may take before its message is nacked, 0 disables it
+	HandlerTimeout time.Duration
+	// AckExtensions is how many times a slow handler may extend AckWaitTimeout
+	AckExtensions int
+	// InactiveThreshold is how long the server keeps a consumer nothing consumes from, 0 leaves the server default
+	InactiveThreshold       time.Duration
+	MaxAckPending           int
+	ExpectedHandlerDuration time.Duration
+	// NackBackoffBase and NackBackoffMax bound the redelivery delay of nacked messages,
+	// a NackBackoffBase of 0, the default, redelivers them immediately
+	NackBackoffBase time.Duration
+	NackBackoffMax  time.Duration
+
+	StartupTimeout time.Duration
+	PublishTimeout time.Duration
+	// DLQPrefix starts the subjects failed messages are moved to, outside of Subjects
+	DLQPrefix string
+	// Subjects are the subject patterns every subscriber consumes
+	Subjects []string
+	// SyncPublishSubjects are the subject patterns published with PublishSync
+	SyncPublishSubjects []string
+
+	MetricsAddr string
+	// MetricsSubjectDepth is the number of subject tokens kept in metric labels, 0 keeps them all
+	MetricsSubjectDepth int
+	// MetricsFinalScrape is how long shutdown waits for Prometheus to collect the last values
+	MetricsFinalScrape time.Duration
+	HealthAddr         string
+	ControlAddr        string
+	// AdminToken guards the admin endpoints of the control server, which are disabled without it
+	AdminToken string
+	// ScalerMetric is the key of the pending count served by GET /scaler
+	ScalerMetric string
+	// LagScrapeInterval is how often the consumer lag is read, 0 disables it
+	LagScrapeInterval time.Duration
+
+	// DeliverPolicy selects where new consumers start in the stream, see parseDeliverPolicy
+	DeliverPolicy nc.SubOpt
+	// AckPolicy is explicit, all or none, AckPolicyOption its subscribe option
+	AckPolicy       string
+	AckPolicyOption nc.SubOpt
+
+	// ReplayFrom is an RFC3339 timestamp or a stream sequence to replay the stream from,
+	// ReplayUntilEnd stops the replay once it caught up with the end of the stream
+	ReplayFrom     string
+	ReplayUntilEnd bool
+	// ReplaySubject restricts the replay to one filter subject instead of Subjects
+	ReplaySubject string
+	// MigrateTarget prefixes the subjects gob messages are republished to as JSON
+	MigrateTarget string
+	// ExportFile is where the stream is exported from ExportFrom, ImportFile the export republished
+	ExportFile string
+	ExportFrom string
+	ImportFile string
+}
+
+// parseConfig applies the command line flags, then the config file, to the environment
+// and loads the configuration
+func parseConfig() (*Config, error) {
+	if err := applyFlags(os.Args[1:]); err != nil {
+		return nil, err
+	}
+	if path := os.Getenv(configFileEnv); path != "" {
+		if err := applyConfigFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return LoadConfig()
+}
+
+// LoadConfig reads the configuration from the environment, using the defaults
+// documented in the README for unset variables
+func LoadConfig() (*Config, error) {
+	cfg := &Config{
+		ClientName:  getEnv("CLIENT_NAME", "pubsub"),
+		Marshaler:   getEnv("MARSHALER", "nats"),
+		Compression: os.Getenv("COMPRESSION"),
+		// validated by withUnmarshalPolicy
+		OnUnmarshalError: os.Getenv("ON_UNMARSHAL_ERROR"),
+		SchemaDir:        os.Getenv("SCHEMA_DIR"),
+		DLQPrefix:        getEnv("DLQ_PREFIX", "dlq"),
+		MetricsAddr:      getEnv("METRICS_ADDR", ":9090"),
+		HealthAddr:       getEnv("HEALTH_ADDR", ":8080"),
+		ControlAddr:      getEnv("CONTROL_ADDR", "127.0.0.1:8081"),
+		AdminToken:       os.Getenv("ADMIN_TOKEN"),
+		ScalerMetric:     getEnv("SCALER_METRIC_NAME", "pending"),
+		ReplayFrom:       os.Getenv("REPLAY_FROM"),
+		ReplaySubject:    os.Getenv("REPLAY_SUBJECT"),
+		MigrateTarget:    os.Getenv("MIGRATE_TARGET"),
+		ExportFile:       os.Getenv("EXPORT_FILE"),
+		ExportFrom:       os.Getenv("EXPORT_FROM"),
+		ImportFile:       os.Getenv("IMPORT_FILE"),
+	}
+	// setting QUEUE_GROUP_PREFIX to an empty string subscribes without a queue group
+	queueGroupPrefix, ok := os.LookupEnv("QUEUE_GROUP_PREFIX")
+	if !ok {
+		queueGroupPrefix = defaultQueueGroupPrefix
+	}
+	cfg.QueueGroupPrefix = queueGroupPrefix
+	// setting DURABLE_PREFIX to an empty string uses the queue group as durable name
+	durablePrefix, ok := os.LookupEnv("DURABLE_PREFIX")
+	if !ok {
+		durablePrefix = defaultDurablePrefix
+	}
+	cfg.DurablePrefix = durablePrefix
+	if prefixes := os.Getenv("DURABLE_PREFIXES"); prefixes != "" {
+		cfg.DurablePrefixes = strings.Split(prefixes, ",")
+	}
+	if kinds := os.Getenv("SUBSCRIBER_MARSHALERS"); kinds != "" {
+		cfg.SubscriberMarshalers = strings.Split(kinds, ",")
+	}
+	switch cfg.DurableCollision = getEnv("DURABLE_COLLISION", "warn"); cfg.DurableCollision {
+	case "warn", "error":
+	default:
+		return nil, fmt.Errorf("unknown DURABLE_COLLISION %q, expected warn or error", cfg.DurableCollision)
+	}
+	cfg.Subjects = strings.Split(getEnv("SUBJECTS", defaultSubjects), ",")
+	for i, subject := range cfg.Subjects {
+		if cfg.Subjects[i] = strings.TrimSpace(subject); cfg.Subjects[i] == "" {
+			return nil, errors.New("SUBJECTS must not contain empty subjects")
+		}
+	}
+	if err := validateDeadLetterPrefix(cfg.DLQPrefix, cfg.Subjects); err != nil {
+		return nil, err
+	}
+	if subjects := os.Getenv("SYNC_PUBLISH_SUBJECTS"); subjects != "" {
+		cfg.SyncPublishSubjects = strings.Split(subjects, ",")
+	}
+
+	var err error
+	if cfg.URL, err = natsURL("NATS_URL"); err != nil {
+		return nil, err
+	}
+	if os.Getenv("MIRROR_NATS_URL") != "" {
+		if cfg.MirrorURL, err = natsURL("MIRROR_NATS_URL"); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.CompressionThreshold, err = getEnvInt("COMPRESSION_THRESHOLD", 1024); err != nil {
+		return nil, err
+	}
+	if cfg.MaxDecompressedSize, err = getEnvInt64("MAX_DECOMPRESSED_SIZE", 64<<20); err != nil {
+		return nil, err
+	}
+	if cfg.MaxDecompressedSize < 1 {
+		return nil, fmt.Errorf("MAX_DECOMPRESSED_SIZE must be positive, got %d", cfg.MaxDecompressedSize)
+	}
+	if cfg.MaxPayload, err = getEnvInt64("MAX_PAYLOAD", 0); err != nil {
+		return nil, err
+	}
+	if cfg.SubscribersCount, err = getEnvInt("SUBSCRIBERS_COUNT", defaultSubscribersCount); err != nil {
+		return nil, err
+	}
+	if cfg.SubscribersCount < 1 {
+		return nil, fmt.Errorf("SUBSCRIBERS_COUNT must be at least 1, got %d", cfg.SubscribersCount)
+	}
+	if cfg.HandlerConcurrency, err = getEnvInt("HANDLER_CONCURRENCY", cfg.SubscribersCount); err != nil {
+		return nil, err
+	}
+	if cfg.HandlerConcurrency < 1 {
+		return nil, fmt.Errorf("HANDLER_CONCURRENCY must be at least 1, got %d", cfg.HandlerConcurrency)
+	}
+	if cfg.ScaleMax, err = getEnvInt("SCALE_MAX", 8); err != nil {
+		return nil, err
+	}
+	if cfg.ScaleMax < 1 {
+		return nil, fmt.Errorf("SCALE_MAX must be at least 1, got %d", cfg.ScaleMax)
+	}
+	if cfg.SubscribeBufferSize, err = getEnvInt("SUBSCRIBE_BUFFER", 0); err != nil {
+		return nil, err
+	}
+	if cfg.SubscribeBufferSize < 0 {
+		return nil, fmt.Errorf("SUBSCRIBE_BUFFER must not be negative, got %d", cfg.SubscribeBufferSize)
+	}
+	if cfg.JetStreamEnabled, err = getEnvBool("JETSTREAM_ENABLED", true); err != nil {
+		return nil, err
+	}
+	if cfg.Dedup, err = getEnvBool("DEDUP", false); err != nil {
+		return nil, err
+	}
+	if cfg.AckWaitTimeout, err = getEnvDuration("ACK_WAIT_TIMEOUT", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.HandlerTimeout, err = getEnvDuration("HANDLER_TIMEOUT", 0); err != nil {
+		return nil, err
+	}
+	if cfg.HandlerTimeout < 0 {
+		return nil, fmt.Errorf("HANDLER_TIMEOUT must not be negative, got %s", cfg.HandlerTimeout)
+	}
+	if cfg.AckExtensions, err = getEnvInt("ACK_EXTENSIONS", 0); err != nil {
+		return nil, err
+	}
+	if cfg.AckExtensions < 0 {
+		return nil, fmt.Errorf("ACK_EXTENSIONS must not be negative, got %d", cfg.AckExtensions)
+	}
+	if cfg.InactiveThreshold, err = getEnvDuration("INACTIVE_THRESHOLD", 300*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.InactiveThreshold < 0 {
+		return nil, fmt.Errorf("INACTIVE_THRESHOLD must not be negative, got %s", cfg.InactiveThreshold)
+	}
+	if cfg.MaxAckPending, err = getEnvInt("MAX_ACK_PENDING", 2048); err != nil {
+		return nil, err
+	}
+	if cfg.ExpectedHandlerDuration, err = getEnvDuration("EXPECTED_HANDLER_DURATION", 10*time.Millisecond); err != nil {
+		return nil, err
+	}
+	if cfg.NackBackoffBase, err = getEnvDuration("NACK_BACKOFF_BASE", 0); err != nil {
+		return nil, err
+	}
+	if cfg.NackBackoffMax, err = getEnvDuration("NACK_BACKOFF_MAX", time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.StartupTimeout, err = getEnvDuration("STARTUP_TIMEOUT", time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.PublishTimeout, err = getEnvDuration("PUBLISH_TIMEOUT", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.MetricsSubjectDepth, err = getEnvInt("METRICS_SUBJECT_DEPTH", 0); err != nil {
+		return nil, err
+	}
+	if cfg.MetricsSubjectDepth < 0 {
+		return nil, fmt.Errorf("METRICS_SUBJECT_DEPTH must not be negative, got %d", cfg.MetricsSubjectDepth)
+	}
+	if cfg.MetricsFinalScrape, err = getEnvDuration("METRICS_FINAL_SCRAPE_TIMEOUT", 0); err != nil {
+		return nil, err
+	}
+	if cfg.MetricsFinalScrape < 0 {
+		return nil, fmt.Errorf("METRICS_FINAL_SCRAPE_TIMEOUT must not be negative, got %s", cfg.MetricsFinalScrape)
+	}
+	if cfg.LagScrapeInterval, err = getEnvDuration("LAG_SCRAPE_INTERVAL", 15*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.LagScrapeInterval < 0 {
+		return nil, fmt.Errorf("LAG_SCRAPE_INTERVAL must not be negative, got %s", cfg.LagScrapeInterval)
+	}
+	if cfg.DeliverPolicy, err = parseDeliverPolicy(os.Getenv("DELIVER_POLICY")); err != nil {
+		return nil, err
+	}
+	cfg.AckPolicy = getEnv("ACK_POLICY", ackExplicit)
+	if cfg.AckPolicyOption, err = ackPolicyOption(cfg.AckPolicy); err != nil {
+		return nil, err
+	}
+	if cfg.ReplayUntilEnd, err = getEnvBool("REPLAY_UNTIL_END", true); err != nil {
+		return nil, err
+	}
+	if cfg.Ordered, err = getEnvBool("ORDERED", false); err != nil {
+		return nil, err
+	}
+	if cfg.Ordered {
+		if err := cfg.applyOrdered(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Ephemeral, err = getEnvBool("EPHEMERAL", false); err != nil {
+		return nil, err
+	}
+	if cfg.Ephemeral {
+		if err := cfg.applyEphemeral(); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.validateAckPolicy(); err != nil {
+		return nil, err
+	}
+	if cfg.DuplicateCacheSize, err = getEnvInt("DUPLICATE_CACHE_SIZE", 0); err != nil {
+		return nil, err
+	}
+	if cfg.DuplicateCacheSize < 0 {
+		return nil, fmt.Errorf("DUPLICATE_CACHE_SIZE must not be negative, got %d", cfg.DuplicateCacheSize)
+	}
+	if cfg.MessageTTL, err = getEnvDuration("MESSAGE_TTL", 0); err != nil {
+		return nil, err
+	}
+	if cfg.MessageTTL < 0 {
+		return nil, fmt.Errorf("MESSAGE_TTL must not be negative, got %s", cfg.MessageTTL)
+	}
+	if cfg.ExpiryCheck, err = getEnvBool("EXPIRY_CHECK", true); err != nil {
+		return nil, err
+	}
+	if cfg.VerifyOrder, err = getEnvBool("VERIFY_ORDER", false); err != nil {
+		return nil, err
+	}
+	if cfg.DryRun, err = getEnvBool("DRY_RUN", false); err != nil {
+		return nil, err
+	}
+	if cfg.FlushEvery, err = getEnvInt("FLUSH_EVERY", 0); err != nil {
+		return nil, err
+	}
+	if cfg.FlushEvery < 0 {
+		return nil, fmt.Errorf("FLUSH_EVERY must not be negative, got %d", cfg.FlushEvery)
+	}
+	return cfg, nil
+}
+
+// durablePrefix returns the durable prefix of the i-th subscriber of a pattern, counting from 1
+func (c *Config) durablePrefix(i int) string {
+	if i <= len(c.DurablePrefixes) {
+		return strings.TrimSpace(c.DurablePrefixes[i-1])
+	}
+	return c.DurablePrefix
+}
+
+// subscriberMarshaler returns the wire format of the i-th subscriber of a pattern, counting from 1
+func (c *Config) subscriberMarshaler(i int) string {
+	if i <= len(c.SubscriberMarshalers) {
+		if kind := strings.TrimSpace(c.SubscriberMarshalers[i-1]); kind != "" {
+			return kind
+		}
+	}
+	return c.Marshaler
+}
+
+// applyOrdered consumes with a single goroutine and a single unacked message at a time,
+// so that messages are handled one after the other in the order of the stream.
+// Settings that would process messages concurrently are rejected
+func (c *Config) applyOrdered() error {
+	if !c.JetStreamEnabled {
+		return errors.New("ORDERED requires JetStream, unset it or set JETSTREAM_ENABLED=true")
+	}
+	if queueGroupPrefix, ok := os.LookupEnv("QUEUE_GROUP_PREFIX"); ok && queueGroupPrefix != "" {
+		return errors.New("ORDERED=true forbids a queue group, unset QUEUE_GROUP_PREFIX")
+	}
+	if os.Getenv("SUBSCRIBERS_COUNT") != "" && c.SubscribersCount != 1 {
+		return fmt.Errorf("ORDERED=true requires SUBSCRIBERS_COUNT=1, got %d", c.SubscribersCount)
+	}
+	if os.Getenv("MAX_ACK_PENDING") != "" && c.MaxAckPending != 1 {
+		return fmt.Errorf("ORDERED=true requires MAX_ACK_PENDING=1, got %d", c.MaxAckPending)
+	}
+	if os.Getenv("HANDLER_CONCURRENCY") != "" && c.HandlerConcurrency != 1 {
+		return fmt.Errorf("ORDERED=true requires HANDLER_CONCURRENCY=1, got %d", c.HandlerConcurrency)
+	}
+	c.QueueGroupPrefix = ""
+	c.SubscribersCount = 1
+	c.HandlerConcurrency = 1
+	c.MaxAckPending = 1
+	return nil
+}
+
+// validateAckPolicy rejects the settings relying on acks the ACK_POLICY does not send
+//   - none: nothing is redelivered, so ordered processing, ack extensions and nack backoff are meaningless
+//   - all: acking a message acks those delivered before it, which may still be processed
+//     when messages are handled concurrently
+func (c *Config) validateAckPolicy() error {
+	switch c.AckPolicy {
+	case ackNone:
+		if c.Ordered {
+			return errors.New("ACK_POLICY=none cannot be combined with ORDERED=true, which waits for each ack")
+		}
+		if c.AckExtensions > 0 {
+			return fmt.Errorf("ACK_POLICY=none cannot be combined with ACK_EXTENSIONS, got %d", c.AckExtensions)
+		}
+		if os.Getenv("NACK_BACKOFF_BASE") != "" {
+			return errors.New("ACK_POLICY=none cannot be combined with NACK_BACKOFF_BASE, nothing is redelivered")
+		}
+	case ackAll:
+		if c.SubscribersCount > 1 || c.HandlerConcurrency > 1 {
+			return fmt.Errorf("ACK_POLICY=all requires SUBSCRIBERS_COUNT=1 and HANDLER_CONCURRENCY=1, got %d and %d: "+
+				"a message acked would ack those still processed by another goroutine", c.SubscribersCount, c.HandlerConcurrency)
+		}
+	}
+	return nil
+}
+
+// clientName returns the options naming a connection "<CLIENT_NAME>-<role>",
+// which tells the connections apart in `nats server report connections`
+func (c *Config) clientName(options []nc.Option, role string) []nc.Option {
+	return append(options[:len(options):len(options)], nc.Name(c.ClientName+"-"+role))
+}
+
+// subscribeOptions returns the options of the JetStream consumers of the subscribers
+func (c *Config) subscribeOptions() []nc.SubOpt {
+	options := []nc.SubOpt{
+		// DELIVER_POLICY selects where a new consumer starts: from the beginning of the stream (default),
+		// after the messages already stored, at the last message, or at a given time or sequence
+		c.DeliverPolicy,
+
+		// ACK_POLICY acks every message on its own (explicit, default), along with the messages delivered
+		// before it (all), or not at all (none), in which case nothing is ever redelivered
+		c.AckPolicyOption,
+
+		// LimitsPolicy (default) means that messages are retained until any given limit is reached
+		// This could be one of MaxMsgs, MaxBytes, or MaxAge.
+
+		// Discard Policy can be either Old (default) or New. It affects how MaxMessages and MaxBytes operate.
+		// If a limit is reached and the policy is Old, the oldest message is removed.
+		// If the policy is New, new messages are refused if it would put the stream over the limit.
+
+		// InactiveThreshold indicates how long the server should keep a consumer
+		// after detecting a lack of activity. In NATS Server 2.8.4 and earlier, this
+		// option only applies to ephemeral consumers. In NATS Server 2.9.0 and later,
+		// this option applies to both ephemeral and durable consumers, allowing durable
+		// consumers to also be deleted automatically after the inactivity threshold has passed
+		// (By default, durables will remain even when there are periods of inactivity unless InactiveThreshold is set explicitly)
+		// INACTIVE_THRESHOLD sets it, so that the consumers of crashed instances are cleaned up
+	}
+	if c.InactiveThreshold > 0 {
+		options = append(options, nc.InactiveThreshold(c.InactiveThreshold))
+	}
+	if c.AckPolicy != ackNone {
+		options = append(options,
+			// MaxAckPending sets the number of outstanding acks that are allowed before message delivery is halted
+			// if it is too large, the subscriber will have not enough time processing messages
+			// before NATS timeout. In this case, NATS will send the same batch of messages
+			// to another subscriber in the same queue group. Thus, messages may be processed twice
+			nc.MaxAckPending(c.MaxAckPending),
+
+			// AckWait is how long the server waits for an ack before redelivering,
+			// it matches the time the subscriber waits for the handler to Ack/Nack
+			nc.AckWait(c.AckWaitTimeout),
+
+			// MaxDeliver sets the number of redeliveries for a message
+			// Applies to any message that is re-sent due to a negative ack, or no ack sent by the client
+			nc.MaxDeliver(maxDeliver),
+		)
+	}
+	return options
+}
+
+// applyEphemeral consumes with ephemeral push consumers, which tail the stream and are deleted
+// by the server once their subscriber is gone. Without a durable name nor a queue group, every
+// goroutine would get its own copy of each message, so SUBSCRIBERS_COUNT is forced to 1
+// by loadSubscriberConfig. Durable names that are set explicitly are rejected
+func (c *Config) applyEphemeral() error {
+	if !c.JetStreamEnabled {
+		return errors.New("EPHEMERAL requires JetStream, core NATS subscriptions keep no state anyway")
+	}
+	if durablePrefix, ok := os.LookupEnv("DURABLE_PREFIX"); ok && durablePrefix != "" || len(c.DurablePrefixes) > 0 {
+		return errors.New("EPHEMERAL=true forbids durable names, unset DURABLE_PREFIX and DURABLE_PREFIXES")
+	}
+	if queueGroupPrefix, ok := os.LookupEnv("QUEUE_GROUP_PREFIX"); ok && queueGroupPrefix != "" {
+		return errors.New("EPHEMERAL=true forbids a queue group, unset QUEUE_GROUP_PREFIX")
+	}
+	c.DurablePrefix = ""
+	c.QueueGroupPrefix = ""
+	return nil
+}
+
+// getEnv returns the value of the environment variable key, or def when it is unset or empty
+func getEnv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// getEnvBool parses the environment variable key as a bool, or returns def when it is unset or empty
+func getEnvBool(key string, def bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return b, nil
+}
+
+// getEnvInt parses the environment variable key as an int, or returns def when it is unset or empty
+func getEnvInt(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return n, nil
+}
+
+// getEnvInt64 parses the environment variable key as an int64, or returns def when it is unset or empty
+func getEnvInt64(key string, def int64) (int64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return n, nil
+}
+
+// getEnvFloat parses the environment variable key as a float64, or returns def when it is unset or empty
+func getEnvFloat(key string, def float64) (float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return f, nil
+}
+
+// getEnvDuration parses the environment variable key as a time.Duration, or returns def when it is unset or empty
+func getEnvDuration(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return d, nil
+}
+
+// loadSubscriberConfig builds the configuration shared by every subscriber from cfg, decoding
+// messages with the wire format kind of marshalers. Without a queue group, SubscribersCount is forced to 1
+func loadSubscriberConfig(cfg *Config, kind string, marshalers marshalerStacks, options []nc.Option, jsConfig nats.JetStreamConfig, logger watermill.LoggerAdapter) (nats.SubscriberConfig, error) {
+	unmarshaler, err := marshalers.unmarshaler(kind)
+	if err != nil {
+		return nats.SubscriberConfig{}, err
+	}
+	nakDelay, err := newBackoff(cfg.NackBackoffBase, cfg.NackBackoffMax)
+	if err != nil {
+		return nats.SubscriberConfig{}, err
+	}
+
+	count := cfg.SubscribersCount
+	// without a queue group every goroutine gets its own copy of each message
+	if cfg.QueueGroupPrefix == "" && count != 1 {
+		logger.Info("QUEUE_GROUP_PREFIX is empty, forcing SUBSCRIBERS_COUNT to 1 to avoid duplicated messages", watermill.LogFields{
+			"subscribers_count": count,
+		})
+		count = 1
+	}
+
+	// the following comments are JetStream specific, ie. discussion on durability (JetStreamConfig.Disabled = false)
+	return nats.SubscriberConfig{
+		URL: cfg.URL,
+		// A queue group (queue group should always be used with a durable consumer) allows you to have all subscribers leave
+		// but still maintain state. When a subscriber re-joins, it starts at the last position in that group.
+		// If using empty DurablePrefix or no binding options being specified, the queue name will be used as a durable name
+
+		// When QueueGroup is empty, subscribe without QueueGroup (default subscribe, fan-out push pattern) will be used
+		// - If using non-empty DurablePrefix with default subscribe, the library will attempt to lookup a JetStream
+		//   consumer with this name, and if found, will bind to it and not attempt to delete it.
+		//   However, if not found, the library will send a request to create such durable JetStream consumer.
+		//   Now JetStream will persist the position of the durable consumer over the stream
+		//   Note that DurablePrefix should be unique for each subscriber here to avoid duplication
+		//   ie. each durable consumer should only be bounded by one subscriber in the default subscribe mode
+		// - If using empty DurablePrefix with default subscribe, the library will send a request to the server
+		//   to create an ephemeral JetStream consumer, which will be deleted after an Unsubscribe() or Drain()
+		//   or after InactiveThreshold (defaults to 5 seconds) is reached when not actively consuming messages
+		//   Ephemeral consumers are meant to be used by a single instance of an application (e.g. to get its own replay of the messages in the stream)
+		// In both case, SubscribersCount should be set to 1 to avoid duplication
+		QueueGroupPrefix: cfg.QueueGroupPrefix,
+		SubscribersCount: count, // how many goroutines should consume messages
+		CloseTimeout:     closeTimeout,
+		// How long subscriber should wait for Ack/Nack. When no Ack/Nack was received, message will be redelivered.
+		// Each ack extension gives the handler another AckWaitTimeout, see WithAckExtension
+		AckWaitTimeout: cfg.AckWaitTimeout * time.Duration(cfg.AckExtensions+1),
+		// Nacked messages are redelivered after an exponential backoff instead of immediately
+		NakDelay:    nakDelay,
+		NatsOptions: options,
+		Unmarshaler: unmarshaler,
+		JetStream:   jsConfig,
+	}, nil
+}
+
+// loadPublisherConfig builds the publisher configuration from cfg, with the same URL and options as the subscribers
+func loadPublisherConfig(cfg *Config, marshaler nats.Marshaler, options []nc.Option, jsConfig nats.JetStreamConfig) nats.PublisherConfig {
+	return nats.PublisherConfig{
+		URL:         cfg.URL,
+		NatsOptions: options,
+		Marshaler:   marshaler,
+		JetStream:   jsConfig,
+	}
+}
+
+// jetStreamOnly are the settings of the JetStream consumers, streams and publishes,
+// which validateCoreNATS rejects when set along with JETSTREAM_ENABLED=false
+var jetStreamOnly = []string{
+	"DELIVER_POLICY", "ACK_POLICY", "IDEMPOTENCY_BUCKET", "IDEMPOTENCY_TTL",
+	"DURABLE_PREFIX", "DURABLE_PREFIXES", "DURABLE_COLLISION",
+	"MAX_ACK_PENDING", "ACK_EXTENSIONS", "INACTIVE_THRESHOLD",
+	"NACK_BACKOFF_BASE", "NACK_BACKOFF_MAX", "SYNC_PUBLISH_SUBJECTS",
+}
+
+// validateCoreNATS rejects JetStream-only settings when JetStream is disabled,
+// instead of silently ignoring them
+func validateCoreNATS() error {
+	for _, key := range []string{"AUTO_PROVISION", "DEDUP"} {
+		enabled, err := getEnvBool(key, false)
+		if err != nil {
+			return err
+		}
+		if enabled {
+			return fmt.Errorf("%s requires JetStream, unset it or set JETSTREAM_ENABLED=true", key)
+		}
+	}
+	for _, key := range jetStreamOnly {
+		if os.Getenv(key) != "" {
+			return fmt.Errorf("%s requires JetStream, unset it or set JETSTREAM_ENABLED=true", key)
+		}
+	}
+	return nil
+}
+
+// validateJetStreamConfig checks the ack tuning knobs against the expected time a handler
+// spends on one message. A non-positive maxAckPending is an error; the footguns described
+// next to the subscribe options are returned as warnings:
+//   - ackWait should be at least twice handlerDuration, otherwise slow messages are redelivered while still being processed
+//   - maxAckPending messages handled one after the other should fit in ackWait, otherwise the
+//     last messages of a batch time out and are delivered to another subscriber, ie. processed twice
+//   - inactiveThreshold, when set, should not be shorter than ackWait, otherwise a consumer whose
+//     subscriber restarts may be deleted with its pending redeliveries
+func validateJetStreamConfig(ackWait time.Duration, maxAckPending int, handlerDuration, inactiveThreshold time.Duration) ([]string, error) {
+	if maxAckPending <= 0 {
+		return nil, fmt.Errorf("MAX_ACK_PENDING must be positive, got %d", maxAckPending)
+	}
+	if ackWait <= 0 {
+		return nil, fmt.Errorf("ACK_WAIT_TIMEOUT must be positive, got %s", ackWait)
+	}
+
+	var warnings []string
+	if ackWait < 2*handlerDuration {
+		warnings = append(warnings, fmt.Sprintf(
+			"ACK_WAIT_TIMEOUT (%s) is not comfortably larger than EXPECTED_HANDLER_DURATION (%s), messages may be redelivered while being processed",
+			ackWait, handlerDuration))
+	}
+	if backlog := time.Duration(maxAckPending) * handlerDuration; backlog > ackWait {
+		warnings = append(warnings, fmt.Sprintf(
+			"MAX_ACK_PENDING (%d) x EXPECTED_HANDLER_DURATION (%s) = %s exceeds ACK_WAIT_TIMEOUT (%s), pending messages may time out and be processed twice",
+			maxAckPending, handlerDuration, backlog, ackWait))
+	}
+	if inactiveThreshold > 0 && inactiveThreshold < ackWait {
+		warnings = append(warnings, fmt.Sprintf(
+			"INACTIVE_THRESHOLD (%s) is shorter than ACK_WAIT_TIMEOUT (%s), a consumer may be deleted while a redelivery is pending",
+			inactiveThreshold, ackWait))
+	}
+	return warnings, nil
+}
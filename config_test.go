@@ -0,0 +1,295 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	nc "github.com/nats-io/nats.go"
+)
+
+func TestValidateJetStreamConfig(t *testing.T) {
+	tests := []struct {
+		name              string
+		ackWait           time.Duration
+		maxAckPending     int
+		handlerDuration   time.Duration
+		inactiveThreshold time.Duration
+		// warnings holds a fragment of each expected warning, in order
+		warnings []string
+		err      bool
+	}{
+		{name: "defaults", ackWait: 30 * time.Second, maxAckPending: 2048, handlerDuration: 10 * time.Millisecond, inactiveThreshold: 300 * time.Second},
+		{name: "zero max ack pending", ackWait: 30 * time.Second, maxAckPending: 0, handlerDuration: 10 * time.Millisecond, err: true},
+		{name: "negative max ack pending", ackWait: 30 * time.Second, maxAckPending: -1, handlerDuration: 10 * time.Millisecond, err: true},
+		{name: "zero ack wait", ackWait: 0, maxAckPending: 1, handlerDuration: 10 * time.Millisecond, err: true},
+		// ackWait must be at least twice the handler duration
+		{name: "ack wait twice the handler", ackWait: 2 * time.Second, maxAckPending: 1, handlerDuration: time.Second},
+		{name: "ack wait just below twice the handler", ackWait: 2*time.Second - time.Millisecond, maxAckPending: 1, handlerDuration: time.Second,
+			warnings: []string{"not comfortably larger"}},
+		// maxAckPending handled one after the other must fit in ackWait
+		{name: "backlog fills ack wait", ackWait: 30 * time.Second, maxAckPending: 3000, handlerDuration: 10 * time.Millisecond},
+		{name: "backlog exceeds ack wait", ackWait: 30 * time.Second, maxAckPending: 3001, handlerDuration: 10 * time.Millisecond,
+			warnings: []string{"exceeds ACK_WAIT_TIMEOUT"}},
+		{name: "both", ackWait: time.Second, maxAckPending: 10, handlerDuration: time.Second,
+			warnings: []string{"not comfortably larger", "exceeds ACK_WAIT_TIMEOUT"}},
+		// inactiveThreshold, when set, must not be shorter than ackWait
+		{name: "inactive threshold equals ack wait", ackWait: 30 * time.Second, maxAckPending: 1, handlerDuration: time.Millisecond, inactiveThreshold: 30 * time.Second},
+		{name: "inactive threshold below ack wait", ackWait: 30 * time.Second, maxAckPending: 1, handlerDuration: time.Millisecond, inactiveThreshold: 29 * time.Second,
+			warnings: []string{"INACTIVE_THRESHOLD"}},
+		{name: "inactive threshold unset", ackWait: 30 * time.Second, maxAckPending: 1, handlerDuration: time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warnings, err := validateJetStreamConfig(tt.ackWait, tt.maxAckPending, tt.handlerDuration, tt.inactiveThreshold)
+			if (err != nil) != tt.err {
+				t.Fatalf("err = %v, want error %v", err, tt.err)
+			}
+			if len(warnings) != len(tt.warnings) {
+				t.Fatalf("warnings = %q, want %d", warnings, len(tt.warnings))
+			}
+			for i, fragment := range tt.warnings {
+				if !strings.Contains(warnings[i], fragment) {
+					t.Errorf("warning %q does not mention %q", warnings[i], fragment)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	t.Setenv("NATS_URL", "nats://127.0.0.1:4222")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.URL != "nats://127.0.0.1:4222" {
+		t.Errorf("URL = %q", cfg.URL)
+	}
+	if len(cfg.Subjects) != 1 || cfg.Subjects[0] != defaultSubjects {
+		t.Errorf("Subjects = %q, want %q", cfg.Subjects, defaultSubjects)
+	}
+	if cfg.Marshaler != "nats" || cfg.ClientName != "pubsub" || cfg.DLQPrefix != "dlq" {
+		t.Errorf("Marshaler, ClientName, DLQPrefix = %q, %q, %q", cfg.Marshaler, cfg.ClientName, cfg.DLQPrefix)
+	}
+	if cfg.QueueGroupPrefix != defaultQueueGroupPrefix || cfg.DurablePrefix != defaultDurablePrefix {
+		t.Errorf("QueueGroupPrefix, DurablePrefix = %q, %q", cfg.QueueGroupPrefix, cfg.DurablePrefix)
+	}
+	if cfg.SubscribersCount != defaultSubscribersCount || cfg.HandlerConcurrency != defaultSubscribersCount {
+		t.Errorf("SubscribersCount, HandlerConcurrency = %d, %d, want %d", cfg.SubscribersCount, cfg.HandlerConcurrency, defaultSubscribersCount)
+	}
+	if cfg.ControlAddr != "127.0.0.1:8081" {
+		t.Errorf("ControlAddr = %q, want loopback", cfg.ControlAddr)
+	}
+	if !cfg.JetStreamEnabled || cfg.Dedup || cfg.Ordered || cfg.Ephemeral || cfg.DryRun {
+		t.Errorf("unexpected feature flags: %+v", cfg)
+	}
+	if cfg.AckPolicy != ackExplicit {
+		t.Errorf("AckPolicy = %q, want %q", cfg.AckPolicy, ackExplicit)
+	}
+	durations := []struct {
+		name      string
+		got, want time.Duration
+	}{
+		{"ACK_WAIT_TIMEOUT", cfg.AckWaitTimeout, 30 * time.Second},
+		{"INACTIVE_THRESHOLD", cfg.InactiveThreshold, 300 * time.Second},
+		{"EXPECTED_HANDLER_DURATION", cfg.ExpectedHandlerDuration, 10 * time.Millisecond},
+		{"NACK_BACKOFF_BASE", cfg.NackBackoffBase, 0},
+		{"NACK_BACKOFF_MAX", cfg.NackBackoffMax, time.Minute},
+		{"PUBLISH_TIMEOUT", cfg.PublishTimeout, 5 * time.Second},
+		{"HANDLER_TIMEOUT", cfg.HandlerTimeout, 0},
+	}
+	for _, d := range durations {
+		if d.got != d.want {
+			t.Errorf("%s = %s, want %s", d.name, d.got, d.want)
+		}
+	}
+	if cfg.MaxAckPending != 2048 || cfg.CompressionThreshold != 1024 || cfg.MaxDecompressedSize != 64<<20 {
+		t.Errorf("MaxAckPending, CompressionThreshold, MaxDecompressedSize = %d, %d, %d",
+			cfg.MaxAckPending, cfg.CompressionThreshold, cfg.MaxDecompressedSize)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		key, value string
+	}{
+		{"NATS_URL", ""},
+		{"NATS_URL", "http://127.0.0.1:4222"},
+		{"SUBJECTS", "a,,b"},
+		{"DLQ_PREFIX", "example_topic"},
+		{"DURABLE_COLLISION", "ignore"},
+		{"SUBSCRIBERS_COUNT", "0"},
+		{"SUBSCRIBERS_COUNT", "four"},
+		{"HANDLER_CONCURRENCY", "0"},
+		{"SCALE_MAX", "0"},
+		{"SUBSCRIBE_BUFFER", "-1"},
+		{"MAX_DECOMPRESSED_SIZE", "0"},
+		{"JETSTREAM_ENABLED", "maybe"},
+		{"ACK_WAIT_TIMEOUT", "30"},
+		{"HANDLER_TIMEOUT", "-1s"},
+		{"ACK_EXTENSIONS", "-1"},
+		{"INACTIVE_THRESHOLD", "-1s"},
+		{"MAX_ACK_PENDING", "many"},
+		{"METRICS_SUBJECT_DEPTH", "-1"},
+		{"LAG_SCRAPE_INTERVAL", "-1s"},
+		{"DELIVER_POLICY", "sometimes"},
+		{"ACK_POLICY", "maybe"},
+		{"DUPLICATE_CACHE_SIZE", "-1"},
+		{"MESSAGE_TTL", "-1s"},
+		{"FLUSH_EVERY", "-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key+"="+tt.value, func(t *testing.T) {
+			t.Setenv("NATS_URL", "nats://127.0.0.1:4222")
+			t.Setenv(tt.key, tt.value)
+			if _, err := LoadConfig(); err == nil {
+				t.Errorf("%s=%q was accepted", tt.key, tt.value)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRejectsConflicts(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{"ordered with concurrency", map[string]string{"ORDERED": "true", "QUEUE_GROUP_PREFIX": "", "SUBSCRIBERS_COUNT": "2"}},
+		{"ordered with a queue group", map[string]string{"ORDERED": "true", "QUEUE_GROUP_PREFIX": "example"}},
+		{"ordered without JetStream", map[string]string{"ORDERED": "true", "JETSTREAM_ENABLED": "false"}},
+		{"ephemeral with a durable", map[string]string{"EPHEMERAL": "true", "DURABLE_PREFIX": "durable", "QUEUE_GROUP_PREFIX": ""}},
+		{"ack none with extensions", map[string]string{"ACK_POLICY": "none", "ACK_EXTENSIONS": "2"}},
+		{"ack all with concurrency", map[string]string{"ACK_POLICY": "all", "SUBSCRIBERS_COUNT": "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("NATS_URL", "nats://127.0.0.1:4222")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			if _, err := LoadConfig(); err == nil {
+				t.Errorf("%v was accepted", tt.env)
+			}
+		})
+	}
+}
+
+func TestValidateCoreNATS(t *testing.T) {
+	tests := []struct {
+		key, value string
+		valid      bool
+	}{
+		{"AUTO_PROVISION", "false", true},
+		{"AUTO_PROVISION", "1", false},
+		{"AUTO_PROVISION", "yes", false},
+		{"DEDUP", "true", false},
+		{"DELIVER_POLICY", "new", false},
+		{"MAX_ACK_PENDING", "100", false},
+		{"DURABLE_PREFIX", "durable", false},
+		{"NACK_BACKOFF_BASE", "0", false},
+		{"QUEUE_GROUP_PREFIX", "example", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key+"="+tt.value, func(t *testing.T) {
+			t.Setenv(tt.key, tt.value)
+			if err := validateCoreNATS(); (err == nil) != tt.valid {
+				t.Errorf("validateCoreNATS() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestLoadStreamConfigAutoProvision(t *testing.T) {
+	t.Setenv("AUTO_PROVISION", "1")
+	if cfg, err := loadStreamConfig(); err != nil || cfg == nil {
+		t.Errorf("AUTO_PROVISION=1: %v, %v, want a stream", cfg, err)
+	}
+	t.Setenv("AUTO_PROVISION", "false")
+	if cfg, err := loadStreamConfig(); err != nil || cfg != nil {
+		t.Errorf("AUTO_PROVISION=false: %v, %v, want no stream", cfg, err)
+	}
+	t.Setenv("AUTO_PROVISION", "yes")
+	if _, err := loadStreamConfig(); err == nil {
+		t.Error("AUTO_PROVISION=yes was accepted")
+	}
+}
+
+func TestClientNameAppliedToConnections(t *testing.T) {
+	s := startServer(t, &server.Options{})
+	t.Setenv("NATS_URL", s.ClientURL())
+	t.Setenv("CLIENT_NAME", "orders")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the shared options have spare capacity, each role must get its own copy
+	options := make([]nc.Option, 1, 4)
+	options[0] = nc.MaxReconnects(1)
+	roles := map[string][]nc.Option{
+		"publisher":    cfg.clientName(options, "publisher"),
+		"subscriber-1": cfg.clientName(options, "subscriber-1"),
+	}
+	for role, roleOptions := range roles {
+		conn, err := nc.Connect(cfg.URL, roleOptions...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if want := "orders-" + role; conn.Opts.Name != want {
+			t.Errorf("connection named %q, want %q", conn.Opts.Name, want)
+		}
+	}
+
+	// the server reports each connection with its name
+	connz, err := s.Connz(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, conn := range connz.Conns {
+		names[conn.Name] = true
+	}
+	if !names["orders-publisher"] || !names["orders-subscriber-1"] {
+		t.Errorf("the server reports the connections %v, want orders-publisher and orders-subscriber-1", names)
+	}
+}
+
+func TestInactiveThresholdAppliedToConsumers(t *testing.T) {
+	url := runServer(t, true)
+	js := addStream(t, connect(t, url), "orders", "orders.>")
+	t.Setenv("NATS_URL", url)
+	t.Setenv("ACK_WAIT_TIMEOUT", "30s")
+	tests := []struct {
+		threshold string
+		want      time.Duration
+	}{
+		{"10m", 10 * time.Minute},
+		{"", 300 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Setenv("INACTIVE_THRESHOLD", tt.threshold)
+		cfg, err := LoadConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		consumer := consumerOf(t, js, cfg.subscribeOptions()...)
+		if consumer.InactiveThreshold != tt.want {
+			t.Errorf("INACTIVE_THRESHOLD=%q created a consumer with an inactive threshold of %s, want %s", tt.threshold, consumer.InactiveThreshold, tt.want)
+		}
+		if consumer.AckWait != 30*time.Second {
+			t.Errorf("INACTIVE_THRESHOLD=%q created a consumer with an ack wait of %s, want 30s", tt.threshold, consumer.AckWait)
+		}
+	}
+
+	// 0 leaves the server default
+	t.Setenv("INACTIVE_THRESHOLD", "0")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, def := consumerOf(t, js, cfg.subscribeOptions()...).InactiveThreshold, consumerOf(t, js).InactiveThreshold; got != def {
+		t.Errorf("INACTIVE_THRESHOLD=0 created a consumer with an inactive threshold of %s, want the server default %s", got, def)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// applyConfigFile exports the settings of a YAML or JSON file to their environment variables.
+// The file is keyed by flag name, e.g. `nats-url: nats://localhost:4222`; lists are joined with commas.
+// A variable that is already set, from the environment or a flag, wins over the file,
+// so the precedence is defaults < file < environment < flags.
+// Keys that match no flag are reported as an error
+func applyConfigFile(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %w", err)
+	}
+	settings := make(map[string]any)
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, &settings)
+	case ".json":
+		// numbers are kept as written, float64 would print large integers in exponent form
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		if err = decoder.Decode(&settings); err == nil && decoder.More() {
+			err = errors.New("unexpected data after the settings")
+		}
+	default:
+		return fmt.Errorf("unknown config file extension %q, expected .yaml, .yml or .json", ext)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	envs := make(map[string]string, len(envFlags))
+	for _, f := range envFlags {
+		if f.env != configFileEnv {
+			envs[f.name] = f.env
+		}
+	}
+	var unknown []string
+	for key := range settings {
+		if _, ok := envs[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown keys in config file %s: %s", path, strings.Join(unknown, ", "))
+	}
+
+	for key, value := range settings {
+		if _, ok := os.LookupEnv(envs[key]); ok || value == nil {
+			continue
+		}
+		v, err := settingValue(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s in config file %s: %w", key, path, err)
+		}
+		if err := os.Setenv(envs[key], v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settingValue formats a config file value the way its environment variable expects it
+func settingValue(value any) (string, error) {
+	switch v := value.(type) {
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := settingValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		return "", fmt.Errorf("expected a value or a list, got an object")
+	case json.Number:
+		// integers are kept as written, exponents such as 1e7 expanded like YAML floats
+		if _, err := v.Int64(); err == nil {
+			return v.String(), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return "", err
+		}
+		return settingValue(f)
+	case float64:
+		// YAML floats such as 1e7, printed without an exponent
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeConfigFile writes content to a config file named name and unsets keys,
+// which are restored once the test is done
+func writeConfigFile(t *testing.T, name, content string, keys ...string) string {
+	t.Helper()
+	for _, key := range keys {
+		t.Setenv(key, "")
+		if err := os.Unsetenv(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyConfigFileNumbers(t *testing.T) {
+	tests := []struct {
+		name, content string
+	}{
+		{"settings.json", `{"max-payload": 8388608, "max-decompressed-size": 67108864, "compression-threshold": 1e7, "subjects": ["a.>", "b.>"]}`},
+		{"settings.yaml", "max-payload: 8388608\nmax-decompressed-size: 67108864\ncompression-threshold: 1e7\nsubjects: [a.>, b.>]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfigFile(t, tt.name, tt.content, "MAX_PAYLOAD", "MAX_DECOMPRESSED_SIZE", "COMPRESSION_THRESHOLD", "SUBJECTS")
+			if err := applyConfigFile(path); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{
+				"MAX_PAYLOAD":           "8388608",
+				"MAX_DECOMPRESSED_SIZE": "67108864",
+				"COMPRESSION_THRESHOLD": "10000000",
+				"SUBJECTS":              "a.>,b.>",
+			}
+			for key, value := range want {
+				if got := os.Getenv(key); got != value {
+					t.Errorf("%s = %q, want %q", key, got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyConfigFileEnvironmentWins(t *testing.T) {
+	path := writeConfigFile(t, "settings.yaml", "max-payload: 1024\n")
+	t.Setenv("MAX_PAYLOAD", "2048")
+	if err := applyConfigFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("MAX_PAYLOAD"); got != "2048" {
+		t.Errorf("MAX_PAYLOAD = %q, want the environment value", got)
+	}
+}
+
+func TestApplyConfigFileRejects(t *testing.T) {
+	tests := []struct {
+		name, content string
+	}{
+		{"settings.yaml", "no-such-flag: 1\n"},
+		{"settings.yaml", "subjects:\n  nested: a\n"},
+		{"settings.json", `{"max-payload": 1} {"max-payload": 2}`},
+		{"settings.toml", "max-payload = 1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfigFile(t, tt.name, tt.content, "MAX_PAYLOAD", "SUBJECTS")
+			if err := applyConfigFile(path); err == nil {
+				t.Errorf("%q was accepted", tt.content)
+			}
+		})
+	}
+}
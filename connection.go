@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+// natsURL returns the environment variable key, NATS_URL or MIRROR_NATS_URL, a comma-separated
+// list of servers of the same cluster. Listing several servers lets the client reconnect to a surviving node
+func natsURL(key string) (string, error) {
+	servers, err := parseServers(key, os.Getenv(key))
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(servers, ","), nil
+}
+
+// parseServers splits a comma-separated list of server URLs, rejecting empty entries and unsupported schemes.
+// Servers are reached over NATS (nats://, tls://, or no scheme) or over WebSocket (ws://, wss://),
+// the client cannot mix both in the same list
+func parseServers(key, raw string) ([]string, error) {
+	if raw == "" {
+		return nil, fmt.Errorf("%s is not set", key)
+	}
+	var servers []string
+	websockets := 0
+	for _, server := range strings.Split(raw, ",") {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			return nil, fmt.Errorf("%s %q contains an empty server", key, raw)
+		}
+		switch serverScheme(server) {
+		case "nats", "tls":
+		case "ws", "wss":
+			websockets++
+		default:
+			return nil, fmt.Errorf("%s server %q has unsupported scheme %q, expected nats, tls, ws or wss", key, server, serverScheme(server))
+		}
+		servers = append(servers, server)
+	}
+	if websockets > 0 && websockets < len(servers) {
+		return nil, fmt.Errorf("%s %q mixes WebSocket (ws://, wss://) and NATS servers, use only one kind", key, raw)
+	}
+	return servers, nil
+}
+
+// serverScheme returns the lower-cased scheme of a server URL, nats when it has none
+func serverScheme(server string) string {
+	scheme, _, ok := strings.Cut(server, "://")
+	if !ok {
+		return "nats"
+	}
+	return strings.ToLower(scheme)
+}
+
+// connectionOptions returns the NATS connection options shared by the publisher and the subscribers,
+// events logs the connection state changes of each of them
+func connectionOptions(events *connEvents) ([]nc.Option, error) {
+	// MAX_RECONNECTS is the number of reconnect attempts before giving up, -1 retries forever
+	maxReconnects, err := getEnvInt("MAX_RECONNECTS", nc.DefaultMaxReconnect)
+	if err != nil {
+		return nil, err
+	}
+	// RECONNECT_BUF_SIZE is how many bytes of publishes are buffered while reconnecting
+	reconnectBufSize, err := getEnvInt("RECONNECT_BUF_SIZE", nc.DefaultReconnectBufSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// RECONNECT_WAIT doubles after each failed round of reconnect attempts up to RECONNECT_WAIT_MAX,
+	// RECONNECT_JITTER spreads the clients reconnecting after the same outage
+	reconnectWait, err := getEnvDuration("RECONNECT_WAIT", time.Second)
+	if err != nil {
+		return nil, err
+	}
+	reconnectWaitMax, err := getEnvDuration("RECONNECT_WAIT_MAX", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	reconnectJitter, err := getEnvFloat("RECONNECT_JITTER", 0.2)
+	if err != nil {
+		return nil, err
+	}
+	delay, err := reconnectDelay(reconnectWait, reconnectWaitMax, reconnectJitter)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []nc.Option{
+		nc.RetryOnFailedConnect(true),
+		nc.Timeout(30 * time.Second),
+		nc.CustomReconnectDelay(delay),
+		nc.MaxReconnects(maxReconnects),
+		nc.ReconnectBufSize(reconnectBufSize),
+	}
+	options = append(options, events.options()...)
+
+	servers, err := parseServers("NATS_URL", os.Getenv("NATS_URL"))
+	if err != nil {
+		return nil, err
+	}
+	tlsOptions, err := tlsOptions(servers, os.Getenv("NATS_TLS_CERT"), os.Getenv("NATS_TLS_KEY"), os.Getenv("NATS_TLS_CA"))
+	if err != nil {
+		return nil, err
+	}
+	options = append(options, tlsOptions...)
+
+	authOptions, err := authOptions(os.Getenv("NATS_CREDS"), os.Getenv("NATS_TOKEN"))
+	if err != nil {
+		return nil, err
+	}
+	return append(options, authOptions...), nil
+}
+
+// authOptions returns the option authenticating with either a .creds file or a token.
+// Since every connection is built from the same options, the publisher and
+// the subscribers always authenticate the same way
+func authOptions(creds, token string) ([]nc.Option, error) {
+	switch {
+	case creds != "" && token != "":
+		return nil, errors.New("NATS_CREDS and NATS_TOKEN are mutually exclusive, set only one of them")
+	case creds != "":
+		if err := checkFile("NATS_CREDS", creds); err != nil {
+			return nil, err
+		}
+		return []nc.Option{nc.UserCredentials(creds)}, nil
+	case token != "":
+		return []nc.Option{nc.Token(token)}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// tlsOptions returns the options for a TLS-secured cluster
+//   - cert and key: mutual TLS, the client authenticates with its certificate
+//   - ca: the server certificate is verified against this CA instead of the system roots
+//
+// Every given file must exist, so that a typo never silently falls back to a plain connection.
+// wss:// servers always require TLS, whereas the files are rejected with ws:// servers, which are plain text
+func tlsOptions(servers []string, cert, key, ca string) ([]nc.Option, error) {
+	if (cert == "") != (key == "") {
+		return nil, errors.New("NATS_TLS_CERT and NATS_TLS_KEY must be set together")
+	}
+
+	var options []nc.Option
+	for _, server := range servers {
+		switch serverScheme(server) {
+		case "ws":
+			if cert != "" || ca != "" {
+				return nil, fmt.Errorf("NATS_TLS_CERT, NATS_TLS_KEY and NATS_TLS_CA require wss:// servers, %s is not encrypted", server)
+			}
+		case "wss":
+			if len(options) == 0 {
+				options = append(options, nc.Secure())
+			}
+		}
+	}
+	if cert != "" {
+		if err := checkFile("NATS_TLS_CERT", cert); err != nil {
+			return nil, err
+		}
+		if err := checkFile("NATS_TLS_KEY", key); err != nil {
+			return nil, err
+		}
+		options = append(options, nc.ClientCert(cert, key))
+	}
+	if ca != "" {
+		if err := checkFile("NATS_TLS_CA", ca); err != nil {
+			return nil, err
+		}
+		options = append(options, nc.RootCAs(ca))
+	}
+	return options, nil
+}
+
+// checkFile reports a missing or unreadable file configured by the environment variable name
+func checkFile(name, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s: %s is a directory", name, path)
+	}
+	return nil
+}
+
+// newSubscriber dials its own connection for the subscriber, so that its state can be observed
+// and it can be drained. The connection is closed by Drain() or Close()
+func newSubscriber(config nats.SubscriberConfig, logger watermill.LoggerAdapter) (*subscriber, error) {
+	conn, err := nc.Connect(config.URL, config.NatsOptions...)
+	if err != nil {
+		return nil, connectionError(err)
+	}
+	sub, err := nats.NewSubscriberWithNatsConn(conn, config.GetSubscriberSubscriptionConfig(), logger)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &subscriber{Subscriber: sub, conn: conn, logger: logger}, nil
+}
+
+// publisher wraps the watermill publisher with the connection it dialed
+type publisher struct {
+	*nats.Publisher
+	conn *nc.Conn
+	// flushEvery flushes the connection after that many publishes, 0 never does
+	flushEvery int64
+	published  atomic.Int64
+}
+
+// Flush waits until the server processed everything published so far on the connection.
+// Core NATS publishes otherwise sit in the client buffer for a while, and are lost on a crash
+func (p *publisher) Flush(ctx context.Context) error {
+	if err := p.conn.FlushWithContext(ctx); err != nil {
+		return connectionError(err)
+	}
+	return nil
+}
+
+// Conn returns the connection of the publisher, for the NATS features watermill does not expose.
+// The connection is shared with the publisher and closed by Publisher.Close(), the caller must not close it
+func (p *publisher) Conn() *nc.Conn {
+	return p.conn
+}
+
+// Publish validates topic before publishing messages to it, see validateSubject, and flushes
+// the connection every flushEvery messages
+func (p *publisher) Publish(topic string, messages ...*message.Message) error {
+	if err := validateSubject(topic); err != nil {
+		return err
+	}
+	if err := p.Publisher.Publish(topic, messages...); err != nil {
+		return err
+	}
+	// FLUSH_EVERY trades throughput for durability
+	if p.flushEvery > 0 {
+		before := p.published.Add(int64(len(messages))) - int64(len(messages))
+		if before/p.flushEvery != (before+int64(len(messages)))/p.flushEvery {
+			ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+			defer cancel()
+			return p.Flush(ctx)
+		}
+	}
+	return nil
+}
+
+// newPublisher dials its own connection for the publisher, so that its state can be observed.
+// The connection is closed by Publisher.Close()
+func newPublisher(config nats.PublisherConfig, logger watermill.LoggerAdapter) (*publisher, error) {
+	if config.SubjectCalculator == nil {
+		config.SubjectCalculator = nats.DefaultSubjectCalculator
+	}
+	conn, err := nc.Connect(config.URL, config.NatsOptions...)
+	if err != nil {
+		return nil, connectionError(err)
+	}
+	pub, err := nats.NewPublisherWithNatsConn(conn, config.GetPublisherPublishConfig(), logger)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &publisher{Publisher: pub, conn: conn}, nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+func TestParseServers(t *testing.T) {
+	tests := []struct {
+		raw     string
+		servers []string
+		// err is a fragment of the expected error, empty when the list is valid
+		err string
+	}{
+		{raw: "nats://a:4222", servers: []string{"nats://a:4222"}},
+		{raw: "nats://a:4222,nats://b:4222", servers: []string{"nats://a:4222", "nats://b:4222"}},
+		{raw: " nats://a:4222 , tls://b:4222,c:4222", servers: []string{"nats://a:4222", "tls://b:4222", "c:4222"}},
+		{raw: "ws://a:8080,WSS://b:8443", servers: []string{"ws://a:8080", "WSS://b:8443"}},
+		{raw: "", err: "is not set"},
+		{raw: "nats://a:4222,,nats://b:4222", err: "empty server"},
+		{raw: "nats://a:4222,", err: "empty server"},
+		{raw: "http://a:4222", err: "unsupported scheme"},
+		{raw: "nats://a:4222,ws://b:8080", err: "mixes WebSocket"},
+	}
+	for _, tt := range tests {
+		servers, err := parseServers("NATS_URL", tt.raw)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: err = %v, want it to mention %q", tt.raw, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.raw, err)
+			continue
+		}
+		if !reflect.DeepEqual(servers, tt.servers) {
+			t.Errorf("%q: servers = %q, want %q", tt.raw, servers, tt.servers)
+		}
+	}
+}
+
+// wss:// servers go through the TLS path, ws:// and nats:// servers do not
+func TestWebSocketTLS(t *testing.T) {
+	tests := []struct {
+		url    string
+		secure bool
+	}{
+		{"wss://edge.example.com:8443", true},
+		{"wss://a:8443,WSS://b:8443", true},
+		{"ws://edge.example.com:8080", false},
+		{"nats://127.0.0.1:4222", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("NATS_URL", tt.url)
+		options, err := connectionOptions(newConnEvents(watermill.NopLogger{}, nil))
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		opts := nc.GetDefaultOptions()
+		for _, option := range options {
+			if err := option(&opts); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if opts.Secure != tt.secure {
+			t.Errorf("%s: secure = %v, want %v", tt.url, opts.Secure, tt.secure)
+		}
+	}
+
+	// the TLS files are rejected with the plain text ws:// servers
+	t.Setenv("NATS_URL", "ws://edge.example.com:8080")
+	t.Setenv("NATS_TLS_CA", "ca.pem")
+	if _, err := connectionOptions(newConnEvents(watermill.NopLogger{}, nil)); err == nil || !strings.Contains(err.Error(), "require wss://") {
+		t.Errorf("NATS_TLS_CA with a ws:// server: err = %v, want it to require wss://", err)
+	}
+}
+
+// the client tries every server of the list, so it connects while the first one is down
+func TestServersFailover(t *testing.T) {
+	t.Setenv("NATS_URL", "nats://127.0.0.1:1,"+runServer(t, false))
+	url, err := natsURL("NATS_URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := nc.Connect(url, nc.DontRandomize())
+	if err != nil {
+		t.Fatalf("cannot connect to %s: %v", url, err)
+	}
+	defer conn.Close()
+	if len(conn.Servers()) < 2 {
+		t.Errorf("the connection knows %q, want both servers", conn.Servers())
+	}
+}
+
+// runPingCounter serves the NATS protocol just enough for a publisher on a local port and
+// returns its URL along with the number of PINGs received after the connect handshake,
+// one per flush of the client
+func runPingCounter(t *testing.T) (string, *atomic.Int64) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	var pings atomic.Int64
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"version\":\"2.10.4\",\"proto\":1,\"headers\":true,\"max_payload\":1048576}\r\n")
+		r := bufio.NewReader(conn)
+		connected := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			switch fields[0] {
+			case "PING":
+				// the first PING ends the connect handshake
+				if connected {
+					pings.Add(1)
+				}
+				connected = true
+				fmt.Fprint(conn, "PONG\r\n")
+			case "PUB", "HPUB":
+				size, err := strconv.Atoi(fields[len(fields)-1])
+				if err != nil {
+					return
+				}
+				if _, err := io.CopyN(io.Discard, r, int64(size)+2); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return "nats://" + l.Addr().String(), &pings
+}
+
+func TestPublisherFlushesEveryN(t *testing.T) {
+	url, pings := runPingCounter(t)
+	marshaler, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := newPublisher(nats.PublisherConfig{
+		URL:       url,
+		Marshaler: marshaler,
+		JetStream: nats.JetStreamConfig{Disabled: true},
+	}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	pub.flushEvery = 3
+
+	// a flush waits for its PONG, so the count is up to date once Publish returns
+	for i := 1; i <= 7; i++ {
+		if err := pub.Publish("telemetry.cpu", message.NewMessage(watermill.NewUUID(), nil)); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := pings.Load(), int64(i/3); got != want {
+			t.Fatalf("%d flushes after %d publishes, want %d", got, i, want)
+		}
+	}
+	// a batch crossing a multiple of flushEvery flushes once
+	batch := []*message.Message{message.NewMessage(watermill.NewUUID(), nil), message.NewMessage(watermill.NewUUID(), nil), message.NewMessage(watermill.NewUUID(), nil)}
+	if err := pub.Publish("telemetry.cpu", batch...); err != nil {
+		t.Fatal(err)
+	}
+	if got := pings.Load(); got != 3 {
+		t.Errorf("%d flushes after 10 publishes, want 3", got)
+	}
+
+	pub.flushEvery = 0
+	if err := pub.Publish("telemetry.cpu", batch...); err != nil {
+		t.Fatal(err)
+	}
+	if got := pings.Load(); got != 3 {
+		t.Errorf("FLUSH_EVERY=0 flushed, %d flushes", got)
+	}
+}
+
+// Conn returns the very connection the publisher and the subscriber use
+func TestConnIsTheInternalConnection(t *testing.T) {
+	url := runServer(t, false)
+	marshaler, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := newSubscriber(nats.SubscriberConfig{
+		URL:         url,
+		Unmarshaler: marshaler,
+		JetStream:   nats.JetStreamConfig{Disabled: true},
+	}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.conn.Close()
+	defer sub.Close()
+	if sub.Conn() != sub.conn || sub.Conn() != sub.Conn() {
+		t.Fatal("the subscriber returned another connection")
+	}
+	if _, err := sub.Subscribe(context.Background(), "telemetry.>"); err != nil {
+		t.Fatal(err)
+	}
+	if n := sub.Conn().NumSubscriptions(); n != 1 {
+		t.Errorf("the connection of the subscriber has %d subscriptions, want 1", n)
+	}
+
+	pub, err := newPublisher(nats.PublisherConfig{
+		URL:       url,
+		Marshaler: marshaler,
+		JetStream: nats.JetStreamConfig{Disabled: true},
+	}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := pub.Conn()
+	if conn != pub.conn {
+		t.Fatal("the publisher returned another connection")
+	}
+	if err := pub.Publish("telemetry.cpu", message.NewMessage(watermill.NewUUID(), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if out := conn.Stats().OutMsgs; out != 1 {
+		t.Errorf("the connection of the publisher sent %d messages, want 1", out)
+	}
+	// the publisher owns the connection
+	if err := pub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !conn.IsClosed() {
+		t.Error("the connection is open after the publisher was closed")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	nc "github.com/nats-io/nats.go"
+)
+
+// parseDeliverPolicy returns the subscribe option selecting where a new consumer starts in the stream.
+// policy is one of
+//   - all (default): from the first message of the stream
+//   - new: only the messages published after the consumer was created
+//   - last: from the last message of the stream, or of the filter subject
+//   - start-time=<RFC3339 timestamp>: from the first message stored at or after the timestamp
+//   - start-seq=<sequence>: from the stream sequence, counting from 1
+//
+// The policy only applies when the consumer is created, existing durable consumers keep their position
+func parseDeliverPolicy(policy string) (nc.SubOpt, error) {
+	name, arg, hasArg := strings.Cut(policy, "=")
+	switch name {
+	case "start-time":
+		if arg == "" {
+			return nil, errors.New("DELIVER_POLICY start-time requires a timestamp, e.g. start-time=2024-01-02T15:04:05Z")
+		}
+		t, err := time.Parse(time.RFC3339, arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DELIVER_POLICY start time %q, expected an RFC3339 timestamp", arg)
+		}
+		return nc.StartTime(t), nil
+	case "start-seq":
+		if arg == "" {
+			return nil, errors.New("DELIVER_POLICY start-seq requires a sequence, e.g. start-seq=42")
+		}
+		seq, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil || seq == 0 {
+			return nil, fmt.Errorf("invalid DELIVER_POLICY start sequence %q, sequence numbers start at 1", arg)
+		}
+		return nc.StartSequence(seq), nil
+	}
+
+	var opt nc.SubOpt
+	switch name {
+	case "", "all":
+		opt = nc.DeliverAll()
+	case "new":
+		opt = nc.DeliverNew()
+	case "last":
+		opt = nc.DeliverLast()
+	default:
+		return nil, fmt.Errorf("unknown DELIVER_POLICY %q, expected all, new, last, start-time=<RFC3339 timestamp> or start-seq=<sequence>", policy)
+	}
+	if hasArg {
+		return nil, fmt.Errorf("DELIVER_POLICY %s takes no argument, got %q", name, arg)
+	}
+	return opt, nil
+}
+
+const (
+	// ackExplicit acks every message on its own, the default
+	ackExplicit = "explicit"
+	// ackAll acks a message along with every message delivered before it
+	ackAll = "all"
+	// ackNone expects no ack, messages are never redelivered
+	ackNone = "none"
+)
+
+// ackPolicyOption returns the subscribe option of the ACK_POLICY, explicit when it is empty
+func ackPolicyOption(policy string) (nc.SubOpt, error) {
+	switch policy {
+	case "", ackExplicit:
+		return nc.AckExplicit(), nil
+	case ackAll:
+		return nc.AckAll(), nil
+	case ackNone:
+		return nc.AckNone(), nil
+	default:
+		return nil, fmt.Errorf("unknown ACK_POLICY %q, expected explicit, all or none", policy)
+	}
+}
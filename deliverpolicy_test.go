@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	nc "github.com/nats-io/nats.go"
+)
+
+// consumerOf creates an ephemeral consumer of orders.> with opt and returns its config
+func consumerOf(t *testing.T, js nc.JetStreamContext, opts ...nc.SubOpt) nc.ConsumerConfig {
+	t.Helper()
+	sub, err := js.SubscribeSync("orders.>", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Config
+}
+
+func TestAckPolicyOption(t *testing.T) {
+	js := addStream(t, connect(t, runServer(t, true)), "orders", "orders.>")
+	tests := []struct {
+		policy string
+		want   nc.AckPolicy
+	}{
+		{"", nc.AckExplicitPolicy},
+		{ackExplicit, nc.AckExplicitPolicy},
+		{ackAll, nc.AckAllPolicy},
+		{ackNone, nc.AckNonePolicy},
+	}
+	for _, tt := range tests {
+		opt, err := ackPolicyOption(tt.policy)
+		if err != nil {
+			t.Errorf("ACK_POLICY=%q: %v", tt.policy, err)
+			continue
+		}
+		if got := consumerOf(t, js, opt).AckPolicy; got != tt.want {
+			t.Errorf("ACK_POLICY=%q created a consumer with %v, want %v", tt.policy, got, tt.want)
+		}
+	}
+	for _, policy := range []string{"Explicit", "ALL", "never"} {
+		if _, err := ackPolicyOption(policy); err == nil {
+			t.Errorf("ACK_POLICY=%q was accepted", policy)
+		}
+	}
+}
+
+func TestValidateAckPolicy(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   Config
+		valid bool
+	}{
+		{"explicit with concurrency", Config{AckPolicy: ackExplicit, SubscribersCount: 4, HandlerConcurrency: 4, Ordered: true, AckExtensions: 2}, true},
+		{"none", Config{AckPolicy: ackNone, SubscribersCount: 4}, true},
+		{"none ordered", Config{AckPolicy: ackNone, Ordered: true}, false},
+		{"none with ack extensions", Config{AckPolicy: ackNone, AckExtensions: 1}, false},
+		{"all with a single goroutine", Config{AckPolicy: ackAll, SubscribersCount: 1, HandlerConcurrency: 1}, true},
+		{"all with subscribers", Config{AckPolicy: ackAll, SubscribersCount: 2, HandlerConcurrency: 1}, false},
+		{"all with handler concurrency", Config{AckPolicy: ackAll, SubscribersCount: 1, HandlerConcurrency: 2}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.validateAckPolicy(); (err == nil) != tt.valid {
+			t.Errorf("%s: error = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+
+	t.Setenv("NACK_BACKOFF_BASE", "1s")
+	if err := (&Config{AckPolicy: ackNone}).validateAckPolicy(); err == nil {
+		t.Error("ACK_POLICY=none was accepted with NACK_BACKOFF_BASE")
+	}
+}
+
+func TestParseDeliverPolicy(t *testing.T) {
+	js := addStream(t, connect(t, runServer(t, true)), "orders", "orders.>")
+	for i := 0; i < 3; i++ {
+		if _, err := js.Publish("orders.a", []byte("order")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	startTime := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		policy string
+		want   nc.ConsumerConfig
+	}{
+		{"", nc.ConsumerConfig{DeliverPolicy: nc.DeliverAllPolicy}},
+		{"all", nc.ConsumerConfig{DeliverPolicy: nc.DeliverAllPolicy}},
+		{"new", nc.ConsumerConfig{DeliverPolicy: nc.DeliverNewPolicy}},
+		{"last", nc.ConsumerConfig{DeliverPolicy: nc.DeliverLastPolicy}},
+		{"start-time=2024-01-02T15:04:05Z", nc.ConsumerConfig{DeliverPolicy: nc.DeliverByStartTimePolicy, OptStartTime: &startTime}},
+		{"start-seq=2", nc.ConsumerConfig{DeliverPolicy: nc.DeliverByStartSequencePolicy, OptStartSeq: 2}},
+	}
+	for _, tt := range tests {
+		opt, err := parseDeliverPolicy(tt.policy)
+		if err != nil {
+			t.Errorf("DELIVER_POLICY=%q: %v", tt.policy, err)
+			continue
+		}
+		got := consumerOf(t, js, opt)
+		if got.DeliverPolicy != tt.want.DeliverPolicy || got.OptStartSeq != tt.want.OptStartSeq {
+			t.Errorf("DELIVER_POLICY=%q created a consumer with %v from sequence %d, want %v from %d",
+				tt.policy, got.DeliverPolicy, got.OptStartSeq, tt.want.DeliverPolicy, tt.want.OptStartSeq)
+		}
+		if (got.OptStartTime == nil) != (tt.want.OptStartTime == nil) ||
+			got.OptStartTime != nil && !got.OptStartTime.Equal(*tt.want.OptStartTime) {
+			t.Errorf("DELIVER_POLICY=%q created a consumer starting at %v, want %v", tt.policy, got.OptStartTime, tt.want.OptStartTime)
+		}
+	}
+
+	for _, policy := range []string{
+		"sometimes",
+		"ALL",
+		"new=1",
+		"start-time",
+		"start-time=",
+		"start-time=yesterday",
+		"start-seq",
+		"start-seq=0",
+		"start-seq=-1",
+		"start-seq=first",
+	} {
+		if _, err := parseDeliverPolicy(policy); err == nil {
+			t.Errorf("DELIVER_POLICY=%q was accepted", policy)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// deliveryMode is the delivery guarantee of the subjects matching a pattern
+type deliveryMode string
+
+const (
+	// atLeastOnce consumes with a durable JetStream consumer, unacked messages are redelivered
+	atLeastOnce deliveryMode = "at-least-once"
+	// atMostOnce consumes with a core NATS subscription, acks are no-ops and nothing is redelivered
+	atMostOnce deliveryMode = "at-most-once"
+)
+
+// deliveryRoute maps subject patterns to the delivery mode used to publish and consume them,
+// the subscribers of a route consume all of its patterns
+type deliveryRoute struct {
+	Patterns []string
+	Mode     deliveryMode
+}
+
+// loadDeliveryRoutes reads the JSON file at DELIVERY_MODES_FILE, an object mapping subject
+// patterns to "at-least-once" or "at-most-once", for example
+//
+//	{"example_topic.>": "at-least-once", "telemetry.>": "at-most-once"}
+//
+// Without a file, subjects are consumed together with the default mode, otherwise each pattern
+// has its own route. at-least-once patterns are rejected when JetStream is disabled,
+// since they would silently lose their guarantee
+func loadDeliveryRoutes(subjects []string, jetStreamEnabled bool) ([]deliveryRoute, error) {
+	def := atLeastOnce
+	if !jetStreamEnabled {
+		def = atMostOnce
+	}
+
+	path := os.Getenv("DELIVERY_MODES_FILE")
+	if path == "" {
+		return []deliveryRoute{{Patterns: subjects, Mode: def}}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var modes map[string]deliveryMode
+	if err := json.Unmarshal(data, &modes); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+	if len(modes) == 0 {
+		return nil, fmt.Errorf("%s maps no subject pattern", path)
+	}
+
+	routes := make([]deliveryRoute, 0, len(modes))
+	for pattern, mode := range modes {
+		if mode != atLeastOnce && mode != atMostOnce {
+			return nil, fmt.Errorf("unknown delivery mode %q for %s, expected %s or %s", mode, pattern, atLeastOnce, atMostOnce)
+		}
+		if mode == atLeastOnce && !jetStreamEnabled {
+			return nil, fmt.Errorf("%s requires JetStream for %s, but JETSTREAM_ENABLED=false", mode, pattern)
+		}
+		routes = append(routes, deliveryRoute{Patterns: []string{pattern}, Mode: mode})
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Patterns[0] < routes[j].Patterns[0] })
+	return routes, nil
+}
+
+// deliveryModeOf returns the mode of the first route whose pattern matches subject
+func deliveryModeOf(routes []deliveryRoute, subject string) (deliveryMode, bool) {
+	tokens := strings.Split(subject, ".")
+	for _, r := range routes {
+		for _, pattern := range r.Patterns {
+			if matchSubject(strings.Split(pattern, "."), tokens) {
+				return r.Mode, true
+			}
+		}
+	}
+	return "", false
+}
+
+// matchesAny reports whether subject matches one of the subject patterns
+func matchesAny(patterns []string, subject string) bool {
+	tokens := strings.Split(subject, ".")
+	for _, pattern := range patterns {
+		if matchSubject(strings.Split(pattern, "."), tokens) {
+			return true
+		}
+	}
+	return false
+}
+
+// durableName derives a valid durable consumer name from a subject pattern,
+// so that every at-least-once pattern gets its own consumer.
+// Without a prefix there is no durable name, as with watermill's default calculator
+func durableName(prefix, pattern string) string {
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "-" + strings.NewReplacer(".", "_", "*", "any", ">", "all").Replace(pattern)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+// maxDeliver is the number of times JetStream delivers a message before giving up on it
+const maxDeliver = 15
+
+// metadata keys describing why a message ended up in the dead-letter queue
+const (
+	dlqSubjectKey      = "Dlq-Original-Subject"
+	dlqErrorKey        = "Dlq-Error"
+	dlqNumDeliveredKey = "Dlq-Num-Delivered"
+)
+
+// errUnrecoverable marks failures that redelivering the message will not fix.
+// Wrap it in a handler error to send the message to the dead-letter queue right away
+var errUnrecoverable = errors.New("unrecoverable error")
+
+// handleWithDLQ wraps a handler so that messages which failed for good are republished
+// to "<dlqPrefix>.<subject>" and acked instead of being dropped by JetStream after maxDeliver attempts.
+// A message failed for good when the handler returns errUnrecoverable or when it is on its last delivery.
+// If the republish fails, the error is returned so the message is nacked and not lost.
+// The Nats-Msg-Id header is not carried over, the dead letter would be dropped as a duplicate of
+// the original message by a stream capturing both
+func handleWithDLQ(pub Publisher, dlqPrefix string, logger watermill.LoggerAdapter) Middleware {
+	return func(h Handler) Handler {
+		return func(ctx context.Context, msg *message.Message) error {
+			err := h(ctx, msg)
+			if err == nil {
+				return nil
+			}
+
+			numDelivered := DeliveryAttempt(msg)
+			if !errors.Is(err, errUnrecoverable) && numDelivered < maxDeliver {
+				// let JetStream redeliver it
+				return err
+			}
+
+			subject := msg.Metadata.Get(subjectKey)
+			dlqMsg := message.NewMessage(msg.UUID, msg.Payload)
+			for k, v := range msg.Metadata {
+				if k == nc.MsgIdHdr {
+					continue
+				}
+				dlqMsg.Metadata.Set(k, v)
+			}
+			dlqMsg.Metadata.Set(dlqSubjectKey, subject)
+			dlqMsg.Metadata.Set(dlqErrorKey, err.Error())
+			dlqMsg.Metadata.Set(dlqNumDeliveredKey, strconv.Itoa(numDelivered))
+
+			dlqSubject := dlqPrefix + "." + subject
+			fields := watermill.LogFields{"message_uuid": msg.UUID, "subject": subject, "dlq_subject": dlqSubject, "error": err.Error()}
+			if pubErr := pub.Publish(dlqSubject, dlqMsg); pubErr != nil {
+				logger.Error("Cannot move message to the dead-letter queue", pubErr, fields)
+				return fmt.Errorf("%w (dead-lettering failed: %v)", err, pubErr)
+			}
+			logger.Info("Message moved to the dead-letter queue", fields)
+			return nil
+		}
+	}
+}
+
+// validateDeadLetterPrefix rejects a DLQ_PREFIX whose subjects the subscribers would consume,
+// the dead-lettered messages would be handled again and fail into "<prefix>.<prefix>.<subject>"
+func validateDeadLetterPrefix(prefix string, subjects []string) error {
+	if strings.ContainsAny(prefix, ".*> \t") || prefix == "" {
+		return fmt.Errorf("DLQ_PREFIX must be a single subject token, got %q", prefix)
+	}
+	if subjectsOverlap(subjects, []string{prefix + ".>"}) {
+		return fmt.Errorf("DLQ_PREFIX %q must not be consumed: SUBJECTS (%s) capture %s.>", prefix, strings.Join(subjects, ", "), prefix)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+func TestDLQMovesFailedMessages(t *testing.T) {
+	var subjects []string
+	var moved []*message.Message
+	pub := publisherFunc(func(topic string, msg *message.Message) error {
+		subjects = append(subjects, topic)
+		moved = append(moved, msg)
+		return nil
+	})
+	errFailed := errors.New("failed")
+	h := handleWithDLQ(pub, "dlq", watermill.NopLogger{})(func(ctx context.Context, msg *message.Message) error {
+		if string(msg.Payload) == "invalid" {
+			return fmt.Errorf("invalid order: %w", errUnrecoverable)
+		}
+		return errFailed
+	})
+
+	// a transient failure is left to JetStream to redeliver
+	msg := message.NewMessage(watermill.NewUUID(), []byte("retry"))
+	msg.Metadata.Set(subjectKey, "orders.1")
+	if err := h(context.Background(), msg); !errors.Is(err, errFailed) {
+		t.Fatalf("error = %v, want %v", err, errFailed)
+	}
+	if len(moved) != 0 {
+		t.Fatalf("%d messages moved after a transient failure", len(moved))
+	}
+
+	msg = message.NewMessage(watermill.NewUUID(), []byte("invalid"))
+	msg.Metadata.Set(subjectKey, "orders.1")
+	msg.Metadata.Set("Tenant", "acme")
+	msg.Metadata.Set(nc.MsgIdHdr, msg.UUID)
+	if err := h(context.Background(), msg); err != nil {
+		t.Fatalf("error = %v, want the message acked once dead-lettered", err)
+	}
+	if len(moved) != 1 || subjects[0] != "dlq.orders.1" {
+		t.Fatalf("moved to %v, want dlq.orders.1", subjects)
+	}
+	got := moved[0]
+	if got.UUID != msg.UUID || got.Metadata.Get("Tenant") != "acme" || got.Metadata.Get(dlqSubjectKey) != "orders.1" {
+		t.Errorf("dead letter %s with metadata %v, want the UUID and metadata of %s", got.UUID, got.Metadata, msg.UUID)
+	}
+	if _, ok := got.Metadata[nc.MsgIdHdr]; ok {
+		t.Errorf("dead letter kept the %s header", nc.MsgIdHdr)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+// subscriber wraps the watermill subscriber with its own connection, so that it can be
+// drained: unlike Close(), which discards the messages still waiting for an ack,
+// Drain() stops new deliveries and lets the handlers finish the in-flight messages
+type subscriber struct {
+	*nats.Subscriber
+	conn *nc.Conn
+	// logger is the logger of the watermill subscriber, which the drain summary goes to
+	logger watermill.LoggerAdapter
+	// name identifies the subscriber in logs and metrics, topics are what it subscribes to
+	name   string
+	topics []string
+	// ackWait is the AckWait of the JetStream consumer, extended by WithAckExtension
+	ackWait time.Duration
+	// prioritized hands the messages of the high-priority topics over first, see mergePriority
+	prioritized bool
+
+	mu sync.Mutex
+	// unsubscribe cancels the subscription of each topic subscribed by subscribeAll
+	unsubscribe map[string]context.CancelFunc
+
+	draining atomic.Bool
+	// inFlight counts the messages being handled, drained those completed while draining
+	inFlight atomic.Int64
+	drained  atomic.Int64
+	// acked and nacked count the outcome of the messages handled, failed the handler errors
+	// including those of the messages dead-lettered and acked, see countFailures
+	acked  atomic.Int64
+	nacked atomic.Int64
+	failed atomic.Int64
+}
+
+// Conn returns the connection of the subscriber, for the NATS features watermill does not expose.
+// The connection is shared with the subscriber and closed by Drain(), the caller must not close it
+func (s *subscriber) Conn() *nc.Conn {
+	return s.conn
+}
+
+// Subscribe validates topic before subscribing to it, see validateSubject
+func (s *subscriber) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	if err := validateSubject(topic); err != nil {
+		return nil, err
+	}
+	return s.Subscriber.Subscribe(ctx, topic)
+}
+
+// Unsubscribe stops consuming topic, one of the topics of the subscriber, leaving the others running.
+// The messages of topic not acked yet are redelivered, and its channel is closed once they returned
+func (s *subscriber) Unsubscribe(topic string) error {
+	s.mu.Lock()
+	cancel, ok := s.unsubscribe[topic]
+	delete(s.unsubscribe, topic)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%s is not subscribed to %s", s.name, topic)
+	}
+	cancel()
+	log.Printf("[%s] unsubscribed from %s", s.name, topic)
+	return nil
+}
+
+// track wraps the handler of the subscriber to count the messages it is processing, and whether they are acked
+func (s *subscriber) track(h Handler) Handler {
+	return func(ctx context.Context, msg *message.Message) (err error) {
+		s.inFlight.Add(1)
+		defer func() {
+			if err != nil {
+				s.nacked.Add(1)
+			} else {
+				s.acked.Add(1)
+			}
+			s.inFlight.Add(-1)
+			if s.draining.Load() {
+				s.drained.Add(1)
+			}
+		}()
+		return h(ctx, msg)
+	}
+}
+
+// countFailures counts the errors of the handler it wraps. It goes inside handleWithDLQ, which
+// acks the messages it dead-letters, so that their errors are counted as well
+func (s *subscriber) countFailures(h Handler) Handler {
+	return func(ctx context.Context, msg *message.Message) error {
+		err := h(ctx, msg)
+		if err != nil {
+			s.failed.Add(1)
+		}
+		return err
+	}
+}
+
+// Drain unsubscribes, waits for the in-flight messages to be acked and closes the subscriber.
+// When ctx is done first, the connection is closed and the remaining messages are redelivered later
+func (s *subscriber) Drain(ctx context.Context) error {
+	s.draining.Store(true)
+	if err := s.conn.Drain(); err != nil {
+		return err
+	}
+
+	// nc.Conn.Drain is asynchronous, the connection closes itself once every callback returned,
+	// ie. once every delivered message was acked or nacked
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	var timeoutErr error
+	for !s.conn.IsClosed() && timeoutErr == nil {
+		select {
+		case <-ctx.Done():
+			timeoutErr = ctx.Err()
+			s.conn.Close()
+		case <-ticker.C:
+		}
+	}
+	acked, nacked := s.acked.Load(), s.nacked.Load()
+	s.logger.Info("Subscriber drained", watermill.LogFields{
+		"subscriber": s.name,
+		"drained":    s.drained.Load(),
+		"pending":    s.inFlight.Load(),
+		"processed":  acked + nacked,
+		"acked":      acked,
+		"nacked":     nacked,
+		"errors":     s.failed.Load(),
+	})
+
+	// closing the subscriber closes the message channels, which stops the handler goroutines;
+	// its own drain fails since the connection is already closed
+	if err := s.Subscriber.Close(); err != nil && !errors.Is(err, nc.ErrConnectionClosed) {
+		return err
+	}
+	return timeoutErr
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+// receive returns the subject of the next message of messages, acking it
+func receive(t *testing.T, messages <-chan *message.Message) string {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		msg.Ack()
+		return msg.Metadata.Get(subjectKey)
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+		return ""
+	}
+}
+
+func TestUnsubscribeLeavesOtherTopics(t *testing.T) {
+	url := runServer(t, false)
+	unmarshaler, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := newSubscriber(nats.SubscriberConfig{
+		URL:              url,
+		SubscribersCount: 1,
+		Unmarshaler:      unmarshaler,
+		JetStream:        nats.JetStreamConfig{Disabled: true},
+	}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = sub.Close()
+		sub.conn.Close()
+	})
+	sub.name, sub.topics = "test", []string{"a.>", "b.>"}
+	messages, err := sub.subscribeAll(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the subscriptions must reach the server before the other connection publishes
+	if err := sub.conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	pub := connect(t, url)
+	publish := func(subject string) {
+		t.Helper()
+		if err := pub.Publish(subject, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if err := pub.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish("a.1")
+	publish("b.1")
+	got := map[string]bool{receive(t, messages): true, receive(t, messages): true}
+	if !got["a.1"] || !got["b.1"] {
+		t.Fatalf("received %v, want a.1 and b.1", got)
+	}
+
+	if err := sub.Unsubscribe("a.>"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.Unsubscribe("a.>"); err == nil {
+		t.Error("a topic was unsubscribed twice")
+	}
+	// watermill unsubscribes in the background once the context of the topic is done
+	deadline := time.Now().Add(time.Second)
+	for sub.conn.NumSubscriptions() > 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d subscriptions left, want 1", sub.conn.NumSubscriptions())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	publish("a.2")
+	publish("b.2")
+	if subject := receive(t, messages); subject != "b.2" {
+		t.Errorf("received %s, want only b.2", subject)
+	}
+	select {
+	case msg := <-messages:
+		t.Errorf("received %s from an unsubscribed topic", msg.Metadata.Get(subjectKey))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDrainLogsSummary(t *testing.T) {
+	url := runServer(t, false)
+	unmarshaler, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := watermill.NewCaptureLogger()
+	sub, err := newSubscriber(nats.SubscriberConfig{
+		URL:              url,
+		SubscribersCount: 1,
+		Unmarshaler:      unmarshaler,
+		JetStream:        nats.JetStreamConfig{Disabled: true},
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.name, sub.topics = "test", []string{"a.>"}
+	messages, err := sub.subscribeAll(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	handlers.Add(1)
+	go runHandler(messages, Chain(func(ctx context.Context, msg *message.Message) error {
+		if string(msg.Payload) == "fail" {
+			return errors.New("failed")
+		}
+		return nil
+	}, sub.track, sub.countFailures), 1, 0)
+
+	pub := connect(t, url)
+	for _, payload := range []string{"ok", "fail", "ok"} {
+		if err := pub.Publish("a.1", []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pub.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for sub.acked.Load()+sub.nacked.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages handled, want 3", sub.acked.Load()+sub.nacked.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := sub.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := watermill.LogFields{"processed": int64(3), "acked": int64(2), "nacked": int64(1), "errors": int64(1)}
+	for _, captured := range logger.Captured()[watermill.InfoLogLevel] {
+		if captured.Msg != "Subscriber drained" {
+			continue
+		}
+		for key, value := range want {
+			if captured.Fields[key] != value {
+				t.Errorf("%s = %v, want %v", key, captured.Fields[key], value)
+			}
+		}
+		return
+	}
+	t.Error("no drain summary logged")
+}
+
+func TestEphemeralLeavesNoConsumer(t *testing.T) {
+	url := runServer(t, true)
+	js := addStream(t, connect(t, url), "orders", "orders.>")
+	t.Setenv("NATS_URL", url)
+	t.Setenv("EPHEMERAL", "true")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DurablePrefix != "" || cfg.QueueGroupPrefix != "" {
+		t.Fatalf("DurablePrefix, QueueGroupPrefix = %q, %q, want both cleared", cfg.DurablePrefix, cfg.QueueGroupPrefix)
+	}
+	unmarshaler, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := newSubscriber(nats.SubscriberConfig{
+		URL:              url,
+		QueueGroupPrefix: cfg.QueueGroupPrefix,
+		SubscribersCount: 1,
+		Unmarshaler:      unmarshaler,
+		JetStream:        nats.JetStreamConfig{DurablePrefix: cfg.DurablePrefix, AckAsync: true},
+	}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.name, sub.topics = "test", []string{"orders.>"}
+	if _, err := sub.subscribeAll(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	consumers := func() []*nc.ConsumerInfo {
+		var infos []*nc.ConsumerInfo
+		for info := range js.Consumers("orders") {
+			infos = append(infos, info)
+		}
+		return infos
+	}
+	infos := consumers()
+	if len(infos) != 1 || infos[0].Config.Durable != "" {
+		t.Fatalf("consumers %v, want a single ephemeral one", infos)
+	}
+
+	if err := sub.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the ephemeral consumer is deleted once its subscriber is gone
+	deadline := time.Now().Add(5 * time.Second)
+	for len(consumers()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d consumers left after the subscriber was drained", len(consumers()))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"nats/metrics"
+)
+
+// recentUUIDs remembers the keys of the last processed messages, evicting the least recently seen
+// one past its size. It only knows the messages of this process: unlike IDEMPOTENCY_BUCKET, a duplicate
+// delivered to another replica, or after a restart, is processed again. It is safe for concurrent use
+type recentUUIDs struct {
+	size int
+
+	mu    sync.Mutex
+	order *list.List
+	uuids map[string]*list.Element
+}
+
+// newRecentUUIDs returns nil when size is 0, in which case nothing is remembered
+func newRecentUUIDs(size int) *recentUUIDs {
+	if size <= 0 {
+		return nil
+	}
+	return &recentUUIDs{size: size, order: list.New(), uuids: make(map[string]*list.Element, size)}
+}
+
+// seen reports whether uuid was added and is still remembered, making it the most recent one
+func (r *recentUUIDs) seen(uuid string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.uuids[uuid]
+	if ok {
+		r.order.MoveToFront(e)
+	}
+	return ok
+}
+
+// add remembers uuid, forgetting the least recent UUID when full
+func (r *recentUUIDs) add(uuid string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.uuids[uuid]; ok {
+		r.order.MoveToFront(e)
+		return
+	}
+	r.uuids[uuid] = r.order.PushFront(uuid)
+	if r.order.Len() > r.size {
+		oldest := r.order.Back()
+		r.order.Remove(oldest)
+		delete(r.uuids, oldest.Value.(string))
+	}
+}
+
+// skipDuplicates acks the messages processed recently without processing them again, and remembers
+// the messages h processed successfully by subject and UUID, see processedKey. This is best-effort: two deliveries
+// of a message handled concurrently are both processed, and so are those the cache forgot
+func (r *recentUUIDs) skipDuplicates(logger watermill.LoggerAdapter) Middleware {
+	return func(h Handler) Handler {
+		if r == nil {
+			return h
+		}
+		return func(ctx context.Context, msg *message.Message) error {
+			key := processedKey(msg)
+			if r.seen(key) {
+				subject := msg.Metadata.Get(subjectKey)
+				metrics.DuplicatesSkipped.WithLabelValues(metrics.Subject(subject)).Inc()
+				logger.Debug("Message processed recently, skipping the duplicate", watermill.LogFields{"message_uuid": msg.UUID, "subject": subject})
+				return nil
+			}
+			if err := h(ctx, msg); err != nil {
+				return err
+			}
+			r.add(key)
+			return nil
+		}
+	}
+}
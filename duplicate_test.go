@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestSkipDuplicatesKeysBySubjectAndUUID(t *testing.T) {
+	processed := make(map[string]int)
+	h := newRecentUUIDs(16).skipDuplicates(watermill.NopLogger{})(func(ctx context.Context, msg *message.Message) error {
+		processed[msg.Metadata.Get(subjectKey)]++
+		return nil
+	})
+
+	uuid := watermill.NewUUID()
+	for _, msg := range []*message.Message{
+		delivered(uuid, "example_topic.a"),
+		// the same UUID on another subject is another message
+		delivered(uuid, "example_topic.b"),
+		// a redelivery is skipped
+		delivered(uuid, "example_topic.a"),
+	} {
+		if err := h(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if processed["example_topic.a"] != 1 || processed["example_topic.b"] != 1 {
+		t.Errorf("processed = %v, want each subject once", processed)
+	}
+}
+
+func TestRecentUUIDsEvictsLeastRecent(t *testing.T) {
+	r := newRecentUUIDs(2)
+	r.add("a")
+	r.add("b")
+	// seeing a makes b the least recent one
+	if !r.seen("a") {
+		t.Fatal("a was forgotten")
+	}
+	r.add("c")
+	if r.seen("b") {
+		t.Error("b was not evicted")
+	}
+	if !r.seen("a") || !r.seen("c") {
+		t.Error("a recent key was evicted")
+	}
+	if newRecentUUIDs(0) != nil {
+		t.Error("a zero size remembers messages")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// durableBinding is the durable consumer and the queue group a subscriber consumes with
+type durableBinding struct {
+	subscriber string
+	durable    string
+	queueGroup string
+}
+
+// newDurableBinding returns the binding of a subscriber. Without a durable prefix,
+// the queue group is used as the durable name; without both the consumer is ephemeral
+func newDurableBinding(subscriber, durable, queueGroup string) durableBinding {
+	if durable == "" {
+		durable = queueGroup
+	}
+	return durableBinding{subscriber: subscriber, durable: durable, queueGroup: queueGroup}
+}
+
+// durableCollisions describes every pair of subscribers bound to the same durable consumer
+// without sharing a queue group. A durable push consumer delivers to a single subscription
+// or queue group, so such subscribers fail to bind or steal each other's messages
+func durableCollisions(bindings []durableBinding) []string {
+	byDurable := make(map[string][]durableBinding)
+	for _, b := range bindings {
+		if b.durable != "" {
+			byDurable[b.durable] = append(byDurable[b.durable], b)
+		}
+	}
+
+	var collisions []string
+	for durable, shared := range byDurable {
+		for i := 0; i < len(shared); i++ {
+			for j := i + 1; j < len(shared); j++ {
+				a, b := shared[i], shared[j]
+				if a.queueGroup != "" && a.queueGroup == b.queueGroup {
+					continue
+				}
+				collisions = append(collisions, fmt.Sprintf("%s (queue group %q) and %s (queue group %q) share the durable %q",
+					a.subscriber, a.queueGroup, b.subscriber, b.queueGroup, durable))
+			}
+		}
+	}
+	sort.Strings(collisions)
+	return collisions
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDurableCollisions(t *testing.T) {
+	tests := []struct {
+		name       string
+		bindings   []durableBinding
+		collisions int
+	}{
+		{
+			name: "same durable, same queue group",
+			bindings: []durableBinding{
+				newDurableBinding("subscriber1", "my-durable", "example"),
+				newDurableBinding("subscriber2", "my-durable", "example"),
+			},
+		},
+		{
+			name: "same durable, different queue groups",
+			bindings: []durableBinding{
+				newDurableBinding("subscriber1", "my-durable", "example"),
+				newDurableBinding("subscriber2", "my-durable", "other"),
+			},
+			collisions: 1,
+		},
+		{
+			name: "same durable without queue groups",
+			bindings: []durableBinding{
+				newDurableBinding("subscriber1", "my-durable", ""),
+				newDurableBinding("subscriber2", "my-durable", ""),
+			},
+			collisions: 1,
+		},
+		{
+			name: "distinct durables",
+			bindings: []durableBinding{
+				newDurableBinding("subscriber1", "durable-a", ""),
+				newDurableBinding("subscriber2", "durable-b", "other"),
+			},
+		},
+		{
+			// without a durable prefix the queue group names the consumer
+			name: "queue group as durable name",
+			bindings: []durableBinding{
+				newDurableBinding("subscriber1", "", "example"),
+				newDurableBinding("subscriber2", "example", ""),
+			},
+			collisions: 1,
+		},
+		{
+			name: "ephemeral consumers",
+			bindings: []durableBinding{
+				newDurableBinding("subscriber1", "", ""),
+				newDurableBinding("subscriber2", "", ""),
+			},
+		},
+		{
+			name: "three subscribers, one apart",
+			bindings: []durableBinding{
+				newDurableBinding("subscriber1", "my-durable", "example"),
+				newDurableBinding("subscriber2", "my-durable", "example"),
+				newDurableBinding("subscriber3", "my-durable", "other"),
+			},
+			collisions: 2,
+		},
+	}
+	for _, tt := range tests {
+		collisions := durableCollisions(tt.bindings)
+		if len(collisions) != tt.collisions {
+			t.Errorf("%s: collisions %q, want %d", tt.name, collisions, tt.collisions)
+		}
+	}
+
+	collisions := durableCollisions([]durableBinding{
+		newDurableBinding("subscriber1", "my-durable", "example"),
+		newDurableBinding("subscriber2", "my-durable", "other"),
+	})
+	if len(collisions) != 1 || !strings.Contains(collisions[0], "subscriber1") || !strings.Contains(collisions[0], "subscriber2") || !strings.Contains(collisions[0], `"my-durable"`) {
+		t.Errorf("collision %q does not name both subscribers and the durable", collisions)
+	}
+}
+
+func TestDurablePrefixPerSubscriber(t *testing.T) {
+	t.Setenv("NATS_URL", "nats://127.0.0.1:4222")
+	t.Setenv("DURABLE_PREFIX", "my-durable")
+	t.Setenv("DURABLE_PREFIXES", "orders, audit")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"orders", "audit", "my-durable"} {
+		if got := cfg.durablePrefix(i + 1); got != want {
+			t.Errorf("durable prefix of subscriber %d = %q, want %q", i+1, got, want)
+		}
+	}
+}
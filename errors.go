@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	nc "github.com/nats-io/nats.go"
+)
+
+// Typed errors wrapping the NATS and watermill failures, so that callers can branch
+// with errors.Is. The underlying error stays wrapped and can still be matched too
+var (
+	// ErrConnection is returned when the NATS connection is missing, closed or refused
+	ErrConnection = errors.New("NATS connection failed")
+	// ErrAuthentication is returned when the server rejects the credentials, or they expired or
+	// were revoked. Unlike ErrConnection it is not transient, retrying does not help
+	ErrAuthentication = errors.New("NATS authentication failed")
+	// ErrMarshal is returned when a message cannot be converted to or from a NATS message
+	ErrMarshal = errors.New("cannot marshal message")
+	// ErrPublishTimeout is returned when JetStream did not ack a publish in time
+	ErrPublishTimeout = errors.New("publish timed out")
+	// ErrStreamNotFound is returned when no stream exists, or none captures the subject
+	ErrStreamNotFound = errors.New("stream not found")
+	// ErrInvalidPayload is returned when a payload does not match the JSON Schema of its subject
+	ErrInvalidPayload = errors.New("invalid payload")
+	// ErrStreamOverlap is returned when the provisioned stream would capture subjects of another stream
+	ErrStreamOverlap = errors.New("stream subjects overlap")
+	// ErrPayloadTooLarge is returned before publishing a message larger than the server accepts
+	ErrPayloadTooLarge = errors.New("payload too large")
+	// ErrInvalidSubject is returned instead of publishing to or subscribing to a malformed subject
+	ErrInvalidSubject = errors.New("invalid subject")
+	// ErrQuotaExceeded is returned instead of publishing a message beyond the PUBLISH_QUOTAS of its subject
+	ErrQuotaExceeded = errors.New("publish quota exceeded")
+	// ErrNoResponders is returned right away by a request to a subject nobody is subscribed to
+	ErrNoResponders = errors.New("no responders")
+)
+
+// natsErrors maps the known NATS errors to the typed errors
+var natsErrors = []struct {
+	target error
+	causes []error
+}{
+	{ErrStreamNotFound, []error{nc.ErrStreamNotFound, nc.ErrNoStreamResponse}},
+	{ErrPublishTimeout, []error{nc.ErrTimeout}},
+	{ErrPayloadTooLarge, []error{nc.ErrMaxPayload}},
+	{ErrAuthentication, authErrors},
+	{ErrConnection, []error{
+		nc.ErrConnectionClosed, nc.ErrConnectionDraining, nc.ErrConnectionReconnecting,
+		nc.ErrNoServers, nc.ErrDisconnected, nc.ErrStaleConnection,
+	}},
+}
+
+// authErrors are the NATS errors of rejected credentials
+var authErrors = []error{nc.ErrAuthorization, nc.ErrAuthExpired, nc.ErrAuthRevoked, nc.ErrAccountAuthExpired}
+
+// connectionError wraps an error of nc.Connect with ErrAuthentication when the server rejected
+// the credentials, with ErrConnection otherwise
+func connectionError(err error) error {
+	for _, cause := range authErrors {
+		if errors.Is(err, cause) {
+			return fmt.Errorf("%w: %w", ErrAuthentication, err)
+		}
+	}
+	return fmt.Errorf("%w: %w", ErrConnection, err)
+}
+
+// classifyError wraps err with the typed error matching its cause. watermill wraps
+// the NATS errors without keeping them matchable, so their messages are compared too.
+// Errors that are already classified or that match no known cause are returned unchanged
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, typed := range []error{ErrConnection, ErrAuthentication, ErrMarshal, ErrPublishTimeout, ErrStreamNotFound, ErrInvalidPayload, ErrPayloadTooLarge, ErrNoResponders} {
+		if errors.Is(err, typed) {
+			return err
+		}
+	}
+	for _, m := range natsErrors {
+		for _, cause := range m.causes {
+			if errors.Is(err, cause) || strings.Contains(err.Error(), cause.Error()) {
+				return fmt.Errorf("%w: %w", m.target, err)
+			}
+		}
+	}
+	return err
+}
+
+// classifyPublishError classifies the error of a JetStream publish. nc.ErrNoResponders means
+// ErrStreamNotFound there only: no stream captures the subject of an async publish, while
+// a request failing with it has no responder, see ErrNoResponders
+func classifyPublishError(err error) error {
+	if errors.Is(err, nc.ErrNoResponders) && !errors.Is(err, ErrStreamNotFound) {
+		return fmt.Errorf("%w: %w", ErrStreamNotFound, err)
+	}
+	return classifyError(err)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/nats-io/nats-server/v2/server"
+	nc "github.com/nats-io/nats.go"
+)
+
+func TestClassifyError(t *testing.T) {
+	// the server refusing a stream capturing the subjects of another one
+	stream := &nc.StreamConfig{Name: "example_topic", Subjects: []string{"example_topic.>"}}
+	overlap := &nc.APIError{Code: 400, ErrorCode: jsErrCodeStreamSubjectOverlap, Description: "subjects overlap with an existing stream"}
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"authorization", nc.ErrAuthorization, ErrAuthentication},
+		{"auth expired", nc.ErrAuthExpired, ErrAuthentication},
+		{"auth revoked", nc.ErrAuthRevoked, ErrAuthentication},
+		{"account auth expired", nc.ErrAccountAuthExpired, ErrAuthentication},
+		// watermill wraps the NATS errors without %w
+		{"authorization in a message", fmt.Errorf("cannot publish: %s", nc.ErrAuthorization), ErrAuthentication},
+		{"closed", nc.ErrConnectionClosed, ErrConnection},
+		{"no servers", nc.ErrNoServers, ErrConnection},
+		{"timeout", nc.ErrTimeout, ErrPublishTimeout},
+		{"max payload", nc.ErrMaxPayload, ErrPayloadTooLarge},
+		{"no stream", nc.ErrNoStreamResponse, ErrStreamNotFound},
+		{"stream overlap", streamOverlapError(stream, overlap), ErrStreamOverlap},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyError(tt.err)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("classifyError(%v) = %v, want %v", tt.err, err, tt.want)
+			}
+			if tt.want == ErrAuthentication && errors.Is(err, ErrConnection) {
+				t.Errorf("classifyError(%v) = %v is a connection error", tt.err, err)
+			}
+		})
+	}
+	if err := streamOverlapError(stream, overlap); !errors.Is(err, overlap) || !strings.Contains(err.Error(), "example_topic") {
+		t.Errorf("streamOverlapError = %v, want it to name the stream and wrap the server error", err)
+	}
+	if err := (&nc.APIError{Code: 500, ErrorCode: nc.JSErrCodeJetStreamNotEnabled}); streamOverlapError(stream, err) != err {
+		t.Error("an API error other than the subject overlap was mapped to ErrStreamOverlap")
+	}
+	if err := errors.New("other"); classifyError(err) != err {
+		t.Error("an unknown error was classified")
+	}
+	// no responders means no stream for JetStream publishes only, a request has no responder
+	if err := classifyError(nc.ErrNoResponders); errors.Is(err, ErrStreamNotFound) {
+		t.Errorf("classifyError(%v) = %v, want it unclassified", nc.ErrNoResponders, err)
+	}
+	if err := classifyPublishError(nc.ErrNoResponders); !errors.Is(err, ErrStreamNotFound) {
+		t.Errorf("classifyPublishError(%v) = %v, want %v", nc.ErrNoResponders, err, ErrStreamNotFound)
+	}
+	requestErr := fmt.Errorf("%w: request on orders: %w", ErrNoResponders, nc.ErrNoResponders)
+	if err := classifyError(requestErr); err != requestErr {
+		t.Errorf("classifyError(%v) = %v, want it unchanged", requestErr, err)
+	}
+}
+
+func TestConnectRejectedCredentials(t *testing.T) {
+	url := runServerWith(t, &server.Options{Username: "user", Password: "secret"})
+	_, err := nc.Connect(url, nc.UserInfo("user", "wrong"))
+	if err == nil {
+		t.Fatal("wrong credentials were accepted")
+	}
+	if err = connectionError(err); !errors.Is(err, ErrAuthentication) || errors.Is(err, ErrConnection) {
+		t.Errorf("connectionError = %v, want ErrAuthentication only", err)
+	}
+	if err := connectionError(nc.ErrNoServers); !errors.Is(err, ErrConnection) {
+		t.Errorf("connectionError = %v, want ErrConnection", err)
+	}
+
+	// startup gives up right away instead of retrying until its timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	start := time.Now()
+	err = waitForNATS(ctx, url, []nc.Option{nc.UserInfo("user", "wrong")}, false, watermill.NopLogger{})
+	if !errors.Is(err, ErrAuthentication) {
+		t.Errorf("waitForNATS = %v, want ErrAuthentication", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("waitForNATS retried for %s", elapsed)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	nc "github.com/nats-io/nats.go"
+
+	"nats/metrics"
+)
+
+// connEvent is a change of state of a NATS connection
+type connEvent string
+
+const (
+	connDisconnected connEvent = "disconnected"
+	connReconnected  connEvent = "reconnected"
+	connClosed       connEvent = "closed"
+)
+
+// connEvents logs the disconnects, reconnects, closes and asynchronous errors of every
+// NATS connection built from its options, so that outages show up in the logs. notify, when not nil,
+// is called after each event so that the application can react to it
+type connEvents struct {
+	logger watermill.LoggerAdapter
+	notify func(event connEvent, conn *nc.Conn)
+
+	mu sync.Mutex
+	// disconnectedAt is when each connection was lost, to log the downtime on reconnect
+	disconnectedAt map[*nc.Conn]time.Time
+}
+
+func newConnEvents(logger watermill.LoggerAdapter, notify func(event connEvent, conn *nc.Conn)) *connEvents {
+	return &connEvents{
+		logger:         logger,
+		notify:         notify,
+		disconnectedAt: make(map[*nc.Conn]time.Time),
+	}
+}
+
+// options returns the connection options installing the event handlers
+func (e *connEvents) options() []nc.Option {
+	return []nc.Option{
+		nc.DisconnectErrHandler(e.disconnected),
+		nc.ReconnectHandler(e.reconnected),
+		nc.ClosedHandler(e.closed),
+		nc.ErrorHandler(e.asyncError),
+	}
+}
+
+func (e *connEvents) disconnected(conn *nc.Conn, err error) {
+	e.mu.Lock()
+	e.disconnectedAt[conn] = time.Now()
+	e.mu.Unlock()
+
+	fields := watermill.LogFields{"servers": redactedServers(conn.Servers())}
+	if err != nil {
+		e.logger.Error("NATS connection lost", err, fields)
+	} else {
+		e.logger.Info("NATS connection lost", fields)
+	}
+	e.emit(connDisconnected, conn)
+}
+
+func (e *connEvents) reconnected(conn *nc.Conn) {
+	e.mu.Lock()
+	since, ok := e.disconnectedAt[conn]
+	delete(e.disconnectedAt, conn)
+	e.mu.Unlock()
+
+	fields := watermill.LogFields{"server": redactedServers([]string{conn.ConnectedUrl()})}
+	if ok {
+		fields["downtime"] = time.Since(since).String()
+	}
+	e.logger.Info("NATS connection restored", fields)
+	e.emit(connReconnected, conn)
+}
+
+func (e *connEvents) closed(conn *nc.Conn) {
+	e.mu.Lock()
+	delete(e.disconnectedAt, conn)
+	e.mu.Unlock()
+
+	e.logger.Info("NATS connection closed", watermill.LogFields{"servers": redactedServers(conn.Servers())})
+	e.emit(connClosed, conn)
+}
+
+// maxPendingGrowth bounds how much slowConsumer widens the buffer of a subscription,
+// relative to the nats.go defaults
+const maxPendingGrowth = 8
+
+// asyncError logs the errors NATS reports outside of a call, such as slow consumers
+func (e *connEvents) asyncError(conn *nc.Conn, sub *nc.Subscription, err error) {
+	if errors.Is(err, nc.ErrSlowConsumer) && sub != nil {
+		e.slowConsumer(sub)
+		return
+	}
+	e.logger.Error("NATS asynchronous error", err, watermill.LogFields{"servers": redactedServers(conn.Servers())})
+}
+
+// slowConsumer counts a subscription whose buffer overflowed, which dropped messages
+// (JetStream redelivers them after AckWait). The buffer is doubled, up to maxPendingGrowth
+// times its default size, to absorb the next burst
+func (e *connEvents) slowConsumer(sub *nc.Subscription) {
+	metrics.SlowConsumers.WithLabelValues(metrics.Subject(sub.Subject)).Inc()
+
+	fields := watermill.LogFields{"subject": sub.Subject}
+	if dropped, err := sub.Dropped(); err == nil {
+		fields["dropped"] = dropped
+	}
+	msgLimit, bytesLimit, err := sub.PendingLimits()
+	if err == nil && msgLimit > 0 && bytesLimit > 0 &&
+		msgLimit < maxPendingGrowth*nc.DefaultSubPendingMsgsLimit && bytesLimit < maxPendingGrowth*nc.DefaultSubPendingBytesLimit {
+		if err := sub.SetPendingLimits(2*msgLimit, 2*bytesLimit); err == nil {
+			fields["pending_msgs_limit"], fields["pending_bytes_limit"] = 2*msgLimit, 2*bytesLimit
+		}
+	}
+	e.logger.Info("Slow consumer, messages were dropped", fields)
+}
+
+func (e *connEvents) emit(event connEvent, conn *nc.Conn) {
+	if e.notify != nil {
+		e.notify(event, conn)
+	}
+}
+
+// redactedServers joins server URLs without their user info, which may hold a token
+func redactedServers(servers []string) string {
+	redacted := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if u, err := url.Parse(server); err == nil && u.User != nil {
+			u.User = nil
+			server = u.String()
+		}
+		redacted = append(redacted, server)
+	}
+	return strings.Join(redacted, ",")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"nats/metrics"
+)
+
+// expiresAtKey is the metadata key holding the RFC3339 time after which a message is not worth processing
+const expiresAtKey = "Expires-At"
+
+// SetExpiry makes msg expire at t: a subscriber receiving it later acks it without processing it
+func SetExpiry(msg *message.Message, t time.Time) {
+	msg.Metadata.Set(expiresAtKey, t.UTC().Format(time.RFC3339Nano))
+}
+
+// expiresAt returns the expiry time of msg, false when it has none or it cannot be parsed
+func expiresAt(msg *message.Message) (time.Time, bool) {
+	v, ok := headerValue(msg, expiresAtKey)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// skipExpired acks the messages received past their Expires-At time without passing them to the handler,
+// and counts them. Messages without an expiry, or with one that cannot be parsed, are always processed
+func skipExpired(enabled bool, logger watermill.LoggerAdapter) Middleware {
+	return func(h Handler) Handler {
+		if !enabled {
+			return h
+		}
+		return func(ctx context.Context, msg *message.Message) error {
+			if t, ok := expiresAt(msg); ok && time.Now().After(t) {
+				subject := msg.Metadata.Get(subjectKey)
+				metrics.Expired.WithLabelValues(metrics.Subject(subject)).Inc()
+				logger.Debug("Message expired, skipping it", watermill.LogFields{
+					"message_uuid": msg.UUID,
+					"subject":      subject,
+					"expires_at":   t,
+				})
+				return nil
+			}
+			return h(ctx, msg)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestSkipExpired(t *testing.T) {
+	tests := []struct {
+		name      string
+		enabled   bool
+		expiresAt string
+		handled   bool
+	}{
+		{"expired", true, time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano), false},
+		{"not expired yet", true, time.Now().Add(time.Minute).UTC().Format(time.RFC3339Nano), true},
+		{"no expiry", true, "", true},
+		{"unparseable expiry", true, "tomorrow", true},
+		{"check disabled", false, time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := message.NewMessage(watermill.NewUUID(), nil)
+			if tt.expiresAt != "" {
+				msg.Metadata.Set(expiresAtKey, tt.expiresAt)
+			}
+			messages := make(chan *message.Message, 1)
+			messages <- msg
+			close(messages)
+
+			var handled bool
+			handlers.Add(1)
+			runHandler(messages, skipExpired(tt.enabled, watermill.NopLogger{})(func(ctx context.Context, msg *message.Message) error {
+				handled = true
+				return nil
+			}), 1, 0)
+			if handled != tt.handled {
+				t.Errorf("handled = %v, want %v", handled, tt.handled)
+			}
+			select {
+			case <-msg.Acked():
+			default:
+				t.Error("the message was not acked")
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+// exportSubjectKey is the metadata key holding the subject an exported message was delivered on,
+// it is removed when the message is imported
+const exportSubjectKey = "Export-Subject"
+
+// exportStart parses EXPORT_FROM like REPLAY_FROM, the whole stream being exported when it is empty
+func exportStart(from string) (nc.SubOpt, error) {
+	if from == "" {
+		return nc.DeliverAll(), nil
+	}
+	return replayStart("EXPORT_FROM", from)
+}
+
+// exportStream writes the messages of topics stored from start, at stream sequence seq if any, to the end of the stream to
+// the file at path, for an offline copy that importFile republishes later. Each record is
+// the message marshaled as JSON, UUID and metadata included, preceded by its length as a
+// big-endian uint32. The consumers are ephemeral, see replay. It returns the number of exported messages
+func exportStream(ctx context.Context, config nats.SubscriberConfig, topics []string, start nc.SubOpt, seq uint64, path string, logger watermill.LoggerAdapter) (int, error) {
+	codec, err := newMarshaler("json")
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	// a failed write stops the export, the file would miss messages otherwise
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var writeErr error
+	write := func(ctx context.Context, msg *message.Message) error {
+		out := msg.Copy()
+		out.Metadata.Set(exportSubjectKey, msg.Metadata.Get(subjectKey))
+		natsMsg, err := codec.Marshal(msg.Metadata.Get(subjectKey), out)
+		if err == nil {
+			err = writeRecord(w, natsMsg.Data)
+		}
+		if err != nil {
+			writeErr = fmt.Errorf("cannot export message %s: %w", msg.UUID, err)
+			cancel()
+		}
+		return err
+	}
+	exported, err := replay(ctx, config, topics, start, seq, true, write, logger)
+	if err == nil {
+		err = writeErr
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	return exported, err
+}
+
+// writeRecord writes data preceded by its length
+func writeRecord(w io.Writer, data []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+	if _, err := w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// importFile republishes with pub the messages exportStream wrote to the file at path, each
+// to the subject it was exported from, with its UUID and metadata. It stops at the first
+// failed publish and returns the number of imported messages
+func importFile(path string, pub Publisher) (int, error) {
+	codec, err := newMarshaler("json")
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	imported := 0
+	for {
+		var length [4]byte
+		if _, err := io.ReadFull(r, length[:]); errors.Is(err, io.EOF) {
+			return imported, nil
+		} else if err != nil {
+			return imported, fmt.Errorf("cannot read record %d: %w", imported+1, err)
+		}
+		data := make([]byte, binary.BigEndian.Uint32(length[:]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return imported, fmt.Errorf("cannot read record %d: %w", imported+1, err)
+		}
+		msg, err := codec.Unmarshal(&nc.Msg{Data: data})
+		if err != nil {
+			return imported, fmt.Errorf("%w: record %d: %w", ErrMarshal, imported+1, err)
+		}
+		subject := msg.Metadata.Get(exportSubjectKey)
+		if subject == "" {
+			return imported, fmt.Errorf("record %d has no %s", imported+1, exportSubjectKey)
+		}
+		delete(msg.Metadata, exportSubjectKey)
+		if err := pub.Publish(subject, msg); err != nil {
+			return imported, fmt.Errorf("cannot import message %s to %s: %w", msg.UUID, subject, classifyError(err))
+		}
+		imported++
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	marshaler, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisherOf := func(url string) *publisher {
+		pub, err := newPublisher(nats.PublisherConfig{URL: url, Marshaler: marshaler}, watermill.NopLogger{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = pub.Close() })
+		return pub
+	}
+
+	source := runServer(t, true)
+	addStream(t, connect(t, source), "orders", "orders.>")
+	sent := map[string]*message.Message{
+		"orders.eu": message.NewMessage(watermill.NewUUID(), []byte("order 1")),
+		"orders.us": message.NewMessage(watermill.NewUUID(), []byte("order 2")),
+		"orders.uk": message.NewMessage(watermill.NewUUID(), []byte{}),
+	}
+	sent["orders.eu"].Metadata.Set("Tenant", "acme")
+	pub := publisherOf(source)
+	for subject, msg := range sent {
+		if err := pub.Publish(subject, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "orders.export")
+	exported, err := exportStream(context.Background(), nats.SubscriberConfig{
+		URL:              source,
+		SubscribersCount: 1,
+		Unmarshaler:      marshaler,
+		JetStream:        nats.JetStreamConfig{AckAsync: true},
+	}, []string{"orders.>"}, nc.DeliverAll(), 0, path, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported != len(sent) {
+		t.Fatalf("exported %d messages, want %d", exported, len(sent))
+	}
+
+	target := runServer(t, true)
+	js := addStream(t, connect(t, target), "orders", "orders.>")
+	imported, err := importFile(path, publisherOf(target))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != len(sent) {
+		t.Fatalf("imported %d messages, want %d", imported, len(sent))
+	}
+
+	for seq := uint64(1); seq <= uint64(len(sent)); seq++ {
+		raw, err := js.GetMsg("orders", seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := marshaler.Unmarshal(&nc.Msg{Subject: raw.Subject, Header: raw.Header, Data: raw.Data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, ok := sent[raw.Subject]
+		if !ok {
+			t.Fatalf("message %s imported to %s, which nothing was published to", got.UUID, raw.Subject)
+		}
+		if got.UUID != want.UUID || string(got.Payload) != string(want.Payload) {
+			t.Errorf("%s holds %s %q, want %s %q", raw.Subject, got.UUID, got.Payload, want.UUID, want.Payload)
+		}
+		if got.Metadata.Get("Tenant") != want.Metadata.Get("Tenant") {
+			t.Errorf("%s has Tenant %q, want %q", raw.Subject, got.Metadata.Get("Tenant"), want.Metadata.Get("Tenant"))
+		}
+		if _, ok := got.Metadata[exportSubjectKey]; ok {
+			t.Errorf("%s kept the %s metadata", raw.Subject, exportSubjectKey)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// Filter decides whether a message is passed to the handler
+type Filter func(*message.Message) bool
+
+// And matches the messages matched by every filter
+func And(filters ...Filter) Filter {
+	return func(msg *message.Message) bool {
+		for _, f := range filters {
+			if !f(msg) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Or matches the messages matched by at least one filter
+func Or(filters ...Filter) Filter {
+	return func(msg *message.Message) bool {
+		for _, f := range filters {
+			if f(msg) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MetadataEquals matches the messages whose metadata key holds value
+func MetadataEquals(key, value string) Filter {
+	return func(msg *message.Message) bool {
+		v, ok := headerValue(msg, key)
+		return ok && v == value
+	}
+}
+
+// loadFilter returns the filter configured by FILTER, or nil when it is unset.
+// FILTER lists alternatives separated by "|", each one a comma-separated list of
+// key=value metadata conditions that must all hold, e.g. "Tenant=a,Region=eu|Tenant=b"
+func loadFilter() (Filter, error) {
+	spec := os.Getenv("FILTER")
+	if spec == "" {
+		return nil, nil
+	}
+
+	var alternatives []Filter
+	for _, alternative := range strings.Split(spec, "|") {
+		var conditions []Filter
+		for _, condition := range strings.Split(alternative, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(condition), "=")
+			if !ok || key == "" {
+				return nil, fmt.Errorf("invalid FILTER condition %q, expected key=value", condition)
+			}
+			conditions = append(conditions, MetadataEquals(key, value))
+		}
+		alternatives = append(alternatives, And(conditions...))
+	}
+	return Or(alternatives...), nil
+}
+
+// filtered passes to the handler only the messages matched by f, the other ones
+// are acked without being processed so that the consumer moves past them
+func filtered(f Filter) Middleware {
+	return func(h Handler) Handler {
+		if f == nil {
+			return h
+		}
+		return func(ctx context.Context, msg *message.Message) error {
+			if !f(msg) {
+				return nil
+			}
+			return h(ctx, msg)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestLoadFilter(t *testing.T) {
+	t.Setenv("FILTER", "Tenant=a, Region=eu|Tenant=b")
+	f, err := loadFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		metadata map[string]string
+		match    bool
+	}{
+		{map[string]string{"Tenant": "a", "Region": "eu"}, true},
+		{map[string]string{"Tenant": "a", "Region": "us"}, false},
+		{map[string]string{"Tenant": "a"}, false},
+		{map[string]string{"Tenant": "b", "Region": "us"}, true},
+		{map[string]string{"Tenant": "c", "Region": "eu"}, false},
+		// keys are matched exactly, like headers
+		{map[string]string{"tenant": "b"}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		msg := message.NewMessage(watermill.NewUUID(), nil)
+		for key, value := range tt.metadata {
+			msg.Metadata.Set(key, value)
+		}
+		if got := f(msg); got != tt.match {
+			t.Errorf("filter(%v) = %v, want %v", tt.metadata, got, tt.match)
+		}
+	}
+}
+
+func TestLoadFilterInvalid(t *testing.T) {
+	t.Setenv("FILTER", "")
+	if f, err := loadFilter(); f != nil || err != nil {
+		t.Errorf("an unset FILTER returned a filter, error %v", err)
+	}
+	for _, spec := range []string{"Tenant", "=a", "Tenant=a,", "Tenant=a||Tenant=b"} {
+		t.Setenv("FILTER", spec)
+		if _, err := loadFilter(); err == nil {
+			t.Errorf("FILTER=%q was accepted", spec)
+		}
+	}
+}
+
+func TestFilterEmptyValue(t *testing.T) {
+	// an empty value matches an empty header, not a missing one
+	f := MetadataEquals("Region", "")
+	present := message.NewMessage(watermill.NewUUID(), nil)
+	present.Metadata.Set("Region", "")
+	if !f(present) {
+		t.Error("Region= does not match an empty Region")
+	}
+	if f(message.NewMessage(watermill.NewUUID(), nil)) {
+		t.Error("Region= matches a message without Region")
+	}
+}
+
+func TestFilteredAcksSkippedMessages(t *testing.T) {
+	matching := message.NewMessage(watermill.NewUUID(), nil)
+	matching.Metadata.Set("Tenant", "a")
+	skipped := message.NewMessage(watermill.NewUUID(), nil)
+	skipped.Metadata.Set("Tenant", "b")
+	messages := make(chan *message.Message, 2)
+	messages <- matching
+	messages <- skipped
+	close(messages)
+
+	var handled []string
+	handlers.Add(1)
+	runHandler(messages, filtered(MetadataEquals("Tenant", "a"))(func(ctx context.Context, msg *message.Message) error {
+		handled = append(handled, msg.UUID)
+		return nil
+	}), 1, 0)
+	if len(handled) != 1 || handled[0] != matching.UUID {
+		t.Errorf("handled %v, want only %s", handled, matching.UUID)
+	}
+	for _, msg := range []*message.Message{matching, skipped} {
+		select {
+		case <-msg.Acked():
+		default:
+			t.Errorf("message %s was not acked", msg.UUID)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// envFlag is a command line flag mirroring an environment variable
+type envFlag struct {
+	name  string
+	env   string
+	usage string
+}
+
+// configFileEnv is the variable of the --config flag, which cannot be set from the config file itself
+const configFileEnv = "CONFIG_FILE"
+
+// envFlags lists a flag for every environment variable, see the README for their defaults
+var envFlags = []envFlag{
+	{"config", configFileEnv, "YAML or JSON file of settings keyed by flag name, overridden by the environment and the flags"},
+	{"nats-url", "NATS_URL", "NATS server URL, or a comma-separated list of servers"},
+	{"mirror-nats-url", "MIRROR_NATS_URL", "servers of a second cluster every message is also published to"},
+	{"client-name", "CLIENT_NAME", "prefix of the connection names reported to the server"},
+	{"max-reconnects", "MAX_RECONNECTS", "reconnect attempts before giving up, -1 retries forever"},
+	{"reconnect-wait", "RECONNECT_WAIT", "delay before reconnecting, doubled after each failed round of attempts"},
+	{"reconnect-wait-max", "RECONNECT_WAIT_MAX", "upper bound of the reconnect delay"},
+	{"reconnect-jitter", "RECONNECT_JITTER", "fraction of the reconnect delay randomly taken off, between 0 and 1"},
+	{"reconnect-buf-size", "RECONNECT_BUF_SIZE", "bytes of publishes buffered while reconnecting"},
+	{"nats-tls-cert", "NATS_TLS_CERT", "client certificate for mutual TLS"},
+	{"nats-tls-key", "NATS_TLS_KEY", "client key for mutual TLS"},
+	{"nats-tls-ca", "NATS_TLS_CA", "CA used to verify the server certificate"},
+	{"nats-creds", "NATS_CREDS", "path to a .creds file used to authenticate"},
+	{"nats-token", "NATS_TOKEN", "token used to authenticate"},
+	{"subjects", "SUBJECTS", "comma-separated subject patterns consumed by every subscriber"},
+	{"subscribers", "SUBSCRIBERS_COUNT", "goroutines consuming messages per subscriber"},
+	{"handler-concurrency", "HANDLER_CONCURRENCY", "messages processed at once by each subscriber"},
+	{"scale-max", "SCALE_MAX", "largest number of subscribers per pattern POST /scale may run"},
+	{"subscribe-buffer", "SUBSCRIBE_BUFFER", "delivered messages buffered by each subscriber for its handlers"},
+	{"queue-group", "QUEUE_GROUP_PREFIX", "queue group of the subscribers"},
+	{"durable-prefix", "DURABLE_PREFIX", "durable consumer name of the subscribers"},
+	{"durable-prefixes", "DURABLE_PREFIXES", "comma-separated durable names of the first, second... subscriber"},
+	{"durable-collision", "DURABLE_COLLISION", "warn or error when subscribers share a durable without sharing a queue group"},
+	{"ack-wait-timeout", "ACK_WAIT_TIMEOUT", "how long JetStream waits for an ack before redelivering"},
+	{"handler-timeout", "HANDLER_TIMEOUT", "how long a handler may take before its message is nacked, 0 disables it"},
+	{"ack-extensions", "ACK_EXTENSIONS", "times a slow handler may extend the ack wait timeout"},
+	{"inactive-threshold", "INACTIVE_THRESHOLD", "how long the server keeps a consumer nothing consumes from, 0 uses the server default"},
+	{"max-ack-pending", "MAX_ACK_PENDING", "outstanding unacked messages allowed per consumer"},
+	{"expected-handler-duration", "EXPECTED_HANDLER_DURATION", "expected time to process one message"},
+	{"nack-backoff-base", "NACK_BACKOFF_BASE", "delay before redelivering a nacked message, 0 redelivers immediately"},
+	{"nack-backoff-max", "NACK_BACKOFF_MAX", "upper bound of the nack redelivery delay"},
+	{"subject-templates", "SUBJECT_TEMPLATES", "comma-separated templates naming subject tokens set as metadata, e.g. example_topic.{type}.{detail}"},
+	{"filter", "FILTER", "metadata conditions a message must match to be processed, e.g. Tenant=a,Region=eu|Tenant=b"},
+	{"rate-limit", "RATE_LIMIT", "maximum messages per second processed by each subscriber"},
+	{"rate-burst", "RATE_BURST", "number of messages that may exceed the rate limit at once"},
+	{"dlq-prefix", "DLQ_PREFIX", "first token of the dead letter subjects, outside of SUBJECTS"},
+	{"health-addr", "HEALTH_ADDR", "listen address of the /healthz and /readyz probes"},
+	{"control-addr", "CONTROL_ADDR", "listen address of POST /pause, POST /resume, POST /scale and the admin endpoints"},
+	{"admin-token", "ADMIN_TOKEN", "bearer token of the control endpoints, unset leaves POST /pause, /resume and /scale open and disables GET /admin"},
+	{"scaler-metric-name", "SCALER_METRIC_NAME", "key of the consumer pending count served by GET /scaler"},
+	{"metrics-addr", "METRICS_ADDR", "listen address of the Prometheus /metrics endpoint"},
+	{"metrics-subject-depth", "METRICS_SUBJECT_DEPTH", "subject tokens kept in metric labels, the others are collapsed into >, 0 keeps them all"},
+	{"metrics-final-scrape-timeout", "METRICS_FINAL_SCRAPE_TIMEOUT", "how long shutdown waits for a last scrape of /metrics, 0 does not wait"},
+	{"lag-scrape-interval", "LAG_SCRAPE_INTERVAL", "how often the consumer lag gauges are refreshed, 0 disables them"},
+	{"tracing", "TRACING_ENABLED", "export OpenTelemetry spans"},
+	{"otlp-endpoint", "OTEL_EXPORTER_OTLP_ENDPOINT", "OTLP/HTTP endpoint spans are exported to"},
+	{"log-format", "LOG_FORMAT", "text or json"},
+	{"log-level", "LOG_LEVEL", "trace, debug, info, warn or error"},
+	{"marshaler", "MARSHALER", "wire format: nats, gob, json, proto or a registered name"},
+	{"subscriber-marshalers", "SUBSCRIBER_MARSHALERS", "comma-separated wire formats of the first, second... subscriber, empty entries use MARSHALER"},
+	{"on-unmarshal-error", "ON_UNMARSHAL_ERROR", "nack, drop or dlq"},
+	{"max-payload", "MAX_PAYLOAD", "largest message published in bytes, headers included, 0 uses the server limit"},
+	{"subject-strip-tokens", "SUBJECT_STRIP_TOKENS", "leading subject tokens removed before publishing, kept in the Original-Subject metadata"},
+	{"schema-dir", "SCHEMA_DIR", "directory of <subject>.json JSON Schemas payloads are validated against"},
+	{"compression", "COMPRESSION", "none, gzip or zstd"},
+	{"compression-threshold", "COMPRESSION_THRESHOLD", "bodies smaller than this many bytes are not compressed"},
+	{"max-decompressed-size", "MAX_DECOMPRESSED_SIZE", "largest body in bytes a compressed message may decompress to"},
+	{"startup-timeout", "STARTUP_TIMEOUT", "how long to wait for NATS at startup"},
+	{"publish-timeout", "PUBLISH_TIMEOUT", "how long a publish may wait for its ack"},
+	{"publish-quotas", "PUBLISH_QUOTAS", "comma-separated <subject prefix>=<messages>:<bytes> published per second at most"},
+	{"publish-buffer-size", "PUBLISH_BUFFER_SIZE", "publishes held while the connection is down, the next ones are dropped, 0 holds none"},
+	{"publish-retry-attempts", "PUBLISH_RETRY_ATTEMPTS", "attempts at a publish failing on a transient error, 1 does not retry"},
+	{"publish-retry-backoff", "PUBLISH_RETRY_BACKOFF", "delay before the first publish retry, doubled after each attempt"},
+	{"publish-retry-backoff-max", "PUBLISH_RETRY_BACKOFF_MAX", "upper bound of the publish retry delay"},
+	{"flush-every", "FLUSH_EVERY", "flush the core NATS publishers after that many publishes, 0 never flushes"},
+	{"sync-publish-subjects", "SYNC_PUBLISH_SUBJECTS", "comma-separated subject patterns published synchronously"},
+	{"deliver-policy", "DELIVER_POLICY", "where new consumers start: all, new, last, start-time=<RFC3339 timestamp> or start-seq=<sequence>"},
+	{"ack-policy", "ACK_POLICY", "explicit, all or none, none never redelivers"},
+	{"ordered", "ORDERED", "process messages one at a time in stream order"},
+	{"ephemeral", "EPHEMERAL", "consume with ephemeral consumers, deleted once the subscribers are gone"},
+	{"message-ttl", "MESSAGE_TTL", "expiry set on the published messages that have none, 0 sets none"},
+	{"expiry-check", "EXPIRY_CHECK", "ack the messages received past their Expires-At time without processing them"},
+	{"verify-order", "VERIFY_ORDER", "stamp the published messages with a sequence per subject and report those consumed out of order"},
+	{"dry-run", "DRY_RUN", "log the messages instead of publishing them, and consume nothing"},
+	{"jetstream", "JETSTREAM_ENABLED", "false uses core NATS, at-most-once delivery"},
+	{"delivery-modes-file", "DELIVERY_MODES_FILE", "JSON file mapping subject patterns to delivery modes"},
+	{"dedup", "DEDUP", "publish msg.UUID as the Nats-Msg-Id header"},
+	{"duplicate-cache-size", "DUPLICATE_CACHE_SIZE", "processed message UUIDs remembered in memory to skip duplicates, 0 disables it"},
+	{"idempotency-bucket", "IDEMPOTENCY_BUCKET", "KV bucket remembering the processed message UUIDs, unset disables it"},
+	{"idempotency-ttl", "IDEMPOTENCY_TTL", "how long a processed message UUID is remembered when AUTO_PROVISION creates the bucket"},
+	{"replay-from", "REPLAY_FROM", "RFC3339 timestamp or stream sequence to reprocess the stream from, then exit"},
+	{"replay-subject", "REPLAY_SUBJECT", "filter subject replayed instead of the subjects"},
+	{"replay-until-end", "REPLAY_UNTIL_END", "stop the replay at the current end of the stream instead of on Ctrl+C"},
+	{"export-file", "EXPORT_FILE", "write the messages of the subjects to this file up to the end of the stream, then exit"},
+	{"export-from", "EXPORT_FROM", "RFC3339 timestamp or stream sequence the export starts from, unset exports the whole stream"},
+	{"import-file", "IMPORT_FILE", "republish the messages of a file written with EXPORT_FILE, then exit"},
+	{"loadtest", "LOADTEST", "publish random payloads at a fixed rate, print the throughput and latencies, then exit"},
+	{"payload-size", "LOADTEST_PAYLOAD_SIZE", "size in bytes of the load test payloads"},
+	{"rate", "LOADTEST_RATE", "messages per second published by the load test"},
+	{"duration", "LOADTEST_DURATION", "how long the load test publishes"},
+	{"batch-size", "LOADTEST_BATCH_SIZE", "messages of a subject the load test publishes at once with PublishBatch"},
+	{"max-pending", "LOADTEST_MAX_PENDING", "async publishes of the load test batches waiting for their acks at once"},
+	{"migrate-target", "MIGRATE_TARGET", "republish the gob messages of the subjects as JSON on <target>.<subject> until Ctrl+C, instead of running the example"},
+	{"auto-provision", "AUTO_PROVISION", "create or update the stream and the idempotency bucket at startup"},
+	{"shards", "SHARDS", "number of streams the subjects are spread over, 0 disables sharding"},
+	{"shard-key-token", "SHARD_KEY_TOKEN", "index of the subject token hashed to select the shard"},
+	{"priority", "PRIORITY", "send messages with Priority=high to their own stream, consumed before the low-priority one"},
+	{"stream-name", "STREAM_NAME", "name of the provisioned stream"},
+	{"stream-subjects", "STREAM_SUBJECTS", "comma-separated subjects captured by the provisioned stream"},
+	{"stream-reuse-superset", "STREAM_REUSE_SUPERSET", "use an existing stream capturing all the stream subjects instead of failing on the overlap"},
+	{"stream-retention", "STREAM_RETENTION", "limits, interest or workqueue"},
+	{"stream-max-age", "STREAM_MAX_AGE", "maximum age of the messages in the stream"},
+	{"stream-max-bytes", "STREAM_MAX_BYTES", "maximum size of the stream"},
+	{"stream-replicas", "STREAM_REPLICAS", "number of stream replicas"},
+	{"stream-duplicate-window", "STREAM_DUPLICATE_WINDOW", "how long the stream remembers message IDs"},
+}
+
+// applyFlags parses the command line and exports every flag that was set to its
+// environment variable, so a flag overrides the environment and an unset flag leaves it alone.
+// It returns flag.ErrHelp when --help was requested, after printing the usage
+func applyFlags(args []string) error {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	for _, f := range envFlags {
+		fs.String(f.name, "", fmt.Sprintf("%s (env %s)", f.usage, f.env))
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+		fmt.Fprintln(fs.Output(), "Every flag mirrors an environment variable, a flag that is set takes precedence over it.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+
+	envs := make(map[string]string, len(envFlags))
+	for _, f := range envFlags {
+		envs[f.name] = f.env
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err == nil {
+			err = os.Setenv(envs[f.Name], f.Value.String())
+		}
+	})
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"nats/metrics"
+)
+
+// Handler processes a single message. Returning nil acks the message,
+// returning an error nacks it so that JetStream redelivers it
+type Handler func(ctx context.Context, msg *message.Message) error
+
+// runHandler calls h for every message until the channel is closed,
+// which happens when the subscriber is closed.
+// The messages delivered by the goroutines of the subscriber are processed in parallel,
+// at most concurrency at a time: the others wait in the subscriber, unacked.
+// The context of h expires ackWait after the message was received, when the subscriber stops
+// waiting for its ack, so that slow calls give up before it is redelivered; 0 sets no deadline
+func runHandler(messages <-chan *message.Message, h Handler, concurrency int, ackWait time.Duration) {
+	defer handlers.Done()
+	sem := make(chan struct{}, concurrency)
+	var running sync.WaitGroup
+	defer running.Wait()
+	for msg := range messages {
+		received := time.Now()
+		sem <- struct{}{}
+		running.Add(1)
+		go func(msg *message.Message) {
+			defer func() {
+				<-sem
+				running.Done()
+			}()
+			ctx := msg.Context()
+			if ackWait > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithDeadline(ctx, received.Add(ackWait))
+				defer cancel()
+			}
+			if err := h(ctx, msg); err != nil {
+				msg.Nack()
+			} else {
+				// we need to Acknowledge that we received and processed the message,
+				// otherwise, it will be resent over and over again.
+				msg.Ack()
+			}
+		}(msg)
+	}
+}
+
+// logMessage is the example handler, it only logs the received message and its metadata
+func logMessage(from string) Handler {
+	return func(ctx context.Context, msg *message.Message) error {
+		if len(msg.Payload) == 0 {
+			log.Printf("[%s] received headers-only message: %s, metadata: %s", from, msg.UUID, formatMetadata(msg.Metadata))
+			return nil
+		}
+		log.Printf("[%s] received message: %s, payload: %s, metadata: %s", from, msg.UUID, string(msg.Payload), formatMetadata(msg.Metadata))
+		return nil
+	}
+}
+
+// formatMetadata renders metadata as space-separated key=value pairs, sorted by key
+func formatMetadata(metadata message.Metadata) string {
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+metadata[k])
+	}
+	return strings.Join(pairs, " ")
+}
+
+// headerValue returns the metadata value of key, telling an empty value from a missing key.
+// NATS headers keep the case of their keys, "my-key" does not match "My-Key"
+func headerValue(msg *message.Message, key string) (string, bool) {
+	v, ok := msg.Metadata[key]
+	return v, ok
+}
+
+// processedKey identifies msg among the processed messages: "<subject>.<UUID>", so that messages
+// sharing a UUID on different subjects, such as a message fanned out to several subjects, are each
+// processed once. Messages without a delivery subject are identified by their UUID alone
+func processedKey(msg *message.Message) string {
+	if subject := msg.Metadata.Get(subjectKey); subject != "" {
+		return subject + "." + msg.UUID
+	}
+	return msg.UUID
+}
+
+// DeliveryAttempt returns how many times msg was delivered, counting this delivery: 1 on the
+// first attempt, maxDeliver on the last one JetStream makes. Core NATS messages are delivered once
+func DeliveryAttempt(msg *message.Message) int {
+	attempt, err := strconv.Atoi(msg.Metadata.Get(numDeliveredKey))
+	if err != nil || attempt < 1 {
+		return 1
+	}
+	return attempt
+}
+
+// instrument records the received, acked and nacked counts and the duration of the handler
+func instrument(topic, subscriber string) Middleware {
+	return func(h Handler) Handler {
+		return func(ctx context.Context, msg *message.Message) error {
+			metrics.Received.WithLabelValues(topic, subscriber).Inc()
+			start := time.Now()
+			defer func() {
+				metrics.HandlerDuration.WithLabelValues(topic, subscriber).Observe(time.Since(start).Seconds())
+			}()
+
+			err := h(ctx, msg)
+			if err != nil {
+				metrics.Nacked.WithLabelValues(topic, subscriber).Inc()
+			} else {
+				metrics.Acked.WithLabelValues(topic, subscriber).Inc()
+			}
+			return err
+		}
+	}
+}
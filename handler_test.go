@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+func TestMetadataSurfacesOnConsume(t *testing.T) {
+	url := runServer(t, false)
+	marshaler, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := newSubscriber(nats.SubscriberConfig{
+		URL:         url,
+		Unmarshaler: marshaler,
+		JetStream:   nats.JetStreamConfig{Disabled: true},
+	}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.conn.Close()
+	defer sub.Close()
+	messages, err := sub.Subscribe(context.Background(), "example_topic.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the subscription must reach the server before the publisher connection publishes
+	if err := sub.conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := nats.NewPublisher(nats.PublisherConfig{
+		URL:       url,
+		Marshaler: marshaler,
+		JetStream: nats.JetStreamConfig{Disabled: true},
+	}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte("hello"))
+	msg.Metadata.Set("Tenant", "acme")
+	msg.Metadata.Set("my-key", "lower")
+	msg.Metadata.Set("Empty", "")
+	if err := pub.Publish("example_topic.a", msg); err != nil {
+		t.Fatal(err)
+	}
+
+	var got *message.Message
+	select {
+	case got = <-messages:
+		got.Ack()
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	for key, want := range map[string]string{"Tenant": "acme", "my-key": "lower", subjectKey: "example_topic.a"} {
+		if v, ok := headerValue(got, key); !ok || v != want {
+			t.Errorf("%s = %q (present %v), want %q", key, v, ok, want)
+		}
+	}
+	// header names keep their case
+	if _, ok := headerValue(got, "My-Key"); ok {
+		t.Error("My-Key matched the my-key header")
+	}
+	if v, ok := headerValue(got, "Empty"); !ok || v != "" {
+		t.Errorf("Empty = %q (present %v), want an empty value", v, ok)
+	}
+	if _, ok := headerValue(got, "Missing"); ok {
+		t.Error("Missing is present")
+	}
+}
+
+func TestRunHandlerBoundsConcurrency(t *testing.T) {
+	const concurrency = 3
+	messages := make(chan *message.Message, 20)
+	for i := 0; i < cap(messages); i++ {
+		messages <- message.NewMessage(watermill.NewUUID(), nil)
+	}
+	close(messages)
+
+	var running, maxRunning, handled atomic.Int64
+	h := func(ctx context.Context, msg *message.Message) error {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			max := maxRunning.Load()
+			if n <= max || maxRunning.CompareAndSwap(max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		handled.Add(1)
+		return nil
+	}
+	// runHandler returns once every message was handled
+	handlers.Add(1)
+	runHandler(messages, h, concurrency, 0)
+
+	if handled.Load() != int64(cap(messages)) {
+		t.Errorf("%d messages handled, want %d", handled.Load(), cap(messages))
+	}
+	if max := maxRunning.Load(); max > concurrency {
+		t.Errorf("%d handlers ran at once, want at most %d", max, concurrency)
+	} else if max < 2 {
+		t.Errorf("%d handlers ran at once, want them to run concurrently", max)
+	}
+}
+
+func TestRunHandlerDeadlineFollowsAckWait(t *testing.T) {
+	const ackWait = 2 * time.Second
+	tests := []struct {
+		ackWait     time.Duration
+		hasDeadline bool
+	}{
+		{ackWait, true},
+		{0, false},
+	}
+	for _, tt := range tests {
+		messages := make(chan *message.Message, 1)
+		messages <- message.NewMessage(watermill.NewUUID(), nil)
+		close(messages)
+
+		var handled context.Context
+		var deadline time.Time
+		var hasDeadline bool
+		h := func(ctx context.Context, msg *message.Message) error {
+			handled = ctx
+			deadline, hasDeadline = ctx.Deadline()
+			return nil
+		}
+		before := time.Now()
+		handlers.Add(1)
+		runHandler(messages, h, 1, tt.ackWait)
+		after := time.Now()
+
+		if hasDeadline != tt.hasDeadline {
+			t.Errorf("ack wait %s: context has a deadline %v, want %v", tt.ackWait, hasDeadline, tt.hasDeadline)
+			continue
+		}
+		if !tt.hasDeadline {
+			continue
+		}
+		// the deadline counts from the receipt of the message
+		if deadline.Before(before.Add(tt.ackWait)) || deadline.After(after.Add(tt.ackWait)) {
+			t.Errorf("deadline %s after the message was received, want %s", deadline.Sub(before), tt.ackWait)
+		}
+		// the context is released once the message is acked
+		if handled.Err() != context.Canceled {
+			t.Errorf("context error %v after the ack, want %v", handled.Err(), context.Canceled)
+		}
+	}
+}
+
+func TestDeliveryAttemptCountsRedeliveries(t *testing.T) {
+	url := runServer(t, true)
+	conn := connect(t, url)
+	js := addStream(t, conn, "orders", "orders.>")
+	unmarshaler, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := js.SubscribeSync("orders.>", nc.AckExplicit())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.Publish("orders.1", []byte("order")); err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		natsMsg, err := sub.NextMsg(5 * time.Second)
+		if err != nil {
+			t.Fatalf("delivery %d: %v", attempt, err)
+		}
+		msg, err := unmarshaler.Unmarshal(natsMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := DeliveryAttempt(msg); got != attempt {
+			t.Errorf("DeliveryAttempt = %d, want %d", got, attempt)
+		}
+		// the first delivery is nacked to be redelivered right away
+		if attempt == 1 {
+			err = natsMsg.Nak()
+		} else {
+			err = natsMsg.Ack()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// core NATS messages carry no delivery count
+	if got := DeliveryAttempt(message.NewMessage(watermill.NewUUID(), nil)); got != 1 {
+		t.Errorf("DeliveryAttempt of a core NATS message = %d, want 1", got)
+	}
+}
+
+func TestCoreNATSNackDoesNotRedeliver(t *testing.T) {
+	url := runServer(t, false)
+	marshaler, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := newSubscriber(nats.SubscriberConfig{
+		URL:              url,
+		SubscribersCount: 1,
+		Unmarshaler:      coreUnmarshaler{marshaler},
+		JetStream:        nats.JetStreamConfig{Disabled: true},
+	}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.conn.Close()
+	defer sub.Close()
+	messages, err := sub.Subscribe(context.Background(), "telemetry.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the messages carry a reply subject, which a watermill ack or nack would reply to
+	conn := connect(t, url)
+	inbox, err := conn.SubscribeSync("inbox.telemetry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, payload := range []string{"nacked", "acked"} {
+		natsMsg, err := marshaler.Marshal("telemetry.cpu", message.NewMessage(watermill.NewUUID(), []byte(payload)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		natsMsg.Reply = "inbox.telemetry"
+		if err := conn.PublishMsg(natsMsg); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case msg := <-messages:
+			if string(msg.Payload) != payload {
+				t.Fatalf("delivery %d is %q, want %q", i+1, msg.Payload, payload)
+			}
+			if payload == "nacked" {
+				msg.Nack()
+			} else {
+				msg.Ack()
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s message not delivered", payload)
+		}
+	}
+
+	select {
+	case msg := <-messages:
+		t.Errorf("message %q delivered again after a nack", msg.Payload)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if reply, err := inbox.NextMsg(100 * time.Millisecond); err == nil {
+		t.Errorf("the publisher received %q", reply.Data)
+	}
+}
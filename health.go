@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ThreeDotsLabs/watermill"
+	nc "github.com/nats-io/nats.go"
+)
+
+// serveHealth starts an HTTP server for Kubernetes probes
+//   - /healthz (liveness) answers 200 as long as the process serves requests
+//   - /readyz (readiness) answers 200 only when every connection returned by conns is CONNECTED
+//
+// The returned server should be closed on shutdown
+func serveHealth(addr string, conns func() map[string]*nc.Conn, logger watermill.LoggerAdapter) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		var notReady []string
+		for name, conn := range conns() {
+			if status := conn.Status(); status != nc.CONNECTED {
+				notReady = append(notReady, fmt.Sprintf("%s: %s", name, status))
+			}
+		}
+		if len(notReady) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			for _, line := range notReady {
+				fmt.Fprintln(w, line)
+			}
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		logger.Info("Serving health checks", watermill.LogFields{"addr": addr})
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Health server failed", err, nil)
+		}
+	}()
+	return srv
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+// idempotencyStore remembers every processed message in a KV bucket, keyed by subject and UUID,
+// for as long as the bucket TTL, which can outlast the dedup window of the stream
+type idempotencyStore struct {
+	conn *nc.Conn
+	kv   nc.KeyValue
+}
+
+// newIdempotencyStore opens the KV bucket named by IDEMPOTENCY_BUCKET over its own connection,
+// or returns nil when it is unset. With AUTO_PROVISION=true the bucket is created with a TTL of
+// IDEMPOTENCY_TTL (default 24h), otherwise it must exist and keeps its own TTL
+func newIdempotencyStore(url string, options []nc.Option, logger watermill.LoggerAdapter) (*idempotencyStore, error) {
+	bucket := os.Getenv("IDEMPOTENCY_BUCKET")
+	if bucket == "" {
+		return nil, nil
+	}
+	ttl, err := getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("IDEMPOTENCY_TTL must be positive, got %s", ttl)
+	}
+
+	conn, err := nc.Connect(url, options...)
+	if err != nil {
+		return nil, connectionError(err)
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var kv nc.KeyValue
+	if os.Getenv("AUTO_PROVISION") == "true" {
+		logger.Info("Creating idempotency bucket", watermill.LogFields{"bucket": bucket, "ttl": ttl.String()})
+		kv, err = js.CreateKeyValue(&nc.KeyValueConfig{Bucket: bucket, TTL: ttl})
+	} else {
+		kv, err = js.KeyValue(bucket)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot open idempotency bucket %s: %w", bucket, err)
+	}
+	return &idempotencyStore{conn: conn, kv: kv}, nil
+}
+
+// Close closes the connection of the store, once the subscribers are drained
+func (s *idempotencyStore) Close() error {
+	s.conn.Close()
+	return nil
+}
+
+// idempotent acks the messages already in the store without processing them, and records the
+// messages h processed successfully, by subject and UUID, see processedKey.
+// A message processed twice concurrently, or whose UUID cannot be recorded, may still be
+// processed again: the store narrows the duplicates, it does not make delivery exactly-once.
+// Messages whose key is not a valid KV key are processed without deduplication
+func (s *idempotencyStore) idempotent(logger watermill.LoggerAdapter) Middleware {
+	return func(h Handler) Handler {
+		if s == nil {
+			return h
+		}
+		return func(ctx context.Context, msg *message.Message) error {
+			key := processedKey(msg)
+			fields := watermill.LogFields{"message_uuid": msg.UUID, "key": key}
+			_, err := s.kv.Get(key)
+			switch {
+			case err == nil:
+				logger.Debug("Message already processed, skipping it", fields)
+				return nil
+			case errors.Is(err, nc.ErrInvalidKey):
+				logger.Info("Message key is not a valid KV key, processing it without deduplication", fields)
+				return h(ctx, msg)
+			case !errors.Is(err, nc.ErrKeyNotFound):
+				return fmt.Errorf("cannot look up processed message: %w", err)
+			}
+
+			if err := h(ctx, msg); err != nil {
+				return err
+			}
+			// the message is processed, failing to record it only risks processing it again
+			if _, err := s.kv.Put(key, nil); err != nil {
+				logger.Error("Cannot record processed message", err, fields)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+// delivered returns a message with uuid as if it was delivered on subject
+func delivered(uuid, subject string) *message.Message {
+	msg := message.NewMessage(uuid, nil)
+	msg.Metadata.Set(subjectKey, subject)
+	return msg
+}
+
+func TestIdempotentKeysBySubjectAndUUID(t *testing.T) {
+	conn := connect(t, runServer(t, true))
+	js, err := conn.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err := js.CreateKeyValue(&nc.KeyValueConfig{Bucket: "processed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &idempotencyStore{conn: conn, kv: kv}
+
+	processed := make(map[string]int)
+	h := store.idempotent(watermill.NopLogger{})(func(ctx context.Context, msg *message.Message) error {
+		processed[msg.Metadata.Get(subjectKey)]++
+		return nil
+	})
+
+	uuid := watermill.NewUUID()
+	for _, msg := range []*message.Message{
+		delivered(uuid, "example_topic.a"),
+		// the same UUID on another subject is another message
+		delivered(uuid, "example_topic.b"),
+		// a redelivery is skipped
+		delivered(uuid, "example_topic.a"),
+	} {
+		if err := h(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if processed["example_topic.a"] != 1 || processed["example_topic.b"] != 1 {
+		t.Errorf("processed = %v, want each subject once", processed)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/ThreeDotsLabs/watermill"
+	nc "github.com/nats-io/nats.go"
+)
+
+// consumerInfoer is what lagScaler and scrapeLag need from JetStream, nc.JetStreamContext implements it
+type consumerInfoer interface {
+	StreamNameBySubject(subject string, opts ...nc.JSOpt) (string, error)
+	ConsumerInfo(stream, name string, opts ...nc.JSOpt) (*nc.ConsumerInfo, error)
+}
+
+// lagScaler serves GET /scaler, the messages the durable consumers have left to deliver in the
+// shape of the KEDA metrics-api scaler: {"<metric>": <pending>}, read with valueLocation=<metric>
+type lagScaler struct {
+	js        consumerInfoer
+	consumers []durableConsumer
+	metric    string
+	logger    watermill.LoggerAdapter
+}
+
+// pending returns the NumPending of every consumer added up, consumers that do not exist yet count as 0
+func (s *lagScaler) pending(r *http.Request) (uint64, error) {
+	var pending uint64
+	for _, c := range s.consumers {
+		stream, err := s.js.StreamNameBySubject(c.subject, nc.Context(r.Context()))
+		if err == nil {
+			var info *nc.ConsumerInfo
+			if info, err = s.js.ConsumerInfo(stream, c.durable, nc.Context(r.Context())); err == nil {
+				pending += info.NumPending
+				continue
+			}
+		}
+		if !consumerMissing(err) {
+			return 0, err
+		}
+	}
+	return pending, nil
+}
+
+// register adds GET /scaler to mux
+func (s *lagScaler) register(mux *http.ServeMux) {
+	mux.HandleFunc("/scaler", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		pending, err := s.pending(r)
+		if err != nil {
+			s.logger.Error("Cannot read consumer lag", err, nil)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]uint64{s.metric: pending}); err != nil {
+			s.logger.Error("Cannot write scaler response", err, nil)
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	nc "github.com/nats-io/nats.go"
+)
+
+// fakeConsumerInfo serves the consumer infos of consumers, keyed by durable name, in the
+// stream of streams keyed by subject
+type fakeConsumerInfo struct {
+	streams   map[string]string
+	consumers map[string]*nc.ConsumerInfo
+	err       error
+}
+
+func (f fakeConsumerInfo) StreamNameBySubject(subject string, opts ...nc.JSOpt) (string, error) {
+	stream, ok := f.streams[subject]
+	if !ok {
+		return "", nc.ErrNoMatchingStream
+	}
+	return stream, nil
+}
+
+func (f fakeConsumerInfo) ConsumerInfo(stream, name string, opts ...nc.JSOpt) (*nc.ConsumerInfo, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	info, ok := f.consumers[name]
+	if !ok || info.Stream != stream {
+		return nil, nc.ErrConsumerNotFound
+	}
+	return info, nil
+}
+
+func TestLagScaler(t *testing.T) {
+	js := fakeConsumerInfo{
+		streams: map[string]string{"orders.>": "orders", "audit.>": "audit"},
+		consumers: map[string]*nc.ConsumerInfo{
+			"orders_a": {Stream: "orders", NumPending: 7},
+			"orders_b": {Stream: "orders", NumPending: 3},
+		},
+	}
+	tests := []struct {
+		name      string
+		js        consumerInfoer
+		consumers []durableConsumer
+		method    string
+		want      int
+		pending   uint64
+	}{
+		{
+			name:      "pending added up",
+			js:        js,
+			consumers: []durableConsumer{{"orders.>", "orders_a"}, {"orders.>", "orders_b"}},
+			method:    http.MethodGet,
+			want:      http.StatusOK,
+			pending:   10,
+		},
+		{
+			name:      "missing consumer and stream count as 0",
+			js:        js,
+			consumers: []durableConsumer{{"orders.>", "orders_a"}, {"audit.>", "audit"}, {"metrics.>", "metrics"}},
+			method:    http.MethodGet,
+			want:      http.StatusOK,
+			pending:   7,
+		},
+		{
+			name:      "JetStream unavailable",
+			js:        fakeConsumerInfo{streams: js.streams, err: nc.ErrJetStreamNotEnabled},
+			consumers: []durableConsumer{{"orders.>", "orders_a"}},
+			method:    http.MethodGet,
+			want:      http.StatusServiceUnavailable,
+		},
+		{
+			name:      "wrong method",
+			js:        js,
+			consumers: []durableConsumer{{"orders.>", "orders_a"}},
+			method:    http.MethodPost,
+			want:      http.StatusMethodNotAllowed,
+		},
+	}
+	for _, tt := range tests {
+		mux := http.NewServeMux()
+		(&lagScaler{js: tt.js, consumers: tt.consumers, metric: "pending", logger: watermill.NopLogger{}}).register(mux)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(tt.method, "/scaler", nil))
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var body map[string]uint64
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if pending, ok := body["pending"]; !ok || pending != tt.pending || len(body) != 1 {
+			t.Errorf("%s: body = %v, want {\"pending\": %d}", tt.name, body, tt.pending)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	nc "github.com/nats-io/nats.go"
+
+	"nats/metrics"
+)
+
+// durableConsumer is a durable consumer whose lag is exported, subject is one it consumes
+type durableConsumer struct {
+	subject string
+	durable string
+}
+
+// watchLag exports the pending and ack pending counts of the consumers every interval,
+// over its own connection so that it keeps working while the subscribers drain.
+// Consumers that do not exist yet, e.g. while the stream is being provisioned, are skipped
+// until they do. The returned closer stops watching and closes the connection
+func watchLag(url string, options []nc.Option, consumers []durableConsumer, interval time.Duration, logger watermill.LoggerAdapter) (closerFunc, error) {
+	conn, err := nc.Connect(url, options...)
+	if err != nil {
+		return nil, connectionError(err)
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			for _, c := range consumers {
+				scrapeLag(js, c, logger)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() error {
+		cancel()
+		<-done
+		conn.Close()
+		return nil
+	}, nil
+}
+
+// scrapeLag updates the lag gauges of c from its consumer info
+func scrapeLag(js consumerInfoer, c durableConsumer, logger watermill.LoggerAdapter) {
+	fields := watermill.LogFields{"durable": c.durable, "subject": c.subject}
+	stream, err := js.StreamNameBySubject(c.subject)
+	if err == nil {
+		var info *nc.ConsumerInfo
+		if info, err = js.ConsumerInfo(stream, c.durable); err == nil {
+			metrics.ConsumerPending.WithLabelValues(c.durable).Set(float64(info.NumPending))
+			metrics.ConsumerAckPending.WithLabelValues(c.durable).Set(float64(info.NumAckPending))
+			return
+		}
+	}
+	if consumerMissing(err) {
+		logger.Debug("Consumer does not exist yet, lag not exported", fields)
+		return
+	}
+	logger.Error("Cannot read consumer lag", err, fields)
+}
+
+// consumerMissing reports whether err is about a stream or consumer that does not exist yet
+func consumerMissing(err error) bool {
+	return errors.Is(err, nc.ErrStreamNotFound) || errors.Is(err, nc.ErrConsumerNotFound) || errors.Is(err, nc.ErrNoMatchingStream)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	nc "github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"nats/metrics"
+)
+
+func TestScrapeLag(t *testing.T) {
+	js := fakeConsumerInfo{
+		streams: map[string]string{"orders.>": "orders", "audit.>": "audit"},
+		consumers: map[string]*nc.ConsumerInfo{
+			"lag_orders": {Stream: "orders", NumPending: 7, NumAckPending: 2},
+		},
+	}
+	logger := watermill.NewCaptureLogger()
+	scrapeLag(js, durableConsumer{"orders.>", "lag_orders"}, logger)
+	if pending := testutil.ToFloat64(metrics.ConsumerPending.WithLabelValues("lag_orders")); pending != 7 {
+		t.Errorf("pending = %v, want 7", pending)
+	}
+	if ackPending := testutil.ToFloat64(metrics.ConsumerAckPending.WithLabelValues("lag_orders")); ackPending != 2 {
+		t.Errorf("ack pending = %v, want 2", ackPending)
+	}
+
+	// a consumer or stream that does not exist yet is skipped without an error
+	scrapeLag(js, durableConsumer{"audit.>", "lag_audit"}, logger)
+	scrapeLag(js, durableConsumer{"metrics.>", "lag_metrics"}, logger)
+	if errs := logger.Captured()[watermill.ErrorLogLevel]; len(errs) > 0 {
+		t.Errorf("missing consumers logged %v", errs)
+	}
+	if debug := logger.Captured()[watermill.DebugLogLevel]; len(debug) != 2 {
+		t.Errorf("missing consumers logged %d debug messages, want 2", len(debug))
+	}
+
+	scrapeLag(fakeConsumerInfo{streams: js.streams, err: nc.ErrJetStreamNotEnabled}, durableConsumer{"orders.>", "lag_orders"}, logger)
+	if errs := logger.Captured()[watermill.ErrorLogLevel]; len(errs) != 1 {
+		t.Errorf("%d errors logged when JetStream is unavailable, want 1", len(errs))
+	}
+	// the gauges keep the last scraped lag
+	if pending := testutil.ToFloat64(metrics.ConsumerPending.WithLabelValues("lag_orders")); pending != 7 {
+		t.Errorf("pending = %v after a failed scrape, want 7", pending)
+	}
+}
+
+func TestConsumerMissing(t *testing.T) {
+	for err, want := range map[error]bool{
+		nc.ErrStreamNotFound:   true,
+		nc.ErrConsumerNotFound: true,
+		nc.ErrNoMatchingStream: true,
+		fmt.Errorf("lookup orders: %w", nc.ErrConsumerNotFound): true,
+		nc.ErrJetStreamNotEnabled:                               false,
+		nc.ErrTimeout:                                           false,
+	} {
+		if got := consumerMissing(err); got != want {
+			t.Errorf("consumerMissing(%v) = %v, want %v", err, got, want)
+		}
+	}
+}
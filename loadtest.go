@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"golang.org/x/time/rate"
+)
+
+// maxLoadTestInFlight bounds the publishes a load test waits on at once
+const maxLoadTestInFlight = 256
+
+// loadTest publishes random payloads at a fixed rate to benchmark a cluster
+type loadTest struct {
+	payloadSize int
+	rate        int
+	duration    time.Duration
+	// batchSize messages of a subject are published at once with PublishBatch when above 1
+	batchSize int
+	// maxPending is the number of async publishes of the batches allowed to wait for their acks at once
+	maxPending int
+}
+
+// loadLoadTest returns the load test requested with LOADTEST=true, nil otherwise.
+// LOADTEST_PAYLOAD_SIZE (default 1024 bytes), LOADTEST_RATE (default 1000 messages per second)
+// and LOADTEST_DURATION (default 30s) shape the load, LOADTEST_BATCH_SIZE (default 1) publishes
+// that many messages of a subject at once, with at most LOADTEST_MAX_PENDING (default 16384) waiting for their acks
+func loadLoadTest() (*loadTest, error) {
+	enabled, err := getEnvBool("LOADTEST", false)
+	if err != nil || !enabled {
+		return nil, err
+	}
+	lt := &loadTest{}
+	if lt.payloadSize, err = getEnvInt("LOADTEST_PAYLOAD_SIZE", 1024); err != nil {
+		return nil, err
+	}
+	if lt.rate, err = getEnvInt("LOADTEST_RATE", 1000); err != nil {
+		return nil, err
+	}
+	if lt.duration, err = getEnvDuration("LOADTEST_DURATION", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if lt.batchSize, err = getEnvInt("LOADTEST_BATCH_SIZE", 1); err != nil {
+		return nil, err
+	}
+	if lt.batchSize < 1 {
+		return nil, fmt.Errorf("LOADTEST_BATCH_SIZE must be at least 1, got %d", lt.batchSize)
+	}
+	if lt.maxPending, err = getEnvInt("LOADTEST_MAX_PENDING", batchMaxPending); err != nil {
+		return nil, err
+	}
+	if lt.maxPending < 1 {
+		return nil, fmt.Errorf("LOADTEST_MAX_PENDING must be at least 1, got %d", lt.maxPending)
+	}
+	if lt.payloadSize < 0 || lt.rate < 1 || lt.duration <= 0 {
+		return nil, fmt.Errorf("LOADTEST_PAYLOAD_SIZE must not be negative, LOADTEST_RATE and LOADTEST_DURATION must be positive, got %d, %d and %s",
+			lt.payloadSize, lt.rate, lt.duration)
+	}
+	return lt, nil
+}
+
+// loadTestReport sums up a load test
+type loadTestReport struct {
+	published int
+	errors    int
+	elapsed   time.Duration
+	// latencies of the successful publishes, sorted
+	latencies []time.Duration
+}
+
+// run publishes to topics in turn at the configured rate until the duration elapsed or ctx is done,
+// one message at a time with publish, or batchSize messages at once with publishBatch.
+// Publishes run concurrently, so a slow ack does not lower the rate
+func (lt *loadTest) run(ctx context.Context, topics []string, publish func(ctx context.Context, topic string, msg *message.Message) error,
+	publishBatch func(topic string, msgs []*message.Message) error) loadTestReport {
+	ctx, cancel := context.WithTimeout(ctx, lt.duration)
+	defer cancel()
+
+	limiter := rate.NewLimiter(rate.Limit(lt.rate), lt.batchSize)
+	inFlight := make(chan struct{}, maxLoadTestInFlight)
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		report loadTestReport
+	)
+	start := time.Now()
+	for i := 0; ; i++ {
+		if err := limiter.WaitN(ctx, lt.batchSize); err != nil {
+			break
+		}
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func(topic string) {
+			defer func() {
+				<-inFlight
+				wg.Done()
+			}()
+			msgs := make([]*message.Message, lt.batchSize)
+			for j := range msgs {
+				payload := make([]byte, lt.payloadSize)
+				rand.Read(payload)
+				msgs[j] = message.NewMessage(watermill.NewUUID(), payload)
+			}
+
+			sent := time.Now()
+			var err error
+			if lt.batchSize == 1 {
+				err = publish(context.Background(), topic, msgs[0])
+			} else {
+				err = publishBatch(topic, msgs)
+			}
+			latency := time.Since(sent)
+
+			// a *BatchError names the failed messages, the others of the batch were stored
+			failed := 0
+			var batchErr *BatchError
+			if errors.As(err, &batchErr) {
+				failed = len(batchErr.Failures)
+			} else if err != nil {
+				failed = len(msgs)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			report.errors += failed
+			report.published += len(msgs) - failed
+			for j := failed; j < len(msgs); j++ {
+				report.latencies = append(report.latencies, latency)
+			}
+		}(topics[i%len(topics)])
+	}
+	wg.Wait()
+	report.elapsed = time.Since(start)
+
+	sort.Slice(report.latencies, func(i, j int) bool { return report.latencies[i] < report.latencies[j] })
+	return report
+}
+
+// percentile returns the latency below which p percent of the publishes completed
+func (r loadTestReport) percentile(p int) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	return r.latencies[(len(r.latencies)-1)*p/100]
+}
+
+// print logs the throughput and latencies of the load test
+func (r loadTestReport) print() {
+	throughput := float64(r.published) / r.elapsed.Seconds()
+	log.Printf("load test: %d messages published in %s, %.1f msg/s", r.published, r.elapsed.Round(time.Millisecond), throughput)
+	log.Printf("load test: publish latency p50 %s, p99 %s", r.percentile(50), r.percentile(99))
+	log.Printf("load test: %d publish errors", r.errors)
+}
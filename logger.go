@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"golang.org/x/exp/slog"
+)
+
+// levelTrace is below slog's debug level, matching watermill's trace logs
+const levelTrace = slog.LevelDebug - 4
+
+// newLogger returns the logger shared by the publisher and the subscribers.
+// LOG_FORMAT=json switches from the watermill stdlib logger to JSON lines,
+// LOG_LEVEL (trace/debug/info/warn/error, default info) sets the verbosity
+func newLogger() (watermill.LoggerAdapter, error) {
+	var level slog.Level
+	switch l := os.Getenv("LOG_LEVEL"); l {
+	case "trace":
+		level = levelTrace
+	case "debug":
+		level = slog.LevelDebug
+	case "", "info":
+		level = slog.LevelInfo
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		return nil, fmt.Errorf("unknown LOG_LEVEL %q, expected one of trace, debug, info, warn, error", l)
+	}
+
+	switch f := os.Getenv("LOG_FORMAT"); f {
+	case "", "text":
+		// the stdlib logger cannot filter out info logs, so warn and error behave like info
+		return watermill.NewStdLogger(level <= slog.LevelDebug, level <= levelTrace), nil
+	case "json":
+		logger := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+		// route the log package through the same handler so every line is JSON
+		slog.SetDefault(logger)
+		return &slogAdapter{logger: logger}, nil
+	default:
+		return nil, fmt.Errorf("unknown LOG_FORMAT %q, expected text or json", f)
+	}
+}
+
+// slogAdapter implements watermill.LoggerAdapter on top of slog
+type slogAdapter struct {
+	logger *slog.Logger
+}
+
+func (s *slogAdapter) Error(msg string, err error, fields watermill.LogFields) {
+	s.log(slog.LevelError, msg, fields.Add(watermill.LogFields{"err": err}))
+}
+
+func (s *slogAdapter) Info(msg string, fields watermill.LogFields) {
+	s.log(slog.LevelInfo, msg, fields)
+}
+
+func (s *slogAdapter) Debug(msg string, fields watermill.LogFields) {
+	s.log(slog.LevelDebug, msg, fields)
+}
+
+func (s *slogAdapter) Trace(msg string, fields watermill.LogFields) {
+	s.log(levelTrace, msg, fields)
+}
+
+func (s *slogAdapter) With(fields watermill.LogFields) watermill.LoggerAdapter {
+	return &slogAdapter{logger: s.logger.With(attrs(fields)...)}
+}
+
+func (s *slogAdapter) log(level slog.Level, msg string, fields watermill.LogFields) {
+	s.logger.Log(context.Background(), level, msg, attrs(fields)...)
+}
+
+func attrs(fields watermill.LogFields) []any {
+	args := make([]any, 0, len(fields))
+	for k, v := range fields {
+		args = append(args, slog.Any(k, v))
+	}
+	return args
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// Loopback is an in-process Publisher and subscriber delivering messages over Go channels, to run
+// handlers through the whole publish and subscribe path in tests without a NATS server.
+// Subjects match subscription patterns like NATS subjects, "*" and ">" included, and every
+// matching subscription gets its own copy of a message, with Nats-Delivered-Subject set.
+// There is no JetStream: acks and nacks are not waited for and nothing is ever redelivered
+type Loopback struct {
+	bufferSize int
+
+	mu            sync.RWMutex
+	closed        bool
+	subscriptions map[*loopbackSubscription]struct{}
+}
+
+// loopbackSubscription is one Subscribe call of a Loopback
+type loopbackSubscription struct {
+	pattern []string
+	ctx     context.Context
+	// stop releases a blocked deliver when the subscription is closed
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu       sync.Mutex
+	closed   bool
+	messages chan *message.Message
+}
+
+// NewLoopback returns a Loopback whose subscriptions buffer up to bufferSize messages,
+// beyond which Publish blocks until they are consumed
+func NewLoopback(bufferSize int) *Loopback {
+	return &Loopback{bufferSize: bufferSize, subscriptions: make(map[*loopbackSubscription]struct{})}
+}
+
+// Publish delivers messages to the subscriptions matching topic, in order
+func (l *Loopback) Publish(topic string, messages ...*message.Message) error {
+	if err := validateSubject(topic); err != nil {
+		return err
+	}
+	l.mu.RLock()
+	if l.closed {
+		l.mu.RUnlock()
+		return errors.New("loopback is closed")
+	}
+	tokens := strings.Split(topic, ".")
+	var matching []*loopbackSubscription
+	for sub := range l.subscriptions {
+		if matchSubject(sub.pattern, tokens) {
+			matching = append(matching, sub)
+		}
+	}
+	l.mu.RUnlock()
+
+	for _, msg := range messages {
+		for _, sub := range matching {
+			delivered := msg.Copy()
+			delivered.Metadata.Set(subjectKey, topic)
+			sub.deliver(delivered)
+		}
+	}
+	return nil
+}
+
+// Subscribe returns the messages published to the subjects matching pattern from now on.
+// The channel is closed once ctx is done or the Loopback is closed
+func (l *Loopback) Subscribe(ctx context.Context, pattern string) (<-chan *message.Message, error) {
+	if err := validateSubject(pattern); err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, errors.New("loopback is closed")
+	}
+	sub := &loopbackSubscription{
+		pattern:  strings.Split(pattern, "."),
+		ctx:      ctx,
+		stop:     make(chan struct{}),
+		messages: make(chan *message.Message, l.bufferSize),
+	}
+	l.subscriptions[sub] = struct{}{}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-sub.stop:
+		}
+		l.unsubscribe(sub)
+	}()
+	return sub.messages, nil
+}
+
+// Close closes the channels of every subscription
+func (l *Loopback) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	subscriptions := l.subscriptions
+	l.subscriptions = nil
+	l.mu.Unlock()
+
+	for sub := range subscriptions {
+		sub.close()
+	}
+	return nil
+}
+
+func (l *Loopback) unsubscribe(sub *loopbackSubscription) {
+	l.mu.Lock()
+	delete(l.subscriptions, sub)
+	l.mu.Unlock()
+	sub.close()
+}
+
+// deliver hands msg to the subscriber, giving up once the subscription is closed
+func (s *loopbackSubscription) deliver(msg *message.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.messages <- msg:
+	case <-s.stop:
+	}
+}
+
+func (s *loopbackSubscription) close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.messages)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestMatchSubject(t *testing.T) {
+	tests := []struct {
+		pattern, subject string
+		match            bool
+	}{
+		{"example_topic.a", "example_topic.a", true},
+		{"example_topic.a", "example_topic.b", false},
+		{"example_topic.a", "example_topic.a.test", false},
+		// * matches exactly one token, at any position
+		{"example_topic.*", "example_topic.a", true},
+		{"example_topic.*", "example_topic", false},
+		{"example_topic.*", "example_topic.a.test", false},
+		{"*.a", "example_topic.a", true},
+		{"example_topic.*.test", "example_topic.a.test", true},
+		{"example_topic.*.test", "example_topic.a.other", false},
+		// > matches one or more trailing tokens
+		{"example_topic.>", "example_topic.a", true},
+		{"example_topic.>", "example_topic.a.test", true},
+		{"example_topic.>", "example_topic", false},
+		{">", "example_topic", true},
+		{"example_topic.*.>", "example_topic.a.test", true},
+		{"example_topic.*.>", "example_topic.a", false},
+		{"other.>", "example_topic.a", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.subject, func(t *testing.T) {
+			if got := matchSubject(strings.Split(tt.pattern, "."), strings.Split(tt.subject, ".")); got != tt.match {
+				t.Errorf("matchSubject(%s, %s) = %v, want %v", tt.pattern, tt.subject, got, tt.match)
+			}
+		})
+	}
+}
+
+func TestLoopbackDeliversToMatchingSubscriptions(t *testing.T) {
+	loopback := NewLoopback(8)
+	defer loopback.Close()
+	ctx := context.Background()
+	all, err := loopback.Subscribe(ctx, "example_topic.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	onlyA, err := loopback.Subscribe(ctx, "example_topic.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, topic := range []string{"example_topic.a", "example_topic.b", "other.a"} {
+		if err := loopback.Publish(topic, message.NewMessage(watermill.NewUUID(), []byte(topic))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range []string{"example_topic.a", "example_topic.b"} {
+		if got := receive(t, all); got != want {
+			t.Errorf("example_topic.> received %s, want %s", got, want)
+		}
+	}
+	if got := receive(t, onlyA); got != "example_topic.a" {
+		t.Errorf("example_topic.a received %s", got)
+	}
+	select {
+	case msg := <-onlyA:
+		t.Errorf("example_topic.a received %s", msg.Metadata.Get(subjectKey))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestLoopbackSubscriptionEndsWithContext(t *testing.T) {
+	loopback := NewLoopback(0)
+	defer loopback.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	messages, err := loopback.Subscribe(ctx, "example_topic.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an unbuffered subscription nobody reads blocks the publish until it is cancelled
+	published := make(chan error, 1)
+	go func() {
+		published <- loopback.Publish("example_topic.a", message.NewMessage(watermill.NewUUID(), nil))
+	}()
+	cancel()
+	select {
+	case err := <-published:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the publish stayed blocked on a cancelled subscription")
+	}
+	for range messages {
+	}
+
+	if err := loopback.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loopback.Publish("example_topic.a", message.NewMessage(watermill.NewUUID(), nil)); err == nil {
+		t.Error("a closed loopback accepted a publish")
+	}
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
-	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -14,58 +17,91 @@ import (
 	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
 	"github.com/ThreeDotsLabs/watermill/message"
 	nc "github.com/nats-io/nats.go"
+
+	"nats/metrics"
 )
 
+// closeTimeout bounds how long subscribers (and the whole shutdown) may wait for in-flight messages
+const closeTimeout = time.Minute
+
+// publishTopics are the subjects the publisher sends one message to in each round
+var publishTopics = []string{
+	"example_topic.a",
+	"example_topic.b",
+	"example_topic.a.test",
+	"example_topic.b.test",
+}
+
 // push-based consumer example
 func main() {
-	marshaler := &nats.NATSMarshaler{}
-	logger := watermill.NewStdLogger(false, false)
-	options := []nc.Option{
-		nc.RetryOnFailedConnect(true),
-		nc.Timeout(30 * time.Second),
-		nc.ReconnectWait(1 * time.Second),
+	// every setting comes from a command line flag or its environment variable
+	cfg, err := parseConfig()
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
 	}
 
-	// jsSubOptions are JetStream-specific configurations
-	jsSubOptions := []nc.SubOpt{
-		// Read from the beginning of the channel (default)
-		// nc.DeliverAll(),
-
-		// Only receive messages that were created after the consumer was created
-		// nc.DeliverNew(),
-
-		// Start receiving messages with the last message added to the stream,
-		// or the last message in the stream that matches the consumer's filter subject if defined
-		// nc.DeliverLast(),
-
-		// Read from a specific time the message arrived in the channel
-		// nc.StartTime(startTime),
-
-		// MaxAckPending sets the number of outstanding acks that are allowed before message delivery is halted
-		// if it is too large, the subscriber will have not enough time processing messages
-		// before NATS timeout. In this case, NATS will send the same batch of messages
-		// to another subscriber in the same queue group. Thus, messages may be processed twice
-		nc.MaxAckPending(2048),
-
-		// MaxDeliver sets the number of redeliveries for a message
-		// Applies to any message that is re-sent due to a negative ack, or no ack sent by the client
-		nc.MaxDeliver(15),
-		nc.AckExplicit(),
+	// SHARDS spreads the subjects over several streams, the subject of a message selecting its shard
+	sharding, err := loadSharding()
+	if err != nil {
+		log.Fatalf("invalid sharding: %v", err)
+	}
+	// PRIORITY sends the messages with a high Priority metadata to their own stream, consumed first
+	priorities, err := loadPrioritizing()
+	if err != nil {
+		log.Fatalf("invalid priority: %v", err)
+	}
+	// SUBJECT_STRIP_TOKENS sends "tenant1.orders" on "orders", keeping the original subject in the metadata
+	mapper, err := loadSubjectMapper()
+	if err != nil {
+		log.Fatalf("invalid subject mapping: %v", err)
+	}
+	// MARSHALER selects the wire format shared by the publisher and the subscribers,
+	// SUBSCRIBER_MARSHALERS the one of the first, second... subscriber
+	marshalers, err := newMarshalerStacks(cfg, sharding, priorities, mapper)
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	marshaler := marshalers[cfg.Marshaler]
+	logger, err := newLogger()
+	if err != nil {
+		log.Fatalf("invalid logger configuration: %v", err)
+	}
+	// TRACING_ENABLED=true exports nats.publish and nats.process spans over OTLP
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Fatalf("cannot set up tracing: %v", err)
+	}
+	// flushes the spans still buffered once the handlers are done, it is stopped last on shutdown
+	tracing := flusherFunc(shutdownTracing)
 
-		// LimitsPolicy (default) means that messages are retained until any given limit is reached
-		// This could be one of MaxMsgs, MaxBytes, or MaxAge.
+	// PUBLISH_BUFFER_SIZE publishes are held while the connection of their publisher is down
+	gate, err := loadPublishGate(logger)
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	// disconnects, reconnects and closes of every connection are logged
+	options, err := connectionOptions(newConnEvents(logger, gate.notify))
+	if err != nil {
+		log.Fatalf("invalid connection options: %v", err)
+	}
 
-		// Discard Policy can be either Old (default) or New. It affects how MaxMessages and MaxBytes operate.
-		// If a limit is reached and the policy is Old, the oldest message is removed.
-		// If the policy is New, new messages are refused if it would put the stream over the limit.
+	// ACK_WAIT_TIMEOUT and MAX_ACK_PENDING tune redelivery, they are checked against
+	// EXPECTED_HANDLER_DURATION, the time a handler is expected to spend on one message
+	warnings, err := validateJetStreamConfig(cfg.AckWaitTimeout, cfg.MaxAckPending, cfg.ExpectedHandlerDuration, cfg.InactiveThreshold)
+	if err != nil {
+		log.Fatalf("invalid JetStream configuration: %v", err)
+	}
+	for _, warning := range warnings {
+		logger.Info("JetStream configuration warning: "+warning, nil)
+	}
 
-		// InactiveThreshold indicates how long the server should keep a consumer
-		// after detecting a lack of activity. In NATS Server 2.8.4 and earlier, this
-		// option only applies to ephemeral consumers. In NATS Server 2.9.0 and later,
-		// this option applies to both ephemeral and durable consumers, allowing durable
-		// consumers to also be deleted automatically after the inactivity threshold has passed
-		// (By default, durables will remain even when there are periods of inactivity unless InactiveThreshold is set explicitly)
-		nc.InactiveThreshold(300 * time.Second),
+	// jsSubOptions are JetStream-specific configurations
+	jsSubOptions := cfg.subscribeOptions()
+	if cfg.AckPolicy == ackNone {
+		logger.Info("ACK_POLICY=none: messages are not acked and never redelivered, a failed message is lost", nil)
 	}
 
 	// if JetStreamConfig.Disabled is set to true, then core NATS subscription is used
@@ -79,141 +115,661 @@ func main() {
 		TrackMsgId:       false,
 		// use msg.Ack(), which tells the NTS server that the message was successfully processed and it can move on to the next message
 		AckAsync: true,
-		// create or use a durable consumer named "my-durable"
-		DurablePrefix: "my-durable",
-	}
-
-	// the following comments are JetStream specific, ie. discussion on durability (JetStreamConfig.Disabled = false)
-	subscriber1, err := nats.NewSubscriber(
-		nats.SubscriberConfig{
-			URL: os.Getenv("NATS_URL"),
-			// A queue group (queue group should always be used with a durable consumer) allows you to have all subscribers leave
-			// but still maintain state. When a subscriber re-joins, it starts at the last position in that group.
-			// If using empty DurablePrefix or no binding options being specified, the queue name will be used as a durable name
-
-			// When QueueGroup is empty, subscribe without QueueGroup (default subscribe, fan-out push pattern) will be used
-			// - If using non-empty DurablePrefix with default subscribe, the library will attempt to lookup a JetStream
-			//   consumer with this name, and if found, will bind to it and not attempt to delete it.
-			//   However, if not found, the library will send a request to create such durable JetStream consumer.
-			//   Now JetStream will persist the position of the durable consumer over the stream
-			//   Note that DurablePrefix should be unique for each subscriber here to avoid duplication
-			//   ie. each durable consumer should only be bounded by one subscriber in the default subscribe mode
-			// - If using empty DurablePrefix with default subscribe, the library will send a request to the server
-			//   to create an ephemeral JetStream consumer, which will be deleted after an Unsubscribe() or Drain()
-			//   or after InactiveThreshold (defaults to 5 seconds) is reached when not actively consuming messages
-			//   Ephemeral consumers are meant to be used by a single instance of an application (e.g. to get its own replay of the messages in the stream)
-			// In both case, SubscribersCount should be set to 1 to avoid duplication
-			QueueGroupPrefix: "example",
-			SubscribersCount: 4, // how many goroutines should consume messages
-			CloseTimeout:     time.Minute,
-			// How long subscriber should wait for Ack/Nack. When no Ack/Nack was received, message will be redelivered.
-			AckWaitTimeout: time.Second * 30,
-			NatsOptions:    options,
-			Unmarshaler:    marshaler,
-			JetStream:      jsConfig,
+		// create or use a durable consumer named DURABLE_PREFIX ("my-durable" by default),
+		// DURABLE_PREFIXES overrides it for each subscriber
+		DurablePrefix: cfg.DurablePrefix,
+	}
+	publisherJSConfig := nats.JetStreamConfig{
+		Disabled:       false,
+		AutoProvision:  false,
+		ConnectOptions: []nc.JSOpt{
+			// the maximum outstanding async publishes that can be inflight at one time
+			// nc.PublishAsyncMaxPending(16384),
 		},
-		logger,
-	)
-	if err != nil {
-		panic(err)
-	}
-
-	subscriber2, err := nats.NewSubscriber(
-		nats.SubscriberConfig{
-			URL:              os.Getenv("NATS_URL"),
-			QueueGroupPrefix: "example",
-			SubscribersCount: 4,
-			CloseTimeout:     time.Minute,
-			AckWaitTimeout:   time.Second * 30,
-			NatsOptions:      options,
-			Unmarshaler:      marshaler,
-			JetStream:        jsConfig,
+		PublishOptions: nil,
+		// enable idempotent message writes by ignoring duplicate messages as indicated by the Nats-Msg-Id header
+		// DEDUP=true drops retried publishes of the same message within the stream's duplicate window
+		TrackMsgId: cfg.Dedup,
+	}
+	// JETSTREAM_ENABLED=false switches the publisher and both subscribers to core NATS
+	if cfg.JetStreamEnabled {
+		logger.Info("JetStream enabled: at-least-once delivery, messages are redelivered until acked", nil)
+	} else {
+		if err := validateCoreNATS(); err != nil {
+			log.Fatalf("invalid configuration: %v", err)
+		}
+		// core NATS has no consumers: durable names, MaxAckPending, ack policies and redelivery do not apply
+		jsConfig = nats.JetStreamConfig{Disabled: true}
+		publisherJSConfig = nats.JetStreamConfig{Disabled: true}
+		logger.Info("JetStream disabled: at-most-once delivery, messages are lost if no subscriber is connected and acks are no-ops", nil)
+	}
+
+	// wait for NATS to come up before creating any component, giving up after STARTUP_TIMEOUT
+	startupCtx, cancelStartup := context.WithTimeout(context.Background(), cfg.StartupTimeout)
+	err = waitForNATS(startupCtx, cfg.URL, cfg.clientName(options, "startup"), cfg.JetStreamEnabled, logger)
+	cancelStartup()
+	if err != nil {
+		log.Fatalf("NATS is unreachable after %s: %v", cfg.StartupTimeout, err)
+	}
+
+	subscriberConfig, err := loadSubscriberConfig(cfg, cfg.Marshaler, marshalers, options, jsConfig, logger)
+	if err != nil {
+		log.Fatalf("invalid subscriber configuration: %v", err)
+	}
+
+	// AUTO_PROVISION=true creates or updates the stream before anything uses it
+	streamConfig, err := loadStreamConfig()
+	if err != nil {
+		log.Fatalf("invalid stream configuration: %v", err)
+	}
+	// STREAM_REUSE_SUPERSET uses an existing stream capturing all of STREAM_SUBJECTS instead of failing
+	reuseStream, err := getEnvBool("STREAM_REUSE_SUPERSET", false)
+	if err != nil {
+		log.Fatalf("invalid stream configuration: %v", err)
+	}
+	// publishes finding no stream explain how to fix it, or provision it again when it was deleted
+	missing := &missingStream{logger: logger}
+	if streamConfig != nil {
+		if err := validateStreamConfig(streamConfig, jsConfig, subscriberConfig.QueueGroupPrefix); err != nil {
+			log.Fatalf("invalid stream configuration: %v", err)
+		}
+		// the failed messages are kept in a stream of their own, see DLQ_PREFIX
+		for _, stream := range []*nc.StreamConfig{streamConfig, deadLetterStream(streamConfig, cfg.DLQPrefix)} {
+			// with SHARDS, each shard has its own stream, with PRIORITY each priority
+			if priorities != nil {
+				missing.streams = append(missing.streams, priorities.streams(stream)...)
+			} else {
+				missing.streams = append(missing.streams, sharding.streams(stream)...)
+			}
+		}
+		missing.provision = func(stream *nc.StreamConfig) error {
+			return provisionStream(cfg.URL, cfg.clientName(options, "provisioner"), stream, reuseStream, logger)
+		}
+		for _, stream := range missing.streams {
+			if err := missing.provision(stream); err != nil {
+				log.Fatalf("cannot provision stream %s: %v", stream.Name, err)
+			}
+		}
+	}
+
+	// REPLAY_FROM reprocesses the stream from a timestamp or a sequence number, then exits
+	if cfg.ReplayFrom != "" {
+		start, err := replayStart("REPLAY_FROM", cfg.ReplayFrom)
+		if err != nil {
+			log.Fatalf("invalid replay: %v", err)
+		}
+		if !cfg.JetStreamEnabled {
+			log.Fatalf("invalid replay: REPLAY_FROM requires JetStream")
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		replayConfig := subscriberConfig
+		replayConfig.NatsOptions = cfg.clientName(options, "replay")
+		// REPLAY_SUBJECT replays a single filter subject instead of every pattern of SUBJECTS
+		replaySubjects := cfg.Subjects
+		if cfg.ReplaySubject != "" {
+			replaySubjects = []string{cfg.ReplaySubject}
+		}
+		replayed, err := replay(ctx, replayConfig, priorities.patterns(sharding.patterns(replaySubjects)), start, startSequence(cfg.ReplayFrom), cfg.ReplayUntilEnd, Chain(exampleRouter("replay").Process, traced, recovered(logger)), logger)
+		stop()
+		logger.Info("Replay finished", watermill.LogFields{"from": cfg.ReplayFrom, "replayed": replayed})
+		if err != nil {
+			log.Fatalf("replay failed: %v", err)
+		}
+		return
+	}
+
+	// MIGRATE_TARGET republishes the gob messages of SUBJECTS as JSON on "<MIGRATE_TARGET>.<subject>"
+	// until Ctrl+C, nothing else is consumed nor published
+	if cfg.MigrateTarget != "" {
+		jsonMarshaler, err := newMarshaler("json")
+		if err != nil {
+			log.Fatalf("invalid migration: %v", err)
+		}
+		pub, err := newPublisher(loadPublisherConfig(cfg, jsonMarshaler, cfg.clientName(options, "migrate-publisher"), publisherJSConfig), logger)
+		if err != nil {
+			log.Fatalf("cannot create migration publisher: %v", err)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		migrateConfig := subscriberConfig
+		migrateConfig.NatsOptions = cfg.clientName(options, "migrate")
+		migrated, err := migrate(ctx, migrateConfig, cfg.Subjects, cfg.MigrateTarget, pub, cfg.DLQPrefix, logger)
+		stop()
+		pub.Close()
+		logger.Info("Migration stopped", watermill.LogFields{"target": cfg.MigrateTarget, "migrated": migrated})
+		if err != nil {
+			log.Fatalf("migration failed: %v", err)
+		}
+		return
+	}
+
+	// EXPORT_FILE writes the messages of SUBJECTS stored from EXPORT_FROM to the end of the stream to a file, then exits
+	if cfg.ExportFile != "" {
+		start, err := exportStart(cfg.ExportFrom)
+		if err != nil {
+			log.Fatalf("invalid export: %v", err)
+		}
+		if !cfg.JetStreamEnabled {
+			log.Fatalf("invalid export: EXPORT_FILE requires JetStream")
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		exportConfig := subscriberConfig
+		exportConfig.NatsOptions = cfg.clientName(options, "export")
+		exported, err := exportStream(ctx, exportConfig, priorities.patterns(sharding.patterns(cfg.Subjects)), start, startSequence(cfg.ExportFrom), cfg.ExportFile, logger)
+		stop()
+		logger.Info("Export finished", watermill.LogFields{"file": cfg.ExportFile, "exported": exported})
+		if err != nil {
+			log.Fatalf("export failed: %v", err)
+		}
+		return
+	}
+
+	// IMPORT_FILE republishes the messages of a file written with EXPORT_FILE to their subjects, then exits
+	if cfg.ImportFile != "" {
+		pub, err := newPublisher(loadPublisherConfig(cfg, marshaler, cfg.clientName(options, "import-publisher"), publisherJSConfig), logger)
+		if err != nil {
+			log.Fatalf("cannot create import publisher: %v", err)
+		}
+		imported, err := importFile(cfg.ImportFile, pub)
+		pub.Close()
+		logger.Info("Import finished", watermill.LogFields{"file": cfg.ImportFile, "imported": imported})
+		if err != nil {
+			log.Fatalf("import failed: %v", err)
+		}
+		return
+	}
+
+	// DELIVERY_MODES_FILE maps subject patterns to at-least-once (JetStream) or at-most-once (core NATS)
+	routes, err := loadDeliveryRoutes(cfg.Subjects, cfg.JetStreamEnabled)
+	if err != nil {
+		log.Fatalf("invalid delivery modes: %v", err)
+	}
+
+	// every pattern is consumed by two subscribers sharing the queue group,
+	// or by a single one in ordered and ephemeral modes, which have no queue group
+	subscribersPerRoute := 2
+	if cfg.Ordered || cfg.Ephemeral {
+		subscribersPerRoute = 1
+	}
+	if cfg.Ephemeral && cfg.SubscribersCount != 1 {
+		logger.Info("EPHEMERAL=true requires SUBSCRIBERS_COUNT=1, each goroutine of an ephemeral consumer would receive every message", watermill.LogFields{
+			"subscribers_count": cfg.SubscribersCount,
+		})
+	}
+	// SCALE_MAX bounds how many subscribers per pattern POST /scale may run,
+	// subscribers without a queue group would each receive every message
+	scale := &scaler{max: cfg.ScaleMax}
+	if subscriberConfig.QueueGroupPrefix == "" {
+		scale.max = 1
+	}
+	var subscribers []*subscriber
+	var consumers []durableConsumer
+	var bindings []durableBinding
+	seen := make(map[string]bool)
+	clients := 0
+	for _, route := range routes {
+		route := route
+		// with SHARDS, every pattern is consumed on each shard, with PRIORITY with each priority
+		patterns := priorities.patterns(sharding.patterns(route.Patterns))
+		routeConfig := subscriberConfig
+		// at-most-once routes and ACK_POLICY=none have no redelivery: Ack and Nack do nothing
+		noAcks := route.Mode == atMostOnce || cfg.AckPolicy == ackNone
+		if noAcks {
+			routeConfig.Unmarshaler = coreUnmarshaler{routeConfig.Unmarshaler}
+		}
+		if route.Mode == atMostOnce {
+			// no durable consumer
+			routeConfig.JetStream = nats.JetStreamConfig{Disabled: true}
+		} else if len(routes) > 1 || len(patterns) > 1 {
+			// each at-least-once pattern needs its own durable consumer
+			routeConfig.JetStream.DurableCalculator = durableName
+		}
+		// create builds the i-th subscriber of the route, at startup and when scaling up
+		create := func(i int) (*subscriber, error) {
+			name := fmt.Sprintf("subscriber%d", i)
+			if len(routes) > 1 {
+				name = fmt.Sprintf("subscriber%d[%s]", i, strings.Join(route.Patterns, ","))
+			}
+			clients++
+			config := routeConfig
+			config.NatsOptions = cfg.clientName(options, fmt.Sprintf("subscriber-%d", clients))
+			if !config.JetStream.Disabled {
+				config.JetStream.DurablePrefix = cfg.durablePrefix(i)
+			}
+			if kind := cfg.subscriberMarshaler(i); kind != cfg.Marshaler {
+				unmarshaler, err := marshalers.unmarshaler(kind)
+				if err != nil {
+					return nil, fmt.Errorf("cannot create %s: %w", name, err)
+				}
+				if noAcks {
+					unmarshaler = coreUnmarshaler{unmarshaler}
+				}
+				config.Unmarshaler = unmarshaler
+			}
+
+			sub, err := newSubscriber(config, logger)
+			if err != nil {
+				return nil, fmt.Errorf("cannot create %s: %w", name, err)
+			}
+			sub.name, sub.topics, sub.ackWait = name, patterns, cfg.AckWaitTimeout
+			sub.prioritized = priorities != nil
+			return sub, nil
+		}
+
+		var routeSubscribers []*subscriber
+		for i := 1; i <= subscribersPerRoute; i++ {
+			sub, err := create(i)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !routeConfig.JetStream.Disabled {
+				durables := routeConfig.JetStream
+				durables.DurablePrefix = cfg.durablePrefix(i)
+				for _, pattern := range patterns {
+					binding := newDurableBinding(sub.name, durables.CalculateDurableName(pattern), routeConfig.QueueGroupPrefix)
+					bindings = append(bindings, binding)
+					if binding.durable != "" && !seen[binding.durable] {
+						seen[binding.durable] = true
+						consumers = append(consumers, durableConsumer{subject: pattern, durable: binding.durable})
+					}
+				}
+			}
+			routeSubscribers = append(routeSubscribers, sub)
+		}
+		subscribers = append(subscribers, routeSubscribers...)
+		scale.add(create, routeSubscribers)
+	}
+
+	// subscribers sharing a durable consumer have to share its queue group too
+	if collisions := durableCollisions(bindings); len(collisions) > 0 {
+		if cfg.DurableCollision == "error" {
+			log.Fatalf("durable name collision: %s", strings.Join(collisions, "; "))
+		}
+		for _, collision := range collisions {
+			logger.Info("Durable name collision: "+collision, nil)
+		}
+	}
+
+	// publishing uses the delivery mode of the subject, one publisher per mode,
+	// MIRROR_NATS_URL adds one per mode on the second cluster
+	publishers := make(map[deliveryMode]*publisher)
+	mirrors := make(map[deliveryMode]*publisher)
+	for _, route := range routes {
+		if _, ok := publishers[route.Mode]; ok {
+			continue
+		}
+		pubJSConfig := publisherJSConfig
+		if route.Mode == atMostOnce {
+			pubJSConfig = nats.JetStreamConfig{Disabled: true}
+		}
+		pubOptions := cfg.clientName(options, "publisher")
+		if len(routes) > 1 {
+			pubOptions = cfg.clientName(options, "publisher-"+string(route.Mode))
+		}
+		pub, err := newPublisher(loadPublisherConfig(cfg, marshaler, pubOptions, pubJSConfig), logger)
+		if err != nil {
+			log.Fatalf("cannot create %s publisher: %v", route.Mode, err)
+		}
+		if route.Mode == atMostOnce {
+			// FLUSH_EVERY bounds how many core NATS publishes a crash may lose
+			pub.flushEvery = int64(cfg.FlushEvery)
+		}
+		publishers[route.Mode] = pub
+		if cfg.MirrorURL != "" {
+			config := loadPublisherConfig(cfg, marshaler, cfg.clientName(options, "mirror-"+string(route.Mode)), pubJSConfig)
+			config.URL = cfg.MirrorURL
+			if mirrors[route.Mode], err = newPublisher(config, logger); err != nil {
+				log.Fatalf("cannot create %s mirror publisher: %v", route.Mode, err)
+			}
+			mirrors[route.Mode].flushEvery = pub.flushEvery
+		}
+	}
+	// publisherFor returns the publisher matching the delivery mode of topic,
+	// subjects matching no pattern use the mode of the first one
+	modeFor := func(topic string) deliveryMode {
+		if mode, ok := deliveryModeOf(routes, topic); ok {
+			return mode
+		}
+		return routes[0].Mode
+	}
+	publisherFor := func(topic string) *publisher {
+		return publishers[modeFor(topic)]
+	}
+	// mirroredFor also publishes to the mirror publisher of the delivery mode of topic, if any
+	mirroredFor := func(topic string) Publisher {
+		mirror, ok := mirrors[modeFor(topic)]
+		if !ok {
+			return publisherFor(topic)
+		}
+		return multiPublisher{publishers: []Publisher{publisherFor(topic), mirror}, logger: logger}
+	}
+
+	// without MAX_PAYLOAD, the limit advertised by the server applies
+	marshalers.useServerLimit(publishers[routes[0].Mode].Conn())
+
+	// malformed messages are moved with the publisher of the first delivery mode
+	if err := marshalers.publishWith(publishers[routes[0].Mode].Conn(), routes[0].Mode == atLeastOnce); err != nil {
+		log.Fatalf("cannot publish malformed messages: %v", err)
+	}
+
+	// SYNC_PUBLISH_SUBJECTS are published with PublishSync, which waits for the stream to store them
+	var syncPub *syncPublisher
+	if len(cfg.SyncPublishSubjects) > 0 {
+		pub, ok := publishers[atLeastOnce]
+		if !ok {
+			log.Fatalf("invalid configuration: SYNC_PUBLISH_SUBJECTS requires an at-least-once (JetStream) delivery mode")
+		}
+		if syncPub, err = newSyncPublisher(pub.Conn(), marshaler, publisherJSConfig); err != nil {
+			log.Fatalf("cannot create sync publisher: %v", err)
+		}
+	}
+
+	// IDEMPOTENCY_BUCKET skips the messages already processed, for longer than the dedup window
+	idempotency, err := newIdempotencyStore(cfg.URL, cfg.clientName(options, "idempotency"), logger)
+	if err != nil {
+		log.Fatalf("cannot create idempotency store: %v", err)
+	}
+
+	// METRICS_ADDR is where Prometheus metrics are served on /metrics,
+	// METRICS_SUBJECT_DEPTH bounds the number of subject labels
+	metrics.SetSubjectDepth(cfg.MetricsSubjectDepth)
+	metricsServer := metrics.Serve(cfg.MetricsAddr, cfg.MetricsFinalScrape, logger)
+
+	// LAG_SCRAPE_INTERVAL is how often the consumer lag gauges are refreshed, 0 disables them
+	lagWatcher := closerFunc(func() error { return nil })
+	if cfg.LagScrapeInterval > 0 && len(consumers) > 0 {
+		if lagWatcher, err = watchLag(cfg.URL, cfg.clientName(options, "lag"), consumers, cfg.LagScrapeInterval, logger); err != nil {
+			log.Fatalf("cannot watch consumer lag: %v", err)
+		}
+	}
+
+	// HEALTH_ADDR is where the /healthz and /readyz probes are served
+	healthServer := serveHealth(cfg.HealthAddr, func() map[string]*nc.Conn {
+		// the subscribers change when scaling
+		conns := scale.conns()
+		for mode, pub := range publishers {
+			conns["publisher["+string(mode)+"]"] = pub.Conn()
+		}
+		return conns
+	}, logger)
+
+	// CONTROL_ADDR is where processing is paused and resumed with POST /pause and POST /resume,
+	// the subscribers scaled with POST /scale?count=N, the streams inspected under /admin
+	// and the lag read by an autoscaler with GET /scaler
+	// its hooks keep an audit trail of the outcome of every message, at debug level
+	sup := &supervisor{
+		OnAck: func(msg *message.Message) {
+			logger.Debug("Message acked", watermill.LogFields{"message_uuid": msg.UUID, "subject": msg.Metadata.Get(subjectKey)})
 		},
-		logger,
-	)
-	if err != nil {
-		panic(err)
-	}
-
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		fmt.Println("\r- Ctrl+C pressed in Terminal - closing subscriber")
-		subscriber1.Close()
-		subscriber2.Close()
-		os.Exit(0)
-	}()
-
-	messages1, err := subscriber1.Subscribe(context.Background(), "example_topic.>")
-	if err != nil {
-		panic(err)
-	}
-	go processJS(messages1, "subscriber1")
-
-	messages2, err := subscriber2.Subscribe(context.Background(), "example_topic.>")
-	if err != nil {
-		panic(err)
-	}
-	go processJS(messages2, "subscriber2")
-
-	publisher, err := nats.NewPublisher(
-		nats.PublisherConfig{
-			URL:         os.Getenv("NATS_URL"),
-			NatsOptions: options,
-			Marshaler:   marshaler,
-			JetStream: nats.JetStreamConfig{
-				Disabled:       false,
-				AutoProvision:  false,
-				ConnectOptions: []nc.JSOpt{
-					// the maximum outstanding async publishes that can be inflight at one time
-					// nc.PublishAsyncMaxPending(16384),
-				},
-				PublishOptions: nil,
-				// enable idempotent message writes by ignoring duplicate messages as indicated by the Nats-Msg-Id header
-				TrackMsgId: false,
-			},
+		OnNack: func(msg *message.Message, err error) {
+			logger.Debug("Message nacked", watermill.LogFields{"message_uuid": msg.UUID, "subject": msg.Metadata.Get(subjectKey), "error": err.Error()})
 		},
-		logger,
-	)
+	}
+	// ADMIN_TOKEN enables GET /admin/streams and GET /admin/consumers, and GET /scaler reports the
+	// consumer lag to KEDA, both over the connection of the publisher
+	var adminEndpoints *admin
+	var lagEndpoint *lagScaler
+	if cfg.JetStreamEnabled {
+		js, err := publishers[routes[0].Mode].Conn().JetStream()
+		if err != nil {
+			log.Fatalf("cannot serve the JetStream endpoints: %v", err)
+		}
+		if cfg.AdminToken != "" {
+			adminEndpoints = &admin{js: js, token: cfg.AdminToken, logger: logger}
+		}
+		if len(consumers) > 0 {
+			lagEndpoint = &lagScaler{js: js, consumers: consumers, metric: cfg.ScalerMetric, logger: logger}
+		}
+	}
+	controlServer := serveControl(cfg.ControlAddr, cfg.AdminToken, sup, scale, adminEndpoints, lagEndpoint, logger)
+
+	// messages that keep failing are moved to "<DLQ_PREFIX>.<subject>"
+	dlq := handleWithDLQ(publishers[routes[0].Mode], cfg.DLQPrefix, logger)
+
+	// ctx is cancelled on Ctrl+C or SIGTERM, which stops the publish loop below immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// FILTER skips the messages whose metadata does not match, they are acked unprocessed
+	filter, err := loadFilter()
+	if err != nil {
+		log.Fatalf("invalid filter: %v", err)
+	}
+	// SUBJECT_TEMPLATES sets named subject tokens as metadata, e.g. type=a out of example_topic.a.test
+	templates, err := loadSubjectTemplates()
 	if err != nil {
-		panic(err)
+		log.Fatalf("invalid subject templates: %v", err)
 	}
 
-	i := 0
-	var id string
-	for {
-		id = strconv.Itoa(i)
-		msgA := message.NewMessage(id, []byte("hello from a"))
-		msgB := message.NewMessage(id, []byte("hello from b"))
-		msgATest := message.NewMessage(id, []byte("hello from a.test"))
-		msgBTest := message.NewMessage(id, []byte("hello from b.test"))
+	// RATE_LIMIT caps how many messages per second each subscriber processes
+	if _, err := newRateLimiter(); err != nil {
+		log.Fatalf("invalid rate limit: %v", err)
+	}
+
+	// DUPLICATE_CACHE_SIZE remembers the UUIDs processed by every subscriber of the process
+	recent := newRecentUUIDs(cfg.DuplicateCacheSize)
+
+	// VERIFY_ORDER stamps every published message with a sequence per subject
+	// and reports the messages consumed out of order
+	verifier := newOrderVerifier(cfg.VerifyOrder, logger)
+
+	// HANDLER_CONCURRENCY caps how many messages each subscriber processes at once,
+	// independently of the SUBSCRIBERS_COUNT goroutines fetching them
+	scale.start = func(sub *subscriber) error {
+		limiter, err := newRateLimiter()
+		if err != nil {
+			return err
+		}
+
+		// the messages of every subject of the subscriber go through the same handler
+		messages, err := sub.subscribeAll(context.Background(), cfg.SubscribeBufferSize)
+		if err != nil {
+			return err
+		}
+		handlers.Add(1)
+		go runHandler(messages, Chain(exampleRouter(sub.name).Process,
+			sup.gate,
+			// ACK_EXTENSIONS keeps slow handlers from having their message redelivered meanwhile
+			sub.WithAckExtension(cfg.AckExtensions),
+			correlated(logger),
+			timed(logger),
+			// the extracted tokens can be matched by FILTER
+			extractTokens(templates),
+			filtered(filter),
+			// EXPIRY_CHECK acks the messages past their Expires-At time unprocessed
+			skipExpired(cfg.ExpiryCheck, logger),
+			instrument(strings.Join(sub.topics, ","), sub.name),
+			sub.track,
+			verifier.verify,
+			recent.skipDuplicates(logger),
+			idempotency.idempotent(logger),
+			rateLimited(limiter),
+			traced,
+			dlq,
+			// handler errors are counted before the DLQ acks the dead-lettered messages
+			sub.countFailures,
+			// HANDLER_TIMEOUT nacks the messages of hanging handlers, which then go through the DLQ like any failure
+			handlerTimeout(cfg.HandlerTimeout, logger),
+			// panics are handled like errors by the middlewares above: nacked, counted and dead-lettered
+			recovered(logger),
+		), cfg.HandlerConcurrency, subscriberConfig.AckWaitTimeout)
+		return nil
+	}
+	// DRY_RUN connects the subscribers, which validates the configuration, but consumes nothing
+	if cfg.DryRun {
+		scale.start = func(sub *subscriber) error {
+			logger.Info("Dry run, not consuming", watermill.LogFields{"subscriber": sub.name, "topics": sub.topics})
+			return nil
+		}
+	}
+	for _, sub := range subscribers {
+		if err := scale.start(sub); err != nil {
+			log.Fatalf("cannot subscribe %s: %v", sub.name, err)
+		}
+	}
+
+	// PUBLISH_RETRY_ATTEMPTS publishes again the messages failing on a transient error
+	publishRetries, err := loadPublishRetry(cfg.Dedup, logger)
+	if err != nil {
+		log.Fatalf("invalid publish retry: %v", err)
+	}
+
+	// PUBLISH_QUOTAS bounds the messages and bytes published per second per subject prefix
+	quotas, err := loadPublishQuotas()
+	if err != nil {
+		log.Fatalf("invalid publish quotas: %v", err)
+	}
 
-		if err := publisher.Publish("example_topic.a", msgA); err != nil {
-			panic(err)
+	// publish sends msg with the publisher of its subject
+	publish := func(ctx context.Context, topic string, msg *message.Message) error {
+		if err := quotas.admit(topic, msg); err != nil {
+			return err
 		}
-		if err := publisher.Publish("example_topic.b", msgB); err != nil {
-			panic(err)
+		verifier.stamp(topic, msg)
+		// MESSAGE_TTL gives the messages without an expiry one
+		if _, ok := expiresAt(msg); !ok && cfg.MessageTTL > 0 {
+			SetExpiry(msg, time.Now().Add(cfg.MessageTTL))
 		}
+		send := func() error {
+			// DRY_RUN logs the messages without touching NATS
+			if cfg.DryRun {
+				return dryRunPublisher{logger}.Publish(topic, msg)
+			}
+			// an outage pauses publishing until the connection is back
+			if err := gate.wait(ctx, publisherFor(topic).Conn(), topic, msg); err != nil {
+				return err
+			}
+			if syncPub == nil || !matchesAny(cfg.SyncPublishSubjects, topic) {
+				return publishWithTimeout(ctx, mirroredFor(topic), topic, msg, cfg.PublishTimeout)
+			}
+			if err := syncPub.PublishSync(topic, withCorrelationID(ctx, msg)); err != nil {
+				return err
+			}
+			logger.Debug("Publish confirmed", watermill.LogFields{
+				"topic":    topic,
+				"stream":   msg.Metadata.Get(streamKey),
+				"sequence": msg.Metadata.Get(streamSequenceKey),
+			})
+			return nil
+		}
+		err := publishRetries.publish(ctx, topic, msg, send)
+		if errors.Is(err, ErrStreamNotFound) {
+			err = missing.recover(priorities.subject(msg, sharding.subject(topic)), err, send)
+		}
+		if errors.Is(err, errPublishDropped) {
+			// counted by the gate, the publish loop goes on
+			return nil
+		}
+		// nothing is handed to NATS in a dry run
+		if err == nil && !cfg.DryRun {
+			metrics.Published.WithLabelValues(metrics.Subject(topic)).Inc()
+		}
+		return err
+	}
 
-		if err := publisher.Publish("example_topic.a.test", msgATest); err != nil {
-			panic(err)
+	// LOADTEST=true replaces the publish loop with random payloads at a fixed rate, then shuts down
+	loadTest, err := loadLoadTest()
+	if err != nil {
+		log.Fatalf("invalid load test: %v", err)
+	}
+	if loadTest != nil {
+		// LOADTEST_BATCH_SIZE publishes straight to JetStream with PublishBatch, waiting for the acks of a batch together
+		var batches *batchPublisher
+		if loadTest.batchSize > 1 {
+			pub, ok := publishers[atLeastOnce]
+			if !ok || cfg.DryRun {
+				log.Fatalf("invalid load test: LOADTEST_BATCH_SIZE requires an at-least-once (JetStream) delivery mode and no DRY_RUN")
+			}
+			if batches, err = newBatchPublisher(pub.Conn(), marshaler, publisherJSConfig, loadTest.maxPending, cfg.PublishTimeout); err != nil {
+				log.Fatalf("cannot create batch publisher: %v", err)
+			}
 		}
-		if err := publisher.Publish("example_topic.b.test", msgBTest); err != nil {
-			panic(err)
+		loadTest.run(ctx, publishTopics, publish, func(topic string, msgs []*message.Message) error {
+			_, err := batches.PublishBatch(topic, msgs)
+			return err
+		}).print()
+		// the acks of batches that timed out may still be on their way, wait for them before closing
+		if batches != nil {
+			flushCtx, cancel := context.WithTimeout(context.Background(), cfg.PublishTimeout)
+			if err := batches.FlushPending(flushCtx); err != nil {
+				log.Printf("load test: %v", err)
+			}
+			cancel()
 		}
+	}
+
+	if loadTest == nil {
+		// the example loop sends every message through publish, bound to the application context
+		examples := publisherFunc(func(topic string, msg *message.Message) error {
+			return publish(ctx, topic, msg)
+		})
+		if err := publishExamples(ctx, examples, publishTopics, time.Second); err != nil {
+			log.Fatalf("cannot publish: %v", err)
+		}
+	}
 
-		time.Sleep(time.Second)
-		i++
+	log.Println("shutting down: draining subscribers, then closing publisher")
+	// components are closed in reverse order: the subscribers are drained while the publishers
+	// still dead-letter their failed messages, and metrics and probes stay available until they are gone
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	closers := []io.Closer{tracing, healthServer, controlServer, metricsServer}
+	// the idempotency store records the messages the subscribers finish while draining
+	if idempotency != nil {
+		closers = append(closers, idempotency)
+	}
+	// publishers are closed in turn, their Flush does not make them flushers kept for last
+	for _, pub := range publishers {
+		closers = append(closers, closerFunc(pub.Close))
+	}
+	for _, mirror := range mirrors {
+		closers = append(closers, closerFunc(mirror.Close))
+	}
+	// the scaler drains the subscribers running at that time, before the publishers
+	// their handlers dead-letter and mirror messages through are closed
+	closers = append(closers, scale)
+	// the lag watcher is stopped first, it reads consumers that are about to be drained
+	closers = append(closers, lagWatcher)
+	// paused handlers would hold their messages until the drain times out
+	sup.Resume()
+	err = shutdown(shutdownCtx, closers...)
+	if cfg.VerifyOrder {
+		log.Printf("order verification: %d messages consumed out of order", verifier.Violations())
+	}
+	if err != nil {
+		log.Printf("shutdown failed: %v", err)
+		cancel()
+		os.Exit(1)
 	}
 }
 
-func processJS(messages <-chan *message.Message, from string) {
-	for msg := range messages {
-		log.Printf("[%s] received message: %s, payload: %s", from, msg.UUID, string(msg.Payload))
+// exampleRouter routes the ".a" and ".b" subjects to their own handlers, which log the messages
+// under "<from>/a" and "<from>/b", the other subjects to the fallback logging under from.
+// This is where subject-specific processing is plugged in
+func exampleRouter(from string) *Router {
+	router, err := newExampleRouter(logMessage(from+"/a"), logMessage(from+"/b"), logMessage(from))
+	if err != nil {
+		log.Fatalf("invalid route: %v", err)
+	}
+	return router
+}
 
-		// we need to Acknowledge that we received and processed the message,
-		// otherwise, it will be resent over and over again.
-		msg.Ack()
+// newExampleRouter routes example_topic.a and its sub-subjects to a, example_topic.b and its
+// sub-subjects to b, and the other subjects to fallback
+func newExampleRouter(a, b, fallback Handler) (*Router, error) {
+	router := NewRouter(fallback)
+	routes := []struct {
+		pattern string
+		h       Handler
+	}{
+		{"example_topic.a", a},
+		{"example_topic.a.>", a},
+		{"example_topic.b", b},
+		{"example_topic.b.>", b},
+	}
+	for _, r := range routes {
+		if err := router.Handle(r.pattern, r.h); err != nil {
+			return nil, err
+		}
 	}
+	return router, nil
 }
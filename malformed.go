@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+// unmarshalPolicy is what happens to a message that cannot be unmarshaled, set by ON_UNMARSHAL_ERROR
+type unmarshalPolicy string
+
+const (
+	// unmarshalNack nacks the message, it is redelivered up to MaxDeliver times
+	unmarshalNack unmarshalPolicy = "nack"
+	// unmarshalDrop acks the message without processing it
+	unmarshalDrop unmarshalPolicy = "drop"
+	// unmarshalDLQ moves the raw message to "<dlqPrefix>.malformed.<subject>" and acks it
+	unmarshalDLQ unmarshalPolicy = "dlq"
+)
+
+const (
+	// malformedToken follows the dead-letter prefix in the subject of the messages moved by unmarshalDLQ.
+	// The dead-letter prefix is outside SUBJECTS, so the moved messages are not consumed again
+	malformedToken = "malformed"
+	// unmarshalErrorKey is the header holding the decode error of a malformed message
+	unmarshalErrorKey = "Unmarshal-Error"
+)
+
+// malformedUnmarshaler applies its policy to the messages the wrapped unmarshaler fails to
+// decode. watermill only logs these failures and never acks the message, so without it a
+// malformed message is redelivered every AckWait until MaxDeliver is reached
+type malformedUnmarshaler struct {
+	nats.MarshalerUnmarshaler
+	policy unmarshalPolicy
+	// dlqPrefix starts the subjects the dlq policy moves malformed messages to
+	dlqPrefix string
+	// publish sends a malformed message with the dlq policy, it is set by publishWith
+	publish func(*nc.Msg) error
+}
+
+// withUnmarshalPolicy wraps m to handle its unmarshal failures according to policy,
+// which is one of nack (default), drop or dlq. The dlq policy moves them under dlqPrefix
+func withUnmarshalPolicy(m nats.MarshalerUnmarshaler, policy, dlqPrefix string) (*malformedUnmarshaler, error) {
+	switch p := unmarshalPolicy(policy); p {
+	case "":
+		return &malformedUnmarshaler{MarshalerUnmarshaler: m, policy: unmarshalNack, dlqPrefix: dlqPrefix}, nil
+	case unmarshalNack, unmarshalDrop, unmarshalDLQ:
+		return &malformedUnmarshaler{MarshalerUnmarshaler: m, policy: p, dlqPrefix: dlqPrefix}, nil
+	default:
+		return nil, fmt.Errorf("unknown ON_UNMARSHAL_ERROR %q, expected one of nack, drop, dlq", policy)
+	}
+}
+
+// publishWith makes the dlq policy publish on conn, through JetStream when jetStream is set.
+// It must be called before subscribing
+func (m *malformedUnmarshaler) publishWith(conn *nc.Conn, jetStream bool) error {
+	if !jetStream {
+		m.publish = conn.PublishMsg
+		return nil
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		return err
+	}
+	m.publish = func(msg *nc.Msg) error {
+		_, err := js.PublishMsg(msg)
+		return err
+	}
+	return nil
+}
+
+func (m *malformedUnmarshaler) Unmarshal(natsMsg *nc.Msg) (*message.Message, error) {
+	msg, err := m.MarshalerUnmarshaler.Unmarshal(natsMsg)
+	if err == nil {
+		return msg, nil
+	}
+	err = fmt.Errorf("%w: %w", ErrMarshal, err)
+
+	switch m.policy {
+	case unmarshalDrop:
+		m.settle(natsMsg, true)
+	case unmarshalDLQ:
+		if pubErr := m.forward(natsMsg, err); pubErr != nil {
+			// keep the message, it is redelivered until it can be moved
+			m.settle(natsMsg, false)
+			return nil, fmt.Errorf("%w, cannot move it to %s: %v", err, m.malformedSubject(natsMsg.Subject), pubErr)
+		}
+		m.settle(natsMsg, true)
+	default:
+		m.settle(natsMsg, false)
+	}
+	return nil, err
+}
+
+// settle acks or nacks natsMsg. Core NATS messages have nothing to settle,
+// their reply subject belongs to the requester
+func (m *malformedUnmarshaler) settle(natsMsg *nc.Msg, ack bool) {
+	if _, err := natsMsg.Metadata(); err != nil {
+		return
+	}
+	if ack {
+		_ = natsMsg.Ack()
+	} else {
+		_ = natsMsg.Nak()
+	}
+}
+
+// malformedSubject is where the dlq policy moves the malformed messages of subject
+func (m *malformedUnmarshaler) malformedSubject(subject string) string {
+	return m.dlqPrefix + "." + malformedToken + "." + subject
+}
+
+// forward publishes the raw body and headers of natsMsg to "<dlqPrefix>.malformed.<subject>",
+// with the decode error in the Unmarshal-Error header. Nats-Msg-Id is left out: the stream of
+// the moved messages would drop it as a duplicate of another message sharing the UUID
+func (m *malformedUnmarshaler) forward(natsMsg *nc.Msg, decodeErr error) error {
+	if m.publish == nil {
+		return fmt.Errorf("%w: no publisher for malformed messages", ErrConnection)
+	}
+	out := nc.NewMsg(m.malformedSubject(natsMsg.Subject))
+	out.Data = natsMsg.Data
+	for key, values := range natsMsg.Header {
+		if key == nc.MsgIdHdr {
+			continue
+		}
+		out.Header[key] = append([]string(nil), values...)
+	}
+	out.Header.Set(unmarshalErrorKey, decodeErr.Error())
+	return m.publish(out)
+}
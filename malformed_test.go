@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	nc "github.com/nats-io/nats.go"
+)
+
+// deliverMalformed publishes a body gob cannot decode to subject and returns its delivery
+func deliverMalformed(t *testing.T, js nc.JetStreamContext, subject string) (*nc.Subscription, *nc.Msg) {
+	t.Helper()
+	out := nc.NewMsg(subject)
+	out.Data = []byte("not gob")
+	out.Header.Set(nc.MsgIdHdr, "malformed-1")
+	out.Header.Set("Trace", "kept")
+	if _, err := js.PublishMsg(out); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := js.SubscribeSync(subject, nc.ManualAck(), nc.AckWait(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sub.Unsubscribe() })
+	msg, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub, msg
+}
+
+func newMalformedUnmarshaler(t *testing.T, policy string, conn *nc.Conn) *malformedUnmarshaler {
+	t.Helper()
+	gob, err := newMarshaler("gob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := withUnmarshalPolicy(gob, policy, "dlq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.publishWith(conn, true); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestUnmarshalPolicyDLQ(t *testing.T) {
+	conn := connect(t, runServer(t, true))
+	js := addStream(t, conn, "events", "events.>")
+	addStream(t, conn, "events_dlq", "dlq.>")
+	m := newMalformedUnmarshaler(t, "dlq", conn)
+
+	sub, msg := deliverMalformed(t, js, "events.a")
+	if _, err := m.Unmarshal(msg); !errors.Is(err, ErrMarshal) {
+		t.Fatalf("err = %v, want ErrMarshal", err)
+	}
+
+	moved, err := js.GetLastMsg("events_dlq", "dlq.malformed.events.a")
+	if err != nil {
+		t.Fatalf("malformed message not moved: %v", err)
+	}
+	if string(moved.Data) != "not gob" {
+		t.Errorf("moved body = %q", moved.Data)
+	}
+	if moved.Header.Get(unmarshalErrorKey) == "" {
+		t.Error("the decode error is missing")
+	}
+	if moved.Header.Get("Trace") != "kept" {
+		t.Error("the headers of the message were not kept")
+	}
+	if id := moved.Header.Get(nc.MsgIdHdr); id != "" {
+		t.Errorf("%s = %q was forwarded", nc.MsgIdHdr, id)
+	}
+	// the moved message is outside the subjects of the original stream
+	if info, err := js.StreamInfo("events"); err != nil || info.State.Msgs != 1 {
+		t.Errorf("events stream = %+v, %v, want only the original message", info, err)
+	}
+	assertSettled(t, sub)
+}
+
+func TestUnmarshalPolicyDrop(t *testing.T) {
+	conn := connect(t, runServer(t, true))
+	js := addStream(t, conn, "events", "events.>")
+	m := newMalformedUnmarshaler(t, "drop", conn)
+
+	sub, msg := deliverMalformed(t, js, "events.a")
+	if _, err := m.Unmarshal(msg); !errors.Is(err, ErrMarshal) {
+		t.Fatalf("err = %v, want ErrMarshal", err)
+	}
+	assertSettled(t, sub)
+}
+
+func TestUnmarshalPolicyNack(t *testing.T) {
+	conn := connect(t, runServer(t, true))
+	js := addStream(t, conn, "events", "events.>")
+	m := newMalformedUnmarshaler(t, "", conn)
+
+	sub, msg := deliverMalformed(t, js, "events.a")
+	if _, err := m.Unmarshal(msg); !errors.Is(err, ErrMarshal) {
+		t.Fatalf("err = %v, want ErrMarshal", err)
+	}
+	redelivered, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("nacked message not redelivered: %v", err)
+	}
+	if meta, err := redelivered.Metadata(); err != nil || meta.NumDelivered != 2 {
+		t.Errorf("metadata = %+v, %v, want a second delivery", meta, err)
+	}
+}
+
+func TestUnmarshalPolicyRejectsUnknown(t *testing.T) {
+	gob, err := newMarshaler("gob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := withUnmarshalPolicy(gob, "retry", "dlq"); err == nil {
+		t.Error("an unknown policy was accepted")
+	}
+}
+
+// assertSettled fails when the consumer of sub still waits for an ack
+func assertSettled(t *testing.T, sub *nc.Subscription) {
+	t.Helper()
+	// acks are sent asynchronously, the consumer info may lag behind
+	deadline := time.Now().Add(time.Second)
+	for {
+		info, err := sub.ConsumerInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.NumAckPending == 0 && info.NumRedelivered == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("message not acked: %d pending", info.NumAckPending)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
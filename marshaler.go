@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+const (
+	// subjectKey is the metadata key holding the subject a message was delivered on
+	subjectKey = "Nats-Delivered-Subject"
+	// numDeliveredKey is the metadata key holding how many times JetStream delivered a message
+	numDeliveredKey = "Nats-Num-Delivered"
+	// numPendingKey is the metadata key holding how many messages the JetStream consumer has left to deliver
+	numPendingKey = "Nats-Num-Pending"
+	// ackSubjectKey is the metadata key holding the subject a JetStream message is acked on
+	ackSubjectKey = "Nats-Ack-Subject"
+	// replySubjectKey is the metadata key holding the reply subject of a core NATS request
+	replySubjectKey = "Nats-Reply-Subject"
+	// shardKey is the metadata key holding the shard a message was sent on, see sharding
+	shardKey = "Nats-Shard"
+	// streamKey and streamSequenceKey are the metadata keys holding where PublishSync or PublishBatch stored a message
+	streamKey         = "Nats-Stream"
+	streamSequenceKey = "Nats-Stream-Sequence"
+)
+
+// marshalers holds the wire formats newMarshaler can select, by name
+var marshalers = struct {
+	sync.RWMutex
+	byName map[string]nats.MarshalerUnmarshaler
+}{byName: map[string]nats.MarshalerUnmarshaler{
+	"nats":  &nats.NATSMarshaler{},
+	"gob":   nats.GobMarshaler{},
+	"json":  nats.JSONMarshaler{},
+	"proto": ProtoMarshaler{},
+}}
+
+// RegisterMarshaler makes a custom wire format (Avro, MessagePack...) selectable with MARSHALER=name.
+// m both marshals and unmarshals, so the publisher and the subscribers agree on the format.
+// Registering an existing name replaces it; it is safe to call concurrently with newMarshaler
+func RegisterMarshaler(name string, m nats.MarshalerUnmarshaler) {
+	marshalers.Lock()
+	defer marshalers.Unlock()
+	marshalers.byName[name] = m
+}
+
+// newMarshaler returns the wire format registered as kind. The same value is used
+// as the publisher's Marshaler and the subscribers' Unmarshaler, so both sides
+// always agree on the format
+//   - nats (default): payload as the NATS body, UUID and metadata as NATS headers
+//   - gob: the whole watermill message gob-encoded, readable by Go consumers only
+//   - json: the whole watermill message (UUID, metadata and payload) as a JSON document
+//   - proto: UUID and payload as a protobuf body, metadata as NATS headers, see ProtoMarshaler
+//   - any name passed to RegisterMarshaler
+func newMarshaler(kind string) (nats.MarshalerUnmarshaler, error) {
+	if kind == "" {
+		kind = "nats"
+	}
+	marshalers.RLock()
+	defer marshalers.RUnlock()
+	m, ok := marshalers.byName[kind]
+	if !ok {
+		names := make([]string, 0, len(marshalers.byName))
+		for name := range marshalers.byName {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown marshaler %q, expected one of %s", kind, strings.Join(names, ", "))
+	}
+	return deliveryMarshaler{m}, nil
+}
+
+// deliveryMarshaler adds the delivery details of a NATS message (subject, JetStream
+// delivery count or request reply subject) to the metadata of the unmarshaled message.
+// These keys only describe the current delivery, so they are never sent on publish
+type deliveryMarshaler struct {
+	nats.MarshalerUnmarshaler
+}
+
+// deliveryKeys are the metadata keys set by deliveryMarshaler, PublishSync and PublishBatch,
+// they describe a single delivery or publish and are never sent
+var deliveryKeys = []string{subjectKey, numDeliveredKey, numPendingKey, ackSubjectKey, replySubjectKey, shardKey, streamKey, streamSequenceKey}
+
+func (d deliveryMarshaler) Marshal(topic string, msg *message.Message) (*nc.Msg, error) {
+	for _, key := range deliveryKeys {
+		if _, ok := msg.Metadata[key]; ok {
+			msg = msg.Copy()
+			for _, key := range deliveryKeys {
+				delete(msg.Metadata, key)
+			}
+			break
+		}
+	}
+	return d.MarshalerUnmarshaler.Marshal(topic, msg)
+}
+
+func (d deliveryMarshaler) Unmarshal(natsMsg *nc.Msg) (*message.Message, error) {
+	msg, err := d.MarshalerUnmarshaler.Unmarshal(natsMsg)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Metadata == nil {
+		msg.Metadata = make(message.Metadata)
+	}
+	// headers-only messages decode to a nil payload with some formats, handlers always get a non-nil one
+	if msg.Payload == nil {
+		msg.Payload = message.Payload{}
+	}
+	msg.Metadata.Set(subjectKey, natsMsg.Subject)
+	// only JetStream messages carry delivery metadata, their reply subject is used for acks
+	if meta, err := natsMsg.Metadata(); err == nil {
+		msg.Metadata.Set(numDeliveredKey, strconv.FormatUint(meta.NumDelivered, 10))
+		msg.Metadata.Set(numPendingKey, strconv.FormatUint(meta.NumPending, 10))
+		msg.Metadata.Set(ackSubjectKey, natsMsg.Reply)
+	} else if natsMsg.Reply != "" {
+		msg.Metadata.Set(replySubjectKey, natsMsg.Reply)
+	}
+	return msg, nil
+}
+
+// coreUnmarshaler makes Ack and Nack no-ops for the messages of core NATS subscriptions, which
+// are delivered at most once. Watermill acks by replying to the reply subject of a message,
+// which for a core NATS request is the inbox of the requester: it would receive "+ACK" or "-NAK".
+// The reply subject is cleared once deliveryMarshaler kept it in the replySubjectKey metadata,
+// which RequestReply.Respond replies to
+type coreUnmarshaler struct {
+	nats.Unmarshaler
+}
+
+func (u coreUnmarshaler) Unmarshal(natsMsg *nc.Msg) (*message.Message, error) {
+	msg, err := u.Unmarshaler.Unmarshal(natsMsg)
+	// watermill reads the reply subject of this very message when the handler acks or nacks
+	natsMsg.Reply = ""
+	return msg, err
+}
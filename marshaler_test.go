@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// unregisterMarshalers removes the custom formats a test registered
+func unregisterMarshalers(t *testing.T, names ...string) {
+	t.Cleanup(func() {
+		marshalers.Lock()
+		defer marshalers.Unlock()
+		for _, name := range names {
+			delete(marshalers.byName, name)
+		}
+	})
+}
+
+func TestRegisterMarshalerSelectsCustomFormat(t *testing.T) {
+	unregisterMarshalers(t, "custom")
+	RegisterMarshaler("custom", nats.JSONMarshaler{})
+
+	m, err := newMarshaler("custom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	natsMsg, err := m.Marshal("events.a", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.Unmarshal(natsMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UUID != msg.UUID || string(got.Payload) != "payload" {
+		t.Errorf("round trip = %s %q, want %s %q", got.UUID, got.Payload, msg.UUID, msg.Payload)
+	}
+}
+
+func TestNewMarshalerUnknownName(t *testing.T) {
+	_, err := newMarshaler("avro")
+	if err == nil {
+		t.Fatal("an unregistered marshaler was returned")
+	}
+	// the error lists the registered formats
+	for _, name := range []string{"nats", "gob", "json", "proto"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("%q does not list %s", err, name)
+		}
+	}
+}
+
+func TestRegisterMarshalerConcurrently(t *testing.T) {
+	const workers = 16
+	names := make([]string, workers)
+	for i := range names {
+		names[i] = fmt.Sprintf("concurrent-%d", i)
+	}
+	unregisterMarshalers(t, names...)
+
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(2)
+		go func(name string) {
+			defer wg.Done()
+			RegisterMarshaler(name, nats.GobMarshaler{})
+		}(name)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if _, err := newMarshaler("nats"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, name := range names {
+		if _, err := newMarshaler(name); err != nil {
+			t.Errorf("%s was not registered: %v", name, err)
+		}
+	}
+}
+
+func TestSubscribersWithDifferentMarshalers(t *testing.T) {
+	url := runServer(t, false)
+	t.Setenv("NATS_URL", url)
+	t.Setenv("SUBSCRIBER_MARSHALERS", "json,gob")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stacks, err := newMarshalerStacks(cfg, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each subscriber decodes the format its own publisher sends
+	received := make(map[string]<-chan *message.Message)
+	for _, kind := range cfg.SubscriberMarshalers {
+		config, err := loadSubscriberConfig(cfg, kind, stacks, nil, nats.JetStreamConfig{Disabled: true}, watermill.NopLogger{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub, err := newSubscriber(config, watermill.NopLogger{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = sub.Close()
+			sub.conn.Close()
+		})
+		if received[kind], err = sub.Subscribe(context.Background(), "bridge."+kind); err != nil {
+			t.Fatal(err)
+		}
+		if err := sub.conn.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, kind := range cfg.SubscriberMarshalers {
+		pub, err := newPublisher(nats.PublisherConfig{
+			URL:       url,
+			Marshaler: stacks[kind],
+			JetStream: nats.JetStreamConfig{Disabled: true},
+		}, watermill.NopLogger{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pub.Close()
+		msg := message.NewMessage(watermill.NewUUID(), []byte(kind+" order"))
+		msg.Metadata.Set("Format", kind)
+		if err := pub.Publish("bridge."+kind, msg); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-received[kind]:
+			got.Ack()
+			if got.UUID != msg.UUID || string(got.Payload) != kind+" order" || got.Metadata.Get("Format") != kind {
+				t.Errorf("the %s subscriber received %s %q with metadata %v, want %s %q", kind, got.UUID, got.Payload, got.Metadata, msg.UUID, msg.Payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the %s subscriber received nothing", kind)
+		}
+	}
+
+	if _, err := loadSubscriberConfig(cfg, "proto", stacks, nil, nats.JetStreamConfig{Disabled: true}, watermill.NopLogger{}); err == nil {
+		t.Error("a subscriber was configured with a marshaler that has no stack")
+	}
+}
+
+func TestHeadersOnlyMessage(t *testing.T) {
+	url := runServer(t, false)
+	for _, kind := range []string{"nats", "gob", "json", "proto"} {
+		marshaler, err := newMarshaler(kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub, err := newSubscriber(nats.SubscriberConfig{
+			URL:         url,
+			Unmarshaler: marshaler,
+			JetStream:   nats.JetStreamConfig{Disabled: true},
+		}, watermill.NopLogger{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages, err := sub.Subscribe(context.Background(), "control."+kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sub.conn.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		pub, err := newPublisher(nats.PublisherConfig{
+			URL:       url,
+			Marshaler: marshaler,
+			JetStream: nats.JetStreamConfig{Disabled: true},
+		}, watermill.NopLogger{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := message.NewMessage(watermill.NewUUID(), nil)
+		msg.Metadata.Set("Command", "pause")
+		if err := pub.Publish("control."+kind, msg); err != nil {
+			t.Fatal(err)
+		}
+
+		// the handler gets the headers and an empty, non-nil payload
+		handled := make(chan *message.Message, 1)
+		handlers.Add(1)
+		go runHandler(messages, func(ctx context.Context, msg *message.Message) error {
+			handled <- msg
+			return nil
+		}, 1, 0)
+		select {
+		case got := <-handled:
+			if got.Payload == nil || len(got.Payload) != 0 || got.Metadata.Get("Command") != "pause" {
+				t.Errorf("%s: received payload %#v with metadata %v, want an empty payload with Command=pause", kind, got.Payload, got.Metadata)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the headers-only message was not handled", kind)
+		}
+		_ = pub.Close()
+		_ = sub.Close()
+		sub.conn.Close()
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	nc "github.com/nats-io/nats.go"
+)
+
+// marshalerStack is a wire format wrapped with the sharding, priority, compression, payload limit,
+// schema validation, unmarshal error policy and subject mapping of the configuration
+type marshalerStack struct {
+	nats.MarshalerUnmarshaler
+	payloadLimit *payloadLimiter
+	malformed    *malformedUnmarshaler
+}
+
+// newMarshalerStack builds the stack of the wire format kind, see newMarshaler
+func newMarshalerStack(cfg *Config, kind string, s *sharding, p *prioritizing, mapper SubjectMapper) (*marshalerStack, error) {
+	marshaler, err := newMarshaler(kind)
+	if err != nil {
+		return nil, fmt.Errorf("invalid marshaler: %w", err)
+	}
+	marshaler = withSharding(marshaler, s)
+	marshaler = withPriority(marshaler, p)
+	// COMPRESSION compresses bodies of at least COMPRESSION_THRESHOLD bytes,
+	// MAX_DECOMPRESSED_SIZE bounds what a compressed body may decompress to
+	marshaler, err = withCompression(marshaler, cfg.Compression, cfg.CompressionThreshold, cfg.MaxDecompressedSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compression: %w", err)
+	}
+	// MAX_PAYLOAD rejects oversized messages before they are sent, compression included
+	payloadLimit, err := withPayloadLimit(marshaler, cfg.MaxPayload)
+	if err != nil {
+		return nil, err
+	}
+	// SCHEMA_DIR holds the JSON Schemas payloads are validated against before publishing
+	marshaler, err = withSchemaValidation(payloadLimit, cfg.SchemaDir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema validation: %w", err)
+	}
+	// ON_UNMARSHAL_ERROR decides what happens to the messages that cannot be decoded
+	malformed, err := withUnmarshalPolicy(marshaler, cfg.OnUnmarshalError, cfg.DLQPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &marshalerStack{
+		// SUBJECT_STRIP_TOKENS sends "tenant1.orders" on "orders", keeping the original subject in the metadata
+		MarshalerUnmarshaler: withSubjectMapper(malformed, mapper),
+		payloadLimit:         payloadLimit,
+		malformed:            malformed,
+	}, nil
+}
+
+// marshalerStacks holds the stack of every wire format in use, keyed by kind: MARSHALER,
+// shared by the publisher and the subscribers, and the kinds of SUBSCRIBER_MARSHALERS
+type marshalerStacks map[string]*marshalerStack
+
+// newMarshalerStacks builds the stacks of every wire format cfg uses
+func newMarshalerStacks(cfg *Config, s *sharding, p *prioritizing, mapper SubjectMapper) (marshalerStacks, error) {
+	stacks := make(marshalerStacks)
+	for _, kind := range append([]string{cfg.Marshaler}, cfg.SubscriberMarshalers...) {
+		if kind = strings.TrimSpace(kind); kind == "" || stacks[kind] != nil {
+			continue
+		}
+		stack, err := newMarshalerStack(cfg, kind, s, p, mapper)
+		if err != nil {
+			return nil, err
+		}
+		stacks[kind] = stack
+	}
+	return stacks, nil
+}
+
+// unmarshaler returns the unmarshaler of the wire format kind
+func (m marshalerStacks) unmarshaler(kind string) (nats.Unmarshaler, error) {
+	stack, ok := m[kind]
+	if !ok {
+		return nil, fmt.Errorf("no marshaler %q was configured", kind)
+	}
+	return stack, nil
+}
+
+// useServerLimit applies the max_payload advertised by the server of conn to every stack,
+// see payloadLimiter.useServerLimit
+func (m marshalerStacks) useServerLimit(conn *nc.Conn) {
+	for _, stack := range m {
+		stack.payloadLimit.useServerLimit(conn)
+	}
+}
+
+// publishWith makes every stack move its malformed messages on conn, see malformedUnmarshaler.publishWith
+func (m marshalerStacks) publishWith(conn *nc.Conn, jetStream bool) error {
+	for _, stack := range m {
+		if err := stack.malformed.publishWith(conn, jetStream); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// merge forwards the messages of every channel to the returned one, which buffers up to
+// bufferSize messages and is closed once all of them are. Each channel has its own forwarding
+// goroutine, which returns as soon as that channel is closed, so closing one subscription
+// does not leave it behind
+func merge(bufferSize int, channels ...<-chan *message.Message) <-chan *message.Message {
+	if len(channels) == 1 && bufferSize == 0 {
+		return channels[0]
+	}
+	out := make(chan *message.Message, bufferSize)
+	var forwarding sync.WaitGroup
+	forwarding.Add(len(channels))
+	for _, messages := range channels {
+		go func(messages <-chan *message.Message) {
+			defer forwarding.Done()
+			for msg := range messages {
+				out <- msg
+			}
+		}(messages)
+	}
+	go func() {
+		forwarding.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// subscribeAll subscribes to every topic of the subscriber and merges their messages into one channel
+// buffering up to bufferSize of them, which is closed when the subscriber is closed. With PRIORITY,
+// the messages of the high-priority topics are handed over before those of the others.
+// Each topic can be unsubscribed on its own with Unsubscribe
+func (s *subscriber) subscribeAll(ctx context.Context, bufferSize int) (<-chan *message.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unsubscribe == nil {
+		s.unsubscribe = make(map[string]context.CancelFunc, len(s.topics))
+	}
+	channels := make([]<-chan *message.Message, 0, len(s.topics))
+	var high []<-chan *message.Message
+	for _, topic := range s.topics {
+		// watermill unsubscribes the topic once the context of its subscription is done
+		topicCtx, cancel := context.WithCancel(ctx)
+		messages, err := s.Subscribe(topicCtx, topic)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		s.unsubscribe[topic] = cancel
+		if s.prioritized && isHighPriority(topic) {
+			high = append(high, messages)
+		} else {
+			channels = append(channels, messages)
+		}
+	}
+	if s.prioritized {
+		return mergePriority(merge(bufferSize, high...), merge(bufferSize, channels...)), nil
+	}
+	return merge(bufferSize, channels...), nil
+}
+
+// mergePriority forwards the messages of high and low to the returned channel, which is closed
+// once both of them are. A message of low is only forwarded when high has none waiting, so that
+// high-priority messages jump the queue of the low-priority ones already delivered
+func mergePriority(high, low <-chan *message.Message) <-chan *message.Message {
+	out := make(chan *message.Message)
+	go func() {
+		defer close(out)
+		for high != nil || low != nil {
+			// high-priority messages first, whenever there is one
+			select {
+			case msg, ok := <-high:
+				if !ok {
+					high = nil
+				} else {
+					out <- msg
+				}
+				continue
+			default:
+			}
+			select {
+			case msg, ok := <-high:
+				if !ok {
+					high = nil
+					continue
+				}
+				out <- msg
+			case msg, ok := <-low:
+				if !ok {
+					low = nil
+					continue
+				}
+				out <- msg
+			}
+		}
+	}()
+	return out
+}
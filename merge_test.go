@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestMergeReceivesFromEveryChannel(t *testing.T) {
+	a, b := make(chan *message.Message), make(chan *message.Message)
+	merged := merge(0, a, b)
+
+	fromA := message.NewMessage(watermill.NewUUID(), []byte("a"))
+	fromB := message.NewMessage(watermill.NewUUID(), []byte("b"))
+	go func() {
+		a <- fromA
+		b <- fromB
+		// closing one channel leaves the other one forwarding
+		close(a)
+		b <- fromB
+		close(b)
+	}()
+
+	got := make(map[string]int)
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case msg, ok := <-merged:
+			if !ok {
+				if got["a"] != 1 || got["b"] != 2 {
+					t.Errorf("received %v, want a once and b twice", got)
+				}
+				return
+			}
+			got[string(msg.Payload)]++
+		case <-timeout:
+			t.Fatalf("received %v, the merged channel is not closed", got)
+		}
+	}
+}
+
+func TestMergePriorityHandsHighOverFirst(t *testing.T) {
+	high, low := make(chan *message.Message, 3), make(chan *message.Message, 3)
+	// both priorities are waiting before the merge starts
+	for i := 0; i < 3; i++ {
+		low <- message.NewMessage(watermill.NewUUID(), []byte("low"))
+		high <- message.NewMessage(watermill.NewUUID(), []byte("high"))
+	}
+	close(high)
+	close(low)
+
+	var order []string
+	for msg := range mergePriority(high, low) {
+		order = append(order, string(msg.Payload))
+	}
+	want := []string{"high", "high", "high", "low", "low", "low"}
+	if len(order) != len(want) {
+		t.Fatalf("received %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("received %v, want %v", order, want)
+		}
+	}
+}
+
+// BenchmarkMergeBufferSize measures how long a message waits between its delivery by a
+// subscription and its handler with SUBSCRIBE_BUFFER sizes: a larger buffer frees the
+// subscriptions sooner, but the messages it holds wait longer and stay in memory
+func BenchmarkMergeBufferSize(b *testing.B) {
+	for _, bufferSize := range []int{0, 16, 256, 1024} {
+		b.Run(strconv.Itoa(bufferSize), func(b *testing.B) {
+			channels := []chan *message.Message{make(chan *message.Message), make(chan *message.Message)}
+			merged := merge(bufferSize, channels[0], channels[1])
+			delivered := make([]time.Time, b.N)
+			b.ResetTimer()
+			go func() {
+				for i := 0; i < b.N; i++ {
+					delivered[i] = time.Now()
+					channels[i%len(channels)] <- message.NewMessage(strconv.Itoa(i), nil)
+				}
+				for _, messages := range channels {
+					close(messages)
+				}
+			}()
+			var waited time.Duration
+			for msg := range merged {
+				i, _ := strconv.Atoi(msg.UUID)
+				waited += time.Since(delivered[i])
+				// a handler doing a little work
+				time.Sleep(time.Microsecond)
+			}
+			b.ReportMetric(float64(waited.Nanoseconds())/float64(b.N), "ns-latency/msg")
+		})
+	}
+}
@@ -0,0 +1,194 @@
+// Package metrics holds the Prometheus collectors of the example and the
+// HTTP server exposing them on /metrics.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "pubsub"
+
+var (
+	// Published counts messages successfully handed to NATS, by topic
+	Published = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_published_total",
+		Help:      "Number of messages published.",
+	}, []string{"topic"})
+
+	// Received counts messages delivered to a handler, by topic and subscriber
+	Received = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_received_total",
+		Help:      "Number of messages received by a subscriber.",
+	}, []string{"topic", "subscriber"})
+
+	// Acked counts messages acknowledged by a handler, by topic and subscriber
+	Acked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_acked_total",
+		Help:      "Number of messages acknowledged.",
+	}, []string{"topic", "subscriber"})
+
+	// Nacked counts messages negatively acknowledged by a handler, by topic and subscriber
+	Nacked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_nacked_total",
+		Help:      "Number of messages negatively acknowledged.",
+	}, []string{"topic", "subscriber"})
+
+	// HandlerDuration observes how long a handler takes to process one message
+	HandlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "handler_duration_seconds",
+		Help:      "Time spent processing a single message.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"topic", "subscriber"})
+
+	// SlowConsumers counts the slow consumer errors of a subscription, which drop messages
+	// because the handlers do not keep up with the deliveries
+	SlowConsumers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "slow_consumers_total",
+		Help:      "Number of slow consumer errors, each dropping messages.",
+	}, []string{"subject"})
+
+	// Expired counts the messages acked without processing because they were received past their Expires-At time
+	Expired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_expired_total",
+		Help:      "Number of messages skipped because they expired before being processed.",
+	}, []string{"subject"})
+
+	// DuplicatesSkipped counts the messages acked without processing because their UUID was processed recently
+	DuplicatesSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_duplicate_skipped_total",
+		Help:      "Number of messages skipped because a message with the same UUID was processed recently.",
+	}, []string{"subject"})
+
+	// OrderViolations counts the messages consumed out of order, with VERIFY_ORDER
+	OrderViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "order_violations_total",
+		Help:      "Number of messages consumed with a sequence not greater than the last one of their subject.",
+	}, []string{"subject"})
+
+	// PublishDropped counts the messages dropped because too many publishes were held while their connection was down
+	PublishDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_publish_dropped_total",
+		Help:      "Number of messages dropped because the publish buffer was full while reconnecting.",
+	}, []string{"subject"})
+
+	// QuotaRejected counts the messages not published because they exceeded the quota of their subject
+	QuotaRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_quota_rejected_total",
+		Help:      "Number of messages rejected because they exceeded the publish quota of their subject.",
+	}, []string{"subject"})
+
+	// ConsumerPending is the number of stream messages not yet delivered to a durable consumer
+	ConsumerPending = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nats",
+		Name:      "consumer_pending",
+		Help:      "Number of messages waiting to be delivered to the consumer.",
+	}, []string{"durable"})
+
+	// ConsumerAckPending is the number of messages delivered to a durable consumer and not acked yet
+	ConsumerAckPending = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nats",
+		Name:      "consumer_ack_pending",
+		Help:      "Number of messages delivered to the consumer and waiting for an ack.",
+	}, []string{"durable"})
+)
+
+// subjectDepth is the number of leading subject tokens kept in labels, 0 keeps them all
+var subjectDepth int
+
+// SetSubjectDepth makes Subject keep the first depth tokens of subjects, 0 keeps them all.
+// It must be called before the collectors are used
+func SetSubjectDepth(depth int) {
+	subjectDepth = depth
+}
+
+// Subject returns the label of subject: its tokens past the configured depth, which usually
+// hold ids or tenants, are collapsed into ">", so that "example_topic.a.test" and
+// "example_topic.b.test" are both counted as "example_topic.>" with a depth of 1
+// and the number of series stays bounded
+func Subject(subject string) string {
+	if subjectDepth <= 0 {
+		return subject
+	}
+	tokens := strings.SplitN(subject, ".", subjectDepth+1)
+	if len(tokens) <= subjectDepth {
+		return subject
+	}
+	return strings.Join(tokens[:subjectDepth], ".") + ".>"
+}
+
+// Server exposes the default registry on /metrics
+type Server struct {
+	*http.Server
+	// finalScrape is how long Flush waits for a last scrape
+	finalScrape time.Duration
+
+	mu sync.Mutex
+	// scraped is closed and replaced whenever a scrape completes
+	scraped chan struct{}
+}
+
+// Serve starts an HTTP server exposing the default registry on /metrics.
+// On shutdown, the returned server waits up to finalScrape for Prometheus to collect
+// the last values before stopping, see Flush
+func Serve(addr string, finalScrape time.Duration, logger watermill.LoggerAdapter) *Server {
+	s := &Server{finalScrape: finalScrape, scraped: make(chan struct{})}
+	metrics := promhttp.Handler()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		metrics.ServeHTTP(w, r)
+		s.mu.Lock()
+		close(s.scraped)
+		s.scraped = make(chan struct{})
+		s.mu.Unlock()
+	})
+
+	s.Server = &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		logger.Info("Serving metrics", watermill.LogFields{"addr": addr})
+		if err := s.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Metrics server failed", err, nil)
+		}
+	}()
+	return s
+}
+
+// Flush waits for the next scrape to complete, so that the final values are collected,
+// then stops the server once the scrapes in progress completed. It gives up waiting after
+// finalScrape or when ctx is done, and does not wait at all when finalScrape is 0
+func (s *Server) Flush(ctx context.Context) error {
+	if s.finalScrape > 0 {
+		s.mu.Lock()
+		scraped := s.scraped
+		s.mu.Unlock()
+
+		timer := time.NewTimer(s.finalScrape)
+		select {
+		case <-scraped:
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+	}
+	return s.Shutdown(ctx)
+}
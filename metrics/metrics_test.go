@@ -0,0 +1,40 @@
+package metrics
+
+import "testing"
+
+func TestSubjectCollapsesPastDepth(t *testing.T) {
+	t.Cleanup(func() { SetSubjectDepth(0) })
+	tests := []struct {
+		depth   int
+		subject string
+		want    string
+	}{
+		{0, "example_topic.a.test", "example_topic.a.test"},
+		{1, "example_topic.a.test", "example_topic.>"},
+		{1, "example_topic.b.test", "example_topic.>"},
+		{2, "example_topic.a.test", "example_topic.a.>"},
+		{2, "example_topic.b.test", "example_topic.b.>"},
+		{3, "example_topic.a.test", "example_topic.a.test"},
+		{1, "example_topic", "example_topic"},
+		{-1, "example_topic.a.test", "example_topic.a.test"},
+	}
+	for _, tt := range tests {
+		SetSubjectDepth(tt.depth)
+		if got := Subject(tt.subject); got != tt.want {
+			t.Errorf("depth %d: Subject(%q) = %q, want %q", tt.depth, tt.subject, got, tt.want)
+		}
+	}
+}
+
+func TestSubjectLabelsShareSeries(t *testing.T) {
+	t.Cleanup(func() { SetSubjectDepth(0) })
+	SetSubjectDepth(1)
+	if a, b := Subject("example_topic.a.test"), Subject("example_topic.b.test"); a != b {
+		t.Errorf("example_topic.a.test and example_topic.b.test are labelled %q and %q, want the same label", a, b)
+	}
+	// tenant.*.* subjects keep a series per tenant with a depth of 2
+	SetSubjectDepth(2)
+	if a, b := Subject("tenant.acme.orders"), Subject("tenant.acme.invoices"); a != b || a != "tenant.acme.>" {
+		t.Errorf("the subjects of a tenant are labelled %q and %q, want tenant.acme.>", a, b)
+	}
+}
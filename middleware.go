@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// correlationIDKey is the metadata key holding the ID correlating the messages of one request
+const correlationIDKey = "Correlation-ID"
+
+// Middleware adds a cross-cutting concern to a Handler
+type Middleware func(Handler) Handler
+
+// Chain wraps h with mws, the first middleware being the outermost one:
+// Chain(h, a, b) handles a message with a(b(h))
+func Chain(h Handler, mws ...Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// recovered turns a panic of the handler into an error, so that the message is
+// nacked instead of the panic crashing the handler goroutine and the process
+func recovered(logger watermill.LoggerAdapter) Middleware {
+	return func(h Handler) Handler {
+		return func(ctx context.Context, msg *message.Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("handler panicked: %v", r)
+					logger.Error("Handler panicked", err, watermill.LogFields{
+						"message_uuid": msg.UUID,
+						"stack":        string(debug.Stack()),
+					})
+				}
+			}()
+			return h(ctx, msg)
+		}
+	}
+}
+
+// timed logs how long the handler took to process each message and its outcome
+func timed(logger watermill.LoggerAdapter) Middleware {
+	return func(h Handler) Handler {
+		return func(ctx context.Context, msg *message.Message) error {
+			start := time.Now()
+			err := h(ctx, msg)
+			fields := watermill.LogFields{"message_uuid": msg.UUID, "duration": time.Since(start).String()}
+			if err != nil {
+				fields["error"] = err.Error()
+			}
+			logger.Debug("Message handled", fields)
+			return err
+		}
+	}
+}
+
+// errHandlerTimeout is returned for the messages whose handler did not return within HANDLER_TIMEOUT
+var errHandlerTimeout = errors.New("handler timed out")
+
+// handlerTimeout cancels the context of h after timeout and nacks the message if h has not returned
+// by then, so that it is redelivered, possibly to another subscriber. A handler ignoring its
+// context keeps running in the background but its outcome is discarded. 0 disables the timeout
+func handlerTimeout(timeout time.Duration, logger watermill.LoggerAdapter) Middleware {
+	return func(h Handler) Handler {
+		if timeout <= 0 {
+			return h
+		}
+		return func(ctx context.Context, msg *message.Message) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			done := make(chan error, 1)
+			go func() {
+				done <- h(ctx, msg)
+			}()
+			select {
+			case err := <-done:
+				return err
+			case <-ctx.Done():
+				if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					return ctx.Err()
+				}
+				logger.Info("Handler timed out, nacking the message", watermill.LogFields{
+					"message_uuid": msg.UUID,
+					"timeout":      timeout.String(),
+				})
+				return fmt.Errorf("%w after %s", errHandlerTimeout, timeout)
+			}
+		}
+	}
+}
+
+// correlationIDCtxKey is the context key of the correlation ID of the message being handled
+type correlationIDCtxKey struct{}
+
+// correlated reads the correlation ID of every message, generating one when it has none,
+// logs it and passes it to the handler in ctx, where withCorrelationID picks it up
+func correlated(logger watermill.LoggerAdapter) Middleware {
+	return func(h Handler) Handler {
+		return func(ctx context.Context, msg *message.Message) error {
+			correlationID, ok := headerValue(msg, correlationIDKey)
+			if !ok || correlationID == "" {
+				correlationID = watermill.NewUUID()
+				msg.Metadata.Set(correlationIDKey, correlationID)
+			}
+			logger.Info("Handling message", watermill.LogFields{
+				"message_uuid":   msg.UUID,
+				"correlation_id": correlationID,
+				"subject":        msg.Metadata.Get(subjectKey),
+			})
+			return h(context.WithValue(ctx, correlationIDCtxKey{}, correlationID), msg)
+		}
+	}
+}
+
+// withCorrelationID copies the correlation ID of the message handled in ctx onto msg,
+// unless msg has one already. The publish path calls it, so that the messages
+// published from within a handler carry the ID of the message being handled
+func withCorrelationID(ctx context.Context, msg *message.Message) *message.Message {
+	if _, set := headerValue(msg, correlationIDKey); set {
+		return msg
+	}
+	if correlationID, ok := ctx.Value(correlationIDCtxKey{}).(string); ok {
+		msg.Metadata.Set(correlationIDKey, correlationID)
+	}
+	return msg
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestRecoveredPanicNacks(t *testing.T) {
+	h := Chain(func(ctx context.Context, msg *message.Message) error {
+		if string(msg.Payload) == "panic" {
+			panic("boom")
+		}
+		return nil
+	}, recovered(watermill.NopLogger{}))
+
+	messages := make(chan *message.Message, 2)
+	panicking := message.NewMessage(watermill.NewUUID(), []byte("panic"))
+	healthy := message.NewMessage(watermill.NewUUID(), []byte("ok"))
+	messages <- panicking
+	messages <- healthy
+	close(messages)
+
+	handlers.Add(1)
+	done := make(chan struct{})
+	go func() {
+		// a panic escaping the handler would crash the test binary instead
+		runHandler(messages, h, 1, 0)
+		close(done)
+	}()
+
+	select {
+	case <-panicking.Nacked():
+	case <-panicking.Acked():
+		t.Fatal("the panicking message was acked")
+	case <-time.After(time.Second):
+		t.Fatal("the panicking message was not nacked")
+	}
+	// the goroutine survived the panic and handles the next message
+	select {
+	case <-healthy.Acked():
+	case <-time.After(time.Second):
+		t.Fatal("the message after the panic was not acked")
+	}
+	<-done
+}
+
+func TestRecoveredReturnsPanicAsError(t *testing.T) {
+	h := recovered(watermill.NopLogger{})(func(ctx context.Context, msg *message.Message) error {
+		panic("boom")
+	})
+	err := h(context.Background(), message.NewMessage(watermill.NewUUID(), nil))
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("err = %v, want the panic value", err)
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(h Handler) Handler {
+			return func(ctx context.Context, msg *message.Message) error {
+				calls = append(calls, name)
+				return h(ctx, msg)
+			}
+		}
+	}
+	errHandled := errors.New("handled")
+	h := Chain(func(ctx context.Context, msg *message.Message) error {
+		calls = append(calls, "handler")
+		return errHandled
+	}, trace("a"), trace("b"))
+
+	if err := h(context.Background(), message.NewMessage(watermill.NewUUID(), nil)); !errors.Is(err, errHandled) {
+		t.Errorf("err = %v, want the handler error", err)
+	}
+	if got := strings.Join(calls, ","); got != "a,b,handler" {
+		t.Errorf("calls = %s, want a,b,handler", got)
+	}
+}
+
+func TestCorrelationIDPropagatesToPublishedMessages(t *testing.T) {
+	published := make(map[string]string)
+	pub := publisherFunc(func(topic string, msg *message.Message) error {
+		published[topic] = msg.Metadata.Get(correlationIDKey)
+		return nil
+	})
+	h := correlated(watermill.NopLogger{})(func(ctx context.Context, msg *message.Message) error {
+		if err := publishWithTimeout(ctx, pub, "shipments.1", message.NewMessage(watermill.NewUUID(), nil), time.Second); err != nil {
+			return err
+		}
+		// a correlation ID set by the handler is kept
+		explicit := message.NewMessage(watermill.NewUUID(), nil)
+		explicit.Metadata.Set(correlationIDKey, "other")
+		return publishWithTimeout(ctx, pub, "audit.1", explicit, time.Second)
+	})
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte("order"))
+	msg.Metadata.Set(correlationIDKey, "corr-1")
+	if err := h(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if published["shipments.1"] != "corr-1" {
+		t.Errorf("published %s = %q, want corr-1", correlationIDKey, published["shipments.1"])
+	}
+	if published["audit.1"] != "other" {
+		t.Errorf("published %s = %q, want the explicit other", correlationIDKey, published["audit.1"])
+	}
+
+	// outside of a handler nothing is added
+	plain := message.NewMessage(watermill.NewUUID(), nil)
+	if err := publishWithTimeout(context.Background(), pub, "orders.1", plain, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := plain.Metadata[correlationIDKey]; ok {
+		t.Errorf("a message published outside of a handler got a %s", correlationIDKey)
+	}
+}
+
+func TestHandlerTimeoutNacksSlowHandler(t *testing.T) {
+	cancelled := make(chan struct{})
+	slow := func(ctx context.Context, msg *message.Message) error {
+		select {
+		case <-ctx.Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+		return nil
+	}
+	h := handlerTimeout(50*time.Millisecond, watermill.NopLogger{})(slow)
+	msg := message.NewMessage(watermill.NewUUID(), nil)
+	if err := h(context.Background(), msg); !errors.Is(err, errHandlerTimeout) {
+		t.Fatalf("error = %v, want %v", err, errHandlerTimeout)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("the context of the slow handler was not cancelled")
+	}
+
+	// runHandler nacks the timed out message
+	messages := make(chan *message.Message, 1)
+	msg = message.NewMessage(watermill.NewUUID(), nil)
+	messages <- msg
+	close(messages)
+	handlers.Add(1)
+	runHandler(messages, handlerTimeout(50*time.Millisecond, watermill.NopLogger{})(func(ctx context.Context, msg *message.Message) error {
+		<-ctx.Done()
+		return nil
+	}), 1, 0)
+	select {
+	case <-msg.Nacked():
+	default:
+		t.Error("the timed out message was not nacked")
+	}
+
+	// a handler finishing in time keeps its outcome
+	fast := handlerTimeout(time.Second, watermill.NopLogger{})(func(ctx context.Context, msg *message.Message) error {
+		return nil
+	})
+	if err := fast(context.Background(), message.NewMessage(watermill.NewUUID(), nil)); err != nil {
+		t.Errorf("error = %v for a handler finishing in time", err)
+	}
+}
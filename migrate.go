@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+// migrationDurable names the consumer of the migration, so that a restarted migration resumes
+const migrationDurable = "migrate"
+
+// migrate bridges a move from gob to JSON: it consumes the gob messages of topics and
+// republishes them with pub, which marshals JSON, on "<target>.<subject>", keeping their UUID
+// and metadata. Messages that cannot be decoded are moved to "<dlqPrefix>.malformed.<subject>",
+// the ones that cannot be republished to "<dlqPrefix>.<subject>".
+// It runs until ctx is done and returns the number of migrated messages
+func migrate(ctx context.Context, config nats.SubscriberConfig, topics []string, target string, pub *publisher, dlqPrefix string, logger watermill.LoggerAdapter) (int64, error) {
+	gob, err := newMarshaler("gob")
+	if err != nil {
+		return 0, err
+	}
+	malformed, err := withUnmarshalPolicy(gob, string(unmarshalDLQ), dlqPrefix)
+	if err != nil {
+		return 0, err
+	}
+	if err := malformed.publishWith(pub.Conn(), !config.JetStream.Disabled); err != nil {
+		return 0, err
+	}
+	config.Unmarshaler = malformed
+	// a single consumer per subject, whose position survives a restart
+	config.QueueGroupPrefix = ""
+	config.SubscribersCount = 1
+	if !config.JetStream.Disabled {
+		config.JetStream.DurablePrefix = migrationDurable
+		config.JetStream.DurableCalculator = durableName
+	}
+
+	sub, err := newSubscriber(config, logger)
+	if err != nil {
+		return 0, err
+	}
+	sub.name, sub.topics = "migrate", topics
+	messages, err := sub.subscribeAll(context.Background(), 0)
+	if err != nil {
+		sub.Close()
+		return 0, err
+	}
+
+	var migrated atomic.Int64
+	convert := func(ctx context.Context, msg *message.Message) error {
+		subject := msg.Metadata.Get(subjectKey)
+		out := message.NewMessage(msg.UUID, msg.Payload)
+		for key, value := range msg.Metadata {
+			out.Metadata.Set(key, value)
+		}
+		if err := pub.Publish(target+"."+subject, out); err != nil {
+			return fmt.Errorf("%w: republish of %s as JSON: %w", errUnrecoverable, msg.UUID, classifyError(err))
+		}
+		migrated.Add(1)
+		return nil
+	}
+	handlers.Add(1)
+	go runHandler(messages, Chain(convert, handleWithDLQ(pub, dlqPrefix, logger), recovered(logger)), 1, config.AckWaitTimeout)
+
+	<-ctx.Done()
+	drainCtx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	err = sub.Drain(drainCtx)
+	handlers.Wait()
+	if errors.Is(err, nc.ErrConnectionClosed) {
+		err = nil
+	}
+	return migrated.Load(), err
+}
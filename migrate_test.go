@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+func TestMigrateRepublishesGobAsJSON(t *testing.T) {
+	url := runServer(t, true)
+	conn := connect(t, url)
+	js := addStream(t, conn, "orders", "orders.>")
+	addStream(t, conn, "migrated", "json.>")
+	addStream(t, conn, "dlq", "dlq.>")
+	gob, err := newMarshaler("gob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonMarshaler, err := newMarshaler("json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gobPub, err := newPublisher(nats.PublisherConfig{URL: url, Marshaler: gob}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gobPub.Close()
+	jsonPub, err := newPublisher(nats.PublisherConfig{URL: url, Marshaler: jsonMarshaler}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jsonPub.Close()
+
+	order := message.NewMessage(watermill.NewUUID(), []byte(`{"id": 1}`))
+	order.Metadata.Set("Tenant", "acme")
+	if err := gobPub.Publish("orders.1", order); err != nil {
+		t.Fatal(err)
+	}
+	// not gob, moved to the DLQ instead of being migrated
+	if _, err := js.Publish("orders.2", []byte("not gob")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	type result struct {
+		migrated int64
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		migrated, err := migrate(ctx, nats.SubscriberConfig{
+			URL:            url,
+			AckWaitTimeout: 5 * time.Second,
+			JetStream:      nats.JetStreamConfig{AckAsync: true},
+		}, []string{"orders.>"}, "json", jsonPub, "dlq", watermill.NopLogger{})
+		done <- result{migrated, err}
+	}()
+
+	stored := func(stream string) uint64 {
+		info, err := js.StreamInfo(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.State.Msgs
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for stored("migrated") < 1 || stored("dlq") < 1 {
+		if time.Now().After(deadline) {
+			cancel()
+			t.Fatalf("%d messages migrated and %d dead-lettered, want 1 each", stored("migrated"), stored("dlq"))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if r.migrated != 1 {
+			t.Errorf("migrated %d messages, want 1", r.migrated)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the migration did not stop")
+	}
+
+	raw, err := js.GetLastMsg("migrated", "json.orders.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !json.Valid(raw.Data) {
+		t.Fatalf("json.orders.1 holds %q, which is not JSON", raw.Data)
+	}
+	got, err := jsonMarshaler.Unmarshal(&nc.Msg{Subject: raw.Subject, Header: raw.Header, Data: raw.Data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UUID != order.UUID || string(got.Payload) != string(order.Payload) || got.Metadata.Get("Tenant") != "acme" {
+		t.Errorf("migrated %s %q with metadata %v, want %s %q with Tenant=acme", got.UUID, got.Payload, got.Metadata, order.UUID, order.Payload)
+	}
+	if _, err := js.GetLastMsg("dlq", "dlq.malformed.orders.2"); err != nil {
+		t.Errorf("the malformed message is not in the DLQ: %v", err)
+	}
+}
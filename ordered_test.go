@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+func TestOrderedHandlesMessagesInSequence(t *testing.T) {
+	const count = 10
+	url := runServer(t, true)
+	addStream(t, connect(t, url), "orders", "orders.>")
+	t.Setenv("NATS_URL", url)
+	t.Setenv("ORDERED", "true")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshaler, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := newPublisher(nats.PublisherConfig{URL: url, Marshaler: marshaler}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	for i := 1; i <= count; i++ {
+		// spread over subjects, the order is the one of the stream
+		if err := pub.Publish("orders."+strconv.Itoa(i%3), message.NewMessage(watermill.NewUUID(), []byte(strconv.Itoa(i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sub, err := newSubscriber(nats.SubscriberConfig{
+		URL:              url,
+		QueueGroupPrefix: cfg.QueueGroupPrefix,
+		SubscribersCount: cfg.SubscribersCount,
+		Unmarshaler:      marshaler,
+		JetStream: nats.JetStreamConfig{
+			DurablePrefix: cfg.DurablePrefix,
+			AckAsync:      true,
+			SubscribeOptions: []nc.SubOpt{
+				cfg.DeliverPolicy,
+				cfg.AckPolicyOption,
+				nc.MaxAckPending(cfg.MaxAckPending),
+				nc.AckWait(5 * time.Second),
+			},
+		},
+	}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.conn.Close()
+	sub.name, sub.topics = "ordered", []string{"orders.>"}
+	messages, err := sub.subscribeAll(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first delivery of message 3 fails, it must be handled again before message 4
+	var (
+		mu      sync.Mutex
+		order   []string
+		failed  bool
+		running atomic.Int32
+	)
+	done := make(chan struct{})
+	h := func(ctx context.Context, msg *message.Message) error {
+		if running.Add(1) > 1 {
+			t.Error("two messages were handled at once")
+		}
+		defer running.Add(-1)
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, string(msg.Payload))
+		if string(msg.Payload) == "3" && !failed {
+			failed = true
+			return errors.New("cannot handle message 3")
+		}
+		if string(msg.Payload) == strconv.Itoa(count) {
+			close(done)
+		}
+		return nil
+	}
+	handlers.Add(1)
+	go runHandler(messages, h, cfg.HandlerConcurrency, 0)
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		mu.Lock()
+		defer mu.Unlock()
+		t.Fatalf("handled %v, message %d never came", order, count)
+	}
+	if err := sub.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"1", "2", "3", "3", "4", "5", "6", "7", "8", "9", "10"}
+	if len(order) != len(want) {
+		t.Fatalf("handled %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("handled %v, want %v", order, want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+// payloadLimiter rejects the messages larger than the server accepts before they are sent,
+// the server would otherwise close the connection with a cryptic maximum payload violation
+type payloadLimiter struct {
+	nats.MarshalerUnmarshaler
+	// max is the largest accepted body plus headers in bytes, 0 until it is known
+	max int64
+}
+
+// withPayloadLimit wraps m to reject messages of more than max bytes once marshaled,
+// headers included. With max 0, the limit advertised by the server is used, see useServerLimit
+func withPayloadLimit(m nats.MarshalerUnmarshaler, max int64) (*payloadLimiter, error) {
+	if max < 0 {
+		return nil, fmt.Errorf("MAX_PAYLOAD must not be negative, got %d", max)
+	}
+	return &payloadLimiter{MarshalerUnmarshaler: m, max: max}, nil
+}
+
+// useServerLimit applies the max_payload advertised by the server of conn, unless a limit
+// was configured. It must be called before publishing
+func (p *payloadLimiter) useServerLimit(conn *nc.Conn) {
+	if p.max == 0 {
+		p.max = conn.MaxPayload()
+	}
+}
+
+func (p *payloadLimiter) Marshal(topic string, msg *message.Message) (*nc.Msg, error) {
+	natsMsg, err := p.MarshalerUnmarshaler.Marshal(topic, msg)
+	if err != nil || p.max == 0 {
+		return natsMsg, err
+	}
+	if size := int64(len(natsMsg.Data) + headerSize(natsMsg.Header)); size > p.max {
+		return nil, fmt.Errorf("%w: message %s on %s is %d bytes, at most %d are allowed", ErrPayloadTooLarge, msg.UUID, topic, size, p.max)
+	}
+	return natsMsg, nil
+}
+
+// headerSize returns the size of h on the wire, which counts towards max_payload
+func headerSize(h nc.Header) int {
+	if len(h) == 0 {
+		return 0
+	}
+	// "NATS/1.0\r\n", one "key: value\r\n" line per value, then "\r\n"
+	size := len("NATS/1.0\r\n") + len("\r\n")
+	for key, values := range h {
+		for _, value := range values {
+			size += len(key) + len(": ") + len(value) + len("\r\n")
+		}
+	}
+	return size
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/nats-io/nats-server/v2/server"
+	nc "github.com/nats-io/nats.go"
+)
+
+func TestPayloadOverServerLimit(t *testing.T) {
+	url := runServerWith(t, &server.Options{MaxPayload: 1024})
+	base, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit, err := withPayloadLimit(base, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := newPublisher(nats.PublisherConfig{
+		URL:       url,
+		Marshaler: limit,
+		JetStream: nats.JetStreamConfig{Disabled: true},
+	}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	limit.useServerLimit(pub.Conn())
+	if limit.max != 1024 {
+		t.Fatalf("limit = %d, want the 1024 bytes advertised by the server", limit.max)
+	}
+
+	conn := connect(t, url)
+	sub, err := conn.SubscribeSync("orders.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// the headers count towards the limit along with the body
+	msg := message.NewMessage(watermill.NewUUID(), bytes.Repeat([]byte("x"), 1000))
+	if err := pub.Publish("orders.big", msg); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("error = %v, want %v", err, ErrPayloadTooLarge)
+	}
+	// the message was rejected before reaching the server, which keeps the connection open
+	if err := pub.Publish("orders.small", message.NewMessage(watermill.NewUUID(), []byte("order"))); err != nil {
+		t.Fatalf("publish after a rejected message: %v", err)
+	}
+	got, err := sub.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Subject != "orders.small" {
+		t.Errorf("received a message on %s, want orders.small", got.Subject)
+	}
+}
+
+func TestPayloadConfiguredLimit(t *testing.T) {
+	base, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := withPayloadLimit(base, -1); err == nil {
+		t.Error("a negative MAX_PAYLOAD was accepted")
+	}
+	msg := message.NewMessage(watermill.NewUUID(), bytes.Repeat([]byte("x"), 100))
+	natsMsg, err := base.Marshal("orders", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(natsMsg.Data) + headerSize(natsMsg.Header))
+	for max, rejected := range map[int64]bool{size: false, size - 1: true} {
+		limit, err := withPayloadLimit(base, max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a configured limit takes precedence over the server one
+		limit.useServerLimit(nil)
+		if _, err := limit.Marshal("orders", msg); errors.Is(err, ErrPayloadTooLarge) != rejected {
+			t.Errorf("MAX_PAYLOAD=%d: error = %v, want rejected %v", max, err, rejected)
+		}
+	}
+}
+
+func TestHeaderSize(t *testing.T) {
+	if size := headerSize(nil); size != 0 {
+		t.Errorf("headerSize(nil) = %d, want 0", size)
+	}
+	h := nc.Header{"A": {"1", "22"}}
+	// NATS/1.0\r\n A: 1\r\n A: 22\r\n \r\n
+	if size := headerSize(h); size != 10+6+7+2 {
+		t.Errorf("headerSize(%v) = %d, want 25", h, size)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+const (
+	// priorityKey is the metadata key selecting the priority of a published message, high or low
+	priorityKey = "Priority"
+	// priorityHigh and priorityLow start the subjects messages are sent on with PRIORITY, e.g. "high.orders"
+	priorityHigh = "high"
+	priorityLow  = "low"
+)
+
+// prioritizing sends the messages of each priority on their own subjects, captured by their own
+// stream and consumed by their own consumers. A message published to a subject is sent on
+// "high.<subject>" when its Priority metadata is high, on "low.<subject>" otherwise, and the
+// subscribers hand the high-priority messages over before the low-priority ones
+type prioritizing struct{}
+
+// loadPrioritizing returns the prioritizing enabled by PRIORITY, nil when it is not
+func loadPrioritizing() (*prioritizing, error) {
+	enabled, err := getEnvBool("PRIORITY", false)
+	if err != nil || !enabled {
+		return nil, err
+	}
+	if shards, _ := getEnvInt("SHARDS", 0); shards > 0 {
+		return nil, fmt.Errorf("PRIORITY=true cannot be combined with SHARDS, got %d", shards)
+	}
+	return &prioritizing{}, nil
+}
+
+// priorityOf returns the priority of msg, low unless its Priority metadata is high
+func priorityOf(msg *message.Message) (string, error) {
+	switch priority := strings.ToLower(msg.Metadata.Get(priorityKey)); priority {
+	case priorityHigh:
+		return priorityHigh, nil
+	case "", priorityLow:
+		return priorityLow, nil
+	default:
+		return "", fmt.Errorf("%w: unknown %s %q, expected high or low", ErrMarshal, priorityKey, priority)
+	}
+}
+
+// subject returns the subject msg published to subject is sent on, subject itself when p is nil
+func (p *prioritizing) subject(msg *message.Message, subject string) string {
+	if p == nil {
+		return subject
+	}
+	priority, err := priorityOf(msg)
+	if err != nil {
+		return subject
+	}
+	return priority + "." + subject
+}
+
+// patterns returns the patterns consuming the subjects of patterns with each priority, the
+// high-priority ones first. It returns patterns themselves when p is nil
+func (p *prioritizing) patterns(patterns []string) []string {
+	if p == nil {
+		return patterns
+	}
+	prioritized := make([]string, 0, 2*len(patterns))
+	for _, priority := range []string{priorityHigh, priorityLow} {
+		for _, pattern := range patterns {
+			prioritized = append(prioritized, priority+"."+pattern)
+		}
+	}
+	return prioritized
+}
+
+// streams returns the stream of each priority, named "<name>_high" and "<name>_low" and capturing
+// the subjects of cfg with that priority. It returns cfg alone when p is nil
+func (p *prioritizing) streams(cfg *nc.StreamConfig) []*nc.StreamConfig {
+	if p == nil {
+		return []*nc.StreamConfig{cfg}
+	}
+	var streams []*nc.StreamConfig
+	for _, priority := range []string{priorityHigh, priorityLow} {
+		stream := *cfg
+		stream.Name = cfg.Name + "_" + priority
+		stream.Subjects = make([]string, len(cfg.Subjects))
+		for i, subject := range cfg.Subjects {
+			stream.Subjects[i] = priority + "." + subject
+		}
+		streams = append(streams, &stream)
+	}
+	return streams
+}
+
+// isHighPriority reports whether topic consumes high-priority messages
+func isHighPriority(topic string) bool {
+	return strings.HasPrefix(topic, priorityHigh+".")
+}
+
+// withPriority wraps m so that messages are sent on the subject of their priority. On consume, the
+// priority is removed from the delivered subject and kept in the Priority metadata, so handlers
+// see the subject the message was published to. A nil p sends messages on their own subject
+func withPriority(m nats.MarshalerUnmarshaler, p *prioritizing) nats.MarshalerUnmarshaler {
+	if p == nil {
+		return m
+	}
+	return priorityMarshaler{MarshalerUnmarshaler: m}
+}
+
+// priorityMarshaler sends messages on the subject of their priority
+type priorityMarshaler struct {
+	nats.MarshalerUnmarshaler
+}
+
+func (m priorityMarshaler) Marshal(topic string, msg *message.Message) (*nc.Msg, error) {
+	priority, err := priorityOf(msg)
+	if err != nil {
+		return nil, err
+	}
+	return m.MarshalerUnmarshaler.Marshal(priority+"."+topic, msg)
+}
+
+func (m priorityMarshaler) Unmarshal(natsMsg *nc.Msg) (*message.Message, error) {
+	msg, err := m.MarshalerUnmarshaler.Unmarshal(natsMsg)
+	if err != nil {
+		return nil, err
+	}
+	if priority, published, ok := strings.Cut(msg.Metadata.Get(subjectKey), "."); ok && (priority == priorityHigh || priority == priorityLow) {
+		msg.Metadata.Set(subjectKey, published)
+		msg.Metadata.Set(priorityKey, priority)
+	}
+	return msg, nil
+}
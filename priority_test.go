@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestPriorityMarshalerStripsPrefix(t *testing.T) {
+	m, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = withPriority(m, &prioritizing{})
+	for _, tt := range []struct{ priority, subject string }{
+		{"high", "high.orders.1"},
+		{"", "low.orders.1"},
+	} {
+		msg := message.NewMessage(watermill.NewUUID(), []byte("order"))
+		msg.Metadata.Set(priorityKey, tt.priority)
+		natsMsg, err := m.Marshal("orders.1", msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if natsMsg.Subject != tt.subject {
+			t.Errorf("priority %q sent on %s, want %s", tt.priority, natsMsg.Subject, tt.subject)
+		}
+
+		got, err := m.Unmarshal(natsMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := tt.subject[:len(tt.subject)-len(".orders.1")]
+		if got.Metadata.Get(subjectKey) != "orders.1" || got.Metadata.Get(priorityKey) != want {
+			t.Errorf("received on %s with priority %q, want orders.1 with %s",
+				got.Metadata.Get(subjectKey), got.Metadata.Get(priorityKey), want)
+		}
+	}
+
+	msg := message.NewMessage(watermill.NewUUID(), nil)
+	msg.Metadata.Set(priorityKey, "urgent")
+	if _, err := m.Marshal("orders.1", msg); err == nil {
+		t.Error("an unknown priority was accepted")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// field numbers of pubsub.v1.Message, see proto/message.proto
+const (
+	protoUUIDField    protowire.Number = 1
+	protoPayloadField protowire.Number = 2
+)
+
+// ProtoMarshaler encodes messages for consumers written in other languages
+//   - UUID and payload: NATS body, as a pubsub.v1.Message (proto/message.proto)
+//   - UUID: also the _watermill_message_uuid header, used for JetStream deduplication
+//   - metadata: one NATS header per key
+type ProtoMarshaler struct{}
+
+// Marshal transforms a watermill message into a protobuf body and NATS headers.
+func (ProtoMarshaler) Marshal(topic string, msg *message.Message) (*nc.Msg, error) {
+	header := make(nc.Header)
+	header.Set(nats.WatermillUUIDHdr, msg.UUID)
+	for k, v := range msg.Metadata {
+		header.Set(k, v)
+	}
+
+	var body []byte
+	body = protowire.AppendTag(body, protoUUIDField, protowire.BytesType)
+	body = protowire.AppendString(body, msg.UUID)
+	body = protowire.AppendTag(body, protoPayloadField, protowire.BytesType)
+	body = protowire.AppendBytes(body, msg.Payload)
+
+	return &nc.Msg{Subject: topic, Data: body, Header: header}, nil
+}
+
+// Unmarshal extracts a watermill message from a protobuf body and NATS headers.
+func (ProtoMarshaler) Unmarshal(natsMsg *nc.Msg) (*message.Message, error) {
+	var uuid string
+	var payload []byte
+
+	data := natsMsg.Data
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, fmt.Errorf("cannot decode message: %w", protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		switch {
+		case num == protoUUIDField && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return nil, fmt.Errorf("cannot decode message uuid: %w", protowire.ParseError(n))
+			}
+			uuid, data = v, data[n:]
+		case num == protoPayloadField && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return nil, fmt.Errorf("cannot decode message payload: %w", protowire.ParseError(n))
+			}
+			payload, data = append([]byte(nil), v...), data[n:]
+		default:
+			// skip unknown fields, so the schema can evolve
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return nil, fmt.Errorf("cannot decode message: %w", protowire.ParseError(n))
+			}
+			data = data[n:]
+		}
+	}
+	if uuid == "" {
+		uuid = natsMsg.Header.Get(nats.WatermillUUIDHdr)
+	}
+
+	msg := message.NewMessage(uuid, payload)
+	for k, v := range natsMsg.Header {
+		if k == nats.WatermillUUIDHdr || len(v) == 0 {
+			continue
+		}
+		if len(v) > 1 {
+			return nil, fmt.Errorf("multiple values received in NATS header %q", k)
+		}
+		msg.Metadata.Set(k, v[0])
+	}
+	return msg, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// a consumer in another language only has the NATS message: the metadata in its headers
+// and a pubsub.v1.Message in its body
+func TestProtoMarshalerReadByRawSubscriber(t *testing.T) {
+	url := runServer(t, false)
+	conn := connect(t, url)
+	raw, err := conn.SubscribeSync("orders.created")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the subscription must reach the server before the publisher connection publishes
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := nats.NewPublisher(nats.PublisherConfig{
+		URL:       url,
+		Marshaler: ProtoMarshaler{},
+		JetStream: nats.JetStreamConfig{Disabled: true},
+	}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	msg := message.NewMessage("uuid-1", []byte(`{"id":1}`))
+	msg.Metadata.Set("Tenant", "acme")
+	if err := pub.Publish("orders.created", msg); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := raw.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := got.Header.Get("Tenant"); v != "acme" {
+		t.Errorf("Tenant header = %q, want acme", v)
+	}
+	if v := got.Header.Get(nats.WatermillUUIDHdr); v != "uuid-1" {
+		t.Errorf("%s header = %q, want uuid-1", nats.WatermillUUIDHdr, v)
+	}
+
+	var uuid string
+	var payload []byte
+	for data := got.Data; len(data) > 0; {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 || typ != protowire.BytesType {
+			t.Fatalf("invalid body %x", got.Data)
+		}
+		v, m := protowire.ConsumeBytes(data[n:])
+		if m < 0 {
+			t.Fatalf("invalid body %x", got.Data)
+		}
+		switch num {
+		case protoUUIDField:
+			uuid = string(v)
+		case protoPayloadField:
+			payload = v
+		}
+		data = data[n+m:]
+	}
+	if uuid != "uuid-1" {
+		t.Errorf("uuid field = %q, want uuid-1", uuid)
+	}
+	if !bytes.Equal(payload, msg.Payload) {
+		t.Errorf("payload field = %q, want %q", payload, msg.Payload)
+	}
+
+	// and the message still round-trips through the marshaler
+	back, err := ProtoMarshaler{}.Unmarshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.UUID != msg.UUID || !bytes.Equal(back.Payload, msg.Payload) || back.Metadata.Get("Tenant") != "acme" {
+		t.Errorf("round trip = %s %q %v, want %s %q %v", back.UUID, back.Payload, back.Metadata, msg.UUID, msg.Payload, msg.Metadata)
+	}
+}
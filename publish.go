@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Publisher is what the publish path needs from a publisher, the NATS publisher
+// implements it and tests can substitute a fake that records the messages
+type Publisher interface {
+	Publish(topic string, messages ...*message.Message) error
+	Close() error
+}
+
+// exampleRoundKey is the metadata key numbering the rounds of publishExamples
+const exampleRoundKey = "Round"
+
+// publisherFunc adapts a function publishing one message to Publisher, like closerFunc does for io.Closer.
+// Close does nothing, the publishers behind the function are closed on their own
+type publisherFunc func(topic string, msg *message.Message) error
+
+func (f publisherFunc) Publish(topic string, messages ...*message.Message) error {
+	for _, msg := range messages {
+		if err := f(topic, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f publisherFunc) Close() error {
+	return nil
+}
+
+// dryRunPublisher logs the messages it is given instead of publishing them, for DRY_RUN
+type dryRunPublisher struct {
+	logger watermill.LoggerAdapter
+}
+
+func (p dryRunPublisher) Publish(topic string, messages ...*message.Message) error {
+	for _, msg := range messages {
+		p.logger.Info("Dry run, message not published", watermill.LogFields{
+			"topic":        topic,
+			"message_uuid": msg.UUID,
+			"payload_size": len(msg.Payload),
+		})
+	}
+	return nil
+}
+
+func (p dryRunPublisher) Close() error {
+	return nil
+}
+
+// multiPublisher publishes every message with each of its publishers, e.g. to a primary and a
+// mirror cluster. A publish fails only when all of them fail, the failures of the others are logged
+type multiPublisher struct {
+	publishers []Publisher
+	logger     watermill.LoggerAdapter
+}
+
+func (m multiPublisher) Publish(topic string, messages ...*message.Message) error {
+	failed := make(map[int]error)
+	for i, pub := range m.publishers {
+		if err := pub.Publish(topic, messages...); err != nil {
+			failed[i] = err
+		}
+	}
+	if len(failed) == len(m.publishers) {
+		errs := make([]error, 0, len(failed))
+		for i := range m.publishers {
+			errs = append(errs, failed[i])
+		}
+		return errors.Join(errs...)
+	}
+	for i, err := range failed {
+		m.logger.Error("Publish failed on one of the publishers", err, watermill.LogFields{
+			"topic":     topic,
+			"publisher": i,
+		})
+	}
+	return nil
+}
+
+// Close closes every publisher
+func (m multiPublisher) Close() error {
+	var errs []error
+	for _, pub := range m.publishers {
+		errs = append(errs, pub.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// HeaderPublisher publishes payloads along with explicit headers, without building the message by hand
+type HeaderPublisher struct {
+	Publisher
+}
+
+// PublishWithHeaders publishes payload to topic as a message with a new UUID, headers being its metadata.
+// The nats and proto marshalers send every entry as the NATS header of the same name, gob and json
+// carry them in the body; consumers read them from msg.Metadata either way. The headers set by the
+// marshaler and the consume side, see deliveryKeys, cannot be published and are rejected with ErrMarshal
+func (p HeaderPublisher) PublishWithHeaders(topic string, payload []byte, headers map[string]string) error {
+	for key := range headers {
+		if reservedHeader(key) {
+			return fmt.Errorf("%w: header %s is reserved", ErrMarshal, key)
+		}
+	}
+	msg := message.NewMessage(watermill.NewUUID(), payload)
+	for key, value := range headers {
+		msg.Metadata.Set(key, value)
+	}
+	return p.Publish(topic, msg)
+}
+
+// reservedHeader reports whether the header key is set by the marshaler or on the consume side
+func reservedHeader(key string) bool {
+	if strings.EqualFold(key, nats.WatermillUUIDHdr) || strings.EqualFold(key, nc.MsgIdHdr) {
+		return true
+	}
+	for _, reserved := range deliveryKeys {
+		if strings.EqualFold(key, reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+// publishExamples publishes a "hello from" message to every topic each interval until ctx is done,
+// numbered by the exampleRoundKey metadata. Every message gets its own UUID: the topics share a
+// stream, and DEDUP, IDEMPOTENCY_BUCKET and DUPLICATE_CACHE_SIZE would drop the messages of a round
+// reusing one, or of a restarted process counting from 0 again.
+// It stops at the first failed publish and returns its error
+func publishExamples(ctx context.Context, pub Publisher, topics []string, interval time.Duration) error {
+	for i := 0; ctx.Err() == nil; i++ {
+		round := strconv.Itoa(i)
+		for _, topic := range topics {
+			msg := message.NewMessage(watermill.NewUUID(), []byte("hello from "+strings.TrimPrefix(topic, "example_topic.")))
+			msg.Metadata.Set(exampleRoundKey, round)
+			err := pub.Publish(topic, msg)
+			if errors.Is(err, context.Canceled) {
+				// shutting down
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+	}
+	return nil
+}
+
+// publishWithTimeout publishes msg to topic, giving up when the ack does not land
+// within timeout or when ctx is cancelled. The publish itself cannot be interrupted,
+// so it keeps running in the background after the helper gave up.
+// Published from within a handler, msg carries the correlation ID of the handled message
+func publishWithTimeout(ctx context.Context, pub Publisher, topic string, msg *message.Message, timeout time.Duration) error {
+	withCorrelationID(ctx, msg)
+	ctx, span := startPublishSpan(ctx, topic, msg)
+	defer span.End()
+
+	err := func() error {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- pub.Publish(topic, msg)
+		}()
+
+		select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("%w: no ack for message %s on %s after %s", ErrPublishTimeout, msg.UUID, topic, timeout)
+			}
+			return ctx.Err()
+		}
+	}()
+	if err != nil {
+		err = classifyError(err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// syncPublisher publishes to JetStream and waits for the server ack of every message,
+// for the subjects that need a confirmation before the caller moves on
+type syncPublisher struct {
+	js        nc.JetStreamContext
+	marshaler nats.Marshaler
+	jsConfig  nats.JetStreamConfig
+}
+
+// newSyncPublisher creates a syncPublisher sharing the connection of the publisher
+func newSyncPublisher(conn *nc.Conn, marshaler nats.Marshaler, jsConfig nats.JetStreamConfig) (*syncPublisher, error) {
+	js, err := conn.JetStream(jsConfig.ConnectOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return &syncPublisher{js: js, marshaler: marshaler, jsConfig: jsConfig}, nil
+}
+
+// PublishSync publishes msg to topic and waits until JetStream stored it. On success the
+// stream and the sequence number the message was stored at are added to msg.Metadata under
+// streamKey and streamSequenceKey, so that the caller can log or store them for auditing
+func (p *syncPublisher) PublishSync(topic string, msg *message.Message) error {
+	if err := validateSubject(topic); err != nil {
+		return err
+	}
+	_, span := startPublishSpan(msg.Context(), topic, msg)
+	defer span.End()
+
+	ack, err := func() (*nc.PubAck, error) {
+		natsMsg, err := p.marshaler.Marshal(topic, msg)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrMarshal, err)
+		}
+		opts := p.jsConfig.PublishOptions
+		if p.jsConfig.TrackMsgId {
+			opts = append(opts, nc.MsgId(msg.UUID))
+		}
+		return p.js.PublishMsg(natsMsg, opts...)
+	}()
+	if err != nil {
+		err = classifyPublishError(err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	msg.Metadata.Set(streamKey, ack.Stream)
+	msg.Metadata.Set(streamSequenceKey, strconv.FormatUint(ack.Sequence, 10))
+	return nil
+}
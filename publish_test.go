@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+// the example topics share a stream, messages reusing a UUID would be dropped as duplicates
+func TestPublishExamplesUniqueUUIDs(t *testing.T) {
+	url := runServer(t, true)
+	js := addStream(t, connect(t, url), "example_topic", "example_topic.>")
+	marshaler, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// DEDUP publishes the UUIDs as Nats-Msg-Id, the stream drops a reused one
+	natsPub, err := newPublisher(nats.PublisherConfig{
+		URL:       url,
+		Marshaler: marshaler,
+		JetStream: nats.JetStreamConfig{TrackMsgId: true},
+	}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer natsPub.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	uuids := make(map[string]string)
+	rounds := make(map[string]int)
+	pub := publisherFunc(func(topic string, msg *message.Message) error {
+		if previous, ok := uuids[msg.UUID]; ok {
+			t.Errorf("%s reuses the UUID %s of a message to %s", topic, msg.UUID, previous)
+		}
+		uuids[msg.UUID] = topic
+		rounds[msg.Metadata.Get(exampleRoundKey)]++
+		if len(uuids) == 2*len(publishTopics) {
+			cancel()
+		}
+		return natsPub.Publish(topic, msg)
+	})
+	if err := publishExamples(ctx, pub, publishTopics, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if rounds["0"] != len(publishTopics) || rounds["1"] != len(publishTopics) {
+		t.Errorf("messages per round = %v, want %d in rounds 0 and 1", rounds, len(publishTopics))
+	}
+	info, err := js.StreamInfo("example_topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := uint64(2 * len(publishTopics)); info.State.Msgs != want {
+		t.Errorf("stream stored %d messages, want %d", info.State.Msgs, want)
+	}
+}
+
+func TestPublishWithHeadersArriveAsNATSHeaders(t *testing.T) {
+	url := runServer(t, false)
+	marshaler, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := nats.NewPublisher(nats.PublisherConfig{
+		URL:       url,
+		Marshaler: marshaler,
+		JetStream: nats.JetStreamConfig{Disabled: true},
+	}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	conn := connect(t, url)
+	raw, err := conn.SubscribeSync("example_topic.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the subscription must reach the server before the publisher connection publishes
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	headers := map[string]string{"Tenant": "acme", "trace-id": "abc123"}
+	if err := (HeaderPublisher{pub}).PublishWithHeaders("example_topic.a", []byte("hello"), headers); err != nil {
+		t.Fatal(err)
+	}
+	natsMsg, err := raw.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each entry is the NATS header of the same name, case included
+	for key, want := range headers {
+		if got := natsMsg.Header.Get(key); got != want {
+			t.Errorf("NATS header %s = %q, want %q", key, got, want)
+		}
+	}
+	if natsMsg.Header.Get(nats.WatermillUUIDHdr) == "" {
+		t.Error("the message was published without a UUID")
+	}
+	// and the consumer reads them back from the metadata
+	msg, err := marshaler.Unmarshal(natsMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range headers {
+		if got := msg.Metadata.Get(key); got != want {
+			t.Errorf("metadata %s = %q, want %q", key, got, want)
+		}
+	}
+	if string(msg.Payload) != "hello" {
+		t.Errorf("payload = %q", msg.Payload)
+	}
+}
+
+func TestPublishWithHeadersRejectsReserved(t *testing.T) {
+	pub := HeaderPublisher{publisherFunc(func(topic string, msg *message.Message) error {
+		t.Errorf("a message with a reserved header was published: %v", msg.Metadata)
+		return nil
+	})}
+	for _, key := range []string{nats.WatermillUUIDHdr, nc.MsgIdHdr, subjectKey, "nats-delivered-subject"} {
+		if err := pub.PublishWithHeaders("example_topic.a", nil, map[string]string{key: "x"}); !errors.Is(err, ErrMarshal) {
+			t.Errorf("%s: err = %v, want ErrMarshal", key, err)
+		}
+	}
+}
+
+// fakePublisher records the messages published to it, or fails every publish with err when set
+type fakePublisher struct {
+	err       error
+	topics    []string
+	published []*message.Message
+}
+
+func (p *fakePublisher) Publish(topic string, messages ...*message.Message) error {
+	if p.err != nil {
+		return p.err
+	}
+	for _, msg := range messages {
+		p.topics = append(p.topics, topic)
+		p.published = append(p.published, msg)
+	}
+	return nil
+}
+
+func (p *fakePublisher) Close() error {
+	return nil
+}
+
+func TestPublishExamples(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	pub := &fakePublisher{}
+	if err := publishExamples(ctx, pub, []string{"example_topic.a", "example_topic.b"}, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if len(pub.published) < 4 {
+		t.Fatalf("%d messages published, want at least two rounds", len(pub.published))
+	}
+	// every round publishes to the topics in order
+	for i, msg := range pub.published {
+		topic, suffix := "example_topic.a", "a"
+		if i%2 == 1 {
+			topic, suffix = "example_topic.b", "b"
+		}
+		if pub.topics[i] != topic || string(msg.Payload) != "hello from "+suffix || msg.Metadata.Get(exampleRoundKey) != strconv.Itoa(i/2) {
+			t.Errorf("message %d: %q to %s in round %s, want %q to %s in round %d", i, msg.Payload, pub.topics[i], msg.Metadata.Get(exampleRoundKey), "hello from "+suffix, topic, i/2)
+		}
+	}
+
+	// a cancelled context publishes nothing
+	pub = &fakePublisher{}
+	if err := publishExamples(ctx, pub, []string{"example_topic.a"}, time.Millisecond); err != nil || len(pub.published) != 0 {
+		t.Errorf("publishExamples after cancellation = %v with %d messages published, want nothing", err, len(pub.published))
+	}
+
+	errDown := errors.New("cluster down")
+	tests := []struct {
+		name    string
+		err     error
+		wantErr error
+	}{
+		{"failed publish", errDown, errDown},
+		// a publish interrupted by the shutdown is not a failure
+		{"publish cancelled", context.Canceled, nil},
+	}
+	for _, tt := range tests {
+		err := publishExamples(context.Background(), &fakePublisher{err: tt.err}, []string{"example_topic.a"}, time.Millisecond)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: publishExamples = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestMultiPublisher(t *testing.T) {
+	errDown := errors.New("cluster down")
+	tests := []struct {
+		name                  string
+		primaryErr, mirrorErr error
+		wantErr               bool
+	}{
+		{"both succeed", nil, nil, false},
+		{"mirror fails", nil, errDown, false},
+		{"primary fails", errDown, nil, false},
+		{"both fail", errDown, errDown, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary, mirror := &fakePublisher{err: tt.primaryErr}, &fakePublisher{err: tt.mirrorErr}
+			logger := watermill.NewCaptureLogger()
+			pub := multiPublisher{publishers: []Publisher{primary, mirror}, logger: logger}
+			msg := message.NewMessage(watermill.NewUUID(), []byte("order"))
+			err := pub.Publish("orders.1", msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, errDown) {
+					t.Errorf("error = %v, want %v", err, errDown)
+				}
+				return
+			}
+			for name, fake := range map[string]*fakePublisher{"primary": primary, "mirror": mirror} {
+				if fake.err != nil {
+					continue
+				}
+				if len(fake.published) != 1 || fake.published[0] != msg || fake.topics[0] != "orders.1" {
+					t.Errorf("%s received %v on %v, want %s on orders.1", name, fake.published, fake.topics, msg.UUID)
+				}
+			}
+			// the failure of a single publisher is logged instead of returned
+			if failures := len(logger.Captured()[watermill.ErrorLogLevel]); (tt.primaryErr != nil || tt.mirrorErr != nil) != (failures == 1) {
+				t.Errorf("%d failures logged", failures)
+			}
+		})
+	}
+}
+
+func TestDryRunPublishesNothing(t *testing.T) {
+	conn := connect(t, runServer(t, false))
+	sub, err := conn.SubscribeSync(">")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := watermill.NewCaptureLogger()
+	pub := dryRunPublisher{logger}
+	messages := []*message.Message{
+		message.NewMessage(watermill.NewUUID(), []byte("order 1")),
+		message.NewMessage(watermill.NewUUID(), []byte("order 22")),
+	}
+	if err := pub.Publish("orders.1", messages...); err != nil {
+		t.Fatal(err)
+	}
+
+	logged := logger.Captured()[watermill.InfoLogLevel]
+	if len(logged) != len(messages) {
+		t.Fatalf("%d messages logged, want %d", len(logged), len(messages))
+	}
+	for i, entry := range logged {
+		if entry.Fields["topic"] != "orders.1" || entry.Fields["message_uuid"] != messages[i].UUID || entry.Fields["payload_size"] != len(messages[i].Payload) {
+			t.Errorf("logged %v, want message %s on orders.1", entry.Fields, messages[i].UUID)
+		}
+	}
+	if msg, err := sub.NextMsg(100 * time.Millisecond); !errors.Is(err, nc.ErrTimeout) {
+		t.Errorf("a dry run reached NATS: %v, %v", msg, err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"nats/metrics"
+)
+
+// quotaWindow is the sliding window the publish quotas are counted over
+const quotaWindow = time.Second
+
+// publishQuota bounds the messages and payload bytes published per second to the subjects
+// starting with prefix, 0 leaving the dimension unbounded
+type publishQuota struct {
+	prefix   string
+	messages int
+	bytes    int
+
+	mu sync.Mutex
+	// sent are the publishes of the last quotaWindow, oldest first
+	sent      []quotaUsage
+	sentBytes int
+}
+
+// quotaUsage is one publish counted against a quota
+type quotaUsage struct {
+	at    time.Time
+	bytes int
+}
+
+// publishQuotas are the quotas of PUBLISH_QUOTAS, the longest prefix matching a subject applies
+type publishQuotas []*publishQuota
+
+// loadPublishQuotas parses PUBLISH_QUOTAS, a comma-separated list of <prefix>=<messages>:<bytes>
+// per second, e.g. "orders.=100:1048576,audit.=:65536". It returns nil when it is unset
+func loadPublishQuotas() (publishQuotas, error) {
+	spec := os.Getenv("PUBLISH_QUOTAS")
+	if spec == "" {
+		return nil, nil
+	}
+	var quotas publishQuotas
+	for _, entry := range strings.Split(spec, ",") {
+		prefix, limits, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || prefix == "" {
+			return nil, fmt.Errorf("invalid PUBLISH_QUOTAS entry %q, expected <prefix>=<messages>:<bytes>", entry)
+		}
+		messages, bytes, _ := strings.Cut(limits, ":")
+		q := &publishQuota{prefix: prefix}
+		var err error
+		if q.messages, err = parseQuotaLimit(messages); err != nil {
+			return nil, fmt.Errorf("invalid PUBLISH_QUOTAS messages of %s: %w", prefix, err)
+		}
+		if q.bytes, err = parseQuotaLimit(bytes); err != nil {
+			return nil, fmt.Errorf("invalid PUBLISH_QUOTAS bytes of %s: %w", prefix, err)
+		}
+		if q.messages == 0 && q.bytes == 0 {
+			return nil, fmt.Errorf("PUBLISH_QUOTAS entry %q sets no limit", entry)
+		}
+		quotas = append(quotas, q)
+	}
+	return quotas, nil
+}
+
+// parseQuotaLimit parses a limit of PUBLISH_QUOTAS, empty meaning unbounded
+func parseQuotaLimit(limit string) (int, error) {
+	if limit == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(limit)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a non-negative number", limit)
+	}
+	return n, nil
+}
+
+// quotaOf returns the quota of topic, nil when no prefix matches it
+func (q publishQuotas) quotaOf(topic string) *publishQuota {
+	var match *publishQuota
+	for _, quota := range q {
+		if strings.HasPrefix(topic, quota.prefix) && (match == nil || len(quota.prefix) > len(match.prefix)) {
+			match = quota
+		}
+	}
+	return match
+}
+
+// admit counts the publish of msg to topic against its quota, or rejects it with ErrQuotaExceeded
+// when the quota would be exceeded. Rejected publishes are not counted
+func (q publishQuotas) admit(topic string, msg *message.Message) error {
+	quota := q.quotaOf(topic)
+	if quota == nil {
+		return nil
+	}
+	if err := quota.admit(time.Now(), len(msg.Payload)); err != nil {
+		metrics.QuotaRejected.WithLabelValues(metrics.Subject(topic)).Inc()
+		return fmt.Errorf("%w: %s on %s", ErrQuotaExceeded, err, topic)
+	}
+	return nil
+}
+
+// admit counts a publish of size bytes at now, unless it would exceed the quota
+func (q *publishQuota) admit(now time.Time, size int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	expired := 0
+	for expired < len(q.sent) && now.Sub(q.sent[expired].at) >= quotaWindow {
+		q.sentBytes -= q.sent[expired].bytes
+		expired++
+	}
+	q.sent = q.sent[expired:]
+
+	if q.messages > 0 && len(q.sent)+1 > q.messages {
+		return fmt.Errorf("more than %d messages per second to %s", q.messages, q.prefix)
+	}
+	if q.bytes > 0 && q.sentBytes+size > q.bytes {
+		return fmt.Errorf("more than %d bytes per second to %s", q.bytes, q.prefix)
+	}
+	q.sent = append(q.sent, quotaUsage{at: now, bytes: size})
+	q.sentBytes += size
+	return nil
+}
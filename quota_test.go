@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestPublishQuotas(t *testing.T) {
+	t.Setenv("PUBLISH_QUOTAS", "orders.=2:,orders.eu.=:10,audit.=:1048576")
+	quotas, err := loadPublishQuotas()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish := func(topic string, payload string) error {
+		return quotas.admit(topic, message.NewMessage(watermill.NewUUID(), []byte(payload)))
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := publish("orders.us", "order"); err != nil {
+			t.Fatalf("publish %d: %v", i+1, err)
+		}
+	}
+	if err := publish("orders.us", "order"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("third publish to orders.us = %v, want %v", err, ErrQuotaExceeded)
+	}
+	// the other topics have quotas of their own, or none
+	if err := publish("audit.login", "login"); err != nil {
+		t.Errorf("publish to audit.login = %v", err)
+	}
+	if err := publish("metrics.cpu", "42"); err != nil {
+		t.Errorf("publish to metrics.cpu = %v", err)
+	}
+	// the longest prefix applies, here its byte quota
+	if err := publish("orders.eu.west", "12345678"); err != nil {
+		t.Errorf("publish to orders.eu.west = %v", err)
+	}
+	if err := publish("orders.eu.west", "123"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("publish past the byte quota of orders.eu = %v, want %v", err, ErrQuotaExceeded)
+	}
+}
+
+func TestPublishQuotaSlidingWindow(t *testing.T) {
+	q := &publishQuota{prefix: "orders.", messages: 2}
+	start := time.Now()
+	for _, at := range []time.Duration{0, 500 * time.Millisecond} {
+		if err := q.admit(start.Add(at), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.admit(start.Add(900*time.Millisecond), 1); err == nil {
+		t.Error("a third message within the window was admitted")
+	}
+	// the first publish left the window, the rejected one was not counted
+	if err := q.admit(start.Add(time.Second), 1); err != nil {
+		t.Errorf("publish once the first one left the window = %v", err)
+	}
+	if err := q.admit(start.Add(1200*time.Millisecond), 1); err == nil {
+		t.Error("a third message within the window was admitted")
+	}
+}
+
+func TestLoadPublishQuotasInvalid(t *testing.T) {
+	for _, spec := range []string{"orders.", "=1:1", "orders.=:", "orders.=-1:", "orders.=many:"} {
+		t.Setenv("PUBLISH_QUOTAS", spec)
+		if _, err := loadPublishQuotas(); err == nil {
+			t.Errorf("PUBLISH_QUOTAS=%q was accepted", spec)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"golang.org/x/time/rate"
+)
+
+// newRateLimiter returns the token bucket configured by RATE_LIMIT (messages per second)
+// and RATE_BURST (default 1), or nil when RATE_LIMIT is unset, which disables rate limiting
+func newRateLimiter() (*rate.Limiter, error) {
+	limit, err := getEnvInt("RATE_LIMIT", 0)
+	if err != nil {
+		return nil, err
+	}
+	if limit == 0 {
+		return nil, nil
+	}
+	burst, err := getEnvInt("RATE_BURST", 1)
+	if err != nil {
+		return nil, err
+	}
+	if limit < 0 || burst < 1 {
+		return nil, fmt.Errorf("RATE_LIMIT must be positive and RATE_BURST at least 1, got %d and %d", limit, burst)
+	}
+	return rate.NewLimiter(rate.Limit(limit), burst), nil
+}
+
+// rateLimited blocks each message until the limiter grants a token. The limiter is shared by every
+// goroutine of a subscriber, so the limit applies to the subscriber as a whole.
+// If ctx is cancelled while waiting, the message is nacked without being processed
+func rateLimited(limiter *rate.Limiter) Middleware {
+	return func(h Handler) Handler {
+		if limiter == nil {
+			return h
+		}
+		return func(ctx context.Context, msg *message.Message) error {
+			if err := limiter.Wait(ctx); err != nil {
+				return fmt.Errorf("rate limiter: %w", err)
+			}
+			return h(ctx, msg)
+		}
+	}
+}
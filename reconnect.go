@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+
+	"nats/metrics"
+)
+
+// errPublishDropped is returned by publishGate.wait for a message dropped because the gate was full
+var errPublishDropped = errors.New("publish dropped while reconnecting")
+
+// publishGate holds the publishes on a connection that is down until it is reconnected, so that
+// an outage pauses the publish loop instead of failing every publish. It follows the connections
+// through the connEvents notifications. At most max publishes are held, the next ones are dropped
+type publishGate struct {
+	max    int
+	logger watermill.LoggerAdapter
+
+	mu sync.Mutex
+	// down is closed when the connection is reconnected or closed
+	down    map[*nc.Conn]chan struct{}
+	waiting int
+}
+
+// loadPublishGate returns the gate holding up to PUBLISH_BUFFER_SIZE publishes, nil when it is 0:
+// publishes then go through during outages and fail
+func loadPublishGate(logger watermill.LoggerAdapter) (*publishGate, error) {
+	max, err := getEnvInt("PUBLISH_BUFFER_SIZE", 1000)
+	if err != nil {
+		return nil, err
+	}
+	if max < 0 {
+		return nil, fmt.Errorf("PUBLISH_BUFFER_SIZE must not be negative, got %d", max)
+	}
+	if max == 0 {
+		return nil, nil
+	}
+	return &publishGate{max: max, logger: logger, down: make(map[*nc.Conn]chan struct{})}, nil
+}
+
+// notify is the connEvents notification tracking which connections are down
+func (g *publishGate) notify(event connEvent, conn *nc.Conn) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch event {
+	case connDisconnected:
+		if _, ok := g.down[conn]; !ok {
+			g.down[conn] = make(chan struct{})
+		}
+	case connReconnected, connClosed:
+		// a closed connection is not coming back, the held publishes fail on it
+		if reconnected, ok := g.down[conn]; ok {
+			close(reconnected)
+			delete(g.down, conn)
+		}
+	}
+}
+
+// wait returns once conn is connected, at once when it is. It returns errPublishDropped when
+// max publishes are already held, and the error of ctx when it is done first. A nil g never waits
+func (g *publishGate) wait(ctx context.Context, conn *nc.Conn, topic string, msg *message.Message) error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	reconnected, down := g.down[conn]
+	if !down {
+		g.mu.Unlock()
+		return nil
+	}
+	if g.waiting >= g.max {
+		g.mu.Unlock()
+		metrics.PublishDropped.WithLabelValues(metrics.Subject(topic)).Inc()
+		g.logger.Info("Publish buffer full while reconnecting, message dropped", watermill.LogFields{
+			"topic":        topic,
+			"message_uuid": msg.UUID,
+		})
+		return errPublishDropped
+	}
+	g.waiting++
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		g.waiting--
+		g.mu.Unlock()
+	}()
+	select {
+	case <-reconnected:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/nats-io/nats-server/v2/server"
+	nc "github.com/nats-io/nats.go"
+)
+
+func TestPublishGateHoldsPublishesWhileReconnecting(t *testing.T) {
+	s := startServer(t, &server.Options{})
+	port := s.Addr().(*net.TCPAddr).Port
+	t.Setenv("PUBLISH_BUFFER_SIZE", "1")
+	gate, err := loadPublishGate(watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshaler, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := newPublisher(nats.PublisherConfig{
+		URL:         s.ClientURL(),
+		Marshaler:   marshaler,
+		JetStream:   nats.JetStreamConfig{Disabled: true},
+		NatsOptions: append(newConnEvents(watermill.NopLogger{}, gate.notify).options(), nc.MaxReconnects(-1), nc.ReconnectWait(50*time.Millisecond)),
+	}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	conn := pub.Conn()
+	publish := func(ctx context.Context, msg *message.Message) error {
+		if err := gate.wait(ctx, conn, "telemetry.cpu", msg); err != nil {
+			return err
+		}
+		return pub.Publish("telemetry.cpu", msg)
+	}
+	if err := publish(context.Background(), message.NewMessage(watermill.NewUUID(), nil)); err != nil {
+		t.Fatalf("publish while connected: %v", err)
+	}
+
+	s.Shutdown()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		gate.mu.Lock()
+		_, down := gate.down[conn]
+		gate.mu.Unlock()
+		if down {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the gate was not notified of the disconnection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	held := make(chan error, 1)
+	go func() { held <- publish(context.Background(), message.NewMessage(watermill.NewUUID(), []byte("held"))) }()
+	select {
+	case err := <-held:
+		t.Fatalf("publish returned %v while disconnected, want it held", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// the gate holds a single publish, the next one is dropped
+	if err := publish(context.Background(), message.NewMessage(watermill.NewUUID(), nil)); !errors.Is(err, errPublishDropped) {
+		t.Errorf("publish past the buffer = %v, want %v", err, errPublishDropped)
+	}
+	// a publish whose context ends first gives up
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	gate.mu.Lock()
+	gate.max = 2
+	gate.mu.Unlock()
+	if err := publish(ctx, message.NewMessage(watermill.NewUUID(), nil)); !errors.Is(err, context.Canceled) {
+		t.Errorf("publish with a cancelled context = %v, want %v", err, context.Canceled)
+	}
+
+	restarted := startServer(t, &server.Options{Port: port})
+	select {
+	case err := <-held:
+		if err != nil {
+			t.Fatalf("held publish: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the held publish was not released once reconnected")
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	varz, err := restarted.Varz(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if varz.InMsgs != 1 {
+		t.Errorf("the restarted server received %d messages, want the held one", varz.InMsgs)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	nc "github.com/nats-io/nats.go"
+)
+
+// replayIdleTimeout ends a replay until the end of the stream when no message arrives,
+// which happens when nothing was stored after the start position
+const replayIdleTimeout = 5 * time.Second
+
+// replayStart parses the environment variable key, REPLAY_FROM or EXPORT_FROM, either an RFC3339
+// timestamp or a stream sequence number
+func replayStart(key, from string) (nc.SubOpt, error) {
+	if seq, err := strconv.ParseUint(from, 10, 64); err == nil {
+		if seq == 0 {
+			return nil, fmt.Errorf("%s sequence numbers start at 1", key)
+		}
+		return nc.StartSequence(seq), nil
+	}
+	t, err := time.Parse(time.RFC3339, from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q, expected an RFC3339 timestamp or a sequence number", key, from)
+	}
+	return nc.StartTime(t), nil
+}
+
+// startSequence returns the stream sequence of a REPLAY_FROM or EXPORT_FROM value, 0 for a timestamp
+func startSequence(from string) uint64 {
+	seq, err := strconv.ParseUint(from, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return seq
+}
+
+// streamInfoer is what checkStartSequence needs from JetStream, nc.JetStreamContext implements it
+type streamInfoer interface {
+	StreamNameBySubject(subject string, opts ...nc.JSOpt) (string, error)
+	StreamInfo(stream string, opts ...nc.JSOpt) (*nc.StreamInfo, error)
+}
+
+// checkStartSequence reports an error, with the range of valid sequences, when seq is not
+// stored in the stream of each of topics: the consumer would otherwise start past its end,
+// or silently at its first message
+func checkStartSequence(js streamInfoer, topics []string, seq uint64) error {
+	for _, topic := range topics {
+		stream, err := js.StreamNameBySubject(topic)
+		if err != nil {
+			return fmt.Errorf("cannot find the stream of %s: %w", topic, err)
+		}
+		info, err := js.StreamInfo(stream)
+		if err != nil {
+			return fmt.Errorf("cannot read stream %s: %w", stream, err)
+		}
+		if info.State.Msgs == 0 {
+			return fmt.Errorf("cannot start at sequence %d of %s, stream %s is empty", seq, topic, stream)
+		}
+		if first, last := info.State.FirstSeq, info.State.LastSeq; seq < first || seq > last {
+			return fmt.Errorf("cannot start at sequence %d of %s, stream %s holds sequences %d to %d", seq, topic, stream, first, last)
+		}
+	}
+	return nil
+}
+
+// replay consumes topics again from start with an ephemeral consumer each, so that the durable
+// consumers of the subscribers keep their position, and processes every message with h.
+// Each consumer filters on its topic, so that starting at seq, the stream sequence of start if any,
+// delivers the messages of the topic from there. seq is checked against the stream first.
+// With untilEnd it returns once it caught up with the end of the stream, otherwise once
+// ctx is done. It returns the number of replayed messages
+func replay(ctx context.Context, config nats.SubscriberConfig, topics []string, start nc.SubOpt, seq uint64, untilEnd bool, h Handler, logger watermill.LoggerAdapter) (int, error) {
+	// no queue group and no durable name make the consumer ephemeral
+	config.QueueGroupPrefix = ""
+	config.SubscribersCount = 1
+	config.JetStream.DurablePrefix = ""
+	config.JetStream.DurableCalculator = nil
+	config.JetStream.SubscribeOptions = append(append([]nc.SubOpt(nil), config.JetStream.SubscribeOptions...), start)
+
+	sub, err := newSubscriber(config, logger)
+	if err != nil {
+		return 0, err
+	}
+	defer sub.Close()
+	if seq > 0 {
+		js, err := sub.Conn().JetStream()
+		if err != nil {
+			return 0, err
+		}
+		if err := checkStartSequence(js, topics, seq); err != nil {
+			return 0, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sub.topics = topics
+	messages, err := sub.subscribeAll(ctx, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	// each topic has its own consumer, which caught up once it delivered a message with none pending
+	replayed, caughtUp := 0, 0
+	idle := time.NewTimer(replayIdleTimeout)
+	defer idle.Stop()
+	for {
+		var idleC <-chan time.Time
+		if untilEnd {
+			idleC = idle.C
+		}
+		select {
+		case <-ctx.Done():
+			return replayed, nil
+		case <-idleC:
+			return replayed, nil
+		case msg, ok := <-messages:
+			if !ok {
+				return replayed, nil
+			}
+			if err := h(msg.Context(), msg); err != nil {
+				msg.Nack()
+			} else {
+				msg.Ack()
+			}
+			replayed++
+			// the consumer has no message left once it delivered the last one of the stream
+			if untilEnd && msg.Metadata.Get(numPendingKey) == "0" {
+				if caughtUp++; caughtUp == len(topics) {
+					return replayed, nil
+				}
+			}
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(replayIdleTimeout)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+func TestReplayFromSequence(t *testing.T) {
+	url := runServer(t, true)
+	js := addStream(t, connect(t, url), "orders", "orders.>")
+	marshaler, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := newPublisher(nats.PublisherConfig{URL: url, Marshaler: marshaler}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	// sequences 1 to 6 alternate between orders.eu and orders.us
+	for i := 1; i <= 6; i++ {
+		subject := "orders.eu"
+		if i%2 == 0 {
+			subject = "orders.us"
+		}
+		if err := pub.Publish(subject, message.NewMessage(watermill.NewUUID(), []byte(strconv.Itoa(i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a durable consumer of the subscribers, which the replay must leave where it is
+	if _, err := js.AddConsumer("orders", &nc.ConsumerConfig{Durable: "subscriber", AckPolicy: nc.AckExplicitPolicy}); err != nil {
+		t.Fatal(err)
+	}
+
+	config := nats.SubscriberConfig{
+		URL:              url,
+		QueueGroupPrefix: "subscribers",
+		SubscribersCount: 4,
+		Unmarshaler:      marshaler,
+		JetStream:        nats.JetStreamConfig{DurablePrefix: "subscriber", AckAsync: true},
+	}
+	tests := []struct {
+		name   string
+		topics []string
+		from   string
+		want   []string
+	}{
+		{"from a sequence", []string{"orders.>"}, "3", []string{"3", "4", "5", "6"}},
+		{"filtered on a topic", []string{"orders.us"}, "3", []string{"4", "6"}},
+		{"last sequence", []string{"orders.>"}, "6", []string{"6"}},
+		{"from a time", []string{"orders.eu"}, "2000-01-01T00:00:00Z", []string{"1", "3", "5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, err := replayStart("REPLAY_FROM", tt.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			h := func(ctx context.Context, msg *message.Message) error {
+				got = append(got, string(msg.Payload))
+				return nil
+			}
+			replayed, err := replay(context.Background(), config, tt.topics, start, startSequence(tt.from), true, h, watermill.NopLogger{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replayed != len(tt.want) || len(got) != len(tt.want) {
+				t.Fatalf("replayed %d messages %v, want %v", replayed, got, tt.want)
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Fatalf("replayed %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	info, err := js.ConsumerInfo("orders", "subscriber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Delivered.Stream != 0 || info.NumPending != 6 {
+		t.Errorf("the durable consumer delivered up to %d with %d pending, want it untouched", info.Delivered.Stream, info.NumPending)
+	}
+}
+
+func TestReplayStartSequenceOutOfRange(t *testing.T) {
+	url := runServer(t, true)
+	conn := connect(t, url)
+	js := addStream(t, conn, "orders", "orders.>")
+	addStream(t, conn, "audit", "audit.>")
+	for i := 0; i < 3; i++ {
+		if _, err := js.Publish("orders.eu", []byte("order")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		topics []string
+		seq    uint64
+		valid  bool
+	}{
+		{[]string{"orders.>"}, 1, true},
+		{[]string{"orders.eu"}, 3, true},
+		{[]string{"orders.>"}, 4, false},
+		{[]string{"audit.>"}, 1, false},
+		{[]string{"orders.>", "audit.>"}, 1, false},
+		{[]string{"metrics.>"}, 1, false},
+	}
+	for _, tt := range tests {
+		if err := checkStartSequence(js, tt.topics, tt.seq); (err == nil) != tt.valid {
+			t.Errorf("sequence %d of %v: error = %v, want valid %v", tt.seq, tt.topics, err, tt.valid)
+		}
+	}
+}
+
+func TestReplayStart(t *testing.T) {
+	for _, from := range []string{"0", "-1", "yesterday", "2024-01-02"} {
+		if _, err := replayStart("REPLAY_FROM", from); err == nil {
+			t.Errorf("REPLAY_FROM=%q was accepted", from)
+		}
+	}
+	for from, want := range map[string]uint64{"42": 42, "2024-01-02T15:04:05Z": 0} {
+		if _, err := replayStart("REPLAY_FROM", from); err != nil {
+			t.Errorf("REPLAY_FROM=%q: %v", from, err)
+		}
+		if got := startSequence(from); got != want {
+			t.Errorf("startSequence(%q) = %d, want %d", from, got, want)
+		}
+	}
+}
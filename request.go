@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+// RequestReply implements synchronous request/response over core NATS.
+// Requests are ephemeral: their subjects must not be captured by a stream,
+// otherwise JetStream stores the request and answers it with a publish ack
+type RequestReply struct {
+	conn      *nc.Conn
+	marshaler nats.MarshalerUnmarshaler
+}
+
+// NewRequestReply creates a RequestReply on conn, encoding messages with marshaler
+func NewRequestReply(conn *nc.Conn, marshaler nats.MarshalerUnmarshaler) *RequestReply {
+	return &RequestReply{conn: conn, marshaler: marshaler}
+}
+
+// Request publishes msg to subject with a unique reply subject and waits for the first reply,
+// until timeout elapses or ctx is done. When nobody is subscribed to subject, the server answers
+// at once and Request fails with ErrNoResponders instead of waiting for the timeout. Servers that
+// do not support headers cannot send that answer, requests to them time out
+func (r *RequestReply) Request(ctx context.Context, subject string, msg *message.Message, timeout time.Duration) (*message.Message, error) {
+	natsMsg, err := r.marshaler.Marshal(subject, msg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMarshal, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	// the connection creates the unique inbox the responder replies to
+	resp, err := r.conn.RequestMsgWithContext(ctx, natsMsg)
+	if errors.Is(err, nc.ErrNoResponders) {
+		return nil, fmt.Errorf("%w: request on %s: %w", ErrNoResponders, subject, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("request on %s: %w", subject, err)
+	}
+	reply, err := r.marshaler.Unmarshal(resp)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMarshal, err)
+	}
+	return reply, nil
+}
+
+// Respond sends reply to the requester of req, it is meant to be called from a handler
+// processing a request delivered by a core NATS subscription
+func (r *RequestReply) Respond(req *message.Message, reply *message.Message) error {
+	replySubject := req.Metadata.Get(replySubjectKey)
+	if replySubject == "" {
+		return fmt.Errorf("message %s is not a request, it has no reply subject", req.UUID)
+	}
+	// the reply belongs to the same request as the message it answers
+	if correlationID, ok := headerValue(req, correlationIDKey); ok {
+		if _, set := headerValue(reply, correlationIDKey); !set {
+			reply.Metadata.Set(correlationIDKey, correlationID)
+		}
+	}
+	natsMsg, err := r.marshaler.Marshal(replySubject, reply)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrMarshal, err)
+	}
+	return r.conn.PublishMsg(natsMsg)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+// newTestRequestReply returns a RequestReply over core NATS on an in-process server
+func newTestRequestReply(t *testing.T) (*RequestReply, *nc.Conn) {
+	t.Helper()
+	conn := connect(t, runServer(t, false))
+	marshaler, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewRequestReply(conn, marshaler), conn
+}
+
+func TestRequestRespond(t *testing.T) {
+	rr, conn := newTestRequestReply(t)
+	// the responder decodes the request like a subscriber and answers it from its handler
+	_, err := conn.Subscribe("control.ping", func(natsMsg *nc.Msg) {
+		req, err := rr.marshaler.Unmarshal(natsMsg)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := rr.Respond(req, message.NewMessage(watermill.NewUUID(), append([]byte("pong "), req.Payload...))); err != nil {
+			t.Error(err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := message.NewMessage(watermill.NewUUID(), []byte("1"))
+	req.Metadata.Set(correlationIDKey, "corr-1")
+	reply, err := rr.Request(context.Background(), "control.ping", req, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Payload) != "pong 1" {
+		t.Errorf("reply payload = %q, want %q", reply.Payload, "pong 1")
+	}
+	if v := reply.Metadata.Get(correlationIDKey); v != "corr-1" {
+		t.Errorf("reply %s = %q, want corr-1", correlationIDKey, v)
+	}
+}
+
+func TestRequestTimesOut(t *testing.T) {
+	rr, conn := newTestRequestReply(t)
+	// a responder that never answers
+	if _, err := conn.Subscribe("control.slow", func(*nc.Msg) {}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := rr.Request(context.Background(), "control.slow", message.NewMessage(watermill.NewUUID(), nil), 100*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestRespondRequiresReplySubject(t *testing.T) {
+	rr, _ := newTestRequestReply(t)
+	if err := rr.Respond(message.NewMessage("1", nil), message.NewMessage("2", nil)); err == nil {
+		t.Error("a message without reply subject was answered")
+	}
+}
+
+// a request nobody is subscribed to fails with the no-responders status of the server,
+// long before its timeout
+func TestRequestNoRespondersFailsFast(t *testing.T) {
+	rr, _ := newTestRequestReply(t)
+	const timeout = 10 * time.Second
+	start := time.Now()
+	_, err := rr.Request(context.Background(), "control.nobody", message.NewMessage(watermill.NewUUID(), nil), timeout)
+	if !errors.Is(err, ErrNoResponders) {
+		t.Fatalf("err = %v, want ErrNoResponders", err)
+	}
+	if elapsed := time.Since(start); elapsed > timeout/10 {
+		t.Errorf("request failed after %s, want right away", elapsed)
+	}
+}
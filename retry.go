@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// publishRetry publishes again the messages whose publish failed on a transient error, after
+// the backoff of base and max. Messages are retried as they are, with DEDUP the retries carry
+// the same Nats-Msg-Id and the stream drops the copies of a publish that had landed.
+// Without DEDUP, timed out publishes may have been stored and are not retried
+type publishRetry struct {
+	attempts int
+	backoff  backoff
+	dedup    bool
+	logger   watermill.LoggerAdapter
+}
+
+// loadPublishRetry returns the retry configured by PUBLISH_RETRY_ATTEMPTS, PUBLISH_RETRY_BACKOFF
+// and PUBLISH_RETRY_BACKOFF_MAX, nil when messages are published only once
+func loadPublishRetry(dedup bool, logger watermill.LoggerAdapter) (*publishRetry, error) {
+	attempts, err := getEnvInt("PUBLISH_RETRY_ATTEMPTS", 1)
+	if err != nil {
+		return nil, err
+	}
+	if attempts < 1 {
+		return nil, fmt.Errorf("PUBLISH_RETRY_ATTEMPTS must be at least 1, got %d", attempts)
+	}
+	if attempts == 1 {
+		return nil, nil
+	}
+	base, err := getEnvDuration("PUBLISH_RETRY_BACKOFF", 100*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	if base <= 0 {
+		return nil, fmt.Errorf("PUBLISH_RETRY_BACKOFF must be positive, got %s", base)
+	}
+	max, err := getEnvDuration("PUBLISH_RETRY_BACKOFF_MAX", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if max < base {
+		return nil, fmt.Errorf("PUBLISH_RETRY_BACKOFF_MAX (%s) must not be less than PUBLISH_RETRY_BACKOFF (%s)", max, base)
+	}
+	return &publishRetry{attempts: attempts, backoff: backoff{base: base, max: max}, dedup: dedup, logger: logger}, nil
+}
+
+// retryable reports whether a publish that failed with err may be attempted again.
+// Rejected credentials are not retried, they fail the same way until they are fixed
+func (r *publishRetry) retryable(err error) bool {
+	if errors.Is(err, ErrAuthentication) {
+		return false
+	}
+	if errors.Is(err, ErrConnection) {
+		return true
+	}
+	return r.dedup && errors.Is(err, ErrPublishTimeout)
+}
+
+// publish calls send until it succeeds, fails on an error that is not transient, ctx is done or
+// the attempts are exhausted, returning the last error. A nil r calls send once
+func (r *publishRetry) publish(ctx context.Context, topic string, msg *message.Message, send func() error) error {
+	if r == nil {
+		return send()
+	}
+	for attempt := 1; ; attempt++ {
+		err := send()
+		if err == nil || !r.retryable(err) {
+			return err
+		}
+		if attempt == r.attempts {
+			return fmt.Errorf("%w (gave up after %d attempts)", err, attempt)
+		}
+		delay := r.backoff.delay(attempt)
+		r.logger.Info("Publish failed, retrying", watermill.LogFields{
+			"topic":        topic,
+			"message_uuid": msg.UUID,
+			"attempt":      attempt,
+			"retry_in":     delay,
+			"err":          err,
+		})
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
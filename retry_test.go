@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestPublishRetryRetryable(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		dedup bool
+		sends int
+	}{
+		{"connection", fmt.Errorf("%w: closed", ErrConnection), false, 3},
+		{"authentication", classifyError(errors.New("nats: authorization violation")), false, 1},
+		{"authentication wrapped as connection", fmt.Errorf("%w: %w", ErrConnection, fmt.Errorf("%w: expired", ErrAuthentication)), false, 1},
+		{"timeout without dedup", ErrPublishTimeout, false, 1},
+		{"timeout with dedup", ErrPublishTimeout, true, 3},
+		{"payload", ErrPayloadTooLarge, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &publishRetry{attempts: 3, backoff: backoff{base: time.Millisecond, max: time.Millisecond}, dedup: tt.dedup, logger: watermill.NopLogger{}}
+			sends := 0
+			err := r.publish(context.Background(), "a", message.NewMessage(watermill.NewUUID(), nil), func() error {
+				sends++
+				return tt.err
+			})
+			if !errors.Is(err, tt.err) {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+			if sends != tt.sends {
+				t.Errorf("%d sends, want %d", sends, tt.sends)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// Router dispatches each message to the handler registered for its subject.
+// Patterns use NATS wildcards: "*" matches exactly one token and ">" matches
+// one or more trailing tokens. The first registered pattern matching the
+// subject wins, messages matching no pattern go to the fallback handler
+type Router struct {
+	routes   []route
+	fallback Handler
+}
+
+type route struct {
+	tokens  []string
+	handler Handler
+}
+
+// NewRouter creates a Router sending unmatched messages to fallback
+func NewRouter(fallback Handler) *Router {
+	return &Router{fallback: fallback}
+}
+
+// Handle registers h for the subjects matching pattern
+func (r *Router) Handle(pattern string, h Handler) error {
+	tokens := strings.Split(pattern, ".")
+	for i, token := range tokens {
+		if token == "" {
+			return fmt.Errorf("invalid pattern %q: empty token", pattern)
+		}
+		if token == ">" && i != len(tokens)-1 {
+			return fmt.Errorf("invalid pattern %q: \">\" must be the last token", pattern)
+		}
+	}
+	r.routes = append(r.routes, route{tokens: tokens, handler: h})
+	return nil
+}
+
+// Process is the Handler of the router, it calls the handler matching the subject
+// the message was delivered on
+func (r *Router) Process(ctx context.Context, msg *message.Message) error {
+	subject := strings.Split(msg.Metadata.Get(subjectKey), ".")
+	for _, route := range r.routes {
+		if matchSubject(route.tokens, subject) {
+			return route.handler(ctx, msg)
+		}
+	}
+	return r.fallback(ctx, msg)
+}
+
+// matchSubject reports whether the subject tokens match the pattern tokens
+func matchSubject(pattern, subject []string) bool {
+	for i, token := range pattern {
+		if token == ">" {
+			return len(subject) > i
+		}
+		if i >= len(subject) || (token != "*" && token != subject[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(subject)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestExampleRouterDispatch(t *testing.T) {
+	var got string
+	record := func(name string) Handler {
+		return func(context.Context, *message.Message) error {
+			got = name
+			return nil
+		}
+	}
+	router, err := newExampleRouter(record("a"), record("b"), record("fallback"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for subject, want := range map[string]string{
+		"example_topic.a":      "a",
+		"example_topic.a.test": "a",
+		"example_topic.b":      "b",
+		"example_topic.b.test": "b",
+		"example_topic.c":      "fallback",
+		"example_topic":        "fallback",
+		"other.a":              "fallback",
+	} {
+		got = ""
+		msg := message.NewMessage("1", nil)
+		msg.Metadata.Set(subjectKey, subject)
+		if err := router.Process(context.Background(), msg); err != nil {
+			t.Fatalf("%s: %v", subject, err)
+		}
+		if got != want {
+			t.Errorf("%s was handled by %q, want %q", subject, got, want)
+		}
+	}
+}
+
+func TestRouterFirstMatchWins(t *testing.T) {
+	var got string
+	router := NewRouter(func(context.Context, *message.Message) error { got = "fallback"; return nil })
+	for _, pattern := range []string{"orders.*", "orders.>"} {
+		pattern := pattern
+		if err := router.Handle(pattern, func(context.Context, *message.Message) error { got = pattern; return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for subject, want := range map[string]string{"orders.created": "orders.*", "orders.created.eu": "orders.>", "orders": "fallback"} {
+		msg := message.NewMessage("1", nil)
+		msg.Metadata.Set(subjectKey, subject)
+		_ = router.Process(context.Background(), msg)
+		if got != want {
+			t.Errorf("%s was handled by %q, want %q", subject, got, want)
+		}
+	}
+}
+
+func TestRouterRejectsInvalidPatterns(t *testing.T) {
+	router := NewRouter(nil)
+	for _, pattern := range []string{"orders..created", "orders.>.eu", ""} {
+		if err := router.Handle(pattern, nil); err == nil {
+			t.Errorf("pattern %q was accepted", pattern)
+		}
+	}
+}
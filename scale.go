@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	nc "github.com/nats-io/nats.go"
+)
+
+// subscriberGroup is the subscribers of one delivery route, sharing its queue group
+// so that they split its messages instead of each receiving all of them
+type subscriberGroup struct {
+	// create builds the i-th subscriber of the route, counting from 1, without subscribing it
+	create func(i int) (*subscriber, error)
+	active []*subscriber
+}
+
+// scaler adds and removes the subscribers of every route at runtime, so that the consumption
+// can follow the load without a restart. Scaling up creates and starts new subscribers,
+// scaling down drains the most recent ones, which finish their in-flight messages first
+type scaler struct {
+	// max is the largest number of subscribers per route
+	max int
+	// start subscribes a new subscriber and starts handling its messages
+	start func(sub *subscriber) error
+
+	mu     sync.Mutex
+	groups []*subscriberGroup
+	// closed is set on shutdown, after which the subscribers are not scaled anymore
+	closed bool
+}
+
+// add registers the subscribers created at startup for a route,
+// create builds the following ones when scaling up
+func (s *scaler) add(create func(i int) (*subscriber, error), subscribers []*subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups = append(s.groups, &subscriberGroup{create: create, active: subscribers})
+}
+
+// Scale sets the number of subscribers of every route to count, between 1 and max.
+// Draining the removed subscribers is bounded by ctx
+func (s *scaler) Scale(ctx context.Context, count int) error {
+	if count < 1 || count > s.max {
+		return fmt.Errorf("count must be between 1 and %d, got %d", s.max, count)
+	}
+	removed, errs := s.resize(count)
+	// the removed subscribers are drained without holding the lock, which the readiness probe needs
+	for _, sub := range removed {
+		if err := sub.Drain(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("cannot drain %s: %w", sub.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resize starts subscribers until every route has count of them,
+// and returns the ones to drain for the routes that have more
+func (s *scaler) resize(count int) (removed []*subscriber, errs []error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, []error{errors.New("shutting down")}
+	}
+
+	for _, g := range s.groups {
+		for len(g.active) < count {
+			sub, err := g.create(len(g.active) + 1)
+			if err != nil {
+				errs = append(errs, err)
+				break
+			}
+			if err := s.start(sub); err != nil {
+				errs = append(errs, fmt.Errorf("cannot subscribe %s: %w", sub.name, err))
+				// the subscriber does not close the connection it was created with
+				sub.Close()
+				sub.conn.Close()
+				break
+			}
+			g.active = append(g.active, sub)
+			log.Printf("[%s] started", sub.name)
+		}
+		for len(g.active) > count {
+			removed = append(removed, g.active[len(g.active)-1])
+			g.active = g.active[:len(g.active)-1]
+		}
+	}
+	return removed, errs
+}
+
+// conns returns the connection of every active subscriber, by subscriber name
+func (s *scaler) conns() map[string]*nc.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conns := make(map[string]*nc.Conn)
+	for _, g := range s.groups {
+		for _, sub := range g.active {
+			conns[sub.name] = sub.Conn()
+		}
+	}
+	return conns
+}
+
+// Drain stops the scaling and drains every subscriber, the most recent first
+func (s *scaler) Drain(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	var active []*subscriber
+	for _, g := range s.groups {
+		active = append(active, g.active...)
+	}
+	s.mu.Unlock()
+
+	var errs []error
+	for i := len(active) - 1; i >= 0; i-- {
+		if err := active[i].Drain(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close drains the subscribers without a deadline, shutdown calls Drain instead
+func (s *scaler) Close() error {
+	return s.Drain(context.Background())
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+)
+
+func TestScaleUpAndDown(t *testing.T) {
+	url := runServer(t, false)
+	unmarshaler, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created []*subscriber
+	create := func(i int) (*subscriber, error) {
+		sub, err := newSubscriber(nats.SubscriberConfig{
+			URL:              url,
+			QueueGroupPrefix: "test",
+			SubscribersCount: 1,
+			Unmarshaler:      unmarshaler,
+			JetStream:        nats.JetStreamConfig{Disabled: true},
+		}, watermill.NopLogger{})
+		if err != nil {
+			return nil, err
+		}
+		sub.name, sub.topics = fmt.Sprintf("subscriber%d", i), []string{"a.>"}
+		created = append(created, sub)
+		return sub, nil
+	}
+	errStart := errors.New("cannot start")
+	var failStart bool
+	scale := &scaler{max: 3, start: func(sub *subscriber) error {
+		if failStart {
+			return errStart
+		}
+		_, err := sub.subscribeAll(context.Background(), 0)
+		return err
+	}}
+	first, err := create(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := scale.start(first); err != nil {
+		t.Fatal(err)
+	}
+	scale.add(create, []*subscriber{first})
+	t.Cleanup(func() { _ = scale.Close() })
+
+	ctx := context.Background()
+	if err := scale.Scale(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	if conns := scale.conns(); len(conns) != 3 {
+		t.Fatalf("%d subscribers after scaling up, want 3", len(conns))
+	}
+	if err := scale.Scale(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if conns := scale.conns(); len(conns) != 1 || conns["subscriber1"] == nil {
+		t.Fatalf("subscribers %v after scaling down, want subscriber1", conns)
+	}
+	// the most recent subscribers were drained
+	for _, sub := range created[1:] {
+		if !sub.conn.IsClosed() {
+			t.Errorf("%s is still connected after scaling down", sub.name)
+		}
+	}
+	for _, count := range []int{0, 4} {
+		if err := scale.Scale(ctx, count); err == nil {
+			t.Errorf("count %d was accepted", count)
+		}
+	}
+
+	// a subscriber failing to start is closed along with its connection
+	failStart = true
+	if err := scale.Scale(ctx, 2); !errors.Is(err, errStart) {
+		t.Fatalf("error = %v, want %v", err, errStart)
+	}
+	if conns := scale.conns(); len(conns) != 1 {
+		t.Errorf("%d subscribers after a failed start, want 1", len(conns))
+	}
+	if failed := created[len(created)-1]; !failed.conn.IsClosed() {
+		t.Errorf("the connection of %s is left open", failed.name)
+	}
+}
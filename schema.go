@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// withSchemaValidation wraps m so that payloads published to a subject having a schema in dir,
+// "<dir>/<subject>.json", are validated against it before being marshaled. Subjects without
+// a schema are published as is. An empty dir disables validation
+func withSchemaValidation(m nats.MarshalerUnmarshaler, dir string) (nats.MarshalerUnmarshaler, error) {
+	if dir == "" {
+		return m, nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("SCHEMA_DIR: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("SCHEMA_DIR: %s is not a directory", dir)
+	}
+	return &validatingMarshaler{
+		MarshalerUnmarshaler: m,
+		dir:                  dir,
+		schemas:              make(map[string]*jsonschema.Schema),
+	}, nil
+}
+
+// validatingMarshaler rejects the payloads that do not match the JSON Schema of their subject,
+// empty payloads of headers-only messages are not validated
+type validatingMarshaler struct {
+	nats.MarshalerUnmarshaler
+	dir string
+
+	mu sync.Mutex
+	// schemas caches the compiled schema of each subject, nil when the subject has none
+	schemas map[string]*jsonschema.Schema
+}
+
+func (v *validatingMarshaler) Marshal(topic string, msg *message.Message) (*nc.Msg, error) {
+	schema, err := v.schema(topic)
+	if err != nil {
+		return nil, err
+	}
+	// headers-only messages carry no document to validate
+	if schema != nil && len(msg.Payload) > 0 {
+		if err := validatePayload(schema, msg.Payload); err != nil {
+			return nil, fmt.Errorf("%w: message %s on %s: %w", ErrInvalidPayload, msg.UUID, topic, err)
+		}
+	}
+	return v.MarshalerUnmarshaler.Marshal(topic, msg)
+}
+
+// schema returns the compiled schema of subject, compiling it on first use
+func (v *validatingMarshaler) schema(subject string) (*jsonschema.Schema, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if schema, ok := v.schemas[subject]; ok {
+		return schema, nil
+	}
+
+	path := filepath.Join(v.dir, subject+".json")
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		v.schemas[subject] = nil
+		return nil, nil
+	}
+	schema, err := jsonschema.Compile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot compile schema of %s: %w", subject, err)
+	}
+	v.schemas[subject] = schema
+	return schema, nil
+}
+
+// validatePayload checks that payload is a JSON document matching schema
+func validatePayload(schema *jsonschema.Schema, payload []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	// keeps the precision of the numbers checked by the schema
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return fmt.Errorf("payload is not JSON: %w", err)
+	}
+	if dec.More() {
+		return errors.New("payload holds more than one JSON document")
+	}
+	return schema.Validate(doc)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["id", "amount"],
+	"properties": {
+		"id": {"type": "string"},
+		"amount": {"type": "number", "minimum": 0}
+	}
+}`
+
+func TestSchemaValidation(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "orders.created.json"), []byte(orderSchema), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	base, err := newMarshaler("json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := withSchemaValidation(base, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		subject string
+		payload string
+		valid   bool
+	}{
+		{"matching", "orders.created", `{"id": "42", "amount": 9.99}`, true},
+		{"extra property", "orders.created", `{"id": "42", "amount": 0, "note": "gift"}`, true},
+		{"headers only", "orders.created", ``, true},
+		{"missing property", "orders.created", `{"id": "42"}`, false},
+		{"wrong type", "orders.created", `{"id": 42, "amount": 9.99}`, false},
+		{"below minimum", "orders.created", `{"id": "42", "amount": -1}`, false},
+		{"not JSON", "orders.created", `order 42`, false},
+		{"two documents", "orders.created", `{"id": "42", "amount": 1} {}`, false},
+		{"subject without schema", "orders.deleted", `not JSON`, true},
+	}
+	for _, tt := range tests {
+		_, err := m.Marshal(tt.subject, message.NewMessage(watermill.NewUUID(), []byte(tt.payload)))
+		if tt.valid && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrInvalidPayload) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, ErrInvalidPayload)
+		}
+	}
+}
+
+func TestSchemaValidationInvalidDir(t *testing.T) {
+	base, err := newMarshaler("json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := withSchemaValidation(base, ""); err != nil || m != base {
+		t.Errorf("an empty SCHEMA_DIR wrapped the marshaler: %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(file, []byte(orderSchema), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{file, filepath.Join(t.TempDir(), "missing")} {
+		if _, err := withSchemaValidation(base, dir); err == nil {
+			t.Errorf("SCHEMA_DIR=%s was accepted", dir)
+		}
+	}
+
+	// a schema that does not compile fails the publish instead of letting it through
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "orders.json"), []byte(`{"type": 42}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := withSchemaValidation(base, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Marshal("orders", message.NewMessage(watermill.NewUUID(), []byte(`{}`))); err == nil {
+		t.Error("a message was validated against a schema that does not compile")
+	}
+}
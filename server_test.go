@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	nc "github.com/nats-io/nats.go"
+)
+
+// runServer starts an in-process NATS server for the duration of the test, with JetStream
+// when jetStream is set, and returns its URL
+func runServer(t testing.TB, jetStream bool) string {
+	t.Helper()
+	return runServerWith(t, &server.Options{JetStream: jetStream})
+}
+
+// runServerWith starts an in-process NATS server with opts, listening on a random local port,
+// and returns its URL
+func runServerWith(t testing.TB, opts *server.Options) string {
+	t.Helper()
+	return startServer(t, opts).ClientURL()
+}
+
+// startServer starts an in-process NATS server with opts, listening on opts.Port or a random
+// local port when it is 0, and returns it for the tests that shut it down
+func startServer(t testing.TB, opts *server.Options) *server.Server {
+	t.Helper()
+	opts.Host = "127.0.0.1"
+	if opts.Port == 0 {
+		opts.Port = -1
+	}
+	opts.NoLog, opts.NoSigs = true, true
+	opts.StoreDir = t.TempDir()
+	s, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatalf("cannot create NATS server: %v", err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Fatal("NATS server is not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+// connect returns a raw connection to url, closed at the end of the test
+func connect(t testing.TB, url string) *nc.Conn {
+	t.Helper()
+	conn, err := nc.Connect(url)
+	if err != nil {
+		t.Fatalf("cannot connect to %s: %v", url, err)
+	}
+	t.Cleanup(conn.Close)
+	return conn
+}
+
+// addStream creates a stream capturing subjects on conn
+func addStream(t testing.TB, conn *nc.Conn, name string, subjects ...string) nc.JetStreamContext {
+	t.Helper()
+	js, err := conn.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.AddStream(&nc.StreamConfig{Name: name, Subjects: subjects, Storage: nc.MemoryStorage}); err != nil {
+		t.Fatalf("cannot create stream %s: %v", name, err)
+	}
+	return js
+}
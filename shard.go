@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+// shardPrefix starts the first token of the subjects messages are sent on when sharding, e.g. "shard3"
+const shardPrefix = "shard"
+
+// sharding spreads the subjects over several streams. A message published to a subject is sent on
+// "shard<i>.<subject>", i being a hash of one of its tokens, so that every message of a subject
+// lands on the same shard and is consumed in order. Each shard has its own stream and consumers
+type sharding struct {
+	count int
+	// token is the index of the subject token hashed, subjects with fewer tokens are hashed whole
+	token int
+}
+
+// loadSharding returns the sharding configured by SHARDS and SHARD_KEY_TOKEN, nil when SHARDS is 0
+func loadSharding() (*sharding, error) {
+	count, err := getEnvInt("SHARDS", 0)
+	if err != nil {
+		return nil, err
+	}
+	if count < 0 {
+		return nil, fmt.Errorf("SHARDS must not be negative, got %d", count)
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	token, err := getEnvInt("SHARD_KEY_TOKEN", 1)
+	if err != nil {
+		return nil, err
+	}
+	if token < 0 {
+		return nil, fmt.Errorf("SHARD_KEY_TOKEN must not be negative, got %d", token)
+	}
+	return &sharding{count: count, token: token}, nil
+}
+
+// shardOf returns the shard of subject, between 0 and count-1
+func (s *sharding) shardOf(subject string) int {
+	key := subject
+	if tokens := strings.Split(subject, "."); s.token < len(tokens) {
+		key = tokens[s.token]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(s.count))
+}
+
+// subject returns the subject a message published to subject is sent on,
+// subject itself when s is nil
+func (s *sharding) subject(subject string) string {
+	if s == nil {
+		return subject
+	}
+	return shardPrefix + strconv.Itoa(s.shardOf(subject)) + "." + subject
+}
+
+// patterns returns the patterns consuming the subjects of patterns on every shard,
+// patterns themselves when s is nil
+func (s *sharding) patterns(patterns []string) []string {
+	if s == nil {
+		return patterns
+	}
+	sharded := make([]string, 0, s.count*len(patterns))
+	for i := 0; i < s.count; i++ {
+		for _, pattern := range patterns {
+			sharded = append(sharded, shardPrefix+strconv.Itoa(i)+"."+pattern)
+		}
+	}
+	return sharded
+}
+
+// streams returns the stream of every shard, named "<name>_<i>" and capturing the subjects
+// of cfg on its shard. It returns cfg alone when s is nil
+func (s *sharding) streams(cfg *nc.StreamConfig) []*nc.StreamConfig {
+	if s == nil {
+		return []*nc.StreamConfig{cfg}
+	}
+	streams := make([]*nc.StreamConfig, s.count)
+	for i := range streams {
+		stream := *cfg
+		stream.Name = cfg.Name + "_" + strconv.Itoa(i)
+		stream.Subjects = make([]string, len(cfg.Subjects))
+		for j, subject := range cfg.Subjects {
+			stream.Subjects[j] = shardPrefix + strconv.Itoa(i) + "." + subject
+		}
+		streams[i] = &stream
+	}
+	return streams
+}
+
+// unshard splits a subject sent on a shard into the shard and the subject it was published to
+func unshard(subject string) (shard, published string, ok bool) {
+	shard, published, ok = strings.Cut(subject, ".")
+	if !ok || !strings.HasPrefix(shard, shardPrefix) {
+		return "", "", false
+	}
+	if _, err := strconv.Atoi(strings.TrimPrefix(shard, shardPrefix)); err != nil {
+		return "", "", false
+	}
+	return shard, published, true
+}
+
+// withSharding wraps m so that messages are sent on the subject of their shard. On consume, the
+// shard is removed from the delivered subject and kept in the shardKey metadata, so handlers
+// see the subject the message was published to. A nil s sends messages on their own subject
+func withSharding(m nats.MarshalerUnmarshaler, s *sharding) nats.MarshalerUnmarshaler {
+	if s == nil {
+		return m
+	}
+	return shardingMarshaler{MarshalerUnmarshaler: m, sharding: s}
+}
+
+// shardingMarshaler sends messages on the subject of their shard
+type shardingMarshaler struct {
+	nats.MarshalerUnmarshaler
+	sharding *sharding
+}
+
+func (m shardingMarshaler) Marshal(topic string, msg *message.Message) (*nc.Msg, error) {
+	return m.MarshalerUnmarshaler.Marshal(m.sharding.subject(topic), msg)
+}
+
+func (m shardingMarshaler) Unmarshal(natsMsg *nc.Msg) (*message.Message, error) {
+	msg, err := m.MarshalerUnmarshaler.Unmarshal(natsMsg)
+	if err != nil {
+		return nil, err
+	}
+	if shard, published, ok := unshard(msg.Metadata.Get(subjectKey)); ok {
+		msg.Metadata.Set(subjectKey, published)
+		msg.Metadata.Set(shardKey, shard)
+	}
+	return msg, nil
+}
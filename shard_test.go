@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+func TestShardingSpreadsSubjectsOverStreams(t *testing.T) {
+	s := &sharding{count: 4, token: 1}
+	conn := connect(t, runServer(t, true))
+	js, err := conn.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams := s.streams(&nc.StreamConfig{Name: "orders", Subjects: []string{"orders.>"}, Storage: nc.MemoryStorage})
+	if len(streams) != 4 || streams[0].Name != "orders_0" || streams[0].Subjects[0] != "shard0.orders.>" {
+		t.Fatalf("streams %+v, want orders_0 to orders_3 capturing shard<i>.orders.>", streams[0])
+	}
+	for _, stream := range streams {
+		if _, err := js.AddStream(stream); err != nil {
+			t.Fatalf("cannot create stream %s: %v", stream.Name, err)
+		}
+	}
+
+	m, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = withSharding(m, s)
+	// the subjects of a key share its shard, two keys hashed apart land on different streams
+	keyA, keyB := "a", ""
+	for _, key := range []string{"b", "c", "d", "e", "f", "g"} {
+		if s.shardOf("orders."+key) != s.shardOf("orders."+keyA) {
+			keyB = key
+			break
+		}
+	}
+	if keyB == "" {
+		t.Fatal("every key hashed to the shard of a")
+	}
+	for _, subject := range []string{"orders." + keyA, "orders." + keyA + ".test", "orders." + keyB} {
+		natsMsg, err := m.Marshal(subject, message.NewMessage(watermill.NewUUID(), []byte("order")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if natsMsg.Subject != s.subject(subject) {
+			t.Errorf("%s sent on %s, want %s", subject, natsMsg.Subject, s.subject(subject))
+		}
+		if _, err := js.PublishMsg(natsMsg); err != nil {
+			t.Fatal(err)
+		}
+
+		// handlers see the subject the message was published to
+		got, err := m.Unmarshal(natsMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shard, _, _ := unshard(natsMsg.Subject); got.Metadata.Get(subjectKey) != subject || got.Metadata.Get(shardKey) != shard {
+			t.Errorf("received on %s from shard %s, want %s from %s", got.Metadata.Get(subjectKey), got.Metadata.Get(shardKey), subject, shard)
+		}
+	}
+
+	stored := make(map[string]uint64)
+	for _, stream := range streams {
+		info, err := js.StreamInfo(stream.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored[stream.Name] = info.State.Msgs
+	}
+	a, b := "orders_"+shardIndex(s, "orders."+keyA), "orders_"+shardIndex(s, "orders."+keyB)
+	if stored[a] != 2 || stored[b] != 1 {
+		t.Errorf("messages per stream %v, want 2 in %s and 1 in %s", stored, a, b)
+	}
+}
+
+// shardIndex returns the shard of subject as the suffix of its stream name
+func shardIndex(s *sharding, subject string) string {
+	shard, _, _ := unshard(s.subject(subject))
+	return shard[len(shardPrefix):]
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// handlers tracks the runHandler goroutines so that shutdown can wait
+// until they have drained their message channels
+var handlers sync.WaitGroup
+
+// flusherFunc adapts a function to flusher, Close flushes within flushTimeout
+type flusherFunc func(ctx context.Context) error
+
+func (f flusherFunc) Flush(ctx context.Context) error {
+	return f(ctx)
+}
+
+func (f flusherFunc) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	return f(ctx)
+}
+
+// closerFunc adapts a function to io.Closer, so it can be passed to shutdown
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// drainer is implemented by components that can finish their in-flight work before closing
+type drainer interface {
+	Drain(ctx context.Context) error
+}
+
+// flusher is implemented by telemetry components (traces, metrics) which must outlive the handlers,
+// so that the spans and counters of the last messages are exported
+type flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// flushTimeout bounds how long each flusher may take, even when the drain used up the shutdown timeout
+const flushTimeout = 5 * time.Second
+
+// shutdown closes every component in reverse startup order, then waits for the
+// handler goroutines to finish the messages that are still in flight.
+// Components implementing drainer are drained instead of closed, bounded by ctx.
+// Closing a subscriber stops new deliveries and closes its message channel,
+// which is what lets the handler goroutines return.
+// Components implementing flusher are flushed last, in the same order, once the handlers are done.
+// It gives up waiting once ctx is done and reports every Close() failure.
+func shutdown(ctx context.Context, closers ...io.Closer) error {
+	var errs []error
+	var flushers []flusher
+	for i := len(closers) - 1; i >= 0; i-- {
+		var err error
+		if f, ok := closers[i].(flusher); ok {
+			flushers = append(flushers, f)
+			continue
+		}
+		if d, ok := closers[i].(drainer); ok {
+			err = d.Drain(ctx)
+		} else {
+			err = closers[i].Close()
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, ctx.Err())
+	}
+
+	for _, f := range flushers {
+		flushCtx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+		if err := f.Flush(flushCtx); err != nil {
+			errs = append(errs, err)
+		}
+		cancel()
+	}
+	return errors.Join(errs...)
+}
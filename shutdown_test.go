@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestShutdownDeadLettersWhileDraining(t *testing.T) {
+	url := runServer(t, true)
+	js := addStream(t, connect(t, url), "DLQ", "dlq.>")
+	marshaler, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := newPublisher(nats.PublisherConfig{URL: url, Marshaler: marshaler}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := newSubscriber(nats.SubscriberConfig{
+		URL:              url,
+		SubscribersCount: 1,
+		Unmarshaler:      marshaler,
+		JetStream:        nats.JetStreamConfig{Disabled: true},
+	}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.name, sub.topics = "test", []string{"orders.>"}
+	messages, err := sub.subscribeAll(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	scale := &scaler{max: 1}
+	scale.add(nil, []*subscriber{sub})
+
+	// the handler fails once the shutdown has started draining the subscriber
+	started := make(chan struct{})
+	handlers.Add(1)
+	go runHandler(messages, Chain(func(ctx context.Context, msg *message.Message) error {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		return fmt.Errorf("invalid order: %w", errUnrecoverable)
+	}, handleWithDLQ(pub, "dlq", watermill.NopLogger{})), 1, 0)
+
+	conn := connect(t, url)
+	if err := conn.Publish("orders.1", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// in the order of main: the publishers first, the scaler after them so that it is drained first
+	if err := shutdown(ctx, closerFunc(pub.Close), scale); err != nil {
+		t.Fatal(err)
+	}
+	info, err := js.StreamInfo("DLQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != 1 {
+		t.Errorf("DLQ has %d messages, want the failed one", info.State.Msgs)
+	}
+}
+
+// fakeExporter records the spans exported to it and how many times it was shut down
+type fakeExporter struct {
+	mu        sync.Mutex
+	spans     []string
+	shutdowns int
+}
+
+func (e *fakeExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, span := range spans {
+		e.spans = append(e.spans, span.Name())
+	}
+	return nil
+}
+
+func (e *fakeExporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.shutdowns++
+	return nil
+}
+
+func TestShutdownFlushesTracingOnce(t *testing.T) {
+	exporter := &fakeExporter{}
+	// the batcher would hold the spans far longer than the test
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter, sdktrace.WithBatchTimeout(time.Hour)))
+	tracing := flusherFunc(provider.Shutdown)
+
+	// a handler finishing its span only once its subscriber is closed
+	stopped := make(chan struct{})
+	handlers.Add(1)
+	go func() {
+		defer handlers.Done()
+		_, span := provider.Tracer(tracerName).Start(context.Background(), "nats.process")
+		<-stopped
+		span.End()
+	}()
+	subscriber := closerFunc(func() error {
+		close(stopped)
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// in the order of main: tracing first, so that it is flushed last
+	if err := shutdown(ctx, tracing, subscriber); err != nil {
+		t.Fatal(err)
+	}
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+	if exporter.shutdowns != 1 {
+		t.Errorf("exporter shut down %d times, want once", exporter.shutdowns)
+	}
+	if len(exporter.spans) != 1 || exporter.spans[0] != "nats.process" {
+		t.Errorf("exported spans %v, want the nats.process span of the last handler", exporter.spans)
+	}
+}
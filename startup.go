@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	nc "github.com/nats-io/nats.go"
+)
+
+const (
+	initialBackoff = 100 * time.Millisecond
+	maxBackoff     = 10 * time.Second
+)
+
+// waitForNATS blocks until the server at url accepts connections and, if jetStream is set, JetStream answers,
+// so that containers starting before their NATS sidecar do not fail right away
+func waitForNATS(ctx context.Context, url string, options []nc.Option, jetStream bool, logger watermill.LoggerAdapter) error {
+	return retry(ctx, logger, "connect to NATS", func() error {
+		conn, err := nc.Connect(url, options...)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		if !jetStream {
+			return conn.FlushWithContext(ctx)
+		}
+		js, err := conn.JetStream(nc.Context(ctx))
+		if err != nil {
+			return err
+		}
+		_, err = js.AccountInfo()
+		return err
+	})
+}
+
+// retry calls fn with exponential backoff until it succeeds or ctx is done
+func retry(ctx context.Context, logger watermill.LoggerAdapter, what string, fn func() error) error {
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		// rejected credentials fail the same way until they are fixed
+		if err = classifyError(err); errors.Is(err, ErrAuthentication) {
+			return fmt.Errorf("cannot %s: %w", what, err)
+		}
+		logger.Info("Startup attempt failed, retrying", watermill.LogFields{
+			"action":  what,
+			"attempt": attempt,
+			"backoff": backoff.String(),
+			"err":     err.Error(),
+		})
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("cannot %s, giving up after %d attempts: %w", what, attempt, err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	nc "github.com/nats-io/nats.go"
+)
+
+// loadStreamConfig returns the stream definition to provision when AUTO_PROVISION=true, nil otherwise.
+// The defaults match the stream created by docker-compose
+func loadStreamConfig() (*nc.StreamConfig, error) {
+	provision, err := getEnvBool("AUTO_PROVISION", false)
+	if err != nil || !provision {
+		return nil, err
+	}
+
+	cfg := &nc.StreamConfig{
+		Name:     getEnv("STREAM_NAME", "example_topic"),
+		Subjects: strings.Split(getEnv("STREAM_SUBJECTS", "example_topic.*,example_topic.*.test"), ","),
+		Storage:  nc.FileStorage,
+		MaxMsgs:  -1,
+		Discard:  nc.DiscardOld,
+	}
+
+	switch r := getEnv("STREAM_RETENTION", "limits"); r {
+	case "limits":
+		cfg.Retention = nc.LimitsPolicy
+	case "interest":
+		cfg.Retention = nc.InterestPolicy
+	case "workqueue":
+		cfg.Retention = nc.WorkQueuePolicy
+	default:
+		return nil, fmt.Errorf("unknown STREAM_RETENTION %q, expected one of limits, interest, workqueue", r)
+	}
+
+	if cfg.MaxAge, err = getEnvDuration("STREAM_MAX_AGE", 0); err != nil {
+		return nil, err
+	}
+	if cfg.MaxBytes, err = getEnvInt64("STREAM_MAX_BYTES", -1); err != nil {
+		return nil, err
+	}
+	if cfg.Replicas, err = getEnvInt("STREAM_REPLICAS", 1); err != nil {
+		return nil, err
+	}
+	// the window in which publishes with an already seen Nats-Msg-Id are dropped, 0 keeps the server default (2m)
+	if cfg.Duplicates, err = getEnvDuration("STREAM_DUPLICATE_WINDOW", 0); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// deadLetterStream returns the stream capturing the dead letter subjects "<prefix>.>" next to cfg,
+// named "<name>_dlq". It keeps the limits of cfg but always retains its messages until they expire,
+// nothing consumes them and the other retention policies would drop them
+func deadLetterStream(cfg *nc.StreamConfig, prefix string) *nc.StreamConfig {
+	return &nc.StreamConfig{
+		Name:      cfg.Name + "_dlq",
+		Subjects:  []string{prefix + ".>"},
+		Storage:   cfg.Storage,
+		Retention: nc.LimitsPolicy,
+		MaxMsgs:   -1,
+		MaxAge:    cfg.MaxAge,
+		MaxBytes:  cfg.MaxBytes,
+		Replicas:  cfg.Replicas,
+		Discard:   nc.DiscardOld,
+	}
+}
+
+// validateStreamConfig rejects stream definitions the server would refuse or that
+// do not fit how the subscribers consume the stream
+func validateStreamConfig(cfg *nc.StreamConfig, jsConfig nats.JetStreamConfig, queueGroupPrefix string) error {
+	if cfg.Replicas < 1 || cfg.Replicas > 5 {
+		return fmt.Errorf("STREAM_REPLICAS must be between 1 and 5, got %d", cfg.Replicas)
+	}
+	if cfg.MaxAge < 0 {
+		return fmt.Errorf("STREAM_MAX_AGE must not be negative, got %s", cfg.MaxAge)
+	}
+	if cfg.Duplicates < 0 {
+		return fmt.Errorf("STREAM_DUPLICATE_WINDOW must not be negative, got %s", cfg.Duplicates)
+	}
+	// the server refuses a duplicate window longer than the age of the messages
+	if cfg.MaxAge > 0 && cfg.Duplicates > cfg.MaxAge {
+		return fmt.Errorf("STREAM_DUPLICATE_WINDOW (%s) must not exceed STREAM_MAX_AGE (%s)", cfg.Duplicates, cfg.MaxAge)
+	}
+	for _, subject := range cfg.Subjects {
+		if strings.TrimSpace(subject) == "" {
+			return errors.New("STREAM_SUBJECTS must not contain empty subjects")
+		}
+	}
+	// a work queue delivers each message to a single consumer, so all subscribers
+	// have to share one durable consumer instead of creating overlapping ones
+	if cfg.Retention == nc.WorkQueuePolicy && (jsConfig.DurablePrefix == "" || queueGroupPrefix == "") {
+		return errors.New("STREAM_RETENTION=workqueue forbids overlapping consumers, " +
+			"subscribers need both a durable name and a queue group to share a single consumer")
+	}
+	return nil
+}
+
+// jsErrCodeStreamSubjectOverlap is the error code of the server refusing a stream whose
+// subjects overlap with those of another stream
+const jsErrCodeStreamSubjectOverlap nc.ErrorCode = 10065
+
+// provisionStream creates the stream, or updates it when it already exists,
+// before any publisher or subscriber uses it, so both sides agree on its definition.
+// watermill's own AutoProvision names the stream after the topic, which cannot
+// contain the wildcards the subscribers listen on, hence it stays disabled.
+// A subject can only be captured by one stream: when other streams capture some of the subjects,
+// it fails with ErrStreamOverlap naming them, unless reuseSuperset is set and a single one of them
+// captures all the subjects, in which case that stream is used as is
+func provisionStream(url string, options []nc.Option, cfg *nc.StreamConfig, reuseSuperset bool, logger watermill.LoggerAdapter) error {
+	conn, err := nc.Connect(url, options...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	js, err := conn.JetStream()
+	if err != nil {
+		return err
+	}
+
+	overlapping := overlappingStreams(js, cfg)
+	if len(overlapping) == 1 && reuseSuperset && capturesAll(overlapping[0].Config.Subjects, cfg.Subjects) {
+		logger.Info("Reusing the stream capturing the subjects", watermill.LogFields{"stream": overlapping[0].Config.Name, "subjects": cfg.Subjects})
+		return nil
+	}
+	if len(overlapping) > 0 {
+		conflicts := make([]string, 0, len(overlapping))
+		for _, info := range overlapping {
+			conflicts = append(conflicts, fmt.Sprintf("%s (%s)", info.Config.Name, strings.Join(info.Config.Subjects, ", ")))
+		}
+		logger.Info("Streams already capture some of the subjects", watermill.LogFields{"stream": cfg.Name, "conflicts": conflicts})
+		return fmt.Errorf("%w: the subjects of %s (%s) are captured by %s", ErrStreamOverlap, cfg.Name, strings.Join(cfg.Subjects, ", "), strings.Join(conflicts, "; "))
+	}
+
+	if _, err := js.StreamInfo(cfg.Name); errors.Is(err, nc.ErrStreamNotFound) {
+		logger.Info("Creating stream", watermill.LogFields{"stream": cfg.Name, "subjects": cfg.Subjects})
+		_, err = js.AddStream(cfg)
+		return streamOverlapError(cfg, err)
+	} else if err != nil {
+		return err
+	}
+
+	logger.Info("Updating stream", watermill.LogFields{"stream": cfg.Name, "subjects": cfg.Subjects})
+	_, err = js.UpdateStream(cfg)
+	return streamOverlapError(cfg, err)
+}
+
+// overlappingStreams returns the streams other than cfg capturing some of its subjects
+func overlappingStreams(js nc.JetStreamManager, cfg *nc.StreamConfig) []*nc.StreamInfo {
+	var overlapping []*nc.StreamInfo
+	for info := range js.Streams() {
+		if info.Config.Name == cfg.Name {
+			continue
+		}
+		if subjectsOverlap(info.Config.Subjects, cfg.Subjects) {
+			overlapping = append(overlapping, info)
+		}
+	}
+	return overlapping
+}
+
+// streamOverlapError turns the error of the server refusing overlapping subjects, e.g. when
+// another stream was created meanwhile, into ErrStreamOverlap. Other errors are returned as is
+func streamOverlapError(cfg *nc.StreamConfig, err error) error {
+	var apiErr *nc.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode == jsErrCodeStreamSubjectOverlap {
+		return fmt.Errorf("%w: the subjects of %s (%s) are captured by another stream: %w", ErrStreamOverlap, cfg.Name, strings.Join(cfg.Subjects, ", "), err)
+	}
+	return err
+}
+
+// subjectsOverlap reports whether a subject can match both a pattern of a and a pattern of b
+func subjectsOverlap(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if patternsOverlap(strings.Split(x, "."), strings.Split(y, ".")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// patternsOverlap reports whether a subject can match both patterns, given as tokens
+func patternsOverlap(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == ">" || b[i] == ">" {
+			return true
+		}
+		if a[i] != "*" && b[i] != "*" && a[i] != b[i] {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
+
+// capturesAll reports whether every subject matching one of patterns matches one of captured too
+func capturesAll(captured, patterns []string) bool {
+	for _, pattern := range patterns {
+		covered := false
+		for _, c := range captured {
+			if patternCovers(strings.Split(c, "."), strings.Split(pattern, ".")) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return false
+		}
+	}
+	return true
+}
+
+// patternCovers reports whether every subject matching sub matches super, both given as tokens
+func patternCovers(super, sub []string) bool {
+	for i, token := range super {
+		if token == ">" {
+			return i < len(sub)
+		}
+		if i >= len(sub) || sub[i] == ">" || (token != "*" && (sub[i] == "*" || token != sub[i])) {
+			return false
+		}
+	}
+	return len(super) == len(sub)
+}
+
+// missingStream handles the publishes failing because no stream captures their subject
+type missingStream struct {
+	// provision creates a stream again, nil without AUTO_PROVISION
+	provision func(cfg *nc.StreamConfig) error
+	// streams are the provisioned streams, one per shard, nil without AUTO_PROVISION
+	streams []*nc.StreamConfig
+	logger  watermill.LoggerAdapter
+
+	// mu keeps concurrent publishes from provisioning the stream at once
+	mu sync.Mutex
+}
+
+// recover is called with the ErrStreamNotFound of a publish to subject. When a provisioned
+// stream captures subject, it was deleted since startup: it is provisioned again and
+// the publish retried once. Otherwise the fix is logged and err is returned with the subject
+func (m *missingStream) recover(subject string, err error, retry func() error) error {
+	var stream *nc.StreamConfig
+	for _, cfg := range m.streams {
+		if matchesAny(cfg.Subjects, subject) {
+			stream = cfg
+			break
+		}
+	}
+	if stream != nil {
+		m.mu.Lock()
+		provisionErr := m.provision(stream)
+		m.mu.Unlock()
+		if provisionErr == nil {
+			m.logger.Info("Stream provisioned again after a publish found none", watermill.LogFields{"stream": stream.Name, "subject": subject})
+			return retry()
+		}
+		m.logger.Error("Cannot provision stream again", provisionErr, watermill.LogFields{"stream": stream.Name, "subject": subject})
+	} else if len(m.streams) > 0 {
+		m.logger.Info("No stream captures the subject, add it to STREAM_SUBJECTS", watermill.LogFields{"subject": subject})
+	} else {
+		m.logger.Info("No stream captures the subject, create one or set AUTO_PROVISION=true with STREAM_SUBJECTS including it", watermill.LogFields{"subject": subject})
+	}
+	return fmt.Errorf("publish to %s: %w", subject, err)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+func TestPublishWithoutStream(t *testing.T) {
+	url := runServer(t, true)
+	conn := connect(t, url)
+	js := addStream(t, conn, "orders", "orders.>")
+	marshaler, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := newPublisher(nats.PublisherConfig{URL: url, Marshaler: marshaler}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	send := func() error {
+		return publishWithTimeout(context.Background(), pub, "invoices.1", message.NewMessage(watermill.NewUUID(), []byte("paid")), 5*time.Second)
+	}
+
+	// no stream captures invoices.1
+	err = send()
+	if !errors.Is(err, ErrStreamNotFound) {
+		t.Fatalf("publish to invoices.1 = %v, want %v", err, ErrStreamNotFound)
+	}
+	logger := watermill.NewCaptureLogger()
+	missing := &missingStream{logger: logger}
+	err = missing.recover("invoices.1", err, send)
+	if !errors.Is(err, ErrStreamNotFound) || !strings.Contains(err.Error(), "invoices.1") {
+		t.Errorf("recover = %v, want %v naming invoices.1", err, ErrStreamNotFound)
+	}
+	if !logger.Has(watermill.CapturedMessage{
+		Level:  watermill.InfoLogLevel,
+		Fields: watermill.LogFields{"subject": "invoices.1"},
+		Msg:    "No stream captures the subject, create one or set AUTO_PROVISION=true with STREAM_SUBJECTS including it",
+	}) {
+		t.Errorf("no guidance logged: %v", logger.Captured())
+	}
+
+	// with AUTO_PROVISION the stream is created and the publish retried
+	missing = &missingStream{
+		streams: []*nc.StreamConfig{{Name: "invoices", Subjects: []string{"invoices.>"}}},
+		provision: func(stream *nc.StreamConfig) error {
+			return provisionStream(url, nil, stream, false, watermill.NopLogger{})
+		},
+		logger: watermill.NopLogger{},
+	}
+	if err := missing.recover("invoices.1", err, send); err != nil {
+		t.Fatalf("recover with AUTO_PROVISION = %v", err)
+	}
+	info, err := js.StreamInfo("invoices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != 1 {
+		t.Errorf("the provisioned stream holds %d messages, want the retried one", info.State.Msgs)
+	}
+}
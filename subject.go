@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+// originalSubjectKey is the metadata key holding the subject a message was published to,
+// before a SubjectMapper changed it
+const originalSubjectKey = "Original-Subject"
+
+// validateSubject rejects with ErrInvalidSubject the subjects the server would refuse with a confusing
+// error: empty, containing whitespace, starting or ending with a dot, or with an empty token
+func validateSubject(subject string) error {
+	switch {
+	case subject == "":
+		return fmt.Errorf("%w: empty subject", ErrInvalidSubject)
+	case strings.IndexFunc(subject, unicode.IsSpace) >= 0:
+		return fmt.Errorf("%w: %q contains whitespace", ErrInvalidSubject, subject)
+	case strings.HasPrefix(subject, ".") || strings.HasSuffix(subject, "."):
+		return fmt.Errorf("%w: %q starts or ends with a dot", ErrInvalidSubject, subject)
+	case strings.Contains(subject, ".."):
+		return fmt.Errorf("%w: %q contains an empty token", ErrInvalidSubject, subject)
+	}
+	return nil
+}
+
+// SubjectMapper returns the subject a message published to in is sent on
+type SubjectMapper func(in string) (out string)
+
+// StripTokens maps a subject to the one without its first n tokens, so that
+// "tenant1.orders" is sent on "orders". Subjects with n tokens or less are kept as is
+func StripTokens(n int) SubjectMapper {
+	return func(in string) string {
+		tokens := strings.SplitN(in, ".", n+1)
+		if len(tokens) <= n {
+			return in
+		}
+		return tokens[n]
+	}
+}
+
+// withSubjectMapper wraps m so that messages are sent on the subject returned by mapper.
+// When it differs, the subject the message was published to is kept in the Original-Subject
+// metadata, see originalSubject. A nil mapper sends messages on their own subject
+func withSubjectMapper(m nats.MarshalerUnmarshaler, mapper SubjectMapper) nats.MarshalerUnmarshaler {
+	if mapper == nil {
+		return m
+	}
+	return mappingMarshaler{MarshalerUnmarshaler: m, mapper: mapper}
+}
+
+// loadSubjectMapper returns the mapper configured by SUBJECT_STRIP_TOKENS, nil when it is 0
+func loadSubjectMapper() (SubjectMapper, error) {
+	n, err := getEnvInt("SUBJECT_STRIP_TOKENS", 0)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("SUBJECT_STRIP_TOKENS must not be negative, got %d", n)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	return StripTokens(n), nil
+}
+
+// mappingMarshaler sends messages on the subject returned by its mapper
+type mappingMarshaler struct {
+	nats.MarshalerUnmarshaler
+	mapper SubjectMapper
+}
+
+func (m mappingMarshaler) Marshal(topic string, msg *message.Message) (*nc.Msg, error) {
+	out := m.mapper(topic)
+	if out == topic {
+		return m.MarshalerUnmarshaler.Marshal(topic, msg)
+	}
+	msg = msg.Copy()
+	msg.Metadata.Set(originalSubjectKey, topic)
+	return m.MarshalerUnmarshaler.Marshal(out, msg)
+}
+
+// originalSubject returns the subject msg was published to, before a SubjectMapper
+// changed it, or the subject it was delivered on when it was not mapped
+func originalSubject(msg *message.Message) string {
+	if subject := msg.Metadata.Get(originalSubjectKey); subject != "" {
+		return subject
+	}
+	return msg.Metadata.Get(subjectKey)
+}
+
+// SubjectTemplate names the tokens of a subject, e.g. "example_topic.{type}.{detail}" reads
+// "a" as type and "test" as detail out of "example_topic.a.test". Tokens other than {name}
+// must be equal to the subject ones, "*" matches any token
+type SubjectTemplate []string
+
+// ParseSubjectTemplate parses a template of dot-separated tokens, at least one of them a {name}
+func ParseSubjectTemplate(template string) (SubjectTemplate, error) {
+	t := SubjectTemplate(strings.Split(template, "."))
+	names := make(map[string]bool)
+	for _, token := range t {
+		name, ok := templateName(token)
+		switch {
+		case token == "":
+			return nil, fmt.Errorf("invalid subject template %q: empty token", template)
+		case !ok && strings.ContainsAny(token, "{}"):
+			return nil, fmt.Errorf("invalid subject template %q: token %q must be a {name} or a literal", template, token)
+		case ok && names[name]:
+			return nil, fmt.Errorf("invalid subject template %q: %q is named twice", template, name)
+		}
+		if ok {
+			names[name] = true
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("invalid subject template %q: no {name} token", template)
+	}
+	return t, nil
+}
+
+// templateName returns the name of a {name} token
+func templateName(token string) (string, bool) {
+	if len(token) < 3 || token[0] != '{' || token[len(token)-1] != '}' {
+		return "", false
+	}
+	name := token[1 : len(token)-1]
+	return name, !strings.ContainsAny(name, "{}")
+}
+
+// Extract returns the named tokens of subject, false when a literal token does not match.
+// Names past the end of a shorter subject are left out, tokens past the end of the template are ignored
+func (t SubjectTemplate) Extract(subject string) (map[string]string, bool) {
+	tokens := strings.Split(subject, ".")
+	named := make(map[string]string)
+	for i, token := range t {
+		name, ok := templateName(token)
+		if i >= len(tokens) {
+			if !ok {
+				return nil, false
+			}
+			continue
+		}
+		switch {
+		case ok:
+			named[name] = tokens[i]
+		case token != "*" && token != tokens[i]:
+			return nil, false
+		}
+	}
+	return named, true
+}
+
+// loadSubjectTemplates returns the comma-separated templates of SUBJECT_TEMPLATES, nil when it is unset
+func loadSubjectTemplates() ([]SubjectTemplate, error) {
+	spec := os.Getenv("SUBJECT_TEMPLATES")
+	if spec == "" {
+		return nil, nil
+	}
+	var templates []SubjectTemplate
+	for _, template := range strings.Split(spec, ",") {
+		t, err := ParseSubjectTemplate(strings.TrimSpace(template))
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// extractTokens sets the named tokens of the subject a message was published to as metadata, using
+// the first of templates that matches it. Messages no template matches are handled unchanged
+func extractTokens(templates []SubjectTemplate) Middleware {
+	return func(h Handler) Handler {
+		if len(templates) == 0 {
+			return h
+		}
+		return func(ctx context.Context, msg *message.Message) error {
+			subject := originalSubject(msg)
+			for _, t := range templates {
+				if named, ok := t.Extract(subject); ok {
+					for name, value := range named {
+						msg.Metadata.Set(name, value)
+					}
+					break
+				}
+			}
+			return h(ctx, msg)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestValidateSubject(t *testing.T) {
+	tests := []struct {
+		subject string
+		valid   bool
+	}{
+		{"example_topic", true},
+		{"example_topic.a", true},
+		{"example_topic.a.test", true},
+		{"example-topic.A_1", true},
+		{"example_topic.*", true},
+		{"example_topic.>", true},
+		{"dlq.malformed.example_topic.a", true},
+		{"", false},
+		{" ", false},
+		{"example topic", false},
+		{"example_topic.a ", false},
+		{"example_topic\t.a", false},
+		{"example_topic\n", false},
+		{".example_topic", false},
+		{"example_topic.", false},
+		{".", false},
+		{"example_topic..a", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subject, func(t *testing.T) {
+			err := validateSubject(tt.subject)
+			if tt.valid && err != nil {
+				t.Errorf("validateSubject(%q) = %v, want nil", tt.subject, err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidSubject) {
+				t.Errorf("validateSubject(%q) = %v, want ErrInvalidSubject", tt.subject, err)
+			}
+		})
+	}
+}
+
+// the publisher and the subscriber reject invalid subjects before reaching NATS
+func TestPublishSubscribeRejectInvalidSubject(t *testing.T) {
+	for _, subject := range []string{"", "example topic", ".example_topic", "example_topic..a"} {
+		err := (&publisher{}).Publish(subject, message.NewMessage(watermill.NewUUID(), nil))
+		if !errors.Is(err, ErrInvalidSubject) {
+			t.Errorf("Publish(%q) = %v, want ErrInvalidSubject", subject, err)
+		}
+		if _, err := (&subscriber{}).Subscribe(context.Background(), subject); !errors.Is(err, ErrInvalidSubject) {
+			t.Errorf("Subscribe(%q) = %v, want ErrInvalidSubject", subject, err)
+		}
+	}
+}
+
+func TestSubjectTemplateExtract(t *testing.T) {
+	template, err := ParseSubjectTemplate("example_topic.{type}.{detail}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		subject string
+		want    map[string]string
+		ok      bool
+	}{
+		{"example_topic.a.test", map[string]string{"type": "a", "detail": "test"}, true},
+		{"example_topic.b.other", map[string]string{"type": "b", "detail": "other"}, true},
+		// missing tokens are left out, extra tokens ignored
+		{"example_topic.a", map[string]string{"type": "a"}, true},
+		{"example_topic", map[string]string{}, true},
+		{"example_topic.a.test.more", map[string]string{"type": "a", "detail": "test"}, true},
+		// the literal token must match
+		{"other_topic.a.test", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subject, func(t *testing.T) {
+			got, ok := template.Extract(tt.subject)
+			if ok != tt.ok {
+				t.Fatalf("Extract(%s) matched = %v, want %v", tt.subject, ok, tt.ok)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Extract(%s) = %v, want %v", tt.subject, got, tt.want)
+			}
+			for name, value := range tt.want {
+				if got[name] != value {
+					t.Errorf("Extract(%s)[%s] = %q, want %q", tt.subject, name, got[name], value)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSubjectTemplateRejects(t *testing.T) {
+	for _, template := range []string{"", "example_topic", "example_topic..{type}", "example_topic.{type", "example_topic.{type}.{type}", "example_topic.{}"} {
+		if _, err := ParseSubjectTemplate(template); err == nil {
+			t.Errorf("%q was accepted", template)
+		}
+	}
+}
+
+func TestExtractTokensSetsMetadata(t *testing.T) {
+	templates := make([]SubjectTemplate, 0, 2)
+	for _, spec := range []string{"orders.{region}", "example_topic.{type}.{detail}"} {
+		template, err := ParseSubjectTemplate(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		templates = append(templates, template)
+	}
+	var got message.Metadata
+	h := extractTokens(templates)(func(ctx context.Context, msg *message.Message) error {
+		got = msg.Metadata
+		return nil
+	})
+
+	msg := message.NewMessage(watermill.NewUUID(), nil)
+	msg.Metadata.Set(subjectKey, "example_topic.a.test")
+	if err := h(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if got.Get("type") != "a" || got.Get("detail") != "test" {
+		t.Errorf("metadata = %v, want type=a and detail=test", got)
+	}
+	if _, ok := got["region"]; ok {
+		t.Error("a template that does not match set its tokens")
+	}
+
+	// a subject no template matches is handled unchanged
+	unmatched := message.NewMessage(watermill.NewUUID(), nil)
+	unmatched.Metadata.Set(subjectKey, "other.a")
+	if err := h(context.Background(), unmatched); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Errorf("metadata = %v, want only the delivery subject", got)
+	}
+}
+
+func TestSubjectMapperStripsTenant(t *testing.T) {
+	url := runServer(t, false)
+	conn := connect(t, url)
+	sub, err := conn.SubscribeSync(">")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	base, err := newMarshaler("nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshaler := withSubjectMapper(base, StripTokens(1))
+	pub, err := newPublisher(nats.PublisherConfig{
+		URL:       url,
+		Marshaler: marshaler,
+		JetStream: nats.JetStreamConfig{Disabled: true},
+	}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	published := message.NewMessage(watermill.NewUUID(), []byte("order"))
+	if err := pub.Publish("tenant1.orders", published); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := published.Metadata[originalSubjectKey]; ok {
+		t.Errorf("the published message got the %s metadata", originalSubjectKey)
+	}
+	natsMsg, err := sub.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if natsMsg.Subject != "orders" {
+		t.Fatalf("sent on %s, want orders", natsMsg.Subject)
+	}
+	msg, err := marshaler.Unmarshal(natsMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := originalSubject(msg); got != "tenant1.orders" {
+		t.Errorf("original subject = %q, want tenant1.orders", got)
+	}
+
+	// the tenant is read back from the original subject
+	template, err := ParseSubjectTemplate("{tenant}.orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tenant string
+	h := extractTokens([]SubjectTemplate{template})(func(ctx context.Context, msg *message.Message) error {
+		tenant = msg.Metadata.Get("tenant")
+		return nil
+	})
+	if err := h(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if tenant != "tenant1" {
+		t.Errorf("tenant = %q, want tenant1", tenant)
+	}
+}
+
+func TestStripTokens(t *testing.T) {
+	for _, tt := range []struct {
+		n        int
+		in, want string
+	}{
+		{1, "tenant1.orders", "orders"},
+		{1, "tenant1.orders.eu", "orders.eu"},
+		{2, "tenant1.region.orders", "orders"},
+		{1, "orders", "orders"},
+		{2, "tenant1.orders", "tenant1.orders"},
+	} {
+		if got := StripTokens(tt.n)(tt.in); got != tt.want {
+			t.Errorf("StripTokens(%d)(%q) = %q, want %q", tt.n, tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// supervisor pauses and resumes message processing without closing the subscriptions.
+// While paused, the handler goroutines block before processing, so nothing is acked and
+// JetStream holds off new deliveries once MaxAckPending messages are outstanding.
+// The zero value is a running supervisor
+type supervisor struct {
+	// OnAck and OnNack, when not nil, receive the outcome of every message gone through gate,
+	// e.g. to keep an audit trail. They are called once the message is acked or nacked,
+	// from the handler goroutines, and must be set before the handlers start
+	OnAck  func(msg *message.Message)
+	OnNack func(msg *message.Message, err error)
+
+	mu     sync.Mutex
+	paused bool
+	// resumed is closed by Resume to release the handlers blocked by Pause
+	resumed chan struct{}
+}
+
+// Pause stops the handlers from processing further messages,
+// the messages they are already processing still complete and are acked
+func (s *supervisor) Pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.paused {
+		return
+	}
+	s.paused = true
+	s.resumed = make(chan struct{})
+}
+
+// Resume releases the handlers, which process the messages they were holding first
+func (s *supervisor) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.paused {
+		return
+	}
+	s.paused = false
+	close(s.resumed)
+}
+
+// gate blocks h while the supervisor is paused. A message held longer than AckWaitTimeout
+// has its context cancelled by the subscriber and will be redelivered, so it is
+// nacked instead of processed, which keeps resuming from handling it twice.
+// It reports the outcome of every message to OnAck or OnNack, after acking or nacking it
+// itself: the ack or nack runHandler sends next does nothing on a settled message
+func (s *supervisor) gate(h Handler) Handler {
+	return func(ctx context.Context, msg *message.Message) (err error) {
+		defer func() {
+			if err == nil {
+				msg.Ack()
+				if s.OnAck != nil {
+					s.OnAck(msg)
+				}
+			} else {
+				msg.Nack()
+				if s.OnNack != nil {
+					s.OnNack(msg, err)
+				}
+			}
+		}()
+
+		s.mu.Lock()
+		paused, resumed := s.paused, s.resumed
+		s.mu.Unlock()
+
+		if paused {
+			select {
+			case <-resumed:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return h(ctx, msg)
+	}
+}
+
+// serveControl starts an HTTP server to pause and resume processing during maintenance
+//   - POST /pause stops processing, subscriptions stay open
+//   - POST /resume restarts processing
+//   - POST /scale?count=N runs N subscribers per pattern, see scaler
+//   - GET /admin/streams and GET /admin/consumers when admin is not nil, see admin
+//
+// The POST endpoints require "Authorization: Bearer <token>" unless token is empty.
+// The returned server should be closed on shutdown
+func serveControl(addr, token string, sup *supervisor, scale *scaler, admin *admin, lag *lagScaler, logger watermill.LoggerAdapter) *http.Server {
+	if token == "" && !loopback(addr) {
+		logger.Info("Control endpoint reachable from other hosts without ADMIN_TOKEN, anyone can pause or scale the subscribers", watermill.LogFields{"addr": addr})
+	}
+	mux := http.NewServeMux()
+	if admin != nil {
+		admin.register(mux)
+	}
+	if lag != nil {
+		lag.register(mux)
+	}
+	mux.HandleFunc("/pause", requireToken(http.MethodPost, token, func(w http.ResponseWriter, r *http.Request) {
+		sup.Pause()
+		logger.Info("Processing paused", nil)
+		fmt.Fprintln(w, "paused")
+	}))
+	mux.HandleFunc("/resume", requireToken(http.MethodPost, token, func(w http.ResponseWriter, r *http.Request) {
+		sup.Resume()
+		logger.Info("Processing resumed", nil)
+		fmt.Fprintln(w, "running")
+	}))
+	mux.HandleFunc("/scale", requireToken(http.MethodPost, token, func(w http.ResponseWriter, r *http.Request) {
+		count, err := strconv.Atoi(r.URL.Query().Get("count"))
+		if err != nil || count < 1 || count > scale.max {
+			http.Error(w, fmt.Sprintf("count must be a number between 1 and %d", scale.max), http.StatusBadRequest)
+			return
+		}
+		// removed subscribers are drained for as long as a shutdown would wait for them
+		ctx, cancel := context.WithTimeout(r.Context(), closeTimeout)
+		defer cancel()
+		if err := scale.Scale(ctx, count); err != nil {
+			logger.Error("Scaling failed", err, watermill.LogFields{"count": count})
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Subscribers scaled", watermill.LogFields{"count": count})
+		fmt.Fprintf(w, "%d subscribers per pattern\n", count)
+	}))
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		logger.Info("Serving control endpoint", watermill.LogFields{"addr": addr})
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Control server failed", err, nil)
+		}
+	}()
+	return srv
+}
+
+// loopback reports whether addr only listens on the loopback interface
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
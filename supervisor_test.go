@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// settled reports whether done, the Acked() or Nacked() channel of a message, is closed
+func settled(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestGateHooksFireOnceSettled(t *testing.T) {
+	errFailed := errors.New("failed")
+	var acked, nacked []string
+	var nackErr error
+	sup := &supervisor{
+		OnAck: func(msg *message.Message) {
+			if !settled(msg.Acked()) {
+				t.Errorf("OnAck called before %s was acked", msg.UUID)
+			}
+			acked = append(acked, msg.UUID)
+		},
+		OnNack: func(msg *message.Message, err error) {
+			if !settled(msg.Nacked()) {
+				t.Errorf("OnNack called before %s was nacked", msg.UUID)
+			}
+			nacked = append(nacked, msg.UUID)
+			nackErr = err
+		},
+	}
+	h := sup.gate(func(ctx context.Context, msg *message.Message) error {
+		if string(msg.Payload) == "fail" {
+			return errFailed
+		}
+		return nil
+	})
+
+	ok := message.NewMessage(watermill.NewUUID(), []byte("ok"))
+	fail := message.NewMessage(watermill.NewUUID(), []byte("fail"))
+	if err := h(context.Background(), ok); err != nil {
+		t.Fatal(err)
+	}
+	if err := h(context.Background(), fail); !errors.Is(err, errFailed) {
+		t.Fatalf("error = %v, want %v", err, errFailed)
+	}
+	if len(acked) != 1 || acked[0] != ok.UUID {
+		t.Errorf("acked %v, want [%s]", acked, ok.UUID)
+	}
+	if len(nacked) != 1 || nacked[0] != fail.UUID {
+		t.Errorf("nacked %v, want [%s]", nacked, fail.UUID)
+	}
+	if !errors.Is(nackErr, errFailed) {
+		t.Errorf("OnNack error = %v, want %v", nackErr, errFailed)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "nats-pubsub"
+
+// setupTracing exports spans over OTLP/HTTP when TRACING_ENABLED=true. The collector is
+// configured with the standard OTEL_EXPORTER_OTLP_ENDPOINT variable (default http://localhost:4318).
+// The returned function flushes and stops the exporter; when tracing is disabled the
+// global no-op tracer is kept and nothing is propagated
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("TRACING_ENABLED") != "true" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(tracerName))),
+	)
+	otel.SetTracerProvider(provider)
+	// W3C trace context, carried in the message metadata and thus in the NATS headers
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// startPublishSpan starts a nats.publish span and injects its context into the metadata of msg
+func startPublishSpan(ctx context.Context, topic string, msg *message.Message) (context.Context, trace.Span) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "nats.publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystem("nats"),
+			semconv.MessagingDestinationName(topic),
+			semconv.MessagingMessageID(msg.UUID),
+		),
+	)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(msg.Metadata))
+	return ctx, span
+}
+
+// traced wraps h in a nats.process span that continues the trace started on publish
+// and records whether the message was acked or nacked
+func traced(h Handler) Handler {
+	return func(ctx context.Context, msg *message.Message) error {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(msg.Metadata))
+		ctx, span := otel.Tracer(tracerName).Start(ctx, "nats.process",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				semconv.MessagingSystem("nats"),
+				semconv.MessagingDestinationName(msg.Metadata.Get(subjectKey)),
+				semconv.MessagingMessageID(msg.UUID),
+			),
+		)
+		defer span.End()
+
+		err := h(ctx, msg)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "nack")
+			span.SetAttributes(attribute.String("messaging.outcome", "nack"))
+		} else {
+			span.SetStatus(codes.Ok, "ack")
+			span.SetAttributes(attribute.String("messaging.outcome", "ack"))
+		}
+		return err
+	}
+}
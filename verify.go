@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"nats/metrics"
+)
+
+const (
+	// verifySequenceKey is the metadata key holding the per-subject sequence stamped by VERIFY_ORDER
+	verifySequenceKey = "Verify-Sequence"
+	// verifyRunKey is the metadata key identifying the publisher process that stamped the sequence
+	verifyRunKey = "Verify-Run"
+)
+
+// orderVerifier checks that the messages of a subject are consumed in the order they were published.
+// The publisher stamps each message with a sequence increasing per subject, and the consumer reports
+// a violation whenever a sequence is not greater than the last one seen for that subject and run.
+// Sequences restart with every publisher process, hence the run identifying it
+type orderVerifier struct {
+	run    string
+	logger watermill.LoggerAdapter
+
+	mu sync.Mutex
+	// published is the last sequence stamped per subject
+	published map[string]uint64
+	// seen is the last sequence consumed per run and subject
+	seen map[string]uint64
+
+	violations atomic.Int64
+}
+
+// newOrderVerifier returns nil when enabled is false, its methods then do nothing
+func newOrderVerifier(enabled bool, logger watermill.LoggerAdapter) *orderVerifier {
+	if !enabled {
+		return nil
+	}
+	return &orderVerifier{
+		run:       watermill.NewShortUUID(),
+		logger:    logger,
+		published: make(map[string]uint64),
+		seen:      make(map[string]uint64),
+	}
+}
+
+// stamp sets the next sequence of topic on msg before it is published
+func (v *orderVerifier) stamp(topic string, msg *message.Message) {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	v.published[topic]++
+	seq := v.published[topic]
+	v.mu.Unlock()
+	msg.Metadata.Set(verifySequenceKey, strconv.FormatUint(seq, 10))
+	msg.Metadata.Set(verifyRunKey, v.run)
+}
+
+// observe records that seq of subject, stamped by run, was consumed. It reports false along
+// with the last sequence seen when seq is not greater, ie. the message arrived out of order
+func (v *orderVerifier) observe(run, subject string, seq uint64) (last uint64, inOrder bool) {
+	key := run + " " + subject
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	last = v.seen[key]
+	if seq <= last {
+		return last, false
+	}
+	v.seen[key] = seq
+	return last, true
+}
+
+// verify checks the order of the stamped messages before h processes them, whatever the outcome.
+// Redeliveries are expected to come after later messages and are not checked
+func (v *orderVerifier) verify(h Handler) Handler {
+	if v == nil {
+		return h
+	}
+	return func(ctx context.Context, msg *message.Message) error {
+		seq, err := strconv.ParseUint(msg.Metadata.Get(verifySequenceKey), 10, 64)
+		if err != nil || DeliveryAttempt(msg) > 1 {
+			return h(ctx, msg)
+		}
+		subject := originalSubject(msg)
+		if last, inOrder := v.observe(msg.Metadata.Get(verifyRunKey), subject, seq); !inOrder {
+			v.violations.Add(1)
+			metrics.OrderViolations.WithLabelValues(metrics.Subject(subject)).Inc()
+			v.logger.Info("Message consumed out of order", watermill.LogFields{
+				"message_uuid": msg.UUID,
+				"subject":      subject,
+				"sequence":     seq,
+				"last_seen":    last,
+			})
+		}
+		return h(ctx, msg)
+	}
+}
+
+// Violations returns the number of messages consumed out of order so far
+func (v *orderVerifier) Violations() int64 {
+	if v == nil {
+		return 0
+	}
+	return v.violations.Load()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestOrderVerifierObserve(t *testing.T) {
+	tests := []struct {
+		name    string
+		run     string
+		subject string
+		seq     uint64
+		inOrder bool
+	}{
+		{"first", "run1", "a", 1, true},
+		{"next", "run1", "a", 2, true},
+		{"gap", "run1", "a", 5, true},
+		{"lower", "run1", "a", 3, false},
+		{"equal", "run1", "a", 5, false},
+		// sequences are per subject
+		{"other subject", "run1", "b", 1, true},
+		// and restart with each publisher process
+		{"other run", "run2", "a", 1, true},
+		{"after a violation", "run1", "a", 6, true},
+	}
+	v := newOrderVerifier(true, watermill.NopLogger{})
+	for _, tt := range tests {
+		if _, inOrder := v.observe(tt.run, tt.subject, tt.seq); inOrder != tt.inOrder {
+			t.Errorf("%s: observe(%s, %s, %d) in order = %v, want %v", tt.name, tt.run, tt.subject, tt.seq, inOrder, tt.inOrder)
+		}
+	}
+}
+
+func TestOrderVerifierCountsViolations(t *testing.T) {
+	v := newOrderVerifier(true, watermill.NopLogger{})
+	stamped := func(topic string) *message.Message {
+		msg := message.NewMessage(watermill.NewUUID(), nil)
+		v.stamp(topic, msg)
+		msg.Metadata.Set(subjectKey, topic)
+		return msg
+	}
+	first, second, third := stamped("a"), stamped("a"), stamped("a")
+	if got := second.Metadata.Get(verifySequenceKey); got != "2" {
+		t.Fatalf("second sequence = %s, want 2", got)
+	}
+
+	handled := 0
+	h := v.verify(func(ctx context.Context, msg *message.Message) error {
+		handled++
+		return nil
+	})
+	redelivery := stamped("b")
+	redelivery.Metadata.Set(numDeliveredKey, strconv.Itoa(2))
+	unstamped := message.NewMessage(watermill.NewUUID(), nil)
+	// third comes before second, the redelivery and the unstamped message are not checked
+	for _, msg := range []*message.Message{first, third, second, redelivery, redelivery, unstamped} {
+		if err := h(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if handled != 6 {
+		t.Errorf("%d messages handled, want every message", handled)
+	}
+	if got := v.Violations(); got != 1 {
+		t.Errorf("%d violations, want 1", got)
+	}
+}
+
+func TestOrderVerifierDisabled(t *testing.T) {
+	v := newOrderVerifier(false, watermill.NopLogger{})
+	msg := message.NewMessage(watermill.NewUUID(), nil)
+	v.stamp("a", msg)
+	if _, ok := msg.Metadata[verifySequenceKey]; ok {
+		t.Error("a disabled verifier stamped the message")
+	}
+	if v.Violations() != 0 {
+		t.Error("a disabled verifier reported violations")
+	}
+}